@@ -1,9 +1,12 @@
 package api
 
 import (
+	"context"
+	"fmt"
 	"github.com/akaspin/soil/agent/api/api-server"
 	"github.com/akaspin/soil/proto"
 	"net/http"
+	"net/url"
 	"os"
 	"syscall"
 )
@@ -28,18 +31,80 @@ func NewAgentStopPut(signalChan chan os.Signal) (e *api_server.Endpoint) {
 		}))
 }
 
-func NewAgentDrainPut(fn func(on bool)) (e *api_server.Endpoint) {
-	e = api_server.NewEndpoint(http.MethodPut, proto.V1AgentDrain, NewWrapper(func() (err error) {
-		fn(true)
+// DrainOperator operates agent drain state
+type DrainOperator interface {
+	State() proto.DrainState
+	Drain(req proto.DrainRequest) error
+	Undrain() error
+}
+
+func NewAgentDrainGet(operator DrainOperator) (e *api_server.Endpoint) {
+	return api_server.GET(proto.V1AgentDrain, &agentDrainGetProcessor{
+		operator: operator,
+	})
+}
+
+type agentDrainGetProcessor struct {
+	operator DrainOperator
+}
+
+func (p *agentDrainGetProcessor) Empty() interface{} {
+	return nil
+}
+
+func (p *agentDrainGetProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	res = p.operator.State()
+	return
+}
+
+// NewAgentDrainPut returns endpoint which puts agent in drain mode. Request
+// body is optional. Empty body drains all pods.
+func NewAgentDrainPut(operator DrainOperator) (e *api_server.Endpoint) {
+	return api_server.PUT(proto.V1AgentDrain, &agentDrainPutProcessor{
+		operator: operator,
+	})
+}
+
+type agentDrainPutProcessor struct {
+	operator DrainOperator
+}
+
+func (p *agentDrainPutProcessor) Empty() interface{} {
+	return &proto.DrainRequest{}
+}
+
+func (p *agentDrainPutProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	req, ok := v.(*proto.DrainRequest)
+	if !ok || req == nil {
+		err = api_server.NewError(http.StatusBadRequest, fmt.Sprintf("bad drain request: %v", v))
+		return
+	}
+	if err = p.operator.Drain(*req); err != nil {
+		err = api_server.NewError(http.StatusBadRequest, err.Error())
 		return
-	}))
+	}
+	res = p.operator.State()
 	return
 }
 
-func NewAgentDrainDelete(fn func(on bool)) (e *api_server.Endpoint) {
-	e = api_server.NewEndpoint(http.MethodDelete, proto.V1AgentDrain, NewWrapper(func() (err error) {
-		fn(false)
+func NewAgentDrainDelete(operator DrainOperator) (e *api_server.Endpoint) {
+	return api_server.DELETE(proto.V1AgentDrain, &agentDrainDeleteProcessor{
+		operator: operator,
+	})
+}
+
+type agentDrainDeleteProcessor struct {
+	operator DrainOperator
+}
+
+func (p *agentDrainDeleteProcessor) Empty() interface{} {
+	return nil
+}
+
+func (p *agentDrainDeleteProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	if err = p.operator.Undrain(); err != nil {
 		return
-	}))
+	}
+	res = p.operator.State()
 	return
 }
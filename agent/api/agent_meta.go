@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/soil/agent/api/api-server"
+	"github.com/akaspin/soil/proto"
+	"net/http"
+	"net/url"
+)
+
+// MetaOperator operates runtime agent metadata
+type MetaOperator interface {
+	Get() map[string]string
+	Set(values map[string]string) error
+	Delete(keys ...string) error
+}
+
+func NewAgentMetaGet(operator MetaOperator) (e *api_server.Endpoint) {
+	return api_server.GET(proto.V1AgentMeta, &agentMetaGetProcessor{
+		operator: operator,
+	})
+}
+
+type agentMetaGetProcessor struct {
+	operator MetaOperator
+}
+
+func (p *agentMetaGetProcessor) Empty() interface{} {
+	return nil
+}
+
+func (p *agentMetaGetProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	res = p.operator.Get()
+	return
+}
+
+func NewAgentMetaPut(operator MetaOperator) (e *api_server.Endpoint) {
+	return api_server.PUT(proto.V1AgentMeta, &agentMetaPutProcessor{
+		operator: operator,
+	})
+}
+
+type agentMetaPutProcessor struct {
+	operator MetaOperator
+}
+
+func (p *agentMetaPutProcessor) Empty() interface{} {
+	return &map[string]string{}
+}
+
+func (p *agentMetaPutProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	values, ok := v.(*map[string]string)
+	if !ok || values == nil || len(*values) == 0 {
+		err = api_server.NewError(http.StatusBadRequest, fmt.Sprintf("bad meta: %v", v))
+		return
+	}
+	if _, ok := (*values)[""]; ok {
+		err = api_server.NewError(http.StatusBadRequest, "bad meta: empty key")
+		return
+	}
+	if err = p.operator.Set(*values); err != nil {
+		err = api_server.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+	res = p.operator.Get()
+	return
+}
+
+func NewAgentMetaDelete(operator MetaOperator) (e *api_server.Endpoint) {
+	return api_server.DELETE(proto.V1AgentMeta, &agentMetaDeleteProcessor{
+		operator: operator,
+	})
+}
+
+type agentMetaDeleteProcessor struct {
+	operator MetaOperator
+}
+
+func (p *agentMetaDeleteProcessor) Empty() interface{} {
+	return &[]string{}
+}
+
+func (p *agentMetaDeleteProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	keys, ok := v.(*[]string)
+	if !ok || keys == nil || len(*keys) == 0 {
+		err = api_server.NewError(http.StatusBadRequest, fmt.Sprintf("bad keys: %v", v))
+		return
+	}
+	if err = p.operator.Delete(*keys...); err != nil {
+		err = api_server.NewError(http.StatusInternalServerError, err.Error())
+		return
+	}
+	res = p.operator.Get()
+	return
+}
@@ -0,0 +1,94 @@
+// +build ide test_unit
+
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/soil/agent/api"
+	"github.com/akaspin/soil/agent/api/api-server"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type testMetaOperator struct {
+	values map[string]string
+	err    error
+}
+
+func (o *testMetaOperator) Get() map[string]string {
+	res := map[string]string{}
+	for k, v := range o.values {
+		res[k] = v
+	}
+	return res
+}
+
+func (o *testMetaOperator) Set(values map[string]string) (err error) {
+	if err = o.err; err != nil {
+		return
+	}
+	for k, v := range values {
+		o.values[k] = v
+	}
+	return
+}
+
+func (o *testMetaOperator) Delete(keys ...string) (err error) {
+	if err = o.err; err != nil {
+		return
+	}
+	for _, k := range keys {
+		delete(o.values, k)
+	}
+	return
+}
+
+func TestAgentMetaPut(t *testing.T) {
+	operator := &testMetaOperator{values: map[string]string{}}
+	processor := api.NewAgentMetaPut(operator).Processor()
+
+	t.Run("ok", func(t *testing.T) {
+		res, err := processor.Process(context.Background(), nil, &map[string]string{"rack": "left"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"rack": "left"}, res)
+	})
+	t.Run("empty payload", func(t *testing.T) {
+		_, err := processor.Process(context.Background(), nil, &map[string]string{})
+		assert.Equal(t, 400, api_server.UnwrapError(err).Code)
+	})
+	t.Run("empty key", func(t *testing.T) {
+		_, err := processor.Process(context.Background(), nil, &map[string]string{"": "1"})
+		assert.Equal(t, api_server.NewError(400, "bad meta: empty key"), err)
+		assert.Equal(t, map[string]string{"rack": "left"}, operator.Get())
+	})
+	t.Run("persistence failure", func(t *testing.T) {
+		operator.err = fmt.Errorf(`read-only file system`)
+		defer func() { operator.err = nil }()
+		_, err := processor.Process(context.Background(), nil, &map[string]string{"rack": "right"})
+		assert.Equal(t, api_server.NewError(500, "read-only file system"), err)
+		assert.Equal(t, map[string]string{"rack": "left"}, operator.Get())
+	})
+}
+
+func TestAgentMetaDelete(t *testing.T) {
+	operator := &testMetaOperator{values: map[string]string{"rack": "left", "dc": "1"}}
+	processor := api.NewAgentMetaDelete(operator).Processor()
+
+	t.Run("ok", func(t *testing.T) {
+		res, err := processor.Process(context.Background(), nil, &[]string{"rack"})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"dc": "1"}, res)
+	})
+	t.Run("empty payload", func(t *testing.T) {
+		_, err := processor.Process(context.Background(), nil, &[]string{})
+		assert.Equal(t, 400, api_server.UnwrapError(err).Code)
+	})
+	t.Run("persistence failure", func(t *testing.T) {
+		operator.err = fmt.Errorf(`read-only file system`)
+		defer func() { operator.err = nil }()
+		_, err := processor.Process(context.Background(), nil, &[]string{"dc"})
+		assert.Equal(t, api_server.NewError(500, "read-only file system"), err)
+		assert.Equal(t, map[string]string{"dc": "1"}, operator.Get())
+	})
+}
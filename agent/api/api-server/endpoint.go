@@ -2,12 +2,23 @@ package api_server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/akaspin/logx"
+	"io"
 	"net/http"
 )
 
+type headerContextKey struct{}
+
+// RequestHeader returns headers of HTTP request from context passed to
+// Processor or nil if context is not bound to request.
+func RequestHeader(ctx context.Context) (res http.Header) {
+	res, _ = ctx.Value(headerContextKey{}).(http.Header)
+	return
+}
+
 type Endpoint struct {
 	path      string
 	method    string
@@ -26,6 +37,12 @@ func PUT(path string, processor Processor) (r *Endpoint) {
 	return
 }
 
+// Returns POST route
+func POST(path string, processor Processor) (r *Endpoint) {
+	r = NewEndpoint(http.MethodPost, path, processor)
+	return
+}
+
 // Returns DELETE route
 func DELETE(path string, processor Processor) (r *Endpoint) {
 	r = NewEndpoint(http.MethodDelete, path, processor)
@@ -55,7 +72,12 @@ func (e *Endpoint) getHandleFunc(log *logx.Log) (h func(w http.ResponseWriter, r
 			func() {
 				defer req.Body.Close()
 				dec := json.NewDecoder(req.Body)
-				if err = dec.Decode(&empty); err != nil {
+				if err = dec.Decode(&empty); err == io.EOF {
+					// empty body
+					err = nil
+					return
+				}
+				if err != nil {
 					sendCode(log, w, req, NewError(http.StatusInternalServerError, "can't parse request"))
 					return
 				}
@@ -63,7 +85,8 @@ func (e *Endpoint) getHandleFunc(log *logx.Log) (h func(w http.ResponseWriter, r
 			}()
 		}
 		var data interface{}
-		if data, err = e.processor.Process(req.Context(), req.URL, empty); err != nil {
+		ctx := context.WithValue(req.Context(), headerContextKey{}, req.Header)
+		if data, err = e.processor.Process(ctx, req.URL, empty); err != nil {
 			if err == ErrorBadRequestData {
 				sendCode(log, w, req, NewError(http.StatusBadRequest, fmt.Sprintf("bad data (%T)%#v", empty, empty)))
 				return
@@ -121,6 +121,7 @@ func (r *Router) ConsumeMessage(message bus.Message) (err error) {
 func (r *Router) newHandler(endpoints []*Endpoint) (fn func(w http.ResponseWriter, req *http.Request)) {
 	get := r.notAllowedHandlerFunc
 	put := r.notAllowedHandlerFunc
+	post := r.notAllowedHandlerFunc
 	del := r.notAllowedHandlerFunc
 	for _, endpoint := range endpoints {
 		switch endpoint.method {
@@ -128,6 +129,8 @@ func (r *Router) newHandler(endpoints []*Endpoint) (fn func(w http.ResponseWrite
 			get = endpoint.getHandleFunc(r.log)
 		case http.MethodPut:
 			put = endpoint.getHandleFunc(r.log)
+		case http.MethodPost:
+			post = endpoint.getHandleFunc(r.log)
 		case http.MethodDelete:
 			del = endpoint.getHandleFunc(r.log)
 		}
@@ -138,6 +141,8 @@ func (r *Router) newHandler(endpoints []*Endpoint) (fn func(w http.ResponseWrite
 			get(w, req)
 		case http.MethodPut:
 			put(w, req)
+		case http.MethodPost:
+			post(w, req)
 		case http.MethodDelete:
 			del(w, req)
 		default:
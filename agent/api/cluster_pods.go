@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/api/api-server"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// NewClusterPodsGet returns endpoint with compact statuses of pods on all
+// nodes in cluster. Endpoint processor accepts messages with compact pod
+// statuses by node ID.
+func NewClusterPodsGet(log *logx.Log) (e *api_server.Endpoint) {
+	return api_server.GET(proto.V1ClusterPods, &clusterPodsProcessor{
+		log:   log.GetLog("api", "get", proto.V1ClusterPods),
+		nodes: map[string]proto.NodePodsStatus{},
+	})
+}
+
+// NewClusterPodGet returns endpoint with compact statuses of one pod by node
+// ID. Endpoint shares processor with given pods endpoint.
+func NewClusterPodGet(pods *api_server.Endpoint) (e *api_server.Endpoint) {
+	return api_server.GET(proto.V1ClusterPods+"/", pods.Processor())
+}
+
+type clusterPodsProcessor struct {
+	log   *logx.Log
+	mu    sync.Mutex
+	nodes map[string]proto.NodePodsStatus
+}
+
+func (p *clusterPodsProcessor) Empty() interface{} {
+	return nil
+}
+
+func (p *clusterPodsProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	pods := proto.ClusterPodsStatus{}
+	p.mu.Lock()
+	for node, statuses := range p.nodes {
+		for name, status := range statuses {
+			if _, ok := pods[name]; !ok {
+				pods[name] = map[string]proto.NodePodStatus{}
+			}
+			pods[name][node] = status
+		}
+	}
+	p.mu.Unlock()
+	if u == nil || !strings.HasPrefix(u.Path, proto.V1ClusterPods+"/") {
+		res = pods
+		return
+	}
+	name := strings.TrimPrefix(u.Path, proto.V1ClusterPods+"/")
+	pod, ok := pods[name]
+	if !ok {
+		err = api_server.NewError(http.StatusNotFound, fmt.Sprintf("pod %s not found", name))
+		return
+	}
+	res = pod
+	return
+}
+
+func (p *clusterPodsProcessor) ConsumeMessage(message bus.Message) (err error) {
+	var v map[string]proto.NodePodsStatus
+	if err = message.Payload().Unmarshal(&v); err != nil {
+		p.log.Error(err)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nodes = v
+	return
+}
@@ -0,0 +1,52 @@
+// +build ide test_unit
+
+package api_test
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/api"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+func TestClusterPodsProcessor_Process(t *testing.T) {
+	processor := api.NewClusterPodsGet(logx.GetLog("test")).Processor()
+	processor.(bus.Consumer).ConsumeMessage(bus.NewMessage("status", map[string]proto.NodePodsStatus{
+		"node-1": {
+			"pod-1": {Namespace: "public", Mark: 1, State: "done", Health: proto.PodHealthPassing},
+			"pod-2": {Namespace: "private", Mark: 2, State: "done", Health: proto.PodHealthFailing, Failure: "[unit failed]"},
+		},
+		"node-2": {
+			"pod-1": {Namespace: "public", Mark: 1, State: "create", Health: proto.PodHealthPending},
+		},
+	}))
+
+	t.Run(`all`, func(t *testing.T) {
+		res, err := processor.Process(context.Background(), &url.URL{Path: "/v1/cluster/pods"}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, proto.ClusterPodsStatus{
+			"pod-1": {
+				"node-1": {Namespace: "public", Mark: 1, State: "done", Health: proto.PodHealthPassing},
+				"node-2": {Namespace: "public", Mark: 1, State: "create", Health: proto.PodHealthPending},
+			},
+			"pod-2": {
+				"node-1": {Namespace: "private", Mark: 2, State: "done", Health: proto.PodHealthFailing, Failure: "[unit failed]"},
+			},
+		}, res)
+	})
+	t.Run(`one`, func(t *testing.T) {
+		res, err := processor.Process(context.Background(), &url.URL{Path: "/v1/cluster/pods/pod-2"}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]proto.NodePodStatus{
+			"node-1": {Namespace: "private", Mark: 2, State: "done", Health: proto.PodHealthFailing, Failure: "[unit failed]"},
+		}, res)
+	})
+	t.Run(`not found`, func(t *testing.T) {
+		_, err := processor.Process(context.Background(), &url.URL{Path: "/v1/cluster/pods/pod-3"}, nil)
+		assert.Error(t, err)
+	})
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent/api/api-server"
@@ -14,15 +15,61 @@ import (
 
 const (
 	V1Registry = "/v1/registry"
+
+	// maximum number of pods in one transaction. Each pod takes up to four
+	// operations in Consul transaction which is limited to 64 operations.
+	// Requests with expected revisions are limited to one transaction. Larger
+	// unconditional requests are split.
+	registryMaxPods = 16
 )
 
-func NewRegistryPodsGet() (e *api_server.Endpoint) {
+// RegistryPod is pod in registry with mark and last recorded revision
+type RegistryPod struct {
+	*manifest.Pod
+	Mark     uint64
+	Revision int `json:",omitempty"`
+}
+
+// RegistryPodUpdate is pod to submit with optional expected last revision.
+// Zero expected revision means pod should not have revisions. Pod without
+// revisions is compared with actual registry value.
+type RegistryPodUpdate struct {
+	*manifest.Pod
+	ExpectRevision *int `json:",omitempty"`
+}
+
+// RegistryPodRemoval is pod name to remove with optional expected last
+// revision. RegistryPodRemoval is unmarshalled from pod name or object.
+type RegistryPodRemoval struct {
+	Name           string
+	ExpectRevision *int `json:",omitempty"`
+}
+
+func (r *RegistryPodRemoval) UnmarshalJSON(data []byte) (err error) {
+	if err = json.Unmarshal(data, &r.Name); err == nil {
+		return
+	}
+	type removal RegistryPodRemoval
+	var v removal
+	if err = json.Unmarshal(data, &v); err != nil {
+		return
+	}
+	*r = RegistryPodRemoval(v)
+	return
+}
+
+// NewRegistryPodsGet returns endpoint with pods in registry. If history is not
+// nil pods are annotated with last revisions.
+func NewRegistryPodsGet(history *RegistryHistory) (e *api_server.Endpoint) {
 	return api_server.GET(V1Registry, &registryPodsGetProcessor{
-		pods: manifest.Registry{},
+		history: history,
+		pods:    manifest.Registry{},
 	})
 }
 
 type registryPodsGetProcessor struct {
+	history *RegistryHistory
+
 	mu   sync.Mutex
 	pods manifest.Registry
 }
@@ -34,7 +81,18 @@ func (p *registryPodsGetProcessor) Empty() interface{} {
 func (p *registryPodsGetProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	res = p.pods
+	pods := make([]RegistryPod, 0, len(p.pods))
+	for _, pod := range p.pods {
+		item := RegistryPod{
+			Pod:  pod,
+			Mark: pod.Mark(),
+		}
+		if p.history != nil {
+			item.Revision = p.history.LastRevision(pod.Name)
+		}
+		pods = append(pods, item)
+	}
+	res = pods
 	return
 }
 
@@ -49,62 +107,147 @@ func (p *registryPodsGetProcessor) ConsumeMessage(message bus.Message) (err erro
 	return
 }
 
-func NewRegistryPodsPut(log *logx.Log, consumer bus.Consumer) (e *api_server.Endpoint) {
+// NewRegistryPodsPut returns endpoint which submits pods to registry. If
+// history is not nil pods are recorded as new revisions and written to
+// registry in transactions. Otherwise pods are submitted to consumer.
+func NewRegistryPodsPut(log *logx.Log, consumer bus.Consumer, history *RegistryHistory) (e *api_server.Endpoint) {
 	return api_server.PUT(V1Registry, &registryPodsPutProcessor{
 		log:      log.GetLog("api", "put", V1Registry),
 		consumer: consumer,
+		history:  history,
 	})
 }
 
 type registryPodsPutProcessor struct {
 	log      *logx.Log
 	consumer bus.Consumer
+	history  *RegistryHistory
 }
 
 func (p *registryPodsPutProcessor) Empty() interface{} {
-	return &manifest.Registry{}
+	return &[]RegistryPodUpdate{}
 }
 
 func (p *registryPodsPutProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
-	v1, ok := v.(*manifest.Registry)
+	v1, ok := v.(*[]RegistryPodUpdate)
 	if !ok || v1 == nil || len(*v1) == 0 {
 		err = api_server.NewError(http.StatusBadRequest, fmt.Sprintf("bad pods: %v", v))
 		return
 	}
-	for _, pod := range *v1 {
-		if consumeErr := p.consumer.ConsumeMessage(bus.NewMessage(pod.Name, pod)); consumeErr != nil {
-			p.log.Error(err)
+	for _, update := range *v1 {
+		if update.Pod == nil {
+			err = api_server.NewError(http.StatusBadRequest, fmt.Sprintf("bad pods: %v", v))
+			return
 		}
 	}
+	writes := make([]RegistryWrite, 0, len(*v1))
+	for _, update := range *v1 {
+		writes = append(writes, RegistryWrite{
+			Name:   update.Name,
+			Pod:    update.Pod,
+			Expect: update.ExpectRevision,
+		})
+	}
+	err = writeRegistryPods(ctx, p.log, p.consumer, p.history, writes)
 	return
 }
 
-func NewRegistryPodsDelete(log *logx.Log, consumer bus.Consumer) (e *api_server.Endpoint) {
+// NewRegistryPodsDelete returns endpoint which removes pods from registry.
+// If history is not nil removals are recorded as new revisions and applied
+// in transactions. Otherwise removals are submitted to consumer.
+func NewRegistryPodsDelete(log *logx.Log, consumer bus.Consumer, history *RegistryHistory) (e *api_server.Endpoint) {
 	return api_server.DELETE(V1Registry, &registryPodsDeleteProcessor{
 		log:      log.GetLog("api", "delete", V1Registry),
 		consumer: consumer,
+		history:  history,
 	})
 }
 
 type registryPodsDeleteProcessor struct {
 	log      *logx.Log
 	consumer bus.Consumer
+	history  *RegistryHistory
 }
 
 func (p *registryPodsDeleteProcessor) Empty() interface{} {
-	return &[]string{}
+	return &[]RegistryPodRemoval{}
 }
 
 func (p *registryPodsDeleteProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
-	pods, ok := v.(*[]string)
+	pods, ok := v.(*[]RegistryPodRemoval)
 	if !ok || pods == nil || len(*pods) == 0 {
 		err = api_server.NewError(http.StatusBadRequest, fmt.Sprintf("bad pods: %v", v))
 		return
 	}
+	writes := make([]RegistryWrite, 0, len(*pods))
 	for _, pod := range *pods {
-		if consumeErr := p.consumer.ConsumeMessage(bus.NewMessage(pod, nil)); consumeErr != nil {
-			p.log.Error(err)
+		writes = append(writes, RegistryWrite{
+			Name:   pod.Name,
+			Expect: pod.ExpectRevision,
+		})
+	}
+	err = writeRegistryPods(ctx, p.log, p.consumer, p.history, writes)
+	return
+}
+
+// writeRegistryPods records revisions and writes pods to registry. Writes
+// with expected revisions are applied in one transaction. Unconditional
+// writes are applied in transactions of up to registryMaxPods pods. Nil pods
+// are removed from registry. If history is nil pods are submitted to consumer.
+func writeRegistryPods(ctx context.Context, log *logx.Log, consumer bus.Consumer, history *RegistryHistory, writes []RegistryWrite) (err error) {
+	names := map[string]struct{}{}
+	conditional := false
+	for _, write := range writes {
+		if _, ok := names[write.Name]; ok {
+			err = api_server.NewError(http.StatusBadRequest, fmt.Sprintf("duplicate pod: %s", write.Name))
+			return
+		}
+		names[write.Name] = struct{}{}
+		if write.Expect != nil && history == nil {
+			err = api_server.NewError(http.StatusBadRequest, `expected revisions are not supported`)
+			return
+		}
+		conditional = conditional || write.Expect != nil
+	}
+	if conditional && len(writes) > registryMaxPods {
+		err = api_server.NewError(http.StatusBadRequest, fmt.Sprintf("too many pods with expected revisions: %d is greater than %d", len(writes), registryMaxPods))
+		return
+	}
+	if history != nil {
+		for offset := 0; offset < len(writes); offset += registryMaxPods {
+			end := offset + registryMaxPods
+			if end > len(writes) {
+				end = len(writes)
+			}
+			if _, writeErr := history.Write(ctx, writes[offset:end]); writeErr != nil {
+				if offset > 0 {
+					log.Errorf(`write failed after %d of %d pods: %v`, offset, len(writes), writeErr)
+				}
+				err = registryWriteError(writeErr)
+				return
+			}
 		}
+		return
+	}
+	for _, write := range writes {
+		var payload interface{}
+		if write.Pod != nil {
+			payload = write.Pod
+		}
+		if consumeErr := consumer.ConsumeMessage(bus.NewMessage(write.Name, payload)); consumeErr != nil {
+			log.Error(consumeErr)
+		}
+	}
+	return
+}
+
+// registryWriteError returns API error for error returned by
+// RegistryHistory.Write
+func registryWriteError(writeErr error) (err error) {
+	if writeErr == ErrRevisionConflict {
+		err = api_server.NewError(http.StatusConflict, fmt.Sprintf("can't write pods: %v", writeErr))
+		return
 	}
+	err = api_server.NewError(http.StatusServiceUnavailable, fmt.Sprintf("can't record revision: %v", writeErr))
 	return
 }
@@ -0,0 +1,432 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/api/api-server"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/cluster"
+	"github.com/akaspin/soil/manifest"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderAuthor  = "X-Soil-Author"
+	HeaderComment = "X-Soil-Comment"
+
+	DefaultRegistryHistory = 10
+
+	registryPrefix          = "registry"
+	registryHistoryPrefix   = "history"
+	registryHistoryAttempts = 10
+	registryHistoryInterval = time.Millisecond * 100
+)
+
+// ErrRevisionConflict is returned by RegistryHistory.Write if expected
+// revision is not last revision of pod
+var ErrRevisionConflict = fmt.Errorf(`revision conflict`)
+
+// RegistryRevision is recorded state of pod in registry
+type RegistryRevision struct {
+	Revision  int
+	Timestamp time.Time
+	Author    string        `json:",omitempty"`
+	Comment   string        `json:",omitempty"`
+	Pod       *manifest.Pod `json:",omitempty"` // Nil if pod is deleted
+}
+
+// RegistryHistoryKV is cluster storage used to record revisions
+type RegistryHistoryKV interface {
+	CAS(ctx context.Context, ops []cluster.CASOp) (ok bool, err error)
+}
+
+// RegistryHistory records revisions of pods in registry to
+// "history/<pod>/<revision>" keys. Revision numbers are claimed with
+// compare-and-set in one transaction with write of pod to "registry/<pod>".
+// Only last "retention" revisions of each pod are kept. RegistryHistory
+// accepts "history" messages with all recorded revisions. Actual registry
+// values are accepted by consumer returned by RegistryConsumer.
+type RegistryHistory struct {
+	log   *logx.Log
+	kv    RegistryHistoryKV
+	store bus.Consumer // permanent "history" store to remove old revisions
+
+	mu        sync.Mutex
+	retention int
+	revisions map[string]map[int]RegistryRevision
+	last      map[string]int         // last known revision by pod
+	registry  map[string]interface{} // actual registry values by pod
+}
+
+func NewRegistryHistory(log *logx.Log, kv RegistryHistoryKV, store bus.Consumer) (h *RegistryHistory) {
+	h = &RegistryHistory{
+		log:       log.GetLog("api", "registry", "history"),
+		kv:        kv,
+		store:     store,
+		retention: DefaultRegistryHistory,
+		revisions: map[string]map[int]RegistryRevision{},
+		last:      map[string]int{},
+		registry:  map[string]interface{}{},
+	}
+	return
+}
+
+// Configure sets number of revisions to keep for each pod
+func (h *RegistryHistory) Configure(retention int) {
+	if retention <= 0 {
+		retention = DefaultRegistryHistory
+	}
+	h.mu.Lock()
+	h.retention = retention
+	h.mu.Unlock()
+}
+
+func (h *RegistryHistory) ConsumeMessage(message bus.Message) (err error) {
+	var raw map[string]RegistryRevision
+	if err = message.Payload().Unmarshal(&raw); err != nil {
+		h.log.Error(err)
+		return
+	}
+	revisions := map[string]map[int]RegistryRevision{}
+	for key, revision := range raw {
+		split := strings.LastIndex(key, "/")
+		if split < 0 {
+			h.log.Warningf(`bad revision: %s`, key)
+			continue
+		}
+		name := key[:split]
+		if _, ok := revisions[name]; !ok {
+			revisions[name] = map[int]RegistryRevision{}
+		}
+		revisions[name][revision.Revision] = revision
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.revisions = revisions
+	for name, pod := range revisions {
+		for revision := range pod {
+			if revision > h.last[name] {
+				h.last[name] = revision
+			}
+		}
+	}
+	return
+}
+
+// RegistryConsumer returns consumer which accepts actual registry values
+func (h *RegistryHistory) RegistryConsumer() (c bus.Consumer) {
+	c = registryHistoryRegistry{history: h}
+	return
+}
+
+func (h *RegistryHistory) consumeRegistry(message bus.Message) (err error) {
+	var registry map[string]interface{}
+	if err = message.Payload().Unmarshal(&registry); err != nil {
+		h.log.Error(err)
+		return
+	}
+	if registry == nil {
+		registry = map[string]interface{}{}
+	}
+	h.mu.Lock()
+	h.registry = registry
+	h.mu.Unlock()
+	return
+}
+
+// Revisions returns recorded revisions of pod ordered by revision number
+func (h *RegistryHistory) Revisions(name string) (res []RegistryRevision) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, revision := range h.revisions[name] {
+		res = append(res, revision)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Revision < res[j].Revision
+	})
+	return
+}
+
+// Revision returns recorded revision of pod
+func (h *RegistryHistory) Revision(name string, revision int) (res RegistryRevision, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res, ok = h.revisions[name][revision]
+	return
+}
+
+// LastRevision returns last known revision of pod or zero if pod has no
+// revisions
+func (h *RegistryHistory) LastRevision(name string) (res int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res = h.last[name]
+	return
+}
+
+// RegistryWrite is write of pod to registry. Nil pod removes pod from
+// registry. If expected revision is defined pod is written only if expected
+// revision is last revision of pod. Zero expected revision means that pod
+// should not have revisions: pod existing in registry without history is
+// compared with actual registry value.
+type RegistryWrite struct {
+	Name    string
+	Pod     *manifest.Pod
+	Expect  *int
+	Comment string // Used if request has no comment header
+}
+
+// Write atomically records new revisions of pods with author and comment
+// from request headers and writes pods to registry in one transaction.
+// Write returns ErrRevisionConflict if any pod with expected revision was
+// changed after expected revision. Writes without expected revisions are
+// retried if pods were changed concurrently.
+func (h *RegistryHistory) Write(ctx context.Context, writes []RegistryWrite) (res []RegistryRevision, err error) {
+	retry := true
+	for _, write := range writes {
+		if write.Expect != nil {
+			retry = false
+		}
+	}
+	for attempt := 0; attempt < registryHistoryAttempts; attempt++ {
+		if attempt > 0 {
+			// wait for actual registry and history
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			case <-time.After(registryHistoryInterval):
+			}
+		}
+		res = make([]RegistryRevision, 0, len(writes))
+		var ops []cluster.CASOp
+		for _, write := range writes {
+			revision := h.newRevision(ctx, write.Pod, write.Comment)
+			var expect *bus.Payload
+			if revision.Revision, expect, err = h.expect(write); err != nil {
+				return
+			}
+			res = append(res, revision)
+			ops = append(ops, h.ops(write.Name, revision, expect)...)
+		}
+		var ok bool
+		if ok, err = h.kv.CAS(ctx, ops); err != nil {
+			return
+		}
+		if ok {
+			for i, write := range writes {
+				h.commit(write.Name, res[i].Revision)
+				h.log.Infof(`recorded %s revision %d`, write.Name, res[i].Revision)
+			}
+			return
+		}
+		if !retry {
+			break
+		}
+	}
+	res = nil
+	err = ErrRevisionConflict
+	return
+}
+
+// expect returns number of new revision and expected registry value for
+// write
+func (h *RegistryHistory) expect(write RegistryWrite) (revision int, expect *bus.Payload, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	last := h.last[write.Name]
+	if write.Expect == nil || *write.Expect == 0 {
+		if write.Expect != nil && last > 0 {
+			err = ErrRevisionConflict
+			return
+		}
+		revision = last + 1
+		if value, ok := h.registry[write.Name]; ok {
+			payload := bus.NewPayload(value)
+			expect = &payload
+		}
+		return
+	}
+	// registry value should be equal to pod in expected revision
+	previous, ok := h.revisions[write.Name][*write.Expect]
+	if !ok {
+		err = ErrRevisionConflict
+		return
+	}
+	revision = *write.Expect + 1
+	if previous.Pod != nil {
+		// backends compare values decoded from JSON
+		var value interface{}
+		if err = bus.NewPayload(previous.Pod).Unmarshal(&value); err != nil {
+			return
+		}
+		payload := bus.NewPayload(value)
+		expect = &payload
+	}
+	return
+}
+
+// ops returns operations to record revision and write pod in revision to
+// registry if actual registry value is equal to expected
+func (h *RegistryHistory) ops(name string, revision RegistryRevision, expect *bus.Payload) (res []cluster.CASOp) {
+	var value interface{}
+	if revision.Pod != nil {
+		value = revision.Pod
+	}
+	res = []cluster.CASOp{
+		{
+			Message: bus.NewMessage(cluster.NormalizeKey(registryHistoryPrefix, name, strconv.Itoa(revision.Revision)), revision),
+		},
+		{
+			Message: bus.NewMessage(cluster.NormalizeKey(registryPrefix, name), value),
+			Expect:  expect,
+		},
+	}
+	return
+}
+
+// commit updates last known revision of pod and prunes old revisions
+func (h *RegistryHistory) commit(name string, revision int) {
+	h.mu.Lock()
+	if revision > h.last[name] {
+		h.last[name] = revision
+	}
+	h.mu.Unlock()
+	h.prune(name, revision)
+}
+
+func (h *RegistryHistory) newRevision(ctx context.Context, pod *manifest.Pod, comment string) (res RegistryRevision) {
+	res = RegistryRevision{
+		Timestamp: time.Now().UTC(),
+		Comment:   comment,
+		Pod:       pod,
+	}
+	if header := api_server.RequestHeader(ctx); header != nil {
+		res.Author = header.Get(HeaderAuthor)
+		if value := header.Get(HeaderComment); value != "" {
+			res.Comment = value
+		}
+	}
+	return
+}
+
+// prune removes revisions which are out of retention
+func (h *RegistryHistory) prune(name string, last int) {
+	h.mu.Lock()
+	var stale []int
+	for revision := range h.revisions[name] {
+		if revision <= last-h.retention {
+			stale = append(stale, revision)
+		}
+	}
+	h.mu.Unlock()
+	for _, revision := range stale {
+		h.store.ConsumeMessage(bus.NewMessage(cluster.NormalizeKey(name, strconv.Itoa(revision)), nil))
+	}
+}
+
+// NewRegistryHistoryGet returns endpoint with revisions of pod on
+// "/v1/registry/<pod>/history".
+func NewRegistryHistoryGet(history *RegistryHistory) (e *api_server.Endpoint) {
+	return api_server.GET(V1Registry+"/", &registryHistoryGetProcessor{
+		history: history,
+	})
+}
+
+type registryHistoryGetProcessor struct {
+	history *RegistryHistory
+}
+
+func (p *registryHistoryGetProcessor) Empty() interface{} {
+	return nil
+}
+
+func (p *registryHistoryGetProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	name, err := registryPodAction(u, "history")
+	if err != nil {
+		return
+	}
+	revisions := p.history.Revisions(name)
+	if len(revisions) == 0 {
+		err = api_server.NewError(http.StatusNotFound, fmt.Sprintf("history of %s not found", name))
+		return
+	}
+	res = revisions
+	return
+}
+
+// NewRegistryRollbackPost returns endpoint which rolls back pod to revision
+// on "/v1/registry/<pod>/rollback?revision=<revision>". Rollback is recorded
+// as new revision.
+func NewRegistryRollbackPost(log *logx.Log, history *RegistryHistory) (e *api_server.Endpoint) {
+	return api_server.POST(V1Registry+"/", &registryRollbackPostProcessor{
+		log:     log.GetLog("api", "post", V1Registry+"/rollback"),
+		history: history,
+	})
+}
+
+type registryRollbackPostProcessor struct {
+	log     *logx.Log
+	history *RegistryHistory
+}
+
+func (p *registryRollbackPostProcessor) Empty() interface{} {
+	return nil
+}
+
+func (p *registryRollbackPostProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	name, err := registryPodAction(u, "rollback")
+	if err != nil {
+		return
+	}
+	revision, convErr := strconv.Atoi(u.Query().Get("revision"))
+	if convErr != nil {
+		err = api_server.NewError(http.StatusBadRequest, fmt.Sprintf("bad revision: %v", convErr))
+		return
+	}
+	target, ok := p.history.Revision(name, revision)
+	if !ok {
+		err = api_server.NewError(http.StatusNotFound, fmt.Sprintf("revision %d of %s not found", revision, name))
+		return
+	}
+	recorded, writeErr := p.history.Write(ctx, []RegistryWrite{
+		{
+			Name:    name,
+			Pod:     target.Pod,
+			Comment: fmt.Sprintf("rollback to %d", revision),
+		},
+	})
+	if writeErr != nil {
+		err = registryWriteError(writeErr)
+		return
+	}
+	res = recorded[0]
+	return
+}
+
+// registryPodAction returns pod name from "/v1/registry/<pod>/<action>"
+func registryPodAction(u *url.URL, action string) (name string, err error) {
+	if u != nil {
+		name = strings.TrimSuffix(strings.TrimPrefix(u.Path, V1Registry+"/"), "/"+action)
+	}
+	if u == nil || !strings.HasSuffix(u.Path, "/"+action) || name == "" || strings.Contains(name, "/") {
+		err = api_server.NewError(http.StatusNotFound, fmt.Sprintf("not found %s", u))
+	}
+	return
+}
+
+type registryHistoryRegistry struct {
+	history *RegistryHistory
+}
+
+func (r registryHistoryRegistry) ConsumeMessage(message bus.Message) (err error) {
+	err = r.history.consumeRegistry(message)
+	return
+}
@@ -0,0 +1,350 @@
+// +build ide test_unit
+
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/api"
+	"github.com/akaspin/soil/agent/api/api-server"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/cluster"
+	"github.com/akaspin/soil/manifest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testingHistoryKV is in-memory storage which propagates all revisions and
+// registry values to consumers on each change
+type testingHistoryKV struct {
+	mu           sync.Mutex
+	failure      error
+	transactions int // number of successful transactions
+	data         map[string]interface{}
+	consumer     bus.Consumer
+	registry     bus.Consumer
+}
+
+func (k *testingHistoryKV) CAS(ctx context.Context, ops []cluster.CASOp) (ok bool, err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.failure != nil {
+		err = k.failure
+		return
+	}
+	for _, op := range ops {
+		current, exists := k.data[op.Message.GetID()]
+		if exists && op.Expect == nil {
+			return
+		}
+		if op.Expect != nil && (!exists || bus.NewPayload(current).Hash() != op.Expect.Hash()) {
+			return
+		}
+	}
+	for _, op := range ops {
+		if op.Message.Payload().IsEmpty() {
+			delete(k.data, op.Message.GetID())
+			continue
+		}
+		var value interface{}
+		if err = op.Message.Payload().Unmarshal(&value); err != nil {
+			return
+		}
+		k.data[op.Message.GetID()] = value
+	}
+	ok = true
+	k.transactions++
+	k.broadcast()
+	return
+}
+
+func (k *testingHistoryKV) ConsumeMessage(message bus.Message) (err error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.data, cluster.NormalizeKey("history", message.GetID()))
+	k.broadcast()
+	return
+}
+
+func (k *testingHistoryKV) broadcast() {
+	payload := map[string]interface{}{}
+	registry := map[string]interface{}{}
+	for key, value := range k.data {
+		if strings.HasPrefix(key, "history/") {
+			payload[strings.TrimPrefix(key, "history/")] = value
+		}
+		if strings.HasPrefix(key, "registry/") {
+			registry[strings.TrimPrefix(key, "registry/")] = value
+		}
+	}
+	k.consumer.ConsumeMessage(bus.NewMessage("history", payload))
+	k.registry.ConsumeMessage(bus.NewMessage("registry", registry))
+}
+
+func (k *testingHistoryKV) value(key string) (res interface{}, ok bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	res, ok = k.data[key]
+	return
+}
+
+func TestRegistryHistory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	kv := &testingHistoryKV{
+		data: map[string]interface{}{},
+	}
+	history := api.NewRegistryHistory(logx.GetLog("test"), kv, kv)
+	history.Configure(2)
+	kv.consumer = history
+	kv.registry = history.RegistryConsumer()
+
+	cons := bus.NewTestingConsumer(ctx)
+	registryGet := api.NewRegistryPodsGet(history)
+	router := api_server.NewRouter(logx.GetLog("test"),
+		registryGet,
+		api.NewRegistryPodsPut(logx.GetLog("test"), cons, history),
+		api.NewRegistryPodsDelete(logx.GetLog("test"), cons, history),
+		api.NewRegistryHistoryGet(history),
+		api.NewRegistryRollbackPost(logx.GetLog("test"), history),
+	)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	do := func(t *testing.T, method, path string, v interface{}, author string) (resp *http.Response) {
+		t.Helper()
+		buf := &bytes.Buffer{}
+		if v != nil {
+			require.NoError(t, json.NewEncoder(buf).Encode(v))
+		}
+		req, err := http.NewRequest(method, srv.URL+path, buf)
+		require.NoError(t, err)
+		if author != "" {
+			req.Header.Set(api.HeaderAuthor, author)
+			req.Header.Set(api.HeaderComment, "by "+author)
+		}
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return
+	}
+	getHistory := func(t *testing.T, name string) (res []api.RegistryRevision) {
+		t.Helper()
+		resp := do(t, http.MethodGet, fmt.Sprintf("/v1/registry/%s/history", name), nil, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		return
+	}
+	pod := func(target string) *manifest.Pod {
+		return &manifest.Pod{
+			Namespace: manifest.PublicNamespace,
+			Name:      "pod-1",
+			Target:    target,
+		}
+	}
+	registryTarget := func(t *testing.T, name string) (res string) {
+		t.Helper()
+		value, ok := kv.value("registry/" + name)
+		if ok {
+			res = value.(map[string]interface{})["Target"].(string)
+		}
+		return
+	}
+
+	t.Run(`not found`, func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, do(t, http.MethodGet, "/v1/registry/pod-1/history", nil, "").StatusCode)
+		assert.Equal(t, http.StatusNotFound, do(t, http.MethodPost, "/v1/registry/pod-1/rollback?revision=1", nil, "").StatusCode)
+	})
+	t.Run(`put`, func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do(t, http.MethodPut, "/v1/registry", manifest.Registry{pod("first.target")}, "alice").StatusCode)
+		assert.Equal(t, http.StatusOK, do(t, http.MethodPut, "/v1/registry", manifest.Registry{pod("second.target")}, "bob").StatusCode)
+		assert.Equal(t, "second.target", registryTarget(t, "pod-1"))
+
+		res := getHistory(t, "pod-1")
+		require.Len(t, res, 2)
+		for i, author := range []string{"alice", "bob"} {
+			assert.Equal(t, i+1, res[i].Revision)
+			assert.Equal(t, author, res[i].Author)
+			assert.Equal(t, "by "+author, res[i].Comment)
+			assert.False(t, res[i].Timestamp.IsZero())
+		}
+		assert.Equal(t, pod("first.target"), res[0].Pod)
+	})
+	t.Run(`get with revisions`, func(t *testing.T) {
+		registryGet.Processor().(bus.Consumer).ConsumeMessage(bus.NewMessage("registry", manifest.Registry{pod("second.target")}))
+		resp := do(t, http.MethodGet, "/v1/registry", nil, "")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		defer resp.Body.Close()
+		var res []api.RegistryPod
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		assert.Equal(t, []api.RegistryPod{
+			{Pod: pod("second.target"), Mark: pod("second.target").Mark(), Revision: 2},
+		}, res)
+	})
+	t.Run(`not ready`, func(t *testing.T) {
+		kv.mu.Lock()
+		kv.failure = cluster.ErrNotReady
+		kv.mu.Unlock()
+		assert.Equal(t, http.StatusServiceUnavailable, do(t, http.MethodPut, "/v1/registry", manifest.Registry{pod("third.target")}, "alice").StatusCode)
+		kv.mu.Lock()
+		kv.failure = nil
+		kv.mu.Unlock()
+		assert.Equal(t, "second.target", registryTarget(t, "pod-1"))
+		assert.Len(t, getHistory(t, "pod-1"), 2)
+		assert.Equal(t, 2, history.LastRevision("pod-1"))
+	})
+	t.Run(`rollback`, func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, do(t, http.MethodPost, "/v1/registry/pod-1/rollback?revision=one", nil, "").StatusCode)
+		assert.Equal(t, http.StatusOK, do(t, http.MethodPost, "/v1/registry/pod-1/rollback?revision=1", nil, "").StatusCode)
+		assert.Equal(t, "first.target", registryTarget(t, "pod-1"))
+
+		// revision 1 is out of retention
+		res := getHistory(t, "pod-1")
+		require.Len(t, res, 2)
+		assert.Equal(t, 2, res[0].Revision)
+		assert.Equal(t, 3, res[1].Revision)
+		assert.Equal(t, "rollback to 1", res[1].Comment)
+		assert.Equal(t, pod("first.target"), res[1].Pod)
+	})
+	t.Run(`delete and rollback`, func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do(t, http.MethodDelete, "/v1/registry", []string{"pod-1"}, "alice").StatusCode)
+		_, ok := kv.value("registry/pod-1")
+		assert.False(t, ok)
+		res := getHistory(t, "pod-1")
+		require.Len(t, res, 2)
+		assert.Equal(t, 4, res[1].Revision)
+		assert.Nil(t, res[1].Pod)
+
+		assert.Equal(t, http.StatusOK, do(t, http.MethodPost, "/v1/registry/pod-1/rollback?revision=3", nil, "bob").StatusCode)
+		assert.Equal(t, "first.target", registryTarget(t, "pod-1"))
+	})
+	t.Run(`compare and set`, func(t *testing.T) {
+		update := func(target string, expect int) []api.RegistryPodUpdate {
+			v := pod(target)
+			v.Name = "pod-2"
+			return []api.RegistryPodUpdate{{Pod: v, ExpectRevision: &expect}}
+		}
+		assert.Equal(t, http.StatusOK, do(t, http.MethodPut, "/v1/registry", update("first.target", 0), "alice").StatusCode)
+		assert.Equal(t, http.StatusConflict, do(t, http.MethodPut, "/v1/registry", update("second.target", 0), "bob").StatusCode)
+		assert.Equal(t, http.StatusConflict, do(t, http.MethodPut, "/v1/registry", update("second.target", 2), "bob").StatusCode)
+		assert.Equal(t, "first.target", registryTarget(t, "pod-2"))
+
+		assert.Equal(t, http.StatusOK, do(t, http.MethodPut, "/v1/registry", update("second.target", 1), "bob").StatusCode)
+		assert.Equal(t, "second.target", registryTarget(t, "pod-2"))
+
+		res := getHistory(t, "pod-2")
+		require.Len(t, res, 2)
+		assert.Equal(t, "bob", res[1].Author)
+		assert.Equal(t, 2, history.LastRevision("pod-2"))
+
+		removal := func(expect int) []api.RegistryPodRemoval {
+			return []api.RegistryPodRemoval{{Name: "pod-2", ExpectRevision: &expect}}
+		}
+		assert.Equal(t, http.StatusConflict, do(t, http.MethodDelete, "/v1/registry", removal(1), "alice").StatusCode)
+		assert.Equal(t, http.StatusOK, do(t, http.MethodDelete, "/v1/registry", removal(2), "alice").StatusCode)
+		_, ok := kv.value("registry/pod-2")
+		assert.False(t, ok)
+		assert.Equal(t, 3, history.LastRevision("pod-2"))
+	})
+	t.Run(`without history`, func(t *testing.T) {
+		// pod-3 is submitted before history
+		kv.mu.Lock()
+		kv.data["registry/pod-3"] = map[string]interface{}{
+			"Namespace": manifest.PublicNamespace,
+			"Name":      "pod-3",
+			"Target":    "first.target",
+		}
+		kv.broadcast()
+		kv.mu.Unlock()
+
+		expect := 0
+		v := pod("second.target")
+		v.Name = "pod-3"
+		update := []api.RegistryPodUpdate{{Pod: v, ExpectRevision: &expect}}
+		assert.Equal(t, http.StatusOK, do(t, http.MethodPut, "/v1/registry", update, "alice").StatusCode)
+		assert.Equal(t, "second.target", registryTarget(t, "pod-3"))
+		assert.Equal(t, 1, history.LastRevision("pod-3"))
+		assert.Equal(t, http.StatusConflict, do(t, http.MethodPut, "/v1/registry", update, "alice").StatusCode)
+	})
+	t.Run(`batch`, func(t *testing.T) {
+		one, two, stale := 1, 0, 0
+		v1 := pod("batch.target")
+		v1.Name = "pod-3"
+		v2 := pod("batch.target")
+		v2.Name = "pod-4"
+		assert.Equal(t, http.StatusConflict, do(t, http.MethodPut, "/v1/registry", []api.RegistryPodUpdate{
+			{Pod: v2, ExpectRevision: &two},
+			{Pod: v1, ExpectRevision: &stale},
+			{Pod: pod("batch.target")},
+		}, "alice").StatusCode)
+		stale = 2
+		assert.Equal(t, http.StatusConflict, do(t, http.MethodPut, "/v1/registry", []api.RegistryPodUpdate{
+			{Pod: v2, ExpectRevision: &two},
+			{Pod: v1, ExpectRevision: &stale},
+		}, "alice").StatusCode)
+		assert.Equal(t, "second.target", registryTarget(t, "pod-3"))
+		assert.Equal(t, "", registryTarget(t, "pod-4"))
+		assert.Equal(t, 0, history.LastRevision("pod-4"))
+		_, ok := kv.value("history/pod-4/1")
+		assert.False(t, ok)
+
+		assert.Equal(t, http.StatusBadRequest, do(t, http.MethodPut, "/v1/registry", []api.RegistryPodUpdate{
+			{Pod: v1}, {Pod: v1},
+		}, "alice").StatusCode)
+		var many []api.RegistryPodRemoval
+		for i := 0; i < 17; i++ {
+			many = append(many, api.RegistryPodRemoval{Name: fmt.Sprintf("pod-%d", i), ExpectRevision: &two})
+		}
+		assert.Equal(t, http.StatusBadRequest, do(t, http.MethodDelete, "/v1/registry", many, "alice").StatusCode)
+
+		assert.Equal(t, http.StatusOK, do(t, http.MethodPut, "/v1/registry", []api.RegistryPodUpdate{
+			{Pod: v2, ExpectRevision: &two},
+			{Pod: v1, ExpectRevision: &one},
+		}, "alice").StatusCode)
+		assert.Equal(t, "batch.target", registryTarget(t, "pod-3"))
+		assert.Equal(t, "batch.target", registryTarget(t, "pod-4"))
+
+		assert.Equal(t, http.StatusConflict, do(t, http.MethodDelete, "/v1/registry", []api.RegistryPodRemoval{
+			{Name: "pod-3"},
+			{Name: "pod-4", ExpectRevision: &two},
+		}, "alice").StatusCode)
+		assert.Equal(t, "batch.target", registryTarget(t, "pod-3"))
+		assert.Equal(t, http.StatusOK, do(t, http.MethodDelete, "/v1/registry", []string{"pod-3", "pod-4"}, "alice").StatusCode)
+		assert.Equal(t, "", registryTarget(t, "pod-3"))
+		assert.Equal(t, "", registryTarget(t, "pod-4"))
+	})
+	t.Run(`large batch`, func(t *testing.T) {
+		var pods manifest.Registry
+		var names []string
+		for i := 0; i < 40; i++ {
+			v := pod("large.target")
+			v.Name = fmt.Sprintf("large-%d", i)
+			pods = append(pods, v)
+			names = append(names, v.Name)
+		}
+		kv.mu.Lock()
+		kv.transactions = 0
+		kv.mu.Unlock()
+		assert.Equal(t, http.StatusOK, do(t, http.MethodPut, "/v1/registry", pods, "alice").StatusCode)
+		for _, name := range names {
+			assert.Equal(t, "large.target", registryTarget(t, name))
+			assert.Equal(t, 1, history.LastRevision(name))
+		}
+		kv.mu.Lock()
+		assert.Equal(t, 3, kv.transactions)
+		kv.mu.Unlock()
+
+		assert.Equal(t, http.StatusOK, do(t, http.MethodDelete, "/v1/registry", names, "alice").StatusCode)
+		for _, name := range names {
+			assert.Equal(t, "", registryTarget(t, name))
+		}
+	})
+}
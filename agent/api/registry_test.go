@@ -27,7 +27,7 @@ func TestRegistryPodsPutProcessor_Process(t *testing.T) {
 	defer cancel()
 
 	cons := bus.NewTestingConsumer(ctx)
-	endpoint := api.NewRegistryPodsPut(logx.GetLog("test"), cons)
+	endpoint := api.NewRegistryPodsPut(logx.GetLog("test"), cons, nil)
 	router := api_server.NewRouter(logx.GetLog("test"), endpoint)
 	srv := httptest.NewServer(router)
 	defer srv.Close()
@@ -77,7 +77,7 @@ func TestRegistryPodsDeleteProcessor_Process(t *testing.T) {
 	defer cancel()
 
 	cons := bus.NewTestingConsumer(ctx)
-	endpoint := api.NewRegistryPodsDelete(logx.GetLog("test"), cons)
+	endpoint := api.NewRegistryPodsDelete(logx.GetLog("test"), cons, nil)
 	router := api_server.NewRouter(logx.GetLog("test"), endpoint)
 	srv := httptest.NewServer(router)
 	defer srv.Close()
@@ -107,7 +107,7 @@ func TestRegistryPodsDeleteProcessor_Process(t *testing.T) {
 }
 
 func TestRegistryPodsGetProcessor_Process(t *testing.T) {
-	endpoint := api.NewRegistryPodsGet()
+	endpoint := api.NewRegistryPodsGet(nil)
 	router := api_server.NewRouter(logx.GetLog("test"), endpoint)
 	srv := httptest.NewServer(router)
 	defer srv.Close()
@@ -152,4 +152,17 @@ func TestRegistryPodsGetProcessor_Process(t *testing.T) {
 			return
 		})
 	})
+	t.Run(`with marks`, func(t *testing.T) {
+		resp, err := http.Get(fmt.Sprintf("%s/v1/registry", srv.URL))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var pods []api.RegistryPod
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&pods))
+		require.Len(t, pods, 2)
+		for _, pod := range pods {
+			assert.NotZero(t, pod.Mark)
+			assert.Equal(t, pod.Pod.Mark(), pod.Mark)
+			assert.Zero(t, pod.Revision)
+		}
+	})
 }
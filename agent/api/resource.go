@@ -0,0 +1,103 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/soil/agent/api/api-server"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ResourceRotator regenerates values of allocated resources
+type ResourceRotator interface {
+	Rotate(kind, id string) error
+}
+
+// ResourceRotatorFunc is function adapter for ResourceRotator
+type ResourceRotatorFunc func(kind, id string) error
+
+func (f ResourceRotatorFunc) Rotate(kind, id string) error {
+	return f(kind, id)
+}
+
+// NewResourceRotatePut returns endpoint which regenerates values of
+// allocated resource. Pods using resource are updated with new values.
+func NewResourceRotatePut(rotator ResourceRotator) (e *api_server.Endpoint) {
+	return api_server.PUT(proto.V1ResourceRotate, &resourceRotatePutProcessor{
+		rotator: rotator,
+	})
+}
+
+type resourceRotatePutProcessor struct {
+	rotator ResourceRotator
+}
+
+func (p *resourceRotatePutProcessor) Empty() interface{} {
+	return &proto.ResourceRotateRequest{}
+}
+
+func (p *resourceRotatePutProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	req, ok := v.(*proto.ResourceRotateRequest)
+	if !ok || req == nil || req.Kind == "" || req.ID == "" {
+		err = api_server.NewError(http.StatusBadRequest, fmt.Sprintf("bad rotate request: %v", v))
+		return
+	}
+	if err = p.rotator.Rotate(req.Kind, req.ID); err != nil {
+		err = api_server.NewError(http.StatusBadRequest, err.Error())
+	}
+	return
+}
+
+// NewResourcesGet returns endpoint with configurations, allocations and
+// capacities of all resource kinds on agent. Inventory is requested from
+// inventoryFn on each call. Secret values are redacted.
+func NewResourcesGet(inventoryFn func() map[string]proto.ResourceInventory) (e *api_server.Endpoint) {
+	return api_server.GET(proto.V1Resources, &resourcesGetProcessor{
+		inventoryFn: inventoryFn,
+	})
+}
+
+// NewResourceGet returns endpoint with inventory of one resource kind.
+// Endpoint shares processor with given resources endpoint.
+func NewResourceGet(resources *api_server.Endpoint) (e *api_server.Endpoint) {
+	return api_server.GET(proto.V1Resources+"/", resources.Processor())
+}
+
+type resourcesGetProcessor struct {
+	inventoryFn func() map[string]proto.ResourceInventory
+}
+
+func (p *resourcesGetProcessor) Empty() interface{} {
+	return nil
+}
+
+func (p *resourcesGetProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	inventory := p.inventoryFn()
+	if inventory == nil {
+		inventory = map[string]proto.ResourceInventory{}
+	}
+	for kind, kindInventory := range inventory {
+		for id, allocation := range kindInventory.Allocations {
+			for k, value := range allocation.Values {
+				allocation.Values[k] = bus.Redact(value)
+			}
+			kindInventory.Allocations[id] = allocation
+		}
+		inventory[kind] = kindInventory
+	}
+	if u == nil || !strings.HasPrefix(u.Path, proto.V1Resources+"/") {
+		res = inventory
+		return
+	}
+	kind := strings.TrimPrefix(u.Path, proto.V1Resources+"/")
+	kindInventory, ok := inventory[kind]
+	if !ok {
+		err = api_server.NewError(http.StatusNotFound, fmt.Sprintf("resource kind %s not found", kind))
+		return
+	}
+	res = kindInventory
+	return
+}
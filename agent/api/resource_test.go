@@ -0,0 +1,88 @@
+// +build ide test_unit
+
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/soil/agent/api"
+	"github.com/akaspin/soil/agent/api/api-server"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+func TestResourceRotatePut(t *testing.T) {
+	var rotated []string
+	processor := api.NewResourceRotatePut(api.ResourceRotatorFunc(func(kind, id string) (err error) {
+		if id == "pod-1.missing" {
+			err = fmt.Errorf(`allocation %s not found`, id)
+			return
+		}
+		rotated = append(rotated, kind+":"+id)
+		return
+	})).Processor()
+
+	t.Run("ok", func(t *testing.T) {
+		_, err := processor.Process(context.Background(), nil, &proto.ResourceRotateRequest{Kind: "secret", ID: "pod-1.db"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"secret:pod-1.db"}, rotated)
+	})
+	t.Run("not found", func(t *testing.T) {
+		_, err := processor.Process(context.Background(), nil, &proto.ResourceRotateRequest{Kind: "secret", ID: "pod-1.missing"})
+		assert.Equal(t, api_server.NewError(400, "allocation pod-1.missing not found"), err)
+	})
+	t.Run("bad request", func(t *testing.T) {
+		_, err := processor.Process(context.Background(), nil, &proto.ResourceRotateRequest{Kind: "secret"})
+		assert.Error(t, err)
+	})
+}
+
+func TestResourcesGet(t *testing.T) {
+	bus.RegisterSecret("secret-password")
+	defer bus.UnregisterSecret("secret-password")
+
+	processor := api.NewResourcesGet(func() map[string]proto.ResourceInventory {
+		return map[string]proto.ResourceInventory{
+			"port": {
+				Nature:     "range",
+				Kind:       "port",
+				Properties: map[string]interface{}{"min": 8000, "max": 8009},
+				Allocations: map[string]proto.ResourceAllocation{
+					"pod-1.http": {Pod: "pod-1", Name: "http", Allocated: true, Values: map[string]string{"value": "8000"}},
+				},
+				Capacity: &proto.ResourceCapacity{Total: 10, Allocated: 1, Free: 9},
+			},
+			"secret": {
+				Nature: "secret",
+				Kind:   "secret",
+				Allocations: map[string]proto.ResourceAllocation{
+					"pod-1.db": {Pod: "pod-1", Name: "db", Allocated: true, Values: map[string]string{"type": "password", "value": "secret-password"}},
+				},
+			},
+		}
+	}).Processor()
+
+	t.Run("all", func(t *testing.T) {
+		res, err := processor.Process(context.Background(), &url.URL{Path: proto.V1Resources}, nil)
+		assert.NoError(t, err)
+		assert.Len(t, res, 2)
+	})
+	t.Run("kind", func(t *testing.T) {
+		res, err := processor.Process(context.Background(), &url.URL{Path: proto.V1Resources + "/secret"}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, proto.ResourceInventory{
+			Nature: "secret",
+			Kind:   "secret",
+			Allocations: map[string]proto.ResourceAllocation{
+				"pod-1.db": {Pod: "pod-1", Name: "db", Allocated: true, Values: map[string]string{"type": "password", "value": "<redacted>"}},
+			},
+		}, res)
+	})
+	t.Run("not found", func(t *testing.T) {
+		_, err := processor.Process(context.Background(), &url.URL{Path: proto.V1Resources + "/unknown"}, nil)
+		assert.Equal(t, api_server.NewError(404, "resource kind unknown not found"), err)
+	})
+}
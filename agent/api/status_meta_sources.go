@@ -0,0 +1,48 @@
+package api
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/api/api-server"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/metadata"
+	"github.com/akaspin/soil/proto"
+	"net/url"
+	"sync"
+)
+
+func NewStatusMetaSourcesGet(log *logx.Log) (e *api_server.Endpoint) {
+	return api_server.GET(proto.V1StatusMetaSources, &statusMetaSourcesProcessor{
+		log:     log.GetLog("api", "get", proto.V1StatusMetaSources),
+		sources: map[string]metadata.SourceStatus{},
+	})
+}
+
+type statusMetaSourcesProcessor struct {
+	log     *logx.Log
+	mu      sync.Mutex
+	sources map[string]metadata.SourceStatus
+}
+
+func (p *statusMetaSourcesProcessor) Empty() interface{} {
+	return nil
+}
+
+func (p *statusMetaSourcesProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res = p.sources
+	return
+}
+
+func (p *statusMetaSourcesProcessor) ConsumeMessage(message bus.Message) (err error) {
+	var v map[string]metadata.SourceStatus
+	if err = message.Payload().Unmarshal(&v); err != nil {
+		p.log.Error(err)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sources = v
+	return
+}
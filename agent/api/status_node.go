@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/api/api-server"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/metadata"
+	"github.com/akaspin/soil/lib"
+	"github.com/akaspin/soil/proto"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// NewStatusNodeGet returns endpoint with actual agent state. Endpoint
+// processor accepts "agent", "meta", "system", "provision", "drain" and
+// "meta_sources" messages. Cluster and resource states are requested on each call.
+func NewStatusNodeGet(log *logx.Log, clusterFn func() proto.ClusterStatus, resourcesFn func() map[string]proto.ResourceWorkerStatus) (e *api_server.Endpoint) {
+	return api_server.GET(proto.V1StatusNode, &statusNodeProcessor{
+		log:         log.GetLog("api", "get", proto.V1StatusNode),
+		clusterFn:   clusterFn,
+		resourcesFn: resourcesFn,
+		status: proto.NodeStatus{
+			NodeInfo: proto.NodeInfo{
+				Version: proto.Version,
+				API:     proto.APIV1Version,
+				Meta:    map[string]string{},
+			},
+			System: map[string]string{},
+			Pods:   map[string]int{},
+		},
+	})
+}
+
+type statusNodeProcessor struct {
+	log         *logx.Log
+	clusterFn   func() proto.ClusterStatus
+	resourcesFn func() map[string]proto.ResourceWorkerStatus
+
+	mu     sync.Mutex
+	status proto.NodeStatus
+}
+
+func (p *statusNodeProcessor) Empty() interface{} {
+	return nil
+}
+
+func (p *statusNodeProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	p.mu.Lock()
+	status := p.status
+	p.mu.Unlock()
+	status.Cluster = p.clusterFn()
+	status.Resources = p.resourcesFn()
+	res = status
+	return
+}
+
+func (p *statusNodeProcessor) ConsumeMessage(message bus.Message) (err error) {
+	if message.GetID() == "drain" {
+		var drain proto.DrainState
+		if err = message.Payload().Unmarshal(&drain); err != nil {
+			p.log.Error(err)
+			return
+		}
+		p.mu.Lock()
+		p.status.Drain = drain
+		p.mu.Unlock()
+		return
+	}
+	if message.GetID() == metadata.SourcesStatusMessageID {
+		var sources map[string]metadata.SourceStatus
+		if err = message.Payload().Unmarshal(&sources); err != nil {
+			p.log.Error(err)
+			return
+		}
+		var failures map[string]string
+		for name, source := range sources {
+			if source.Failure == "" {
+				continue
+			}
+			if failures == nil {
+				failures = map[string]string{}
+			}
+			failures[name] = source.Failure
+		}
+		p.mu.Lock()
+		p.status.MetaSourceFailures = failures
+		p.mu.Unlock()
+		return
+	}
+	var chunk map[string]string
+	if err = message.Payload().Unmarshal(&chunk); err != nil {
+		p.log.Error(err)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch message.GetID() {
+	case "agent":
+		p.status.ID = chunk["id"]
+		p.status.Advertise = chunk["advertise"]
+	case "meta":
+		p.status.Meta = lib.CloneMap(chunk)
+	case "system":
+		p.status.System = lib.CloneMap(chunk)
+	case "provision":
+		pods := map[string]int{}
+		for k, v := range chunk {
+			if strings.HasSuffix(k, ".state") {
+				pods[v]++
+			}
+		}
+		p.status.Pods = pods
+	}
+	return
+}
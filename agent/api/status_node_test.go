@@ -0,0 +1,78 @@
+// +build ide test_unit
+
+package api_test
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/api"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/metadata"
+	"github.com/akaspin/soil/proto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStatusNodeProcessor_Process(t *testing.T) {
+	processor := api.NewStatusNodeGet(logx.GetLog("test"),
+		func() proto.ClusterStatus {
+			return proto.ClusterStatus{
+				Backend: "consul://127.0.0.1:8500/soil",
+				Kind:    "consul",
+				Ready:   true,
+			}
+		},
+		func() map[string]proto.ResourceWorkerStatus {
+			return map[string]proto.ResourceWorkerStatus{
+				"port": {Nature: "range", Allocated: 2},
+			}
+		},
+	).Processor()
+	consumer := processor.(bus.Consumer)
+
+	consumer.ConsumeMessage(bus.NewMessage("agent", map[string]string{
+		"id":              "node-1",
+		"advertise":       "127.0.0.1:7654",
+		"drain.pod.pod-3": "true",
+	}))
+	consumer.ConsumeMessage(bus.NewMessage("meta", map[string]string{"rack": "left"}))
+	consumer.ConsumeMessage(bus.NewMessage("system", map[string]string{"pod_exec": "ExecStart=/usr/bin/sleep inf"}))
+	consumer.ConsumeMessage(bus.NewMessage("host", map[string]string{"hostname": "node-1"}))
+	consumer.ConsumeMessage(bus.NewMessage("drain", proto.DrainState{On: true, Pods: []string{"pod-3"}}))
+	consumer.ConsumeMessage(bus.NewMessage("meta_sources", map[string]metadata.SourceStatus{
+		"provision": {Kind: "file", Values: map[string]string{"rack": "left"}},
+		"facter":    {Kind: "exec", Values: map[string]string{}, Failure: "exit status 1"},
+	}))
+	consumer.ConsumeMessage(bus.NewMessage("provision", map[string]string{
+		"pod-1.present": "true",
+		"pod-1.state":   "done",
+		"pod-2.present": "true",
+		"pod-2.state":   "done",
+		"pod-3.present": "true",
+		"pod-3.state":   "destroy",
+	}))
+
+	res, err := processor.Process(context.Background(), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, proto.NodeStatus{
+		NodeInfo: proto.NodeInfo{
+			ID:        "node-1",
+			Advertise: "127.0.0.1:7654",
+			Version:   proto.Version,
+			API:       proto.APIV1Version,
+			Meta:      map[string]string{"rack": "left"},
+			Drain:     proto.DrainState{On: true, Pods: []string{"pod-3"}},
+		},
+		System: map[string]string{"pod_exec": "ExecStart=/usr/bin/sleep inf"},
+		Cluster: proto.ClusterStatus{
+			Backend: "consul://127.0.0.1:8500/soil",
+			Kind:    "consul",
+			Ready:   true,
+		},
+		Resources: map[string]proto.ResourceWorkerStatus{
+			"port": {Nature: "range", Allocated: 2},
+		},
+		Pods:               map[string]int{"done": 2, "destroy": 1},
+		MetaSourceFailures: map[string]string{"facter": "exit status 1"},
+	}, res)
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/api/api-server"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// NewStatusPodsGet returns endpoint with states of all pods on agent.
+// Endpoint processor accepts "resource" messages with allocated resources and
+// "provision" messages with provision states. Scheduling states are
+// requested from sinkFn on each call.
+func NewStatusPodsGet(log *logx.Log, sinkFn func() map[string]proto.PodStatus) (e *api_server.Endpoint) {
+	return api_server.GET(proto.V1StatusPods, &statusPodsProcessor{
+		log:       log.GetLog("api", "get", proto.V1StatusPods),
+		sinkFn:    sinkFn,
+		resources: map[string]string{},
+		provision: map[string]string{},
+	})
+}
+
+// NewStatusPodGet returns endpoint with state of one pod. Endpoint shares
+// processor with given pods endpoint.
+func NewStatusPodGet(pods *api_server.Endpoint) (e *api_server.Endpoint) {
+	return api_server.GET(proto.V1StatusPods+"/", pods.Processor())
+}
+
+type statusPodsProcessor struct {
+	log    *logx.Log
+	sinkFn func() map[string]proto.PodStatus
+
+	mu        sync.Mutex
+	resources map[string]string
+	provision map[string]string
+}
+
+func (p *statusPodsProcessor) Empty() interface{} {
+	return nil
+}
+
+func (p *statusPodsProcessor) Process(ctx context.Context, u *url.URL, v interface{}) (res interface{}, err error) {
+	pods := p.collect()
+	if u == nil || !strings.HasPrefix(u.Path, proto.V1StatusPods+"/") {
+		res = pods
+		return
+	}
+	name := strings.TrimPrefix(u.Path, proto.V1StatusPods+"/")
+	pod, ok := pods[name]
+	if !ok {
+		err = api_server.NewError(http.StatusNotFound, fmt.Sprintf("pod %s not found", name))
+		return
+	}
+	res = pod
+	return
+}
+
+func (p *statusPodsProcessor) ConsumeMessage(message bus.Message) (err error) {
+	var chunk map[string]string
+	if err = message.Payload().Unmarshal(&chunk); err != nil {
+		p.log.Error(err)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch message.GetID() {
+	case "resource":
+		p.resources = chunk
+	case "provision":
+		p.provision = chunk
+	}
+	return
+}
+
+func (p *statusPodsProcessor) collect() (res map[string]proto.PodStatus) {
+	res = p.sinkFn()
+	get := func(name string) proto.PodStatus {
+		if pod, ok := res[name]; ok {
+			return pod
+		}
+		return proto.PodStatus{
+			Name: name,
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// provision: <pod>.<field>
+	for k, v := range p.provision {
+		split := strings.SplitN(k, ".", 2)
+		if len(split) != 2 {
+			continue
+		}
+		pod := get(split[0])
+		switch split[1] {
+		case "present":
+			pod.Provision.Present = v == "true"
+		case "state":
+			pod.Provision.State = v
+		case "failure":
+			pod.Provision.Failure = v
+		}
+		res[split[0]] = pod
+	}
+
+	// resource: <kind>.<pod>.<resource>.__values
+	for k, v := range p.resources {
+		if !strings.HasSuffix(k, ".__values") {
+			continue
+		}
+		split := strings.SplitN(strings.TrimSuffix(k, ".__values"), ".", 3)
+		if len(split) != 3 {
+			continue
+		}
+		var values map[string]string
+		if err := json.Unmarshal([]byte(v), &values); err != nil {
+			p.log.Error(err)
+			continue
+		}
+		resource := proto.PodResourceStatus{
+			Kind:      split[0],
+			Allocated: values["allocated"] == "true",
+			Failure:   values["failure"],
+			Values:    map[string]string{},
+		}
+		for field, value := range values {
+			if field != "allocated" && field != "failure" {
+				resource.Values[field] = bus.Redact(value)
+			}
+		}
+		pod := get(split[1])
+		if pod.Resources == nil {
+			pod.Resources = map[string]proto.PodResourceStatus{}
+		}
+		pod.Resources[split[2]] = resource
+		res[split[1]] = pod
+	}
+	return
+}
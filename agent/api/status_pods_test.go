@@ -0,0 +1,87 @@
+// +build ide test_unit
+
+package api_test
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/api"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"testing"
+)
+
+func TestStatusPodsProcessor_Process(t *testing.T) {
+	processor := api.NewStatusPodsGet(logx.GetLog("test"), func() map[string]proto.PodStatus {
+		return map[string]proto.PodStatus{
+			"pod-1": {
+				Name:      "pod-1",
+				Namespace: "private",
+				Mark:      1,
+				Arbiters: map[string]proto.PodArbiterStatus{
+					"resource": {Accepted: true},
+					"provision": {
+						Failure: `constraint failed: "false":"true" ("${meta.rack}":"true")`,
+					},
+				},
+			},
+		}
+	}).Processor()
+	consumer := processor.(bus.Consumer)
+	consumer.ConsumeMessage(bus.NewMessage("resource", map[string]string{
+		"port.pod-1.http.allocated": "true",
+		"port.pod-1.http.value":     "8080",
+		"port.pod-1.http.__values":  `{"allocated":"true","value":"8080"}`,
+	}))
+	consumer.ConsumeMessage(bus.NewMessage("provision", map[string]string{
+		"pod-2.present": "true",
+		"pod-2.state":   "done",
+		"pod-2.failure": "[unit failed]",
+	}))
+
+	expect := map[string]proto.PodStatus{
+		"pod-1": {
+			Name:      "pod-1",
+			Namespace: "private",
+			Mark:      1,
+			Arbiters: map[string]proto.PodArbiterStatus{
+				"resource": {Accepted: true},
+				"provision": {
+					Failure: `constraint failed: "false":"true" ("${meta.rack}":"true")`,
+				},
+			},
+			Resources: map[string]proto.PodResourceStatus{
+				"http": {
+					Kind:      "port",
+					Allocated: true,
+					Values:    map[string]string{"value": "8080"},
+				},
+			},
+		},
+		"pod-2": {
+			Name: "pod-2",
+			Provision: proto.PodProvisionStatus{
+				Present: true,
+				State:   "done",
+				Failure: "[unit failed]",
+			},
+		},
+	}
+
+	t.Run(`all`, func(t *testing.T) {
+		res, err := processor.Process(context.Background(), &url.URL{Path: "/v1/status/pods"}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expect, res)
+	})
+	t.Run(`one`, func(t *testing.T) {
+		res, err := processor.Process(context.Background(), &url.URL{Path: "/v1/status/pods/pod-2"}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expect["pod-2"], res)
+	})
+	t.Run(`not found`, func(t *testing.T) {
+		_, err := processor.Process(context.Background(), &url.URL{Path: "/v1/status/pods/pod-3"}, nil)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,71 @@
+package bus
+
+import (
+	"github.com/akaspin/logx"
+	"sync"
+)
+
+// MergePipe merges map[string]string payloads of consumed messages with
+// declared IDs and propagates result to downstream as one message. Values
+// from messages declared later override values from messages declared earlier.
+// MergePipe propagates nothing until messages with all declared IDs are
+// consumed. Equal results are not propagated.
+type MergePipe struct {
+	name       string
+	log        *logx.Log
+	downstream Consumer
+	order      []string
+
+	mu       sync.Mutex
+	declared map[string]Message
+	last     Message
+}
+
+func NewMergePipe(name string, log *logx.Log, downstream Consumer, declared ...string) (p *MergePipe) {
+	p = &MergePipe{
+		name:       name,
+		log:        log.GetLog("pipe", "merge", name),
+		downstream: downstream,
+		order:      declared,
+		declared:   map[string]Message{},
+		last:       NewMessage(name, nil),
+	}
+	for _, m := range declared {
+		p.declared[m] = NewMessage(m, nil)
+	}
+	return
+}
+
+func (p *MergePipe) ConsumeMessage(message Message) (err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, declared := p.declared[message.GetID()]; !declared {
+		return
+	}
+	p.declared[message.GetID()] = message
+	payload := map[string]string{}
+	for _, id := range p.order {
+		msg := p.declared[id]
+		if msg.Payload().IsEmpty() {
+			p.log.Tracef(`skip propagate: "%s" is not consumed`, id)
+			return
+		}
+		var chunk map[string]string
+		if mErr := msg.Payload().Unmarshal(&chunk); mErr != nil {
+			p.log.Error(mErr)
+			continue
+		}
+		for k, v := range chunk {
+			payload[k] = v
+		}
+	}
+	res := NewMessage(p.name, payload)
+	if p.last.IsEqual(res) {
+		p.log.Tracef(`skip propagate: result is equal`)
+		return
+	}
+	p.last = res
+	err = p.downstream.ConsumeMessage(res)
+	return
+}
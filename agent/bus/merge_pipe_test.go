@@ -0,0 +1,67 @@
+// +build ide test_unit
+
+package bus_test
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/fixture"
+	"testing"
+)
+
+func TestMergePipe_ConsumeMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dummy := bus.NewTestingConsumer(ctx)
+	pipe := bus.NewMergePipe("meta", logx.GetLog("test"), dummy, "1", "2")
+
+	t.Run("0 not ready", func(t *testing.T) {
+		pipe.ConsumeMessage(bus.NewMessage("1", map[string]string{
+			"a": "1",
+			"b": "1",
+		}))
+		pipe.ConsumeMessage(bus.NewMessage("3", map[string]string{
+			"a": "3",
+		}))
+		fixture.WaitNoError10(t, dummy.ExpectMessagesFn())
+	})
+	t.Run("1 merge", func(t *testing.T) {
+		pipe.ConsumeMessage(bus.NewMessage("2", map[string]string{
+			"b": "2",
+			"c": "2",
+		}))
+		fixture.WaitNoError10(t, dummy.ExpectMessagesFn(
+			bus.NewMessage("meta", map[string]string{
+				"a": "1",
+				"b": "2",
+				"c": "2",
+			}),
+		))
+	})
+	t.Run("2 equal", func(t *testing.T) {
+		pipe.ConsumeMessage(bus.NewMessage("1", map[string]string{
+			"a": "1",
+		}))
+		fixture.WaitNoError10(t, dummy.ExpectMessagesFn(
+			bus.NewMessage("meta", map[string]string{
+				"a": "1",
+				"b": "2",
+				"c": "2",
+			}),
+		))
+	})
+	t.Run("3 empty map", func(t *testing.T) {
+		pipe.ConsumeMessage(bus.NewMessage("2", map[string]string{}))
+		fixture.WaitNoError10(t, dummy.ExpectMessagesFn(
+			bus.NewMessage("meta", map[string]string{
+				"a": "1",
+				"b": "2",
+				"c": "2",
+			}),
+			bus.NewMessage("meta", map[string]string{
+				"a": "1",
+			}),
+		))
+	})
+}
@@ -44,6 +44,6 @@ func (p Payload) Unmarshal(v interface{}) error {
 }
 
 func (p Payload) String() (res string) {
-	res = fmt.Sprintf("%s(%d)", string(p.data), p.Hash())
+	res = fmt.Sprintf("%s(%d)", Redact(string(p.data)), p.Hash())
 	return
 }
@@ -0,0 +1,59 @@
+package bus
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+const redacted = "<redacted>"
+
+var secrets = struct {
+	mu     sync.RWMutex
+	values map[string]int
+}{
+	values: map[string]int{},
+}
+
+// RegisterSecret registers value to be redacted in string representations of
+// messages and payloads. Values are reference counted.
+func RegisterSecret(value string) {
+	if value == "" {
+		return
+	}
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	secrets.values[value]++
+}
+
+// UnregisterSecret removes value registered by RegisterSecret
+func UnregisterSecret(value string) {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	if secrets.values[value] <= 1 {
+		delete(secrets.values, value)
+		return
+	}
+	secrets.values[value]--
+}
+
+// Redact replaces all registered secrets in string. Secrets are also
+// replaced in JSON-escaped and double JSON-escaped forms.
+func Redact(s string) (res string) {
+	res = s
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	for value := range secrets.values {
+		escaped := jsonEscape(value)
+		for _, form := range []string{value, escaped, jsonEscape(escaped)} {
+			res = strings.Replace(res, form, redacted, -1)
+		}
+	}
+	return
+}
+
+func jsonEscape(s string) (res string) {
+	raw, _ := json.Marshal(s)
+	res = string(raw[1 : len(raw)-1])
+	return
+}
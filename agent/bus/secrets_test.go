@@ -0,0 +1,30 @@
+// +build ide test_unit
+
+package bus_test
+
+import (
+	"encoding/json"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	secret := "very\nsecret\"value"
+	bus.RegisterSecret(secret)
+	bus.RegisterSecret(secret)
+
+	nested, _ := json.Marshal(map[string]string{"value": secret})
+	message := bus.NewMessage("test", map[string]string{
+		"value":    secret,
+		"__values": string(nested),
+	})
+	assert.NotContains(t, message.String(), "very")
+	assert.Equal(t, "password: <redacted>", bus.Redact("password: "+secret))
+
+	bus.UnregisterSecret(secret)
+	assert.Equal(t, "password: <redacted>", bus.Redact("password: "+secret))
+
+	bus.UnregisterSecret(secret)
+	assert.Equal(t, "password: "+secret, bus.Redact("password: "+secret))
+}
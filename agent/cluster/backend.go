@@ -1,7 +1,9 @@
 package cluster
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent/bus"
@@ -13,14 +15,51 @@ import (
 const (
 	backendLocal  = "local"
 	backendConsul = "consul"
+	backendEtcd   = "etcd"
+	backendRaft   = "raft"
 )
 
 type BackendConfig struct {
-	Kind    string
-	ID      string
-	Address string
-	Chroot  string
-	TTL     time.Duration
+	Kind      string
+	ID        string
+	Address   string
+	Advertise string   // Agent advertise address
+	Seeds     []string // Seed addresses from "seed" URL query parameters
+	Chroot    string
+	TTL       time.Duration
+
+	Token      string // ACL token, etcd "user:password" or raft cluster key
+	TokenFile  string // File with Token. Read on each connect
+	Scheme     string // "http" or "https"
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	Datacenter string
+	Namespace  string
+}
+
+// PermissionError is backend failure caused by rejected credentials. Unlike
+// connectivity failures permission failures are not resolved by retries
+// without changes in backend credentials or ACL.
+type PermissionError struct {
+	Err error
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf(`permission denied: %v`, e.Err)
+}
+
+// FailureKind returns kind of backend failure: "permission" for
+// PermissionError and "connection" otherwise.
+func FailureKind(err error) (res string) {
+	if err == nil {
+		return
+	}
+	res = "connection"
+	if _, ok := err.(*PermissionError); ok {
+		res = "permission"
+	}
+	return
 }
 
 type WatchRequest struct {
@@ -38,9 +77,14 @@ type Backend interface {
 
 	Ctx() context.Context      // Backend context closes on backend is not available to accept operations
 	FailCtx() context.Context  // Fail context closes then backend is failed
+	Err() error                // Err returns failure reason of failed backend
 	ReadyCtx() context.Context // Ready context closes then backend is ready to accept operations
 	Submit(ops []StoreOp)      // Submit ops to backend
 	Subscribe(req []WatchRequest)
+
+	// CAS atomically applies operations if all expectations are met. CAS
+	// returns false if any expectation is failed.
+	CAS(ctx context.Context, ops []CASOp) (ok bool, err error)
 	CommitChan() chan []StoreCommit
 	WatchResultsChan() chan WatchResult
 	Leave() // Leave cluster
@@ -48,34 +92,59 @@ type Backend interface {
 
 type BackendFactory func(ctx context.Context, log *logx.Log, config Config) (c Backend, err error)
 
-func DefaultBackendFactory(ctx context.Context, log *logx.Log, config Config) (c Backend, err error) {
-	kvConfig := BackendConfig{
-		Kind:    "local",
-		Chroot:  "soil",
-		ID:      config.NodeID,
-		Address: "localhost",
-		TTL:     config.TTL,
-	}
-	u, err := url.Parse(config.BackendURL)
-	if err != nil {
-		log.Error(err)
-	}
-	if err == nil {
-		kvConfig.Kind = u.Scheme
-		kvConfig.Address = u.Host
-		kvConfig.Chroot = NormalizeKey(u.Path)
-	}
-	kvLog := log.GetLog("cluster", "backend", config.BackendURL, config.NodeID)
-	if kvConfig.ID == "" {
-		err = fmt.Errorf(`empty node id`)
+// DefaultBackendFactory creates backends without persistent local storage
+var DefaultBackendFactory = NewBackendFactory("")
+
+// NewBackendFactory returns factory for supported backends. Local and raft
+// backends persist data in given state directory.
+func NewBackendFactory(stateDir string) (f BackendFactory) {
+	f = func(ctx context.Context, log *logx.Log, config Config) (c Backend, err error) {
+		kvConfig := BackendConfig{
+			Kind:      "local",
+			Chroot:    "soil",
+			ID:        config.NodeID,
+			Address:   "localhost",
+			Advertise: config.Advertise,
+			TTL:       config.TTL,
+
+			Token:      config.Token,
+			TokenFile:  config.TokenFile,
+			Scheme:     config.Scheme,
+			CAFile:     config.CAFile,
+			CertFile:   config.CertFile,
+			KeyFile:    config.KeyFile,
+			Datacenter: config.Datacenter,
+			Namespace:  config.Namespace,
+		}
+		u, err := url.Parse(config.BackendURL)
+		if err != nil {
+			log.Error(err)
+		}
+		if err == nil {
+			kvConfig.Kind = u.Scheme
+			kvConfig.Address = u.Host
+			kvConfig.Chroot = NormalizeKey(u.Path)
+			kvConfig.Seeds = u.Query()["seed"]
+		}
+		kvLog := log.GetLog("cluster", "backend", config.BackendURL, config.NodeID)
+		if kvConfig.ID == "" {
+			err = fmt.Errorf(`empty node id`)
+			return
+		}
+		switch kvConfig.Kind {
+		case backendConsul:
+			c = NewConsulBackend(ctx, kvLog, kvConfig)
+		case backendEtcd:
+			c = NewEtcdBackend(ctx, kvLog, kvConfig)
+		case backendRaft:
+			c = NewRaftBackend(ctx, kvLog, kvConfig, stateDir)
+		case backendLocal:
+			c = NewLocalBackend(ctx, kvLog, kvConfig, stateDir)
+		default:
+			c = NewZeroBackend(ctx, kvLog)
+		}
 		return
 	}
-	switch kvConfig.Kind {
-	case backendConsul:
-		c = NewConsulBackend(ctx, kvLog, kvConfig)
-	default:
-		c = NewZeroBackend(ctx, kvLog)
-	}
 	return
 }
 
@@ -84,6 +153,25 @@ type StoreOp struct {
 	WithTTL bool
 }
 
+// CASOp is store operation applied only if actual value of key is equal to
+// expected. Unlike StoreOp keys are not bound to node ID. WithTTL binds key to
+// node session: key is removed then node TTL is expired.
+type CASOp struct {
+	Message bus.Message  // Key and new value. Empty payload removes key
+	Expect  *bus.Payload // Expected value. Nil means key should not exist
+	WithTTL bool
+}
+
+// casEqual returns true if raw JSON value is equal to expected payload
+func casEqual(raw []byte, expect bus.Payload) (res bool) {
+	var value interface{}
+	if err := json.NewDecoder(bytes.NewReader(raw)).Decode(&value); err != nil {
+		return
+	}
+	res = bus.NewPayload(value).Hash() == expect.Hash()
+	return
+}
+
 type StoreCommit struct {
 	ID      string
 	Hash    uint64
@@ -3,6 +3,7 @@ package cluster
 import (
 	"context"
 	"github.com/akaspin/logx"
+	"sync"
 )
 
 type baseBackend struct {
@@ -19,6 +20,9 @@ type baseBackend struct {
 
 	commitsChan      chan []StoreCommit
 	watchResultsChan chan WatchResult
+
+	errMu sync.Mutex
+	err   error
 }
 
 func newBaseBackend(ctx context.Context, log *logx.Log, config BackendConfig) (b *baseBackend) {
@@ -69,7 +73,19 @@ func (b *baseBackend) Leave() {
 	close(b.leaveChan)
 }
 
+func (b *baseBackend) Err() (err error) {
+	b.errMu.Lock()
+	defer b.errMu.Unlock()
+	err = b.err
+	return
+}
+
 func (b *baseBackend) fail(err error) {
 	b.log.Error(err)
+	b.errMu.Lock()
+	if b.err == nil {
+		b.err = err
+	}
+	b.errMu.Unlock()
 	b.failCancel()
 }
@@ -18,6 +18,16 @@ type Config struct {
 	Advertise     string        `mapstructure:"advertise"`
 	TTL           time.Duration `mapstructure:"ttl"`
 	RetryInterval time.Duration `mapstructure:"retry"`
+
+	// Backend credentials and TLS. Used by consul, etcd and raft backends
+	Token      string `mapstructure:"token"`
+	TokenFile  string `mapstructure:"token_file"`
+	Scheme     string `mapstructure:"scheme"`
+	CAFile     string `mapstructure:"ca_file"`
+	CertFile   string `mapstructure:"cert_file"`
+	KeyFile    string `mapstructure:"key_file"`
+	Datacenter string `mapstructure:"datacenter"`
+	Namespace  string `mapstructure:"namespace"`
 }
 
 func DefaultConfig() (c Config) {
@@ -31,6 +41,15 @@ func DefaultConfig() (c Config) {
 	return
 }
 
+// String returns config representation with masked token
+func (c Config) String() string {
+	if c.Token != "" {
+		c.Token = "<hidden>"
+	}
+	type config Config
+	return fmt.Sprintf("%v", config(c))
+}
+
 func (c Config) IsEqual(config Config) (res bool) {
 	left, _ := hashstructure.Hash(c, nil)
 	right, _ := hashstructure.Hash(config, nil)
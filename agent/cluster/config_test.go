@@ -24,4 +24,31 @@ func TestConfig_Unmarshal(t *testing.T) {
 			RetryInterval: time.Second * 30,
 		}, config)
 	})
+	t.Run("credentials", func(t *testing.T) {
+		var buffers lib.StaticBuffers
+		assert.NoError(t, buffers.ReadFiles("testdata/config_test_1.hcl"))
+		config := cluster.DefaultConfig()
+		assert.NoError(t, (&config).Unmarshal(buffers.GetReaders()...))
+		assert.Equal(t, cluster.Config{
+			NodeID:        "node-1",
+			BackendURL:    "consul://consul.example.com:8501/soil",
+			Advertise:     "localhost:7654",
+			TTL:           time.Minute * 3,
+			RetryInterval: time.Second * 30,
+			Scheme:        "https",
+			TokenFile:     "/etc/soil/consul.token",
+			CAFile:        "/etc/soil/ca.pem",
+			CertFile:      "/etc/soil/cert.pem",
+			KeyFile:       "/etc/soil/key.pem",
+			Datacenter:    "dc2",
+			Namespace:     "team-1",
+		}, config)
+	})
+}
+
+func TestConfig_String(t *testing.T) {
+	config := cluster.DefaultConfig()
+	config.Token = "secret"
+	assert.NotContains(t, config.String(), "secret")
+	assert.Contains(t, config.String(), "<hidden>")
 }
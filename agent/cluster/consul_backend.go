@@ -6,6 +6,11 @@ import (
 	"fmt"
 	"github.com/akaspin/logx"
 	"github.com/hashicorp/consul/api"
+	"github.com/hashicorp/go-cleanhttp"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 )
 
@@ -107,7 +112,7 @@ LOOP:
 		pairs, meta, err := b.conn.KV().List(directory, opts)
 		if err != nil {
 			if err != context.Canceled {
-				b.fail(err)
+				b.fail(consulError(err))
 			}
 			break LOOP
 		}
@@ -181,7 +186,7 @@ func (b *ConsulBackend) processStoreOpts(ops []StoreOp) {
 	}
 	ok, _, _, txnErr := b.conn.KV().Txn(kvOps, (&api.QueryOptions{}).WithContext(b.ctx))
 	if txnErr != nil {
-		b.fail(txnErr)
+		b.fail(consulError(txnErr))
 		return
 	}
 	if !ok {
@@ -196,19 +201,86 @@ func (b *ConsulBackend) processStoreOpts(ops []StoreOp) {
 	}
 }
 
+func (b *ConsulBackend) CAS(ctx context.Context, ops []CASOp) (ok bool, err error) {
+	select {
+	case <-b.readyCtx.Done():
+	default:
+		err = ErrNotReady
+		return
+	}
+	var kvOps api.KVTxnOps
+	for _, op := range ops {
+		key := NormalizeKey(b.config.Chroot, op.Message.GetID())
+		if op.Expect == nil {
+			kvOps = append(kvOps, &api.KVTxnOp{
+				Verb: api.KVCheckNotExists,
+				Key:  key,
+			})
+		} else {
+			var pair *api.KVPair
+			if pair, _, err = b.conn.KV().Get(key, (&api.QueryOptions{}).WithContext(ctx)); err != nil {
+				err = consulError(err)
+				return
+			}
+			if pair == nil || !casEqual(pair.Value, *op.Expect) {
+				return
+			}
+			kvOps = append(kvOps, &api.KVTxnOp{
+				Verb:  api.KVCheckIndex,
+				Key:   key,
+				Index: pair.ModifyIndex,
+			})
+		}
+		if op.Message.Payload().IsEmpty() {
+			kvOps = append(kvOps, &api.KVTxnOp{
+				Verb: api.KVDelete,
+				Key:  key,
+			})
+			continue
+		}
+		var value interface{}
+		if err = op.Message.Payload().Unmarshal(&value); err != nil {
+			return
+		}
+		var valJson []byte
+		if valJson, err = json.Marshal(value); err != nil {
+			return
+		}
+		if op.WithTTL {
+			kvOps = append(kvOps, &api.KVTxnOp{
+				Verb:    api.KVLock,
+				Key:     key,
+				Session: b.sessionID,
+				Value:   valJson,
+			})
+			continue
+		}
+		kvOps = append(kvOps, &api.KVTxnOp{
+			Verb:  api.KVSet,
+			Key:   key,
+			Value: valJson,
+		})
+	}
+	ok, _, _, err = b.conn.KV().Txn(kvOps, (&api.QueryOptions{}).WithContext(ctx))
+	err = consulError(err)
+	return
+}
+
 func (b *ConsulBackend) connect() {
 	b.log.Tracef(`connecting: %s`, b.config.Address)
-	var err error
-	if b.conn, err = api.NewClient(&api.Config{
-		Address: b.config.Address,
-	}); err != nil {
+	config, err := b.clientConfig()
+	if err != nil {
+		b.fail(err)
+		return
+	}
+	if b.conn, err = api.NewClient(config); err != nil {
 		b.fail(err)
 		return
 	}
 
 	sessions, _, err := b.conn.Session().List((&api.QueryOptions{}).WithContext(b.ctx))
 	if err != nil {
-		b.fail(err)
+		b.fail(consulError(err))
 		return
 	}
 	sessionName := NormalizeKey(b.config.Chroot, b.config.ID)
@@ -225,7 +297,7 @@ func (b *ConsulBackend) connect() {
 			Behavior: api.SessionBehaviorDelete,
 		}, (&api.WriteOptions{}).WithContext(b.ctx))
 		if err != nil {
-			b.fail(err)
+			b.fail(consulError(err))
 			return
 		}
 	}
@@ -240,7 +312,7 @@ func (b *ConsulBackend) connect() {
 			b.log.Infof(`leaved (session: %s)`, b.sessionID)
 		default:
 			if renewErr != nil && renewErr != context.Canceled {
-				b.fail(fmt.Errorf(`renew: %v`, renewErr))
+				b.fail(consulError(fmt.Errorf(`renew: %v`, renewErr)))
 			}
 		}
 		b.log.Trace(`renew: closed`)
@@ -248,3 +320,73 @@ func (b *ConsulBackend) connect() {
 	b.log.Infof(`connected (session: %s)`, b.sessionID)
 	b.readyCancel()
 }
+
+// clientConfig returns Consul client config with credentials and TLS
+// settings. Token file is read only if token is not defined.
+func (b *ConsulBackend) clientConfig() (config *api.Config, err error) {
+	config = &api.Config{
+		Address:    b.config.Address,
+		Scheme:     b.config.Scheme,
+		Datacenter: b.config.Datacenter,
+		Token:      b.config.Token,
+		TLSConfig: api.TLSConfig{
+			CAFile:   b.config.CAFile,
+			CertFile: b.config.CertFile,
+			KeyFile:  b.config.KeyFile,
+		},
+	}
+	if config.Token == "" && b.config.TokenFile != "" {
+		var raw []byte
+		if raw, err = ioutil.ReadFile(b.config.TokenFile); err != nil {
+			err = fmt.Errorf(`can't read token file: %v`, err)
+			return
+		}
+		config.Token = strings.TrimSpace(string(raw))
+	}
+	if config.Scheme == "https" {
+		if host, _, splitErr := net.SplitHostPort(b.config.Address); splitErr == nil {
+			config.TLSConfig.Address = host
+		}
+	}
+	if b.config.Namespace != "" {
+		if config.HttpClient, err = api.NewHttpClient(cleanhttp.DefaultPooledTransport(), config.TLSConfig); err != nil {
+			return
+		}
+		config.HttpClient.Transport = &consulNamespaceTransport{
+			namespace: b.config.Namespace,
+			transport: config.HttpClient.Transport,
+		}
+	}
+	return
+}
+
+// consulError wraps ACL failures to PermissionError
+func consulError(err error) (res error) {
+	res = err
+	if err == nil {
+		return
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "response code: 403") ||
+		strings.Contains(strings.ToLower(msg), "permission denied") ||
+		strings.Contains(msg, "ACL not found") {
+		res = &PermissionError{Err: err}
+	}
+	return
+}
+
+// consulNamespaceTransport sets Consul Enterprise namespace to all requests
+type consulNamespaceTransport struct {
+	namespace string
+	transport http.RoundTripper
+}
+
+func (t *consulNamespaceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	clone := *req
+	clone.Header = http.Header{}
+	for k, v := range req.Header {
+		clone.Header[k] = v
+	}
+	clone.Header.Set("X-Consul-Namespace", t.namespace)
+	return t.transport.RoundTrip(&clone)
+}
@@ -0,0 +1,271 @@
+package cluster
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/supervisor"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	ElectionMessageID = "election"
+
+	electionPrefix               = "election"
+	defaultElectionName          = "leader"
+	defaultElectionRetryInterval = time.Second * 5
+	electionReleaseTimeout       = time.Second
+)
+
+// ElectionKV is cluster storage used to elect leader
+type ElectionKV interface {
+	NodeID() string
+	CAS(ctx context.Context, ops []CASOp) (ok bool, err error)
+	SubscribeKey(key string, ctx context.Context, consumer bus.Consumer)
+}
+
+// ElectionHandler is called on each change of node leadership
+type ElectionHandler func(leader bool)
+
+type ElectionConfig struct {
+	KV            ElectionKV
+	Name          string        // Election name. Default is "leader"
+	Consumer      bus.Consumer  // Receives "election" messages with "leader" and "is_leader" variables
+	RetryInterval time.Duration // Interval to retry failed claims
+}
+
+// Election elects one leader among nodes in cluster. Each node tries to
+// claim "election/<name>" key with compare-and-set. Claim is bound to node
+// TTL: if leader dies or leaves cluster key is removed and other nodes
+// claim it. With consul backend claim is consul session lock.
+//
+// Actual leader is propagated to Consumer as "leader" and "is_leader"
+// variables. Leader-only work should be started and stopped by handlers.
+type Election struct {
+	*supervisor.Control
+	log    *logx.Log
+	config ElectionConfig
+
+	wakeChan chan struct{}
+
+	mu        sync.Mutex
+	leader    string // observed leader
+	observed  bool   // election key is observed at least once
+	claimedBy string // node ID used for last successful claim
+	isLeader  bool
+	handlers  []ElectionHandler
+	retry     *time.Timer
+}
+
+func NewElection(ctx context.Context, log *logx.Log, config ElectionConfig) (e *Election) {
+	e = &Election{
+		Control:  supervisor.NewControl(ctx),
+		log:      log.GetLog("cluster", "election"),
+		config:   config,
+		wakeChan: make(chan struct{}, 1),
+	}
+	if e.config.Name == "" {
+		e.config.Name = defaultElectionName
+	}
+	if e.config.RetryInterval <= 0 {
+		e.config.RetryInterval = defaultElectionRetryInterval
+	}
+	return
+}
+
+func (e *Election) Open() (err error) {
+	e.publish("", false)
+	e.config.KV.SubscribeKey(electionPrefix, e.Control.Ctx(), bus.NewFnPipe(func(message bus.Message) bus.Message {
+		e.handleLeader(message)
+		return message
+	}))
+	e.Control.Acquire()
+	go e.loop()
+	err = e.Control.Open()
+	return
+}
+
+func (e *Election) Close() error {
+	e.mu.Lock()
+	if e.retry != nil {
+		e.retry.Stop()
+	}
+	e.mu.Unlock()
+	return e.Control.Close()
+}
+
+// AddHandler registers handler. Handler is called immediately with actual
+// leadership and then on each change. Handlers should not block.
+func (e *Election) AddHandler(handler ElectionHandler) {
+	e.mu.Lock()
+	e.handlers = append(e.handlers, handler)
+	isLeader := e.isLeader
+	e.mu.Unlock()
+	handler(isLeader)
+}
+
+// Leader returns actual leader and true if node is leader
+func (e *Election) Leader() (leader string, isLeader bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	leader = e.leader
+	isLeader = e.isLeader
+	return
+}
+
+func (e *Election) handleLeader(message bus.Message) {
+	var raw map[string]electionOwner
+	if err := message.Payload().Unmarshal(&raw); err != nil {
+		e.log.Error(err)
+		return
+	}
+	e.mu.Lock()
+	e.leader = raw[e.config.Name].Node
+	e.observed = true
+	e.mu.Unlock()
+	e.wake()
+}
+
+func (e *Election) wake() {
+	select {
+	case e.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+func (e *Election) scheduleRetry() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.retry != nil {
+		return
+	}
+	e.retry = time.AfterFunc(e.config.RetryInterval, func() {
+		e.mu.Lock()
+		e.retry = nil
+		e.mu.Unlock()
+		e.wake()
+	})
+}
+
+func (e *Election) loop() {
+	defer e.Control.Release()
+	e.log.Debug(`open`)
+LOOP:
+	for {
+		select {
+		case <-e.Control.Ctx().Done():
+			break LOOP
+		case <-e.wakeChan:
+			e.reconcile()
+		}
+	}
+	e.resign()
+	e.log.Debug(`close`)
+}
+
+func (e *Election) reconcile() {
+	e.mu.Lock()
+	leader := e.leader
+	observed := e.observed
+	claimedBy := e.claimedBy
+	e.mu.Unlock()
+	if !observed {
+		return
+	}
+
+	nodeID := e.config.KV.NodeID()
+	var ok bool
+	var err error
+	switch {
+	case leader == "":
+		ok, err = e.config.KV.CAS(e.Control.Ctx(), e.ops(nodeID, nil))
+	case leader == nodeID && claimedBy != nodeID:
+		// claimed by node in previous run: claim again to bind key to
+		// actual node session
+		expect := bus.NewPayload(e.owner(nodeID))
+		ok, err = e.config.KV.CAS(e.Control.Ctx(), e.ops(nodeID, &expect))
+	case leader != nodeID:
+		claimedBy = ""
+	}
+	if err != nil {
+		e.log.Warningf(`can't claim leadership: %v`, err)
+		e.scheduleRetry()
+	}
+	if ok {
+		claimedBy = nodeID
+		e.log.Infof(`claimed leadership as %s`, nodeID)
+	}
+	e.mu.Lock()
+	e.claimedBy = claimedBy
+	e.mu.Unlock()
+	e.publish(leader, leader != "" && leader == nodeID && claimedBy == nodeID)
+}
+
+// resign releases leadership claimed by node
+func (e *Election) resign() {
+	e.mu.Lock()
+	claimedBy := e.claimedBy
+	e.claimedBy = ""
+	e.mu.Unlock()
+	e.publish("", false)
+	if claimedBy == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), electionReleaseTimeout)
+	defer cancel()
+	expect := bus.NewPayload(e.owner(claimedBy))
+	if _, err := e.config.KV.CAS(ctx, e.ops("", &expect)); err != nil {
+		e.log.Warningf(`can't release leadership: %v`, err)
+		return
+	}
+	e.log.Infof(`released leadership`)
+}
+
+func (e *Election) publish(leader string, isLeader bool) {
+	e.mu.Lock()
+	changed := e.isLeader != isLeader
+	e.isLeader = isLeader
+	handlers := make([]ElectionHandler, len(e.handlers))
+	copy(handlers, e.handlers)
+	e.mu.Unlock()
+
+	e.config.Consumer.ConsumeMessage(bus.NewMessage(ElectionMessageID, map[string]string{
+		"leader":    leader,
+		"is_leader": strconv.FormatBool(isLeader),
+	}))
+	if !changed {
+		return
+	}
+	e.log.Infof(`leadership changed: %t (leader: %s)`, isLeader, leader)
+	for _, handler := range handlers {
+		handler(isLeader)
+	}
+}
+
+func (e *Election) ops(nodeID string, expect *bus.Payload) (res []CASOp) {
+	var value interface{}
+	if nodeID != "" {
+		value = e.owner(nodeID)
+	}
+	res = []CASOp{
+		{
+			Message: bus.NewMessage(NormalizeKey(electionPrefix, e.config.Name), value),
+			Expect:  expect,
+			WithTTL: true,
+		},
+	}
+	return
+}
+
+func (e *Election) owner(nodeID string) (res map[string]string) {
+	res = map[string]string{
+		"node": nodeID,
+	}
+	return
+}
+
+type electionOwner struct {
+	Node string `json:"node"`
+}
@@ -0,0 +1,222 @@
+// +build ide test_unit
+
+package cluster_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/cluster"
+	"github.com/akaspin/soil/fixture"
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testingElectionStore is in-memory CAS storage shared by testing nodes.
+// Volatile records are bound to node and removed on expire.
+type testingElectionStore struct {
+	mu          sync.Mutex
+	data        map[string]interface{}
+	owners      map[string]string
+	subscribers []testingElectionSubscriber
+}
+
+type testingElectionSubscriber struct {
+	key      string
+	ctx      context.Context
+	consumer bus.Consumer
+}
+
+func (s *testingElectionStore) expire(node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, owner := range s.owners {
+		if owner == node {
+			delete(s.data, key)
+			delete(s.owners, key)
+		}
+	}
+	s.broadcast()
+}
+
+func (s *testingElectionStore) broadcast() {
+	for _, sub := range s.subscribers {
+		select {
+		case <-sub.ctx.Done():
+			continue
+		default:
+		}
+		payload := map[string]interface{}{}
+		for k, v := range s.data {
+			if strings.HasPrefix(k, sub.key+"/") {
+				payload[strings.TrimPrefix(k, sub.key+"/")] = v
+			}
+		}
+		sub.consumer.ConsumeMessage(bus.NewMessage(sub.key, payload))
+	}
+}
+
+type testingElectionKV struct {
+	id    string
+	store *testingElectionStore
+}
+
+func (k *testingElectionKV) NodeID() string {
+	return k.id
+}
+
+func (k *testingElectionKV) CAS(ctx context.Context, ops []cluster.CASOp) (ok bool, err error) {
+	k.store.mu.Lock()
+	defer k.store.mu.Unlock()
+	for _, op := range ops {
+		current, exists := k.store.data[op.Message.GetID()]
+		if op.Expect == nil && exists {
+			return
+		}
+		if op.Expect != nil {
+			var expect interface{}
+			if err = op.Expect.Unmarshal(&expect); err != nil || !exists || !reflect.DeepEqual(current, expect) {
+				return
+			}
+		}
+	}
+	for _, op := range ops {
+		if op.Message.Payload().IsEmpty() {
+			delete(k.store.data, op.Message.GetID())
+			delete(k.store.owners, op.Message.GetID())
+			continue
+		}
+		var value interface{}
+		if err = op.Message.Payload().Unmarshal(&value); err != nil {
+			return
+		}
+		k.store.data[op.Message.GetID()] = value
+		if op.WithTTL {
+			k.store.owners[op.Message.GetID()] = k.id
+		}
+	}
+	ok = true
+	k.store.broadcast()
+	return
+}
+
+func (k *testingElectionKV) SubscribeKey(key string, ctx context.Context, consumer bus.Consumer) {
+	k.store.mu.Lock()
+	defer k.store.mu.Unlock()
+	k.store.subscribers = append(k.store.subscribers, testingElectionSubscriber{
+		key:      key,
+		ctx:      ctx,
+		consumer: consumer,
+	})
+	k.store.broadcast()
+}
+
+func TestElection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &testingElectionStore{
+		data:   map[string]interface{}{},
+		owners: map[string]string{},
+	}
+	type node struct {
+		election *cluster.Election
+		consumer *bus.TestingConsumer
+
+		mu      sync.Mutex
+		handled []bool
+	}
+	var nodes []*node
+	for i := 0; i < 3; i++ {
+		n := &node{
+			consumer: bus.NewTestingConsumer(ctx),
+		}
+		n.election = cluster.NewElection(ctx, logx.GetLog("test"), cluster.ElectionConfig{
+			KV: &testingElectionKV{
+				id:    fmt.Sprintf("node-%d", i),
+				store: store,
+			},
+			Consumer:      n.consumer,
+			RetryInterval: time.Millisecond * 100,
+		})
+		n.election.AddHandler(func(leader bool) {
+			n.mu.Lock()
+			n.handled = append(n.handled, leader)
+			n.mu.Unlock()
+		})
+		nodes = append(nodes, n)
+	}
+	expectLeader := func(alive ...int) func() error {
+		return func() (err error) {
+			var leaders []string
+			var leader string
+			for _, i := range alive {
+				observed, isLeader := nodes[i].election.Leader()
+				if observed == "" || (leader != "" && observed != leader) {
+					return fmt.Errorf(`node-%d: unexpected leader %s`, i, observed)
+				}
+				leader = observed
+				if isLeader {
+					leaders = append(leaders, fmt.Sprintf("node-%d", i))
+				}
+			}
+			if len(leaders) != 1 || leaders[0] != leader {
+				err = fmt.Errorf(`leaders: %v (observed: %s)`, leaders, leader)
+			}
+			return
+		}
+	}
+	leaderIndex := func() (res int) {
+		for i, n := range nodes {
+			if _, isLeader := n.election.Leader(); isLeader {
+				res = i
+				return
+			}
+		}
+		return
+	}
+	var first int
+
+	t.Run(`elect`, func(t *testing.T) {
+		for _, n := range nodes {
+			assert.NoError(t, n.election.Open())
+		}
+		fixture.WaitNoError10(t, expectLeader(0, 1, 2))
+		first = leaderIndex()
+		fixture.WaitNoError10(t, nodes[first].consumer.ExpectLastMessageFn(
+			bus.NewMessage("election", map[string]string{
+				"leader":    fmt.Sprintf("node-%d", first),
+				"is_leader": "true",
+			}),
+		))
+		nodes[first].mu.Lock()
+		assert.Equal(t, []bool{false, true}, nodes[first].handled)
+		nodes[first].mu.Unlock()
+	})
+	t.Run(`expire`, func(t *testing.T) {
+		nodes[first].election.Close()
+		nodes[first].election.Wait()
+		store.expire(fmt.Sprintf("node-%d", first))
+		var alive []int
+		for i := range nodes {
+			if i != first {
+				alive = append(alive, i)
+			}
+		}
+		fixture.WaitNoError10(t, expectLeader(alive...))
+		nodes[first].mu.Lock()
+		assert.Equal(t, []bool{false, true, false}, nodes[first].handled)
+		nodes[first].mu.Unlock()
+		fixture.WaitNoError10(t, nodes[first].consumer.ExpectLastMessageFn(
+			bus.NewMessage("election", map[string]string{
+				"leader":    "",
+				"is_leader": "false",
+			}),
+		))
+	})
+}
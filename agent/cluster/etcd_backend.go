@@ -0,0 +1,687 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/hashicorp/go-cleanhttp"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum number of operations in one etcd transaction (etcd "--max-txn-ops")
+const etcdMaxTxnOps = 128
+
+// Etcd v3 Backend. Backend uses etcd JSON gateway. Volatile records are bound
+// to lease which is renewed while backend is running. If token is defined in
+// form "user:password" backend authenticates and renews expired auth token.
+// TLS is configured by scheme, CA, certificate and key files.
+type EtcdBackend struct {
+	*baseBackend
+
+	client   *http.Client
+	scheme   string
+	user     string
+	password string
+	leaseID  etcdInt
+
+	authMu    sync.Mutex
+	authToken string
+
+	opsChan          chan []StoreOp
+	watchRequestChan chan []WatchRequest
+}
+
+func NewEtcdBackend(ctx context.Context, log *logx.Log, config BackendConfig) (b *EtcdBackend) {
+	b = &EtcdBackend{
+		baseBackend:      newBaseBackend(ctx, log, config),
+		scheme:           "http",
+		opsChan:          make(chan []StoreOp, 1),
+		watchRequestChan: make(chan []WatchRequest, 1),
+	}
+	go b.connect()
+	go b.loop()
+	return
+}
+
+func (b *EtcdBackend) Submit(ops []StoreOp) {
+	select {
+	case <-b.ctx.Done():
+		b.log.Warningf(`ignore %v: %v`, ops, b.ctx.Err())
+	case b.opsChan <- ops:
+		b.log.Tracef(`submit: %v`, ops)
+	}
+}
+
+func (b *EtcdBackend) Subscribe(req []WatchRequest) {
+	select {
+	case <-b.ctx.Done():
+		b.log.Warningf(`ignore %v: %v`, req, b.ctx.Err())
+	case b.watchRequestChan <- req:
+		b.log.Tracef(`subscribe: %v`, req)
+	}
+}
+
+func (b *EtcdBackend) CAS(ctx context.Context, ops []CASOp) (ok bool, err error) {
+	select {
+	case <-b.readyCtx.Done():
+	default:
+		err = ErrNotReady
+		return
+	}
+	if len(ops) > etcdMaxTxnOps {
+		err = fmt.Errorf(`too many operations: %d is greater than %d`, len(ops), etcdMaxTxnOps)
+		return
+	}
+	var txn etcdTxnRequest
+	for _, op := range ops {
+		key := []byte(NormalizeKey(b.config.Chroot, op.Message.GetID()))
+		if op.Expect == nil {
+			txn.Compare = append(txn.Compare, etcdCompare{
+				Key:            key,
+				Target:         "CREATE",
+				Result:         "EQUAL",
+				CreateRevision: new(etcdInt),
+			})
+		} else {
+			var res etcdRangeResponse
+			if err = b.call(ctx, "kv/range", etcdRangeRequest{Key: key}, &res); err != nil {
+				return
+			}
+			if len(res.Kvs) == 0 || !casEqual(res.Kvs[0].Value, *op.Expect) {
+				return
+			}
+			modRevision := res.Kvs[0].ModRevision
+			txn.Compare = append(txn.Compare, etcdCompare{
+				Key:         key,
+				Target:      "MOD",
+				Result:      "EQUAL",
+				ModRevision: &modRevision,
+			})
+		}
+		var reqOp etcdRequestOp
+		if reqOp, err = b.requestOp(key, op.Message.Payload(), op.WithTTL); err != nil {
+			return
+		}
+		txn.Success = append(txn.Success, reqOp)
+	}
+	var res etcdTxnResponse
+	if err = b.call(ctx, "kv/txn", txn, &res); err != nil {
+		return
+	}
+	ok = res.Succeeded
+	return
+}
+
+func (b *EtcdBackend) loop() {
+	b.log.Debug(`open`)
+	select {
+	case <-b.ctx.Done():
+		b.log.Error(`backend prematurely closed`)
+		return
+	case <-b.readyCtx.Done():
+		b.log.Trace(`clean state reached`)
+	}
+
+LOOP:
+	for {
+		select {
+		case <-b.leaveChan:
+			break LOOP
+		case <-b.ctx.Done():
+			break LOOP
+		case ops := <-b.opsChan:
+			b.processStoreOps(ops)
+		case requests := <-b.watchRequestChan:
+			for _, req := range requests {
+				go b.watch(req)
+			}
+		}
+	}
+	b.log.Debug(`close`)
+}
+
+func (b *EtcdBackend) watch(req WatchRequest) {
+	directory := NormalizeKey(b.config.Chroot, req.Key)
+	log := b.log.GetLog(b.log.Prefix(), append(b.log.Tags(), "watch", req.Key)...)
+	log.Debug(`open`)
+
+	watchCtx, watchCancel := context.WithCancel(b.ctx)
+	go func() {
+		select {
+		case <-req.Ctx.Done():
+			watchCancel()
+		case <-watchCtx.Done():
+		}
+	}()
+
+	rangeReq := etcdRangeRequest{
+		Key:      []byte(directory),
+		RangeEnd: etcdPrefixEnd([]byte(directory)),
+	}
+LOOP:
+	for {
+		var res etcdRangeResponse
+		if err := b.call(watchCtx, "kv/range", rangeReq, &res); err != nil {
+			if watchCtx.Err() == nil {
+				b.fail(etcdFailure(err))
+			}
+			break LOOP
+		}
+		result := WatchResult{
+			Key:  req.Key,
+			Data: map[string][]byte{},
+		}
+		for _, kv := range res.Kvs {
+			result.Data[TrimKeyPrefix(directory, string(kv.Key))] = kv.Value
+		}
+		select {
+		case <-watchCtx.Done():
+			break LOOP
+		case b.watchResultsChan <- result:
+		}
+		if err := b.waitEvents(watchCtx, rangeReq, res.Header.Revision+1); err != nil {
+			if watchCtx.Err() == nil {
+				b.fail(etcdFailure(err))
+			}
+			break LOOP
+		}
+	}
+	log.Debug(`close`)
+}
+
+// waitEvents blocks until any change in range after given revision
+func (b *EtcdBackend) waitEvents(ctx context.Context, rangeReq etcdRangeRequest, revision etcdInt) (err error) {
+	streamCtx, streamCancel := context.WithCancel(ctx)
+	defer streamCancel()
+	body, err := b.stream(streamCtx, "watch", etcdWatchRequest{
+		CreateRequest: etcdWatchCreateRequest{
+			Key:           rangeReq.Key,
+			RangeEnd:      rangeReq.RangeEnd,
+			StartRevision: revision,
+		},
+	})
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	for {
+		var res etcdWatchResponse
+		if err = dec.Decode(&res); err != nil {
+			return
+		}
+		if res.Error != nil {
+			err = fmt.Errorf(`watch: %s`, res.Error.Message)
+			return
+		}
+		// watch rejected on create (auth) is failure
+		if res.Result.Canceled && res.Result.CancelReason != "" && res.Result.CompactRevision == 0 {
+			err = fmt.Errorf(`watch: %s`, res.Result.CancelReason)
+			return
+		}
+		// canceled watch (compaction) also requires full snapshot
+		if len(res.Result.Events) > 0 || res.Result.Canceled {
+			return
+		}
+	}
+}
+
+// processStoreOps applies operations in transactions of up to etcdMaxTxnOps
+// operations. Commits are sent for each applied transaction.
+func (b *EtcdBackend) processStoreOps(ops []StoreOp) {
+	for len(ops) > 0 {
+		chunk := ops
+		if len(chunk) > etcdMaxTxnOps {
+			chunk = chunk[:etcdMaxTxnOps]
+		}
+		ops = ops[len(chunk):]
+		if !b.commitStoreOps(chunk) {
+			return
+		}
+	}
+}
+
+func (b *EtcdBackend) commitStoreOps(ops []StoreOp) (ok bool) {
+	var txn etcdTxnRequest
+	var commits []StoreCommit
+	for _, op := range ops {
+		var key string
+		if op.WithTTL {
+			key = NormalizeKey(b.config.Chroot, op.Message.GetID(), b.config.ID)
+		} else {
+			key = NormalizeKey(b.config.Chroot, op.Message.GetID())
+		}
+		reqOp, err := b.requestOp([]byte(key), op.Message.Payload(), op.WithTTL)
+		if err != nil {
+			b.log.Errorf(`can't prepare %v: %v`, op, err)
+			continue
+		}
+		txn.Success = append(txn.Success, reqOp)
+		commits = append(commits, StoreCommit{
+			ID:      op.Message.GetID(),
+			Hash:    op.Message.Payload().Hash(),
+			WithTTL: op.WithTTL,
+		})
+	}
+	var res etcdTxnResponse
+	if err := b.call(b.ctx, "kv/txn", txn, &res); err != nil {
+		b.fail(etcdFailure(err))
+		return
+	}
+	if !res.Succeeded {
+		b.fail(fmt.Errorf(`transaction failed`))
+		return
+	}
+	select {
+	case <-b.ctx.Done():
+		b.log.Warningf(`skip to send commit for %v: %v`, commits, b.ctx.Err())
+		return
+	case b.commitsChan <- commits:
+		b.log.Debugf(`commits sent: %v`, commits)
+	}
+	ok = true
+	return
+}
+
+// requestOp returns put or delete operation for payload
+func (b *EtcdBackend) requestOp(key []byte, payload bus.Payload, withTTL bool) (res etcdRequestOp, err error) {
+	if payload.IsEmpty() {
+		res.RequestDeleteRange = &etcdDeleteRequest{
+			Key: key,
+		}
+		return
+	}
+	var value interface{}
+	if err = payload.Unmarshal(&value); err != nil {
+		return
+	}
+	put := &etcdPutRequest{
+		Key: key,
+	}
+	if put.Value, err = json.Marshal(value); err != nil {
+		return
+	}
+	if withTTL {
+		put.Lease = b.leaseID
+	}
+	res.RequestPut = put
+	return
+}
+
+func (b *EtcdBackend) connect() {
+	b.log.Tracef(`connecting: %s`, b.config.Address)
+	if err := b.configure(); err != nil {
+		b.fail(err)
+		return
+	}
+	if b.user != "" {
+		if err := b.authenticate(b.ctx); err != nil {
+			b.fail(etcdFailure(err))
+			return
+		}
+	}
+	ttl := etcdInt(b.config.TTL / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	var lease etcdLease
+	if err := b.call(b.ctx, "lease/grant", etcdLease{TTL: ttl}, &lease); err != nil {
+		b.fail(etcdFailure(err))
+		return
+	}
+	b.leaseID = lease.ID
+
+	// start watchdog
+	go func() {
+		b.log.Trace(`renew: open`)
+		ticker := time.NewTicker(time.Duration(ttl) * time.Second / 3)
+		defer ticker.Stop()
+	LOOP:
+		for {
+			select {
+			case <-b.leaveChan:
+				if err := b.call(context.Background(), "lease/revoke", etcdLease{ID: b.leaseID}, &struct{}{}); err != nil {
+					b.log.Errorf(`revoke: %v`, err)
+				}
+				b.Close()
+				b.log.Infof(`leaved (lease: %d)`, b.leaseID)
+				break LOOP
+			case <-b.ctx.Done():
+				break LOOP
+			case <-ticker.C:
+				if err := b.keepAlive(); err != nil {
+					if b.ctx.Err() == nil {
+						b.fail(etcdFailure(fmt.Errorf(`renew: %v`, err)))
+					}
+					break LOOP
+				}
+			}
+		}
+		b.log.Trace(`renew: closed`)
+	}()
+	b.log.Infof(`connected (lease: %d)`, b.leaseID)
+	b.readyCancel()
+}
+
+func (b *EtcdBackend) keepAlive() (err error) {
+	ctx, cancel := context.WithCancel(b.ctx)
+	defer cancel()
+	body, err := b.stream(ctx, "lease/keepalive", etcdLease{ID: b.leaseID})
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	var res struct {
+		Result etcdLease  `json:"result"`
+		Error  *etcdError `json:"error"`
+	}
+	if err = json.NewDecoder(body).Decode(&res); err != nil {
+		return
+	}
+	if res.Error != nil {
+		err = fmt.Errorf(`%s`, res.Error.Message)
+		return
+	}
+	if res.Result.TTL <= 0 {
+		err = fmt.Errorf(`lease %d is expired`, b.leaseID)
+	}
+	return
+}
+
+// call calls unary gateway method
+func (b *EtcdBackend) call(ctx context.Context, method string, req interface{}, res interface{}) (err error) {
+	body, err := b.stream(ctx, method, req)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	err = json.NewDecoder(body).Decode(res)
+	return
+}
+
+// configure sets up HTTP client and credentials. Token file is read only if
+// token is not defined.
+func (b *EtcdBackend) configure() (err error) {
+	switch b.config.Scheme {
+	case "", "http":
+	case "https":
+		b.scheme = "https"
+	default:
+		err = fmt.Errorf(`unsupported scheme: %s`, b.config.Scheme)
+		return
+	}
+	transport := cleanhttp.DefaultPooledTransport()
+	if b.scheme == "https" {
+		config := &tls.Config{}
+		if b.config.CAFile != "" {
+			var ca []byte
+			if ca, err = ioutil.ReadFile(b.config.CAFile); err != nil {
+				return
+			}
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(ca) {
+				err = fmt.Errorf(`no certificates in %s`, b.config.CAFile)
+				return
+			}
+		}
+		if b.config.CertFile != "" || b.config.KeyFile != "" {
+			var cert tls.Certificate
+			if cert, err = tls.LoadX509KeyPair(b.config.CertFile, b.config.KeyFile); err != nil {
+				return
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		transport.TLSClientConfig = config
+	}
+	b.client = &http.Client{Transport: transport}
+
+	token := b.config.Token
+	if token == "" && b.config.TokenFile != "" {
+		var raw []byte
+		if raw, err = ioutil.ReadFile(b.config.TokenFile); err != nil {
+			err = fmt.Errorf(`can't read token file: %v`, err)
+			return
+		}
+		token = strings.TrimSpace(string(raw))
+	}
+	if token != "" {
+		credentials := strings.SplitN(token, ":", 2)
+		if len(credentials) != 2 || credentials[0] == "" {
+			err = fmt.Errorf(`etcd token should be in form "user:password"`)
+			return
+		}
+		b.user, b.password = credentials[0], credentials[1]
+	}
+	return
+}
+
+// authenticate requests new auth token
+func (b *EtcdBackend) authenticate(ctx context.Context) (err error) {
+	var res struct {
+		Token string `json:"token"`
+	}
+	resp, err := b.do(ctx, "auth/authenticate", etcdAuthRequest{Name: b.user, Password: b.password}, "")
+	if err != nil {
+		return
+	}
+	defer resp.Close()
+	if err = json.NewDecoder(resp).Decode(&res); err != nil {
+		return
+	}
+	b.authMu.Lock()
+	b.authToken = res.Token
+	b.authMu.Unlock()
+	return
+}
+
+// stream calls gateway method and returns response body. Expired auth token
+// is renewed once.
+func (b *EtcdBackend) stream(ctx context.Context, method string, req interface{}) (body io.ReadCloser, err error) {
+	b.authMu.Lock()
+	token := b.authToken
+	b.authMu.Unlock()
+	if body, err = b.do(ctx, method, req, token); err == nil || b.user == "" {
+		return
+	}
+	if status, ok := err.(*etcdStatusError); !ok || status.Code != http.StatusUnauthorized {
+		return
+	}
+	b.log.Debugf(`renewing auth token: %v`, err)
+	if err = b.authenticate(ctx); err != nil {
+		return
+	}
+	b.authMu.Lock()
+	token = b.authToken
+	b.authMu.Unlock()
+	body, err = b.do(ctx, method, req, token)
+	return
+}
+
+// do calls gateway method with given auth token
+func (b *EtcdBackend) do(ctx context.Context, method string, req interface{}, token string) (body io.ReadCloser, err error) {
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s://%s/v3/%s", b.scheme, b.config.Address, method), bytes.NewReader(raw))
+	if err != nil {
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		httpReq.Header.Set("Authorization", token)
+	}
+	resp, err := b.client.Do(httpReq.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		err = &etcdStatusError{
+			Method:  method,
+			Code:    resp.StatusCode,
+			Message: strings.TrimSpace(string(msg)),
+		}
+		return
+	}
+	body = resp.Body
+	return
+}
+
+// etcdStatusError is non-OK response of gateway
+type etcdStatusError struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+func (e *etcdStatusError) Error() string {
+	return fmt.Sprintf(`%s: %d: %s`, e.Method, e.Code, e.Message)
+}
+
+// etcdFailure wraps rejected credentials and denied access to
+// PermissionError
+func etcdFailure(err error) (res error) {
+	res = err
+	if err == nil {
+		return
+	}
+	if status, ok := err.(*etcdStatusError); ok && (status.Code == http.StatusUnauthorized || status.Code == http.StatusForbidden) {
+		res = &PermissionError{Err: err}
+		return
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "authentication failed") ||
+		strings.Contains(msg, "permission denied") ||
+		strings.Contains(msg, "invalid auth token") ||
+		strings.Contains(msg, "user name is empty") {
+		res = &PermissionError{Err: err}
+	}
+	return
+}
+
+// etcdPrefixEnd returns range end for all keys with given prefix
+func etcdPrefixEnd(prefix []byte) (res []byte) {
+	res = append([]byte{}, prefix...)
+	for i := len(res) - 1; i >= 0; i-- {
+		if res[i] < 0xff {
+			res[i]++
+			res = res[:i+1]
+			return
+		}
+	}
+	// all keys
+	res = []byte{0}
+	return
+}
+
+// etcdInt is int64 encoded by gateway as string
+type etcdInt int64
+
+func (i etcdInt) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(i), 10))
+}
+
+func (i *etcdInt) UnmarshalJSON(raw []byte) (err error) {
+	v, err := strconv.ParseInt(strings.Trim(string(raw), `"`), 10, 64)
+	*i = etcdInt(v)
+	return
+}
+
+type etcdError struct {
+	Message string `json:"message"`
+}
+
+type etcdAuthRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type etcdHeader struct {
+	Revision etcdInt `json:"revision"`
+}
+
+type etcdKeyValue struct {
+	Key         []byte  `json:"key"`
+	Value       []byte  `json:"value"`
+	ModRevision etcdInt `json:"mod_revision"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader     `json:"header"`
+	Kvs    []etcdKeyValue `json:"kvs"`
+}
+
+type etcdPutRequest struct {
+	Key   []byte  `json:"key"`
+	Value []byte  `json:"value"`
+	Lease etcdInt `json:"lease,omitempty"`
+}
+
+type etcdDeleteRequest struct {
+	Key []byte `json:"key"`
+}
+
+type etcdRequestOp struct {
+	RequestPut         *etcdPutRequest    `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdDeleteRequest `json:"request_delete_range,omitempty"`
+}
+
+type etcdCompare struct {
+	Key            []byte   `json:"key"`
+	Target         string   `json:"target"`
+	Result         string   `json:"result"`
+	CreateRevision *etcdInt `json:"create_revision,omitempty"`
+	ModRevision    *etcdInt `json:"mod_revision,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare   `json:"compare,omitempty"`
+	Success []etcdRequestOp `json:"success,omitempty"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+type etcdLease struct {
+	ID  etcdInt `json:"ID,omitempty"`
+	TTL etcdInt `json:"TTL,omitempty"`
+}
+
+type etcdWatchCreateRequest struct {
+	Key           []byte  `json:"key"`
+	RangeEnd      []byte  `json:"range_end,omitempty"`
+	StartRevision etcdInt `json:"start_revision,omitempty"`
+}
+
+type etcdWatchRequest struct {
+	CreateRequest etcdWatchCreateRequest `json:"create_request"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Canceled        bool              `json:"canceled"`
+		CancelReason    string            `json:"cancel_reason"`
+		CompactRevision etcdInt           `json:"compact_revision"`
+		Events          []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *etcdError `json:"error"`
+}
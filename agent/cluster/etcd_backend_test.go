@@ -0,0 +1,279 @@
+// +build ide test_cluster,!test_systemd
+
+package cluster_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/cluster"
+	"github.com/akaspin/soil/fixture"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewEtcdBackend(t *testing.T) {
+	srv := fixture.NewEtcdServer(t, nil)
+	defer srv.Clean()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log := logx.GetLog("test")
+
+	t.Run(`no server`, func(t *testing.T) {
+		kv := cluster.NewEtcdBackend(ctx, log, cluster.BackendConfig{
+			Address: srv.Address(),
+			TTL:     time.Minute,
+		})
+		select {
+		case <-kv.ReadyCtx().Done():
+			t.Error(`should be not clean`)
+			t.Fail()
+		case <-kv.FailCtx().Done():
+		}
+	})
+	t.Run(`up`, func(t *testing.T) {
+		srv.Up()
+		srv.WaitAlive()
+	})
+	t.Run(`ready`, func(t *testing.T) {
+		kv := cluster.NewEtcdBackend(ctx, log, cluster.BackendConfig{
+			Address: srv.Address(),
+			TTL:     time.Minute,
+			ID:      "test-node",
+		})
+		defer kv.Close()
+		select {
+		case <-kv.ReadyCtx().Done():
+		case <-kv.FailCtx().Done():
+			t.Error(`should not fail`)
+			t.Fail()
+		}
+	})
+}
+
+func TestEtcdBackend_Submit(t *testing.T) {
+	srv := fixture.NewEtcdServer(t, nil)
+	defer srv.Clean()
+	srv.Up()
+	srv.WaitAlive()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log := logx.GetLog("test")
+
+	kv := cluster.NewEtcdBackend(ctx, log, cluster.BackendConfig{
+		Address: srv.Address(),
+		TTL:     time.Second * 2,
+		Chroot:  "soil",
+		ID:      "node",
+	})
+	defer kv.Close()
+
+	var commits []cluster.StoreCommit
+	go func() {
+		for ok := range kv.CommitChan() {
+			commits = append(commits, ok...)
+		}
+	}()
+	watcher := bus.NewTestingConsumer(ctx)
+	go func() {
+		for result := range kv.WatchResultsChan() {
+			payload := map[string]string{}
+			for k, v := range result.Data {
+				payload[k] = string(v)
+			}
+			watcher.ConsumeMessage(bus.NewMessage(result.Key, payload))
+		}
+	}()
+
+	t.Run("wait clean", func(t *testing.T) {
+		select {
+		case <-kv.ReadyCtx().Done():
+		case <-kv.FailCtx().Done():
+			t.Error(`should not fail`)
+			t.Fail()
+		}
+	})
+	t.Run("subscribe", func(t *testing.T) {
+		kv.Subscribe([]cluster.WatchRequest{
+			{Key: "test", Ctx: ctx},
+		})
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), watcher.ExpectLastMessageFn(
+			bus.NewMessage("test", map[string]string{}),
+		))
+	})
+	t.Run("submit", func(t *testing.T) {
+		kv.Submit([]cluster.StoreOp{
+			{
+				Message: bus.NewMessage("test/01", "01"),
+			},
+			{
+				Message: bus.NewMessage("test/02", "02"),
+				WithTTL: true,
+			},
+		})
+		time.Sleep(time.Millisecond * 300)
+		assert.Equal(t, commits, []cluster.StoreCommit{
+			{ID: "test/01", Hash: 0x814776e2108083a4, WithTTL: false},
+			{ID: "test/02", Hash: 0x7c7cfc54f5f190b3, WithTTL: true}})
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), watcher.ExpectLastMessageFn(
+			bus.NewMessage("test", map[string]string{
+				"01":      `"01"`,
+				"02/node": `"02"`,
+			}),
+		))
+	})
+	t.Run("ensure volatile", func(t *testing.T) {
+		time.Sleep(time.Second * 3)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), watcher.ExpectLastMessageFn(
+			bus.NewMessage("test", map[string]string{
+				"01":      `"01"`,
+				"02/node": `"02"`,
+			}),
+		))
+	})
+	t.Run("cas", func(t *testing.T) {
+		ok, err := kv.CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("test/01", "03")},
+		})
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		expect := bus.NewPayload("01")
+		ok, err = kv.CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("test/01", "03"), Expect: &expect},
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+	t.Run("submit large", func(t *testing.T) {
+		var ops []cluster.StoreOp
+		expect := map[string]string{
+			"01":      `"03"`,
+			"02/node": `"02"`,
+		}
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("large-%03d", i)
+			ops = append(ops, cluster.StoreOp{Message: bus.NewMessage("test/"+key, key)})
+			expect[key] = fmt.Sprintf(`"%s"`, key)
+		}
+		kv.Submit(ops)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), watcher.ExpectLastMessageFn(
+			bus.NewMessage("test", expect),
+		))
+		for i := range ops {
+			ops[i].Message = bus.NewMessage(ops[i].Message.GetID(), nil)
+		}
+		kv.Submit(ops)
+	})
+	t.Run("submit delete", func(t *testing.T) {
+		kv.Submit([]cluster.StoreOp{
+			{
+				Message: bus.NewMessage("test/01", nil),
+			},
+			{
+				Message: bus.NewMessage("test/02", nil),
+				WithTTL: true,
+			},
+		})
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), watcher.ExpectLastMessageFn(
+			bus.NewMessage("test", map[string]string{}),
+		))
+	})
+}
+
+func TestEtcdBackend_TLSAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "soil-etcd-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	srv := fixture.NewEtcdServer(t, func(config *fixture.EtcdServerConfig) {
+		config.TLSDir = dir
+	})
+	defer srv.Clean()
+	fixture.WriteTestingCerts(t, dir, srv.IP())
+	srv.Up()
+	srv.WaitAlive()
+	srv.AddUser("guest", "guest")
+	srv.EnableAuth("secret")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log := logx.GetLog("test")
+
+	newBackend := func(token string) *cluster.EtcdBackend {
+		return cluster.NewEtcdBackend(ctx, log, cluster.BackendConfig{
+			Address:  srv.Address(),
+			TTL:      time.Minute,
+			Chroot:   "soil",
+			ID:       "node",
+			Token:    token,
+			Scheme:   "https",
+			CAFile:   filepath.Join(dir, "ca.pem"),
+			CertFile: filepath.Join(dir, "cert.pem"),
+			KeyFile:  filepath.Join(dir, "key.pem"),
+		})
+	}
+
+	t.Run(`ok`, func(t *testing.T) {
+		kv := newBackend("root:secret")
+		defer kv.Close()
+		select {
+		case <-kv.ReadyCtx().Done():
+		case <-kv.FailCtx().Done():
+			t.Errorf(`should not fail: %v`, kv.Err())
+			return
+		}
+		ok, err := kv.CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("test/01", "01")},
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+	t.Run(`bad password`, func(t *testing.T) {
+		kv := newBackend("root:bad")
+		defer kv.Close()
+		<-kv.FailCtx().Done()
+		assert.Equal(t, "permission", cluster.FailureKind(kv.Err()))
+	})
+	// lease operations are not authorized by etcd: backend without access
+	// fails on first store operation
+	for name, token := range map[string]string{
+		"no credentials":    "",
+		"permission denied": "guest:guest",
+	} {
+		t.Run(name, func(t *testing.T) {
+			kv := newBackend(token)
+			defer kv.Close()
+			select {
+			case <-kv.ReadyCtx().Done():
+			case <-kv.FailCtx().Done():
+				t.Errorf(`should not fail: %v`, kv.Err())
+				return
+			}
+			kv.Submit([]cluster.StoreOp{
+				{Message: bus.NewMessage("test/02", "02")},
+			})
+			<-kv.FailCtx().Done()
+			assert.Equal(t, "permission", cluster.FailureKind(kv.Err()))
+		})
+	}
+	t.Run(`no client certificate`, func(t *testing.T) {
+		kv := cluster.NewEtcdBackend(ctx, log, cluster.BackendConfig{
+			Address: srv.Address(),
+			TTL:     time.Minute,
+			Token:   "root:secret",
+			Scheme:  "https",
+			CAFile:  filepath.Join(dir, "ca.pem"),
+		})
+		defer kv.Close()
+		<-kv.FailCtx().Done()
+		assert.Equal(t, "connection", cluster.FailureKind(kv.Err()))
+	})
+}
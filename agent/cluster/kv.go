@@ -2,11 +2,18 @@ package cluster
 
 import (
 	"context"
+	"fmt"
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
 	"github.com/akaspin/supervisor"
+	"net/url"
+	"sync"
 )
 
+// ErrNotReady is returned by synchronous operations then backend is not ready
+var ErrNotReady = fmt.Errorf(`cluster backend is not ready`)
+
 type kvConfigRequest struct {
 	config   Config
 	internal bool
@@ -43,8 +50,12 @@ type KV struct {
 	log     *logx.Log
 	factory BackendFactory
 
+	mu      sync.Mutex // guards backend and config updates
 	backend Backend
 	config  Config
+	failure error // last backend failure. Cleared then backend is ready
+
+	permissionFailures int // consecutive permission failures
 
 	configRequestChan chan kvConfigRequest
 	storeRequestsChan chan []StoreOp
@@ -131,6 +142,84 @@ func (k *KV) Configure(config Config) {
 	}
 }
 
+// Status returns actual backend status
+func (k *KV) Status() (res proto.ClusterStatus) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	res.Backend = k.config.BackendURL
+	if u, err := url.Parse(k.config.BackendURL); err == nil {
+		res.Kind = u.Scheme
+	}
+	if k.failure != nil {
+		res.Failure = k.failure.Error()
+		res.FailureKind = FailureKind(k.failure)
+	}
+	if k.backend == nil {
+		return
+	}
+	select {
+	case <-k.backend.Ctx().Done():
+		return
+	default:
+	}
+	select {
+	case <-k.backend.ReadyCtx().Done():
+		res.Ready = true
+	default:
+	}
+	return
+}
+
+// setFailure sets last backend failure and returns number of consecutive
+// permission failures
+func (k *KV) setFailure(err error) (permissionFailures int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.failure = err
+	if FailureKind(err) == "permission" {
+		k.permissionFailures++
+	} else {
+		k.permissionFailures = 0
+	}
+	permissionFailures = k.permissionFailures
+	return
+}
+
+// NodeID returns ID of node in actual configuration
+func (k *KV) NodeID() (res string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	res = k.config.NodeID
+	return
+}
+
+// CAS atomically applies operations if all expectations are met. CAS
+// returns ErrNotReady if backend is not ready.
+func (k *KV) CAS(ctx context.Context, ops []CASOp) (ok bool, err error) {
+	k.mu.Lock()
+	backend := k.backend
+	k.mu.Unlock()
+	if backend == nil {
+		err = ErrNotReady
+		return
+	}
+	select {
+	case <-backend.Ctx().Done():
+		err = ErrNotReady
+		return
+	default:
+	}
+	select {
+	case <-backend.ReadyCtx().Done():
+	default:
+		err = ErrNotReady
+		return
+	}
+	ok, err = backend.CAS(ctx, ops)
+	k.log.Tracef(`cas: %v (ok:%t err:%v)`, ops, ok, err)
+	return
+}
+
 // Submit store operations
 func (k *KV) Submit(ops []StoreOp) {
 	select {
@@ -160,7 +249,9 @@ func (k *KV) SubscribeKey(key string, ctx context.Context, consumer bus.Consumer
 func (k *KV) loop() {
 	log := k.log.GetLog("cluster", "kv", "loop")
 	k.log.Info(`open`)
+	k.mu.Lock()
 	k.backend = NewZeroBackend(k.Control.Ctx(), k.log)
+	k.mu.Unlock()
 	config := Config{}
 LOOP:
 	for {
@@ -168,7 +259,7 @@ LOOP:
 		case <-k.Control.Ctx().Done():
 			break LOOP
 		case req := <-k.configRequestChan:
-			log.Tracef(`received config: %v`, req)
+			log.Tracef(`received config: %v (internal: %t)`, req.config, req.internal)
 			var needReconfigure bool
 			select {
 			case <-k.backend.Ctx().Done():
@@ -178,6 +269,9 @@ LOOP:
 			if !req.internal && !config.IsEqual(req.config) {
 				log.Debugf(`external: %v->%v`, config, req.config)
 				needReconfigure = true
+				k.mu.Lock()
+				k.permissionFailures = 0
+				k.mu.Unlock()
 			}
 			if !needReconfigure {
 				log.Tracef(`ignore reconfiguration`)
@@ -197,7 +291,10 @@ LOOP:
 			}
 			newWatchdog(k, backend, req.config)
 			config = req.config
+			k.mu.Lock()
 			k.backend = backend
+			k.config = req.config
+			k.mu.Unlock()
 			k.log.Infof(`backend created: %v`, req.config)
 
 			for id, message := range k.volatile {
@@ -4,11 +4,17 @@ package cluster_test
 
 import (
 	"context"
+	"fmt"
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent/bus"
 	"github.com/akaspin/soil/agent/cluster"
 	"github.com/akaspin/soil/fixture"
+	"github.com/akaspin/soil/proto"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -390,3 +396,196 @@ func TestStore_ConsumeMessage(t *testing.T) {
 		))
 	})
 }
+
+func TestKV_CAS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendCfg := cluster.TestingBackendConfig{
+		Consumer:    bus.NewTestingConsumer(ctx),
+		ReadyChan:   make(chan struct{}, 1),
+		CrashChan:   make(chan struct{}, 1),
+		MessageChan: make(chan map[string]map[string]interface{}),
+	}
+	kv := cluster.NewKV(ctx, logx.GetLog("test"), cluster.NewTestingBackendFactory(backendCfg))
+	assert.NoError(t, kv.Open())
+
+	kvConfig := cluster.DefaultConfig()
+	kvConfig.NodeID = "localhost"
+	kvConfig.RetryInterval = time.Millisecond * 10
+
+	owner := bus.NewPayload(map[string]string{"id": "1"})
+	other := bus.NewPayload(map[string]string{"id": "2"})
+
+	t.Run(`not ready`, func(t *testing.T) {
+		_, err := kv.CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("a", map[string]string{"id": "1"})},
+		})
+		assert.Equal(t, cluster.ErrNotReady, err)
+	})
+	t.Run(`ready`, func(t *testing.T) {
+		kv.Configure(kvConfig)
+		backendCfg.ReadyChan <- struct{}{}
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), func() error {
+			_, err := kv.CAS(ctx, nil)
+			return err
+		})
+	})
+	t.Run(`create`, func(t *testing.T) {
+		ok, err := kv.CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("a", map[string]string{"id": "1"}), WithTTL: true},
+			{Message: bus.NewMessage("b", map[string]string{"id": "1"}), WithTTL: true},
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+	t.Run(`create existent`, func(t *testing.T) {
+		ok, err := kv.CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("c", map[string]string{"id": "2"})},
+			{Message: bus.NewMessage("b", map[string]string{"id": "2"})},
+		})
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	})
+	t.Run(`update`, func(t *testing.T) {
+		ok, err := kv.CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("a", map[string]string{"id": "2"}), Expect: &other},
+		})
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		ok, err = kv.CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("a", map[string]string{"id": "2"}), Expect: &owner},
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+	t.Run(`delete`, func(t *testing.T) {
+		ok, err := kv.CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("b", nil), Expect: &owner},
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = kv.CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("b", map[string]string{"id": "2"})},
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+}
+
+func TestKV_Status(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backendCfg := cluster.TestingBackendConfig{
+		Consumer:    bus.NewTestingConsumer(ctx),
+		ReadyChan:   make(chan struct{}, 1),
+		CrashChan:   make(chan struct{}, 1),
+		MessageChan: make(chan map[string]map[string]interface{}),
+	}
+	kv := cluster.NewKV(ctx, logx.GetLog("test"), cluster.NewTestingBackendFactory(backendCfg))
+	assert.NoError(t, kv.Open())
+
+	kvConfig := cluster.DefaultConfig()
+	kvConfig.NodeID = "localhost"
+	kvConfig.BackendURL = "test://localhost/soil"
+	kvConfig.RetryInterval = time.Millisecond * 10
+
+	expectStatus := func(expect proto.ClusterStatus) func() error {
+		return func() (err error) {
+			if res := kv.Status(); !reflect.DeepEqual(expect, res) {
+				err = fmt.Errorf(`not equal: %v != %v`, expect, res)
+			}
+			return
+		}
+	}
+	t.Run(`ready`, func(t *testing.T) {
+		kv.Configure(kvConfig)
+		backendCfg.ReadyChan <- struct{}{}
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), expectStatus(proto.ClusterStatus{
+			Backend: "test://localhost/soil",
+			Kind:    "test",
+			Ready:   true,
+		}))
+	})
+	t.Run(`failed`, func(t *testing.T) {
+		backendCfg.CrashChan <- struct{}{}
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), expectStatus(proto.ClusterStatus{
+			Backend:     "test://localhost/soil",
+			Kind:        "test",
+			Failure:     "crash",
+			FailureKind: "connection",
+		}))
+	})
+	t.Run(`recovered`, func(t *testing.T) {
+		backendCfg.ReadyChan <- struct{}{}
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), expectStatus(proto.ClusterStatus{
+			Backend: "test://localhost/soil",
+			Kind:    "test",
+			Ready:   true,
+		}))
+	})
+}
+
+func TestKV_Status_ConsulPermission(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Header.Get("X-Consul-Token")]++
+		mu.Unlock()
+		http.Error(w, "Permission denied", http.StatusForbidden)
+	}))
+	defer srv.Close()
+	countRequests := func(token string) (res int) {
+		mu.Lock()
+		defer mu.Unlock()
+		res = requests[token]
+		return
+	}
+
+	kv := cluster.NewKV(ctx, logx.GetLog("test"), cluster.DefaultBackendFactory)
+	assert.NoError(t, kv.Open())
+
+	kvConfig := cluster.DefaultConfig()
+	kvConfig.NodeID = "localhost"
+	kvConfig.BackendURL = "consul://" + srv.Listener.Addr().String() + "/soil"
+	kvConfig.RetryInterval = time.Millisecond * 50
+	kvConfig.Token = "bad"
+
+	t.Run(`permission`, func(t *testing.T) {
+		kv.Configure(kvConfig)
+		fixture.WaitNoError10(t, func() (err error) {
+			res := kv.Status()
+			if res.Ready || res.FailureKind != "permission" {
+				err = fmt.Errorf(`unexpected status: %v`, res)
+			}
+			return
+		})
+	})
+	t.Run(`backoff`, func(t *testing.T) {
+		// 50ms, 100ms, 200ms, 400ms, 800ms
+		time.Sleep(time.Second)
+		assert.True(t, countRequests("bad") <= 6, "requests: %d", countRequests("bad"))
+	})
+	t.Run(`credentials changed`, func(t *testing.T) {
+		kvConfig.Token = "other"
+		kv.Configure(kvConfig)
+		fixture.WaitNoError10(t, func() (err error) {
+			if countRequests("other") == 0 {
+				err = fmt.Errorf(`no requests with new token`)
+			}
+			return
+		})
+		assert.Equal(t, "permission", kv.Status().FailureKind)
+	})
+}
+
+func TestFailureKind(t *testing.T) {
+	assert.Equal(t, "", cluster.FailureKind(nil))
+	assert.Equal(t, "connection", cluster.FailureKind(fmt.Errorf(`connection refused`)))
+	assert.Equal(t, "permission", cluster.FailureKind(&cluster.PermissionError{Err: fmt.Errorf(`403`)}))
+}
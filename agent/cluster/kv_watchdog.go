@@ -5,6 +5,9 @@ import (
 	"time"
 )
 
+// kvPermissionRetryLimit limits retry interval after permission failures
+const kvPermissionRetryLimit = time.Minute * 10
+
 // Backend watchdog evaluates Backend contexts and commit channel
 type kvWatchdog struct {
 	kv      *KV
@@ -34,6 +37,7 @@ func (w *kvWatchdog) ready() {
 		return
 	case <-w.backend.ReadyCtx().Done():
 		w.log.Info(`backend is ready`)
+		w.kv.setFailure(nil)
 		select {
 		case <-w.backend.Ctx().Done():
 		case w.kv.invokePendingChan <- struct{}{}:
@@ -48,11 +52,18 @@ func (w *kvWatchdog) done() {
 	w.log.Trace(`done: backend closed`)
 	select {
 	case <-w.backend.FailCtx().Done():
-		w.log.Errorf(`backend failed: sending wake request after %s`, w.config.RetryInterval)
+		err := w.backend.Err()
+		retry := w.config.RetryInterval
+		if failures := w.kv.setFailure(err); failures > 0 {
+			retry = permissionRetryInterval(retry, failures)
+			w.log.Errorf(`backend failed: %v: check credentials: sending wake request after %s`, err, retry)
+		} else {
+			w.log.Errorf(`backend failed: %v: sending wake request after %s`, err, retry)
+		}
 		select {
 		case <-w.kv.Control.Ctx().Done():
 			w.log.Trace(`skip wake: kv closed`)
-		case <-time.After(w.config.RetryInterval):
+		case <-time.After(retry):
 			w.log.Trace(`sending reconfigure request`)
 			select {
 			case <-w.kv.Control.Ctx().Done():
@@ -68,6 +79,20 @@ func (w *kvWatchdog) done() {
 	}
 }
 
+// permissionRetryInterval doubles retry interval for each consecutive
+// permission failure up to kvPermissionRetryLimit. Retry interval is never
+// reduced below configured.
+func permissionRetryInterval(interval time.Duration, failures int) (res time.Duration) {
+	res = interval
+	for i := 1; i < failures && res < kvPermissionRetryLimit; i++ {
+		res *= 2
+	}
+	if res > kvPermissionRetryLimit && interval < kvPermissionRetryLimit {
+		res = kvPermissionRetryLimit
+	}
+	return
+}
+
 func (w *kvWatchdog) downstream() {
 	w.log.Trace(`downstream: open`)
 LOOP:
@@ -0,0 +1,442 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	localBackendDBName         = "cluster.db"
+	localBackendOpenTimeout    = time.Second * 10
+	localBackendDefaultTTL     = time.Minute
+	localBackendKVBucket       = "kv"
+	localBackendSessionsBucket = "sessions"
+)
+
+// LocalBackend is single-node backend persisted in BoltDB. Volatile records
+// are bound to node session. Session is renewed while backend is running.
+// Records of expired sessions are removed. If state directory is not defined
+// LocalBackend stores data in temporary file which is removed on close.
+type LocalBackend struct {
+	*baseBackend
+
+	stateDir string
+	path     string
+	db       *bolt.DB
+	session  string
+	ttl      time.Duration
+
+	opsChan  chan []StoreOp
+	doneChan chan struct{}
+
+	mu       sync.Mutex
+	watchers map[chan struct{}]struct{}
+}
+
+func NewLocalBackend(ctx context.Context, log *logx.Log, config BackendConfig, stateDir string) (b *LocalBackend) {
+	b = &LocalBackend{
+		baseBackend: newBaseBackend(ctx, log, config),
+		stateDir:    stateDir,
+		session:     NormalizeKey(config.Chroot, config.ID),
+		ttl:         config.TTL,
+		opsChan:     make(chan []StoreOp, 1),
+		doneChan:    make(chan struct{}),
+		watchers:    map[chan struct{}]struct{}{},
+	}
+	if b.ttl <= 0 {
+		b.ttl = localBackendDefaultTTL
+	}
+	go b.loop()
+	return
+}
+
+// Close closes backend and waits for database is closed
+func (b *LocalBackend) Close() error {
+	b.cancel()
+	<-b.doneChan
+	return nil
+}
+
+func (b *LocalBackend) Submit(ops []StoreOp) {
+	select {
+	case <-b.ctx.Done():
+		b.log.Warningf(`ignore %v: %v`, ops, b.ctx.Err())
+	case b.opsChan <- ops:
+		b.log.Tracef(`submit: %v`, ops)
+	}
+}
+
+func (b *LocalBackend) Subscribe(req []WatchRequest) {
+	for _, r := range req {
+		go b.watch(r)
+	}
+}
+
+func (b *LocalBackend) CAS(ctx context.Context, ops []CASOp) (ok bool, err error) {
+	select {
+	case <-b.readyCtx.Done():
+	default:
+		err = ErrNotReady
+		return
+	}
+	err = b.db.Update(func(tx *bolt.Tx) (err error) {
+		bucket := tx.Bucket([]byte(localBackendKVBucket))
+		for _, op := range ops {
+			raw := bucket.Get([]byte(NormalizeKey(b.config.Chroot, op.Message.GetID())))
+			if op.Expect == nil && raw != nil {
+				return
+			}
+			if op.Expect != nil {
+				if raw == nil {
+					return
+				}
+				var record localRecord
+				if err = json.Unmarshal(raw, &record); err != nil {
+					return
+				}
+				if !casEqual(record.Value, *op.Expect) {
+					return
+				}
+			}
+		}
+		for _, op := range ops {
+			if err = b.put(bucket, NormalizeKey(b.config.Chroot, op.Message.GetID()), op.Message.Payload(), op.WithTTL); err != nil {
+				return
+			}
+		}
+		ok = true
+		return
+	})
+	if ok && err == nil {
+		b.notifyWatchers()
+	}
+	return
+}
+
+func (b *LocalBackend) loop() {
+	b.log.Debug(`open`)
+	defer close(b.doneChan)
+	if err := b.open(); err != nil {
+		b.fail(err)
+		return
+	}
+	defer b.closeDB()
+	if err := b.renew(); err != nil {
+		b.fail(err)
+		return
+	}
+	b.log.Infof(`ready (db: %s session: %s)`, b.path, b.session)
+	b.readyCancel()
+
+	ticker := time.NewTicker(b.ttl / 3)
+	defer ticker.Stop()
+LOOP:
+	for {
+		select {
+		case <-b.leaveChan:
+			if err := b.leave(); err != nil {
+				b.log.Error(err)
+			}
+			b.cancel()
+			b.log.Infof(`leaved (session: %s)`, b.session)
+			break LOOP
+		case <-b.ctx.Done():
+			break LOOP
+		case <-ticker.C:
+			if err := b.renew(); err != nil {
+				b.fail(err)
+				break LOOP
+			}
+		case ops := <-b.opsChan:
+			if err := b.processStoreOps(ops); err != nil {
+				b.fail(err)
+				break LOOP
+			}
+		}
+	}
+	b.log.Debug(`close`)
+}
+
+func (b *LocalBackend) open() (err error) {
+	if b.stateDir == "" {
+		var f *os.File
+		if f, err = ioutil.TempFile("", "soil-cluster-"); err != nil {
+			return
+		}
+		f.Close()
+		b.path = f.Name()
+	} else {
+		b.path = filepath.Join(b.stateDir, localBackendDBName)
+	}
+	if b.db, err = bolt.Open(b.path, 0600, &bolt.Options{Timeout: localBackendOpenTimeout}); err != nil {
+		err = fmt.Errorf(`can't open %s: %v`, b.path, err)
+		return
+	}
+	err = b.db.Update(func(tx *bolt.Tx) (err error) {
+		for _, name := range []string{localBackendKVBucket, localBackendSessionsBucket} {
+			if _, err = tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return
+			}
+		}
+		return
+	})
+	return
+}
+
+func (b *LocalBackend) closeDB() {
+	if err := b.db.Close(); err != nil {
+		b.log.Error(err)
+	}
+	if b.stateDir == "" {
+		os.Remove(b.path)
+	}
+}
+
+func (b *LocalBackend) processStoreOps(ops []StoreOp) (err error) {
+	var commits []StoreCommit
+	if err = b.db.Update(func(tx *bolt.Tx) (err error) {
+		bucket := tx.Bucket([]byte(localBackendKVBucket))
+		for _, op := range ops {
+			key := NormalizeKey(b.config.Chroot, op.Message.GetID())
+			if op.WithTTL {
+				key = NormalizeKey(b.config.Chroot, op.Message.GetID(), b.config.ID)
+			}
+			if err = b.put(bucket, key, op.Message.Payload(), op.WithTTL); err != nil {
+				return
+			}
+			commits = append(commits, StoreCommit{
+				ID:      op.Message.GetID(),
+				Hash:    op.Message.Payload().Hash(),
+				WithTTL: op.WithTTL,
+			})
+		}
+		return
+	}); err != nil {
+		return
+	}
+	b.notifyWatchers()
+	select {
+	case <-b.ctx.Done():
+		b.log.Warningf(`skip to send commit for %v: %v`, commits, b.ctx.Err())
+	case b.commitsChan <- commits:
+		b.log.Debugf(`commits sent: %v`, commits)
+	}
+	return
+}
+
+// put puts payload to bucket. Empty payload removes key.
+func (b *LocalBackend) put(bucket *bolt.Bucket, key string, payload bus.Payload, withTTL bool) (err error) {
+	if payload.IsEmpty() {
+		err = bucket.Delete([]byte(key))
+		return
+	}
+	var value interface{}
+	if err = payload.Unmarshal(&value); err != nil {
+		return
+	}
+	record := localRecord{}
+	if record.Value, err = json.Marshal(value); err != nil {
+		return
+	}
+	if withTTL {
+		record.Session = b.session
+	}
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	err = bucket.Put([]byte(key), raw)
+	return
+}
+
+// renew removes records of expired sessions and renews own session
+func (b *LocalBackend) renew() (err error) {
+	var expired int
+	now := time.Now()
+	if err = b.db.Update(func(tx *bolt.Tx) (err error) {
+		sessions := tx.Bucket([]byte(localBackendSessionsBucket))
+		dead := map[string]struct{}{}
+		if err = sessions.ForEach(func(k, v []byte) (err error) {
+			var session localSession
+			if err = json.Unmarshal(v, &session); err != nil {
+				return
+			}
+			if session.Expires.Before(now) {
+				dead[string(k)] = struct{}{}
+			}
+			return
+		}); err != nil {
+			return
+		}
+		for session := range dead {
+			b.log.Infof(`session expired: %s`, session)
+			if err = sessions.Delete([]byte(session)); err != nil {
+				return
+			}
+		}
+		if expired, err = b.deleteSessionRecords(tx, dead); err != nil {
+			return
+		}
+		raw, err := json.Marshal(localSession{
+			Expires: now.Add(b.ttl),
+		})
+		if err != nil {
+			return
+		}
+		err = sessions.Put([]byte(b.session), raw)
+		return
+	}); err != nil {
+		return
+	}
+	if expired > 0 {
+		b.log.Debugf(`expired records removed: %d`, expired)
+		b.notifyWatchers()
+	}
+	return
+}
+
+// leave removes own session and bound records
+func (b *LocalBackend) leave() (err error) {
+	if err = b.db.Update(func(tx *bolt.Tx) (err error) {
+		if err = tx.Bucket([]byte(localBackendSessionsBucket)).Delete([]byte(b.session)); err != nil {
+			return
+		}
+		_, err = b.deleteSessionRecords(tx, map[string]struct{}{
+			b.session: {},
+		})
+		return
+	}); err != nil {
+		return
+	}
+	b.notifyWatchers()
+	return
+}
+
+func (b *LocalBackend) deleteSessionRecords(tx *bolt.Tx, sessions map[string]struct{}) (res int, err error) {
+	if len(sessions) == 0 {
+		return
+	}
+	bucket := tx.Bucket([]byte(localBackendKVBucket))
+	var keys [][]byte
+	if err = bucket.ForEach(func(k, v []byte) (err error) {
+		var record localRecord
+		if err = json.Unmarshal(v, &record); err != nil {
+			return
+		}
+		if _, ok := sessions[record.Session]; ok && record.Session != "" {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return
+	}); err != nil {
+		return
+	}
+	for _, key := range keys {
+		if err = bucket.Delete(key); err != nil {
+			return
+		}
+	}
+	res = len(keys)
+	return
+}
+
+func (b *LocalBackend) watch(req WatchRequest) {
+	directory := NormalizeKey(b.config.Chroot, req.Key)
+	log := b.log.GetLog(b.log.Prefix(), append(b.log.Tags(), "watch", req.Key)...)
+	log.Debug(`open`)
+
+	changes := make(chan struct{}, 1)
+	changes <- struct{}{}
+	b.mu.Lock()
+	b.watchers[changes] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.watchers, changes)
+		b.mu.Unlock()
+	}()
+
+	var last map[string][]byte
+LOOP:
+	for {
+		select {
+		case <-b.ctx.Done():
+			break LOOP
+		case <-req.Ctx.Done():
+			break LOOP
+		case <-changes:
+		}
+		data, err := b.list(directory)
+		if err != nil {
+			select {
+			case <-b.ctx.Done():
+			default:
+				b.fail(err)
+			}
+			break LOOP
+		}
+		if last != nil && reflect.DeepEqual(last, data) {
+			continue LOOP
+		}
+		last = data
+		select {
+		case <-b.ctx.Done():
+			break LOOP
+		case <-req.Ctx.Done():
+			break LOOP
+		case b.watchResultsChan <- WatchResult{
+			Key:  req.Key,
+			Data: data,
+		}:
+		}
+	}
+	log.Debug(`close`)
+}
+
+// list returns values of all keys with given prefix
+func (b *LocalBackend) list(directory string) (res map[string][]byte, err error) {
+	res = map[string][]byte{}
+	err = b.db.View(func(tx *bolt.Tx) (err error) {
+		cursor := tx.Bucket([]byte(localBackendKVBucket)).Cursor()
+		for k, v := cursor.Seek([]byte(directory)); k != nil && strings.HasPrefix(string(k), directory); k, v = cursor.Next() {
+			var record localRecord
+			if err = json.Unmarshal(v, &record); err != nil {
+				return
+			}
+			res[TrimKeyPrefix(directory, string(k))] = record.Value
+		}
+		return
+	})
+	return
+}
+
+func (b *LocalBackend) notifyWatchers() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for changes := range b.watchers {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// localRecord is stored value
+type localRecord struct {
+	Value   json.RawMessage `json:"value"`
+	Session string          `json:"session,omitempty"`
+}
+
+type localSession struct {
+	Expires time.Time `json:"expires"`
+}
@@ -0,0 +1,130 @@
+// +build ide test_unit
+
+package cluster_test
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/cluster"
+	"github.com/akaspin/soil/fixture"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLocalBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stateDir := "testdata/.test_local_backend"
+	os.RemoveAll(stateDir)
+	assert.NoError(t, os.MkdirAll(stateDir, 0755))
+	defer os.RemoveAll(stateDir)
+
+	waitConfig := fixture.DefaultWaitConfig()
+
+	open := func(nodeID string) (kv *cluster.KV, cancel context.CancelFunc) {
+		var kvCtx context.Context
+		kvCtx, cancel = context.WithCancel(ctx)
+		kv = cluster.NewKV(kvCtx, logx.GetLog("test"), cluster.NewBackendFactory(stateDir))
+		assert.NoError(t, kv.Open())
+		config := cluster.DefaultConfig()
+		config.NodeID = nodeID
+		config.TTL = time.Second
+		config.RetryInterval = time.Millisecond * 100
+		kv.Configure(config)
+		return
+	}
+	closeKV := func(kv *cluster.KV, cancel context.CancelFunc) {
+		kv.Close()
+		kv.Wait()
+		cancel()
+	}
+
+	t.Run(`submit and watch`, func(t *testing.T) {
+		kv, cancel := open("node-1")
+		defer closeKV(kv, cancel)
+
+		kv.Submit([]cluster.StoreOp{
+			{Message: bus.NewMessage("registry/pod-1", map[string]string{"name": "pod-1"})},
+			{Message: bus.NewMessage("nodes", map[string]string{"id": "node-1"}), WithTTL: true},
+		})
+		registry := bus.NewTestingConsumer(ctx)
+		kv.SubscribeKey("registry", ctx, registry)
+		nodes := bus.NewTestingConsumer(ctx)
+		kv.SubscribeKey("nodes", ctx, nodes)
+		fixture.WaitNoError(t, waitConfig, registry.ExpectLastMessageFn(
+			bus.NewMessage("registry", map[string]interface{}{
+				"pod-1": map[string]string{"name": "pod-1"},
+			}),
+		))
+		fixture.WaitNoError(t, waitConfig, nodes.ExpectLastMessageFn(
+			bus.NewMessage("nodes", map[string]interface{}{
+				"node-1": map[string]string{"id": "node-1"},
+			}),
+		))
+
+		ok, err := kv.CAS(context.Background(), []cluster.CASOp{
+			{Message: bus.NewMessage("registry/pod-2", map[string]string{"name": "pod-2"})},
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = kv.CAS(context.Background(), []cluster.CASOp{
+			{Message: bus.NewMessage("registry/pod-2", map[string]string{"name": "pod-3"})},
+		})
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		fixture.WaitNoError(t, waitConfig, registry.ExpectLastMessageFn(
+			bus.NewMessage("registry", map[string]interface{}{
+				"pod-1": map[string]string{"name": "pod-1"},
+				"pod-2": map[string]string{"name": "pod-2"},
+			}),
+		))
+	})
+	t.Run(`restart within ttl`, func(t *testing.T) {
+		kv, cancel := open("node-1")
+		defer closeKV(kv, cancel)
+
+		registry := bus.NewTestingConsumer(ctx)
+		kv.SubscribeKey("registry", ctx, registry)
+		nodes := bus.NewTestingConsumer(ctx)
+		kv.SubscribeKey("nodes", ctx, nodes)
+		fixture.WaitNoError(t, waitConfig, registry.ExpectLastMessageFn(
+			bus.NewMessage("registry", map[string]interface{}{
+				"pod-1": map[string]string{"name": "pod-1"},
+				"pod-2": map[string]string{"name": "pod-2"},
+			}),
+		))
+		fixture.WaitNoError(t, waitConfig, nodes.ExpectLastMessageFn(
+			bus.NewMessage("nodes", map[string]interface{}{
+				"node-1": map[string]string{"id": "node-1"},
+			}),
+		))
+	})
+	t.Run(`expire`, func(t *testing.T) {
+		time.Sleep(time.Second * 2)
+		kv, cancel := open("node-2")
+		defer closeKV(kv, cancel)
+
+		kv.Submit([]cluster.StoreOp{
+			{Message: bus.NewMessage("nodes", map[string]string{"id": "node-2"}), WithTTL: true},
+		})
+		registry := bus.NewTestingConsumer(ctx)
+		kv.SubscribeKey("registry", ctx, registry)
+		nodes := bus.NewTestingConsumer(ctx)
+		kv.SubscribeKey("nodes", ctx, nodes)
+		fixture.WaitNoError(t, waitConfig, registry.ExpectLastMessageFn(
+			bus.NewMessage("registry", map[string]interface{}{
+				"pod-1": map[string]string{"name": "pod-1"},
+				"pod-2": map[string]string{"name": "pod-2"},
+			}),
+		))
+		fixture.WaitNoError(t, waitConfig, nodes.ExpectLastMessageFn(
+			bus.NewMessage("nodes", map[string]interface{}{
+				"node-2": map[string]string{"id": "node-2"},
+			}),
+		))
+	})
+}
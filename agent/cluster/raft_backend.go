@@ -0,0 +1,704 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/raft"
+	"github.com/hashicorp/raft-boltdb"
+	"io"
+	stdlog "log"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	raftBackendDirName     = "raft"
+	raftBackendDBName      = "raft.db"
+	raftBackendDefaultPort = "7655"
+	raftBackendDefaultTTL  = time.Minute
+	raftBackendTimeout     = time.Second * 10
+	raftBackendRetry       = time.Second
+	raftBackendSnapshots   = 2
+)
+
+var errRaftNoLeader = errors.New("raft leader is unknown")
+
+// RaftBackend is embedded backend. Agents form Raft group among themselves.
+// Backend listens on address from backend URL and advertises it with host
+// from Agent advertise address. Node without seeds and existing state
+// bootstraps new cluster. Otherwise node joins cluster through seeds. All
+// connections between nodes are authenticated with cluster key or mutual
+// TLS (see raftAuth).
+//
+// Volatile records are bound to node session. Session is renewed through
+// leader while backend is running. Leader removes records of expired
+// sessions. Raft state is persisted in state directory if defined.
+//
+// Raft membership is published with "nodes" records: each member gets "Raft"
+// field with proto.NodeRaftStatus. Members without records are published
+// with ID only.
+type RaftBackend struct {
+	*baseBackend
+
+	stateDir  string
+	advertise string
+	session   string
+	ttl       time.Duration
+
+	auth     *raftAuth
+	fsm      *raftFSM
+	raft     *raft.Raft
+	listener net.Listener
+	stream   *raftStreamLayer
+	store    io.Closer
+	hasState bool
+
+	opsChan  chan []StoreOp
+	doneChan chan struct{}
+
+	mu       sync.Mutex
+	watchers map[chan struct{}]struct{}
+	members  []raft.Server
+}
+
+func NewRaftBackend(ctx context.Context, log *logx.Log, config BackendConfig, stateDir string) (b *RaftBackend) {
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		config.Address = net.JoinHostPort(config.Address, raftBackendDefaultPort)
+	}
+	b = &RaftBackend{
+		baseBackend: newBaseBackend(ctx, log, config),
+		stateDir:    stateDir,
+		advertise:   raftAdvertiseAddress(config.Address, config.Advertise),
+		session:     NormalizeKey(config.Chroot, config.ID),
+		ttl:         config.TTL,
+		opsChan:     make(chan []StoreOp, 1),
+		doneChan:    make(chan struct{}),
+		watchers:    map[chan struct{}]struct{}{},
+	}
+	if b.ttl <= 0 {
+		b.ttl = raftBackendDefaultTTL
+	}
+	var seeds []string
+	for _, seed := range config.Seeds {
+		if seed != b.advertise {
+			seeds = append(seeds, seed)
+		}
+	}
+	b.config.Seeds = seeds
+	b.fsm = newRaftFSM(b.notifyWatchers)
+	go b.loop()
+	return
+}
+
+// Close closes backend and waits for raft is shut down
+func (b *RaftBackend) Close() error {
+	b.cancel()
+	<-b.doneChan
+	return nil
+}
+
+func (b *RaftBackend) Submit(ops []StoreOp) {
+	select {
+	case <-b.ctx.Done():
+		b.log.Warningf(`ignore %v: %v`, ops, b.ctx.Err())
+	case b.opsChan <- ops:
+		b.log.Tracef(`submit: %v`, ops)
+	}
+}
+
+func (b *RaftBackend) Subscribe(req []WatchRequest) {
+	for _, r := range req {
+		go b.watch(r)
+	}
+}
+
+func (b *RaftBackend) CAS(ctx context.Context, ops []CASOp) (ok bool, err error) {
+	select {
+	case <-b.readyCtx.Done():
+	default:
+		err = ErrNotReady
+		return
+	}
+	cmd := raftCommand{
+		Op:      raftCommandCAS,
+		Session: b.session,
+	}
+	for _, op := range ops {
+		record := raftRecordOp{
+			Key:     NormalizeKey(b.config.Chroot, op.Message.GetID()),
+			WithTTL: op.WithTTL,
+		}
+		if record.Value, err = raftValue(op.Message.Payload()); err != nil {
+			return
+		}
+		if op.Expect != nil {
+			if record.Expect, err = raftValue(*op.Expect); err != nil {
+				return
+			}
+		}
+		cmd.Records = append(cmd.Records, record)
+	}
+	ok, err = b.request(raftRequest{
+		Type:    raftRequestApply,
+		Command: cmd,
+	})
+	return
+}
+
+func (b *RaftBackend) loop() {
+	b.log.Debugf(`open (listen: %s advertise: %s)`, b.config.Address, b.advertise)
+	defer close(b.doneChan)
+	if err := b.open(); err != nil {
+		b.fail(err)
+		return
+	}
+	defer b.shutdown()
+	if !b.join() || !b.waitLeader() {
+		return
+	}
+	if ok, err := b.renew(true); err != nil || !ok {
+		b.fail(fmt.Errorf(`can't create session %s: %v`, b.session, err))
+		return
+	}
+	b.log.Infof(`ready (advertise: %s session: %s)`, b.advertise, b.session)
+	b.readyCancel()
+
+	lastRenew := time.Now()
+	ticker := time.NewTicker(b.ttl / 3)
+	defer ticker.Stop()
+LOOP:
+	for {
+		select {
+		case <-b.leaveChan:
+			b.leave()
+			b.cancel()
+			b.log.Infof(`leaved (session: %s)`, b.session)
+			break LOOP
+		case <-b.ctx.Done():
+			break LOOP
+		case <-ticker.C:
+			if b.raft.State() == raft.Leader && b.fsm.hasExpired(time.Now()) {
+				if _, err := b.applyLocal(raftCommand{Op: raftCommandExpire}); err != nil {
+					b.log.Error(err)
+				}
+			}
+			ok, err := b.renew(false)
+			if err == nil && !ok {
+				b.fail(fmt.Errorf(`session expired: %s`, b.session))
+				break LOOP
+			}
+			if err != nil {
+				if time.Since(lastRenew) > b.ttl {
+					b.fail(fmt.Errorf(`can't renew session %s: %v`, b.session, err))
+					break LOOP
+				}
+				b.log.Warningf(`can't renew session %s: %v`, b.session, err)
+				continue LOOP
+			}
+			lastRenew = time.Now()
+		case ops := <-b.opsChan:
+			if err := b.processStoreOps(ops); err != nil {
+				b.fail(err)
+				break LOOP
+			}
+		}
+	}
+	b.log.Debug(`close`)
+}
+
+func (b *RaftBackend) open() (err error) {
+	if b.auth, err = newRaftAuth(b.config); err != nil {
+		return
+	}
+	logger := stdlog.New(raftLogWriter{
+		log: b.log.GetLog(b.log.Prefix(), append(b.log.Tags(), "raft")...),
+	}, "", 0)
+	var logs raft.LogStore
+	var stable raft.StableStore
+	var snapshots raft.SnapshotStore
+	if b.stateDir == "" {
+		store := raft.NewInmemStore()
+		logs, stable = store, store
+		snapshots = raft.NewInmemSnapshotStore()
+	} else {
+		dir := filepath.Join(b.stateDir, raftBackendDirName)
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return
+		}
+		var store *raftboltdb.BoltStore
+		if store, err = raftboltdb.New(raftboltdb.Options{
+			Path: filepath.Join(dir, raftBackendDBName),
+			BoltOptions: &bolt.Options{
+				Timeout: raftBackendTimeout,
+			},
+		}); err != nil {
+			err = fmt.Errorf(`can't open raft store in %s: %v`, dir, err)
+			return
+		}
+		b.store = store
+		logs, stable = store, store
+		if snapshots, err = raft.NewFileSnapshotStoreWithLogger(dir, raftBackendSnapshots, logger); err != nil {
+			b.store.Close()
+			return
+		}
+	}
+	if b.hasState, err = raft.HasExistingState(logs, stable, snapshots); err != nil {
+		b.closeStore()
+		return
+	}
+	if b.listener, err = b.auth.listen(b.config.Address); err != nil {
+		b.closeStore()
+		return
+	}
+	b.stream = newRaftStreamLayer(b.advertise, b.auth)
+	transport := raft.NewNetworkTransportWithLogger(b.stream, 3, raftBackendTimeout, logger)
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(b.config.ID)
+	config.Logger = logger
+	if b.raft, err = raft.NewRaft(config, b.fsm, logs, stable, snapshots, transport); err != nil {
+		transport.Close()
+		b.listener.Close()
+		b.closeStore()
+		return
+	}
+	go b.serve()
+	go b.observe()
+	return
+}
+
+func (b *RaftBackend) shutdown() {
+	if err := b.raft.Shutdown().Error(); err != nil {
+		b.log.Error(err)
+	}
+	b.listener.Close()
+	b.closeStore()
+}
+
+func (b *RaftBackend) closeStore() {
+	if b.store == nil {
+		return
+	}
+	if err := b.store.Close(); err != nil {
+		b.log.Error(err)
+	}
+}
+
+// join bootstraps new cluster or joins existing one through seeds. join
+// returns false if backend is closed.
+func (b *RaftBackend) join() (ok bool) {
+	if len(b.config.Seeds) == 0 {
+		if !b.hasState {
+			b.log.Infof(`bootstrap cluster (id: %s advertise: %s)`, b.config.ID, b.advertise)
+			if err := b.raft.BootstrapCluster(raft.Configuration{
+				Servers: []raft.Server{
+					{
+						ID:      raft.ServerID(b.config.ID),
+						Address: raft.ServerAddress(b.advertise),
+					},
+				},
+			}).Error(); err != nil {
+				b.log.Error(err)
+			}
+		}
+		ok = true
+		return
+	}
+	req := raftRequest{
+		Type:    raftRequestJoin,
+		ID:      b.config.ID,
+		Address: b.advertise,
+	}
+	for {
+		for _, seed := range b.config.Seeds {
+			if _, err := raftCall(b.auth, seed, raftBackendTimeout, req); err != nil {
+				b.log.Warningf(`can't join through %s: %v`, seed, err)
+				continue
+			}
+			b.log.Infof(`joined through %s`, seed)
+			ok = true
+			return
+		}
+		if !b.wait() {
+			return
+		}
+	}
+}
+
+// waitLeader waits for raft leader is known
+func (b *RaftBackend) waitLeader() (ok bool) {
+	for b.raft.Leader() == "" {
+		if !b.wait() {
+			return
+		}
+	}
+	ok = true
+	return
+}
+
+// wait waits for retry interval. wait returns false if backend is closed or
+// leaved before join.
+func (b *RaftBackend) wait() (ok bool) {
+	select {
+	case <-b.ctx.Done():
+	case <-b.leaveChan:
+		b.cancel()
+	case <-time.After(raftBackendRetry):
+		ok = true
+	}
+	return
+}
+
+// serve accepts connections, authenticates them and demultiplexes them by
+// first byte. Unauthenticated connections are closed.
+func (b *RaftBackend) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			kind, err := b.auth.accept(conn)
+			if err != nil {
+				b.log.Warningf(`rejected connection from %s: %v`, conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			switch kind {
+			case raftConnRaft:
+				b.stream.handle(conn)
+			case raftConnCommand:
+				b.serveCommand(conn)
+			default:
+				b.log.Warningf(`unknown connection type %x from %s`, kind, conn.RemoteAddr())
+				conn.Close()
+			}
+		}(conn)
+	}
+}
+
+func (b *RaftBackend) serveCommand(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(raftBackendTimeout))
+	var req raftRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		b.log.Warningf(`can't decode request from %s: %v`, conn.RemoteAddr(), err)
+		return
+	}
+	var res raftResponse
+	ok, err := b.request(req)
+	res.OK = ok
+	if err != nil {
+		res.Error = err.Error()
+	}
+	if err = json.NewEncoder(conn).Encode(res); err != nil {
+		b.log.Warningf(`can't send response to %s: %v`, conn.RemoteAddr(), err)
+	}
+}
+
+// request handles request on leader or forwards request to leader
+func (b *RaftBackend) request(req raftRequest) (ok bool, err error) {
+	if b.raft.State() != raft.Leader {
+		if req.Forwarded {
+			err = raft.ErrNotLeader
+			return
+		}
+		leader := string(b.raft.Leader())
+		if leader == "" {
+			err = errRaftNoLeader
+			return
+		}
+		req.Forwarded = true
+		ok, err = raftCall(b.auth, leader, raftBackendTimeout, req)
+		return
+	}
+	switch req.Type {
+	case raftRequestApply:
+		ok, err = b.applyLocal(req.Command)
+	case raftRequestJoin:
+		ok, err = b.addServer(raft.ServerID(req.ID), raft.ServerAddress(req.Address))
+	case raftRequestRemove:
+		err = b.raft.RemoveServer(raft.ServerID(req.ID), 0, raftBackendTimeout).Error()
+		ok = err == nil
+	default:
+		err = fmt.Errorf(`unknown request: %s`, req.Type)
+	}
+	return
+}
+
+// applyLocal applies command on leader. Leader sets session deadlines by
+// own clock.
+func (b *RaftBackend) applyLocal(cmd raftCommand) (ok bool, err error) {
+	switch cmd.Op {
+	case raftCommandRenew:
+		cmd.Expires = time.Now().Add(cmd.TTL)
+	case raftCommandExpire:
+		cmd.Expires = time.Now()
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return
+	}
+	future := b.raft.Apply(data, raftBackendTimeout)
+	if err = future.Error(); err != nil {
+		return
+	}
+	switch res := future.Response().(type) {
+	case error:
+		err = res
+	case bool:
+		ok = res
+	}
+	return
+}
+
+// addServer adds voter to raft configuration. Stale servers with same ID or
+// address are removed.
+func (b *RaftBackend) addServer(id raft.ServerID, address raft.ServerAddress) (ok bool, err error) {
+	future := b.raft.GetConfiguration()
+	if err = future.Error(); err != nil {
+		return
+	}
+	for _, server := range future.Configuration().Servers {
+		if server.ID == id && server.Address == address {
+			ok = true
+			return
+		}
+		if server.ID == id || server.Address == address {
+			if err = b.raft.RemoveServer(server.ID, 0, raftBackendTimeout).Error(); err != nil {
+				return
+			}
+		}
+	}
+	if err = b.raft.AddVoter(id, address, 0, raftBackendTimeout).Error(); err != nil {
+		return
+	}
+	b.log.Infof(`server added: %s (%s)`, id, address)
+	ok = true
+	return
+}
+
+func (b *RaftBackend) renew(create bool) (ok bool, err error) {
+	ok, err = b.request(raftRequest{
+		Type: raftRequestApply,
+		Command: raftCommand{
+			Op:      raftCommandRenew,
+			Session: b.session,
+			TTL:     b.ttl,
+			Create:  create,
+		},
+	})
+	return
+}
+
+// leave removes own session with bound records and removes node from raft
+// configuration
+func (b *RaftBackend) leave() {
+	if _, err := b.request(raftRequest{
+		Type: raftRequestApply,
+		Command: raftCommand{
+			Op:      raftCommandLeave,
+			Session: b.session,
+		},
+	}); err != nil {
+		b.log.Error(err)
+	}
+	if _, err := b.request(raftRequest{
+		Type: raftRequestRemove,
+		ID:   b.config.ID,
+	}); err != nil {
+		b.log.Error(err)
+	}
+}
+
+func (b *RaftBackend) processStoreOps(ops []StoreOp) (err error) {
+	var commits []StoreCommit
+	cmd := raftCommand{
+		Op:      raftCommandStore,
+		Session: b.session,
+	}
+	for _, op := range ops {
+		record := raftRecordOp{
+			Key:     NormalizeKey(b.config.Chroot, op.Message.GetID()),
+			WithTTL: op.WithTTL,
+		}
+		if op.WithTTL {
+			record.Key = NormalizeKey(b.config.Chroot, op.Message.GetID(), b.config.ID)
+		}
+		if record.Value, err = raftValue(op.Message.Payload()); err != nil {
+			return
+		}
+		cmd.Records = append(cmd.Records, record)
+		commits = append(commits, StoreCommit{
+			ID:      op.Message.GetID(),
+			Hash:    op.Message.Payload().Hash(),
+			WithTTL: op.WithTTL,
+		})
+	}
+	if _, err = b.request(raftRequest{
+		Type:    raftRequestApply,
+		Command: cmd,
+	}); err != nil {
+		return
+	}
+	select {
+	case <-b.ctx.Done():
+		b.log.Warningf(`skip to send commit for %v: %v`, commits, b.ctx.Err())
+	case b.commitsChan <- commits:
+		b.log.Debugf(`commits sent: %v`, commits)
+	}
+	return
+}
+
+func (b *RaftBackend) watch(req WatchRequest) {
+	directory := NormalizeKey(b.config.Chroot, req.Key)
+	log := b.log.GetLog(b.log.Prefix(), append(b.log.Tags(), "watch", req.Key)...)
+	log.Debug(`open`)
+
+	changes := make(chan struct{}, 1)
+	changes <- struct{}{}
+	b.mu.Lock()
+	b.watchers[changes] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.watchers, changes)
+		b.mu.Unlock()
+	}()
+
+	var last map[string][]byte
+LOOP:
+	for {
+		select {
+		case <-b.ctx.Done():
+			break LOOP
+		case <-req.Ctx.Done():
+			break LOOP
+		case <-changes:
+		}
+		data := b.fsm.list(directory)
+		if req.Key == "nodes" {
+			b.withMembers(log, data)
+		}
+		if last != nil && reflect.DeepEqual(last, data) {
+			continue LOOP
+		}
+		last = data
+		select {
+		case <-b.ctx.Done():
+			break LOOP
+		case <-req.Ctx.Done():
+			break LOOP
+		case b.watchResultsChan <- WatchResult{
+			Key:  req.Key,
+			Data: data,
+		}:
+		}
+	}
+	log.Debug(`close`)
+}
+
+func (b *RaftBackend) notifyWatchers() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for changes := range b.watchers {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// observe polls raft configuration and notifies watchers about membership
+// changes
+func (b *RaftBackend) observe() {
+	var index uint64
+	ticker := time.NewTicker(raftBackendRetry)
+	defer ticker.Stop()
+	for {
+		future := b.raft.GetConfiguration()
+		if err := future.Error(); err == nil && future.Index() != index {
+			index = future.Index()
+			b.mu.Lock()
+			b.members = future.Configuration().Servers
+			b.mu.Unlock()
+			b.notifyWatchers()
+		}
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-b.doneChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// withMembers adds raft membership to "nodes" records by node ID
+func (b *RaftBackend) withMembers(log *logx.Log, data map[string][]byte) {
+	b.mu.Lock()
+	members := b.members
+	b.mu.Unlock()
+	for _, server := range members {
+		id := string(server.ID)
+		record := map[string]interface{}{}
+		if raw, ok := data[id]; ok {
+			if err := json.Unmarshal(raw, &record); err != nil {
+				log.Warningf(`skip raft membership of %s: %v`, id, err)
+				continue
+			}
+		} else {
+			record["ID"] = id
+		}
+		record["Raft"] = proto.NodeRaftStatus{
+			Address: string(server.Address),
+			Voter:   server.Suffrage == raft.Voter,
+			Alive:   b.fsm.hasSession(NormalizeKey(b.config.Chroot, id)),
+		}
+		raw, err := json.Marshal(record)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		data[id] = raw
+	}
+}
+
+// raftValue returns JSON value of payload. Empty payload returns nil.
+func raftValue(payload bus.Payload) (res json.RawMessage, err error) {
+	if payload.IsEmpty() {
+		return
+	}
+	var value interface{}
+	if err = payload.Unmarshal(&value); err != nil {
+		return
+	}
+	res, err = json.Marshal(value)
+	return
+}
+
+// raftAdvertiseAddress returns raft address advertised to other nodes: host
+// from Agent advertise address and port from listen address.
+func raftAdvertiseAddress(listen, advertise string) (res string) {
+	res = listen
+	listenHost, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(advertise)
+	if err != nil || host == "" {
+		host = listenHost
+	}
+	res = net.JoinHostPort(host, port)
+	return
+}
@@ -0,0 +1,268 @@
+// +build ide test_unit
+
+package cluster_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/cluster"
+	"github.com/akaspin/soil/fixture"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rejectedRaftCommand sends join request to raft node without credentials
+// and returns response
+func rejectedRaftCommand(t *testing.T, address string) (res string) {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	conn.Write([]byte{'C'})
+	json.NewEncoder(conn).Encode(map[string]string{
+		"type":    "join",
+		"id":      "intruder",
+		"address": "127.0.0.1:1",
+	})
+	raw, _ := ioutil.ReadAll(conn)
+	res = string(raw)
+	return
+}
+
+func TestRaftBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	waitConfig := fixture.WaitConfig{
+		Retry:   time.Millisecond * 200,
+		Retries: 100,
+	}
+	ports := fixture.RandomPorts(t, 3)
+	seed := fmt.Sprintf("127.0.0.1:%d", ports[0])
+
+	configFn := func(nodeID string, port int, seeds bool) (config cluster.Config) {
+		config = cluster.DefaultConfig()
+		config.NodeID = nodeID
+		config.Advertise = "127.0.0.1:7654"
+		config.BackendURL = fmt.Sprintf("raft://127.0.0.1:%d/soil", port)
+		if seeds {
+			config.BackendURL += "?seed=" + seed
+		}
+		config.Token = "cluster-key"
+		config.TTL = time.Second * 3
+		config.RetryInterval = time.Millisecond * 200
+		return
+	}
+	var kvs []*cluster.KV
+	var cancels []context.CancelFunc
+	for i, port := range ports {
+		kvCtx, kvCancel := context.WithCancel(ctx)
+		kv := cluster.NewKV(kvCtx, logx.GetLog("test"), cluster.DefaultBackendFactory)
+		assert.NoError(t, kv.Open())
+		kv.Configure(configFn(fmt.Sprintf("node-%d", i+1), port, i > 0))
+		kvs = append(kvs, kv)
+		cancels = append(cancels, kvCancel)
+	}
+	defer func() {
+		for i, kv := range kvs {
+			kv.Close()
+			kv.Wait()
+			cancels[i]()
+		}
+	}()
+
+	member := func(port int, alive bool) map[string]interface{} {
+		return map[string]interface{}{
+			"Address": fmt.Sprintf("127.0.0.1:%d", port),
+			"Voter":   true,
+			"Alive":   alive,
+		}
+	}
+	nodes := bus.NewTestingConsumer(ctx)
+	kvs[0].SubscribeKey("nodes", ctx, nodes)
+	registry := bus.NewTestingConsumer(ctx)
+	kvs[0].SubscribeKey("registry", ctx, registry)
+
+	t.Run(`submit and watch`, func(t *testing.T) {
+		for i, kv := range kvs {
+			kv.Submit([]cluster.StoreOp{
+				{Message: bus.NewMessage("nodes", map[string]string{"id": fmt.Sprintf("node-%d", i+1)}), WithTTL: true},
+			})
+		}
+		kvs[1].Submit([]cluster.StoreOp{
+			{Message: bus.NewMessage("registry/pod-1", map[string]string{"name": "pod-1"})},
+		})
+		fixture.WaitNoError(t, waitConfig, nodes.ExpectLastMessageFn(
+			bus.NewMessage("nodes", map[string]interface{}{
+				"node-1": map[string]interface{}{"id": "node-1", "Raft": member(ports[0], true)},
+				"node-2": map[string]interface{}{"id": "node-2", "Raft": member(ports[1], true)},
+				"node-3": map[string]interface{}{"id": "node-3", "Raft": member(ports[2], true)},
+			}),
+		))
+		fixture.WaitNoError(t, waitConfig, registry.ExpectLastMessageFn(
+			bus.NewMessage("registry", map[string]interface{}{
+				"pod-1": map[string]string{"name": "pod-1"},
+			}),
+		))
+	})
+	t.Run(`cas`, func(t *testing.T) {
+		ok, err := kvs[2].CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("registry/pod-2", map[string]string{"name": "pod-2"})},
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		ok, err = kvs[1].CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("registry/pod-2", map[string]string{"name": "pod-3"})},
+		})
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		expect := bus.NewPayload(map[string]string{"name": "pod-2"})
+		ok, err = kvs[0].CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("registry/pod-2", map[string]string{"name": "pod-3"}), Expect: &expect},
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		fixture.WaitNoError(t, waitConfig, registry.ExpectLastMessageFn(
+			bus.NewMessage("registry", map[string]interface{}{
+				"pod-1": map[string]string{"name": "pod-1"},
+				"pod-2": map[string]string{"name": "pod-3"},
+			}),
+		))
+	})
+	t.Run(`unauthenticated`, func(t *testing.T) {
+		for _, port := range ports {
+			assert.NotContains(t, rejectedRaftCommand(t, fmt.Sprintf("127.0.0.1:%d", port)), `"ok"`)
+		}
+		// intruder is not counted in quorum
+		expect := bus.NewPayload(map[string]string{"name": "pod-3"})
+		ok, err := kvs[1].CAS(ctx, []cluster.CASOp{
+			{Message: bus.NewMessage("registry/pod-2", map[string]string{"name": "pod-3"}), Expect: &expect},
+		})
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	})
+	t.Run(`leave`, func(t *testing.T) {
+		kvs[1].Configure(configFn("node-4", ports[1], true))
+		fixture.WaitNoError(t, waitConfig, nodes.ExpectLastMessageFn(
+			bus.NewMessage("nodes", map[string]interface{}{
+				"node-1": map[string]interface{}{"id": "node-1", "Raft": member(ports[0], true)},
+				"node-3": map[string]interface{}{"id": "node-3", "Raft": member(ports[2], true)},
+				"node-4": map[string]interface{}{"id": "node-2", "Raft": member(ports[1], true)},
+			}),
+		))
+	})
+	t.Run(`expire`, func(t *testing.T) {
+		kvs[2].Close()
+		kvs[2].Wait()
+		fixture.WaitNoError(t, waitConfig, nodes.ExpectLastMessageFn(
+			bus.NewMessage("nodes", map[string]interface{}{
+				"node-1": map[string]interface{}{"id": "node-1", "Raft": member(ports[0], true)},
+				// stopped node is still raft member
+				"node-3": map[string]interface{}{"ID": "node-3", "Raft": member(ports[2], false)},
+				"node-4": map[string]interface{}{"id": "node-2", "Raft": member(ports[1], true)},
+			}),
+		))
+		fixture.WaitNoError(t, waitConfig, registry.ExpectLastMessageFn(
+			bus.NewMessage("registry", map[string]interface{}{
+				"pod-1": map[string]string{"name": "pod-1"},
+				"pod-2": map[string]string{"name": "pod-3"},
+			}),
+		))
+	})
+}
+
+func TestRaftBackend_NoAuth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ports := fixture.RandomPorts(t, 1)
+	kv := cluster.NewKV(ctx, logx.GetLog("test"), cluster.DefaultBackendFactory)
+	assert.NoError(t, kv.Open())
+	defer func() {
+		kv.Close()
+		kv.Wait()
+	}()
+	config := cluster.DefaultConfig()
+	config.NodeID = "node-1"
+	config.BackendURL = fmt.Sprintf("raft://127.0.0.1:%d/soil", ports[0])
+	config.RetryInterval = time.Second * 10
+	kv.Configure(config)
+	fixture.WaitNoError10(t, func() error {
+		if status := kv.Status(); !strings.Contains(status.Failure, `raft backend requires`) {
+			return fmt.Errorf(`unexpected status: %v`, status)
+		}
+		return nil
+	})
+}
+
+func TestRaftBackend_TLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "soil-raft-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fixture.WriteTestingCerts(t, dir, "127.0.0.1")
+
+	waitConfig := fixture.WaitConfig{
+		Retry:   time.Millisecond * 200,
+		Retries: 100,
+	}
+	ports := fixture.RandomPorts(t, 2)
+	var kvs []*cluster.KV
+	for i, port := range ports {
+		kv := cluster.NewKV(ctx, logx.GetLog("test"), cluster.DefaultBackendFactory)
+		assert.NoError(t, kv.Open())
+		config := cluster.DefaultConfig()
+		config.NodeID = fmt.Sprintf("node-%d", i+1)
+		config.Advertise = "127.0.0.1:7654"
+		config.BackendURL = fmt.Sprintf("raft://127.0.0.1:%d/soil", port)
+		if i > 0 {
+			config.BackendURL += fmt.Sprintf("?seed=127.0.0.1:%d", ports[0])
+		}
+		config.CAFile = filepath.Join(dir, "ca.pem")
+		config.CertFile = filepath.Join(dir, "cert.pem")
+		config.KeyFile = filepath.Join(dir, "key.pem")
+		config.TTL = time.Second * 3
+		config.RetryInterval = time.Millisecond * 200
+		kv.Configure(config)
+		kvs = append(kvs, kv)
+	}
+	defer func() {
+		for _, kv := range kvs {
+			kv.Close()
+			kv.Wait()
+		}
+	}()
+
+	registry := bus.NewTestingConsumer(ctx)
+	kvs[0].SubscribeKey("registry", ctx, registry)
+
+	t.Run(`cas`, func(t *testing.T) {
+		fixture.WaitNoError(t, waitConfig, func() error {
+			_, err := kvs[1].CAS(ctx, []cluster.CASOp{
+				{Message: bus.NewMessage("registry/pod-1", map[string]string{"name": "pod-1"})},
+			})
+			return err
+		})
+		fixture.WaitNoError(t, waitConfig, registry.ExpectLastMessageFn(
+			bus.NewMessage("registry", map[string]interface{}{
+				"pod-1": map[string]string{"name": "pod-1"},
+			}),
+		))
+	})
+	t.Run(`unauthenticated`, func(t *testing.T) {
+		assert.NotContains(t, rejectedRaftCommand(t, fmt.Sprintf("127.0.0.1:%d", ports[0])), `"ok"`)
+	})
+}
@@ -0,0 +1,262 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/hashicorp/raft"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	raftCommandStore  = "store"
+	raftCommandCAS    = "cas"
+	raftCommandRenew  = "renew"
+	raftCommandExpire = "expire"
+	raftCommandLeave  = "leave"
+)
+
+// raftCommand is replicated raft log entry
+type raftCommand struct {
+	Op      string         `json:"op"`
+	Session string         `json:"session,omitempty"`
+	TTL     time.Duration  `json:"ttl,omitempty"`     // renew: session TTL
+	Create  bool           `json:"create,omitempty"`  // renew: create session if not exists
+	Expires time.Time      `json:"expires,omitempty"` // renew and expire: set by leader
+	Records []raftRecordOp `json:"records,omitempty"`
+}
+
+type raftRecordOp struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value,omitempty"`  // empty value removes key
+	Expect  json.RawMessage `json:"expect,omitempty"` // CAS: empty expect means key should not exist
+	WithTTL bool            `json:"ttl,omitempty"`
+}
+
+type raftRecord struct {
+	Value   json.RawMessage `json:"value"`
+	Session string          `json:"session,omitempty"`
+}
+
+type raftFSMState struct {
+	Records  map[string]raftRecord `json:"records"`
+	Sessions map[string]time.Time  `json:"sessions"`
+}
+
+// raftFSM is replicated state machine. Apply returns bool for
+// successfully decoded commands and error otherwise.
+type raftFSM struct {
+	mu     sync.RWMutex
+	state  raftFSMState
+	notify func()
+}
+
+func newRaftFSM(notify func()) (f *raftFSM) {
+	f = &raftFSM{
+		state: raftFSMState{
+			Records:  map[string]raftRecord{},
+			Sessions: map[string]time.Time{},
+		},
+		notify: notify,
+	}
+	return
+}
+
+func (f *raftFSM) Apply(entry *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(entry.Data, &cmd); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	res, changed, err := f.apply(cmd)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if changed {
+		f.notify()
+	}
+	return res
+}
+
+func (f *raftFSM) apply(cmd raftCommand) (ok bool, changed bool, err error) {
+	switch cmd.Op {
+	case raftCommandStore:
+		changed = f.put(cmd.Session, cmd.Records)
+		ok = true
+	case raftCommandCAS:
+		for _, op := range cmd.Records {
+			record, exists := f.state.Records[op.Key]
+			if len(op.Expect) == 0 && exists {
+				return
+			}
+			if len(op.Expect) > 0 {
+				var expect interface{}
+				if err = json.Unmarshal(op.Expect, &expect); err != nil {
+					return
+				}
+				if !exists || !casEqual(record.Value, bus.NewPayload(expect)) {
+					return
+				}
+			}
+		}
+		changed = f.put(cmd.Session, cmd.Records)
+		ok = true
+	case raftCommandRenew:
+		_, exists := f.state.Sessions[cmd.Session]
+		if !exists && !cmd.Create {
+			return
+		}
+		f.state.Sessions[cmd.Session] = cmd.Expires
+		changed = !exists
+		ok = true
+	case raftCommandExpire:
+		dead := map[string]struct{}{}
+		for session, expires := range f.state.Sessions {
+			if expires.Before(cmd.Expires) {
+				dead[session] = struct{}{}
+			}
+		}
+		changed = f.deleteSessions(dead)
+		ok = true
+	case raftCommandLeave:
+		changed = f.deleteSessions(map[string]struct{}{
+			cmd.Session: {},
+		})
+		ok = true
+	default:
+		err = fmt.Errorf(`unknown raft command: %s`, cmd.Op)
+	}
+	return
+}
+
+// put applies record operations. Volatile records of unknown session are
+// ignored.
+func (f *raftFSM) put(session string, ops []raftRecordOp) (changed bool) {
+	for _, op := range ops {
+		if len(op.Value) == 0 {
+			if _, ok := f.state.Records[op.Key]; ok {
+				delete(f.state.Records, op.Key)
+				changed = true
+			}
+			continue
+		}
+		record := raftRecord{
+			Value: op.Value,
+		}
+		if op.WithTTL {
+			if _, ok := f.state.Sessions[session]; !ok {
+				continue
+			}
+			record.Session = session
+		}
+		f.state.Records[op.Key] = record
+		changed = true
+	}
+	return
+}
+
+func (f *raftFSM) deleteSessions(sessions map[string]struct{}) (changed bool) {
+	for session := range sessions {
+		if _, ok := f.state.Sessions[session]; ok {
+			delete(f.state.Sessions, session)
+			changed = true
+		}
+	}
+	for key, record := range f.state.Records {
+		if _, ok := sessions[record.Session]; ok && record.Session != "" {
+			delete(f.state.Records, key)
+			changed = true
+		}
+	}
+	return
+}
+
+// hasSession returns true if session exists
+func (f *raftFSM) hasSession(session string) (ok bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, ok = f.state.Sessions[session]
+	return
+}
+
+// hasExpired returns true if any session is expired at given time
+func (f *raftFSM) hasExpired(now time.Time) (res bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, expires := range f.state.Sessions {
+		if expires.Before(now) {
+			res = true
+			return
+		}
+	}
+	return
+}
+
+// list returns values of all keys with given prefix
+func (f *raftFSM) list(directory string) (res map[string][]byte) {
+	res = map[string][]byte{}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for key, record := range f.state.Records {
+		if strings.HasPrefix(key, directory) {
+			res[TrimKeyPrefix(directory, key)] = record.Value
+		}
+	}
+	return
+}
+
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	snapshot := &raftFSMSnapshot{
+		state: raftFSMState{
+			Records:  make(map[string]raftRecord, len(f.state.Records)),
+			Sessions: make(map[string]time.Time, len(f.state.Sessions)),
+		},
+	}
+	for k, v := range f.state.Records {
+		snapshot.state.Records[k] = v
+	}
+	for k, v := range f.state.Sessions {
+		snapshot.state.Sessions[k] = v
+	}
+	return snapshot, nil
+}
+
+func (f *raftFSM) Restore(source io.ReadCloser) (err error) {
+	defer source.Close()
+	var state raftFSMState
+	if err = json.NewDecoder(source).Decode(&state); err != nil {
+		return
+	}
+	if state.Records == nil {
+		state.Records = map[string]raftRecord{}
+	}
+	if state.Sessions == nil {
+		state.Sessions = map[string]time.Time{}
+	}
+	f.mu.Lock()
+	f.state = state
+	f.mu.Unlock()
+	f.notify()
+	return
+}
+
+type raftFSMSnapshot struct {
+	state raftFSMState
+}
+
+func (s *raftFSMSnapshot) Persist(sink raft.SnapshotSink) (err error) {
+	if err = json.NewEncoder(sink).Encode(s.state); err != nil {
+		sink.Cancel()
+		return
+	}
+	err = sink.Close()
+	return
+}
+
+func (s *raftFSMSnapshot) Release() {}
@@ -0,0 +1,306 @@
+package cluster
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/hashicorp/raft"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Connections to raft backend listener are multiplexed by first byte
+const (
+	raftConnRaft    byte = 'R'
+	raftConnCommand byte = 'C'
+)
+
+const (
+	raftRequestApply  = "apply"
+	raftRequestJoin   = "join"
+	raftRequestRemove = "remove"
+)
+
+// size of challenge sent to connecting node if cluster key is defined
+const raftChallengeSize = 32
+
+var (
+	errRaftStreamClosed = errors.New("raft stream layer is closed")
+	errRaftNoAuth       = errors.New(`raft backend requires "token", "token_file" or "ca_file", "cert_file" and "key_file"`)
+	errRaftBadKey       = errors.New("bad cluster key")
+)
+
+// raftAuth authenticates connections between raft nodes with shared cluster
+// key and mutual TLS. Cluster key is taken from "token" or "token_file".
+// Connecting node proves key with HMAC of random challenge sent by
+// listening node. Mutual TLS is enabled if "ca_file", "cert_file" and
+// "key_file" are defined: both nodes should present certificates signed by
+// CA.
+type raftAuth struct {
+	key []byte
+	tls *tls.Config
+}
+
+func newRaftAuth(config BackendConfig) (a *raftAuth, err error) {
+	a = &raftAuth{}
+	switch {
+	case config.Token != "":
+		a.key = []byte(config.Token)
+	case config.TokenFile != "":
+		var raw []byte
+		if raw, err = ioutil.ReadFile(config.TokenFile); err != nil {
+			err = fmt.Errorf(`can't read token file: %v`, err)
+			return
+		}
+		a.key = []byte(strings.TrimSpace(string(raw)))
+	}
+	if config.CAFile != "" || config.CertFile != "" || config.KeyFile != "" {
+		if config.CAFile == "" || config.CertFile == "" || config.KeyFile == "" {
+			err = fmt.Errorf(`raft TLS requires "ca_file", "cert_file" and "key_file"`)
+			return
+		}
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+			return
+		}
+		var ca []byte
+		if ca, err = ioutil.ReadFile(config.CAFile); err != nil {
+			return
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			err = fmt.Errorf(`no certificates in %s`, config.CAFile)
+			return
+		}
+		a.tls = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+	if len(a.key) == 0 && a.tls == nil {
+		err = errRaftNoAuth
+	}
+	return
+}
+
+// listen returns listener which accepts TLS connections if TLS is enabled
+func (a *raftAuth) listen(address string) (listener net.Listener, err error) {
+	if listener, err = net.Listen("tcp", address); err != nil || a.tls == nil {
+		return
+	}
+	listener = tls.NewListener(listener, a.tls)
+	return
+}
+
+// accept authenticates accepted connection and returns connection kind
+func (a *raftAuth) accept(conn net.Conn) (kind byte, err error) {
+	conn.SetDeadline(time.Now().Add(raftBackendTimeout))
+	defer conn.SetDeadline(time.Time{})
+	buf := make([]byte, 1)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	kind = buf[0]
+	if len(a.key) == 0 {
+		return
+	}
+	challenge := make([]byte, raftChallengeSize)
+	if _, err = rand.Read(challenge); err != nil {
+		return
+	}
+	if _, err = conn.Write(challenge); err != nil {
+		return
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(conn, proof); err != nil {
+		return
+	}
+	if !hmac.Equal(proof, a.proof(kind, challenge)) {
+		err = errRaftBadKey
+	}
+	return
+}
+
+// dial dials connection of given kind to raft node and authenticates it
+func (a *raftAuth) dial(address string, kind byte, timeout time.Duration) (conn net.Conn, err error) {
+	if conn, err = net.DialTimeout("tcp", address, timeout); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if a.tls != nil {
+		config := a.tls.Clone()
+		if config.ServerName, _, err = net.SplitHostPort(address); err != nil {
+			return
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.Handshake(); err != nil {
+			return
+		}
+		conn = tlsConn
+	}
+	if _, err = conn.Write([]byte{kind}); err != nil {
+		return
+	}
+	if len(a.key) > 0 {
+		challenge := make([]byte, raftChallengeSize)
+		if _, err = io.ReadFull(conn, challenge); err != nil {
+			return
+		}
+		if _, err = conn.Write(a.proof(kind, challenge)); err != nil {
+			return
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return
+}
+
+// proof returns HMAC of connection kind and challenge with cluster key
+func (a *raftAuth) proof(kind byte, challenge []byte) (res []byte) {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte{kind})
+	mac.Write(challenge)
+	res = mac.Sum(nil)
+	return
+}
+
+// raftRequest is request to raft leader
+type raftRequest struct {
+	Type      string      `json:"type"`
+	Command   raftCommand `json:"command,omitempty"`
+	ID        string      `json:"id,omitempty"`
+	Address   string      `json:"address,omitempty"`
+	Forwarded bool        `json:"forwarded,omitempty"`
+}
+
+type raftResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// raftAddr is advertised address of raft node
+type raftAddr string
+
+func (a raftAddr) Network() string {
+	return "tcp"
+}
+
+func (a raftAddr) String() string {
+	return string(a)
+}
+
+// raftStreamLayer accepts raft connections demultiplexed from backend
+// listener and dials authenticated raft connections to other nodes.
+type raftStreamLayer struct {
+	advertise raftAddr
+	auth      *raftAuth
+	connChan  chan net.Conn
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func newRaftStreamLayer(advertise string, auth *raftAuth) (s *raftStreamLayer) {
+	s = &raftStreamLayer{
+		advertise: raftAddr(advertise),
+		auth:      auth,
+		connChan:  make(chan net.Conn),
+		closeChan: make(chan struct{}),
+	}
+	return
+}
+
+func (s *raftStreamLayer) handle(conn net.Conn) {
+	select {
+	case <-s.closeChan:
+		conn.Close()
+	case s.connChan <- conn:
+	}
+}
+
+func (s *raftStreamLayer) Accept() (conn net.Conn, err error) {
+	select {
+	case <-s.closeChan:
+		err = errRaftStreamClosed
+	case conn = <-s.connChan:
+	}
+	return
+}
+
+func (s *raftStreamLayer) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+	})
+	return nil
+}
+
+func (s *raftStreamLayer) Addr() net.Addr {
+	return s.advertise
+}
+
+func (s *raftStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (conn net.Conn, err error) {
+	conn, err = s.auth.dial(string(address), raftConnRaft, timeout)
+	return
+}
+
+// raftCall sends request to raft node at given address
+func raftCall(auth *raftAuth, address string, timeout time.Duration, req raftRequest) (ok bool, err error) {
+	conn, err := auth.dial(address, raftConnCommand, timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return
+	}
+	var res raftResponse
+	if err = json.NewDecoder(conn).Decode(&res); err != nil {
+		return
+	}
+	if res.Error != "" {
+		err = fmt.Errorf(`%s: %s`, address, res.Error)
+		return
+	}
+	ok = res.OK
+	return
+}
+
+// raftLogWriter passes raft library logs to backend log
+type raftLogWriter struct {
+	log *logx.Log
+}
+
+func (w raftLogWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	line := string(bytes.TrimSpace(p))
+	switch {
+	case bytes.Contains(p, []byte("[ERR]")):
+		w.log.Error(line)
+	case bytes.Contains(p, []byte("[WARN]")):
+		w.log.Warning(line)
+	case bytes.Contains(p, []byte("[INFO]")):
+		w.log.Info(line)
+	default:
+		w.log.Debug(line)
+	}
+	return
+}
@@ -0,0 +1,11 @@
+cluster {
+  node_id = "node-1"
+  backend = "consul://consul.example.com:8501/soil"
+  scheme = "https"
+  token_file = "/etc/soil/consul.token"
+  ca_file = "/etc/soil/ca.pem"
+  cert_file = "/etc/soil/cert.pem"
+  key_file = "/etc/soil/key.pem"
+  datacenter = "dc2"
+  namespace = "team-1"
+}
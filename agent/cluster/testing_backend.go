@@ -7,6 +7,7 @@ import (
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent/bus"
 	"net/url"
+	"sync"
 )
 
 type TestingBackendConfig struct {
@@ -50,12 +51,16 @@ func NewTestingBackendFactory(backendConfig TestingBackendConfig) (f BackendFact
 type TestingBackend struct {
 	*baseBackend
 	config TestingBackendConfig
+
+	casMu   sync.Mutex
+	casData map[string][]byte
 }
 
 func NewTestingBackend(ctx context.Context, log *logx.Log, config TestingBackendConfig) (b *TestingBackend) {
 	b = &TestingBackend{
 		baseBackend: newBaseBackend(ctx, log, BackendConfig{}),
 		config:      config,
+		casData:     map[string][]byte{},
 	}
 	go func() {
 		select {
@@ -132,6 +137,36 @@ func (b *TestingBackend) Submit(ops []StoreOp) {
 	}
 }
 
+// CAS applies operations to in-memory storage
+func (b *TestingBackend) CAS(ctx context.Context, ops []CASOp) (ok bool, err error) {
+	b.casMu.Lock()
+	defer b.casMu.Unlock()
+	for _, op := range ops {
+		raw, exists := b.casData[op.Message.GetID()]
+		if op.Expect == nil && exists {
+			return
+		}
+		if op.Expect != nil && (!exists || !casEqual(raw, *op.Expect)) {
+			return
+		}
+	}
+	for _, op := range ops {
+		if op.Message.Payload().IsEmpty() {
+			delete(b.casData, op.Message.GetID())
+			continue
+		}
+		var value interface{}
+		if err = op.Message.Payload().Unmarshal(&value); err != nil {
+			return
+		}
+		if b.casData[op.Message.GetID()], err = json.Marshal(value); err != nil {
+			return
+		}
+	}
+	ok = true
+	return
+}
+
 func (b *TestingBackend) Subscribe(requests []WatchRequest) {
 	for _, req := range requests {
 		b.log.Tracef(`subscribe: %s`, req.Key)
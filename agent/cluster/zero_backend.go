@@ -22,3 +22,8 @@ func (w *ZeroBackend) Submit(ops []StoreOp) {
 
 func (w *ZeroBackend) Subscribe(req []WatchRequest) {
 }
+
+func (w *ZeroBackend) CAS(ctx context.Context, ops []CASOp) (ok bool, err error) {
+	err = ErrNotReady
+	return
+}
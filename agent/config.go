@@ -11,8 +11,15 @@ import (
 
 // Agent - specific config
 type Config struct {
-	Meta   map[string]string `hcl:"meta" json:"meta"`
-	System map[string]string `hcl:"system" json:"system"`
+	Meta     map[string]string `hcl:"meta" json:"meta"`
+	System   map[string]string `hcl:"system" json:"system"`
+	Registry RegistryConfig    `hcl:"registry" json:"registry"`
+}
+
+// Public registry config
+type RegistryConfig struct {
+	History     int      `hcl:"history" json:"history"`           // Number of revisions to keep for each pod
+	TrustedKeys []string `hcl:"trusted_keys" json:"trusted_keys"` // Base64 encoded ed25519 public keys to verify public pods
 }
 
 func DefaultConfig() (c *Config) {
@@ -21,6 +28,9 @@ func DefaultConfig() (c *Config) {
 		System: map[string]string{
 			"pod_exec": "ExecStart=/usr/bin/sleep inf",
 		},
+		Registry: RegistryConfig{
+			History: 10,
+		},
 	}
 	return
 }
@@ -34,6 +34,10 @@ func TestConfig_Unmarshal(t *testing.T) {
 				"from-line1":    "true",
 				"from-line2":    "true",
 			},
+			Registry: agent.RegistryConfig{
+				History:     20,
+				TrustedKeys: []string{"W6Bp5EBLRnv0R9/TGF9OzGDF3iwXaS1aU0uXnGMVAuE="},
+			},
 		}, config)
 
 	})
@@ -59,6 +63,10 @@ func TestConfig_Unmarshal(t *testing.T) {
 				"from-line1":    "true",
 				"from-line2":    "true",
 			},
+			Registry: agent.RegistryConfig{
+				History:     20,
+				TrustedKeys: []string{"W6Bp5EBLRnv0R9/TGF9OzGDF3iwXaS1aU0uXnGMVAuE="},
+			},
 		}, config)
 	})
 }
@@ -0,0 +1,8 @@
+// +build ide test_unit
+
+package agent
+
+var (
+	NewPodAnnouncer     = newPodAnnouncer
+	NewRunningCountPipe = newRunningCountPipe
+)
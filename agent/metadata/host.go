@@ -0,0 +1,208 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// HostFacts collects facts about host from procfs, /etc and network interfaces.
+type HostFacts struct {
+	Root        string                            // filesystem root
+	LookupCNAME func(host string) (string, error) // FQDN resolver. net.LookupCNAME if <nil>
+}
+
+// Collect returns flat map with host facts. Collect returns all facts which
+// can be collected with error contains all failures.
+func (f HostFacts) Collect() (res map[string]string, err error) {
+	res = map[string]string{}
+	var failures []error
+	for _, fn := range []func(map[string]string) error{
+		f.collectHostname,
+		f.collectKernel,
+		f.collectCPU,
+		f.collectMemory,
+		f.collectMachineID,
+		f.collectOSRelease,
+		f.collectIPs,
+	} {
+		if failure := fn(res); failure != nil {
+			failures = append(failures, failure)
+		}
+	}
+	if len(failures) > 0 {
+		err = fmt.Errorf("%v", failures)
+	}
+	return
+}
+
+func (f HostFacts) path(p string) string {
+	if f.Root == "" {
+		return p
+	}
+	return filepath.Join(f.Root, p)
+}
+
+func (f HostFacts) readTrimmed(p string) (res string, err error) {
+	raw, err := ioutil.ReadFile(f.path(p))
+	if err != nil {
+		return
+	}
+	res = strings.TrimSpace(string(raw))
+	return
+}
+
+func (f HostFacts) collectHostname(res map[string]string) (err error) {
+	hostname, err := f.readTrimmed("/proc/sys/kernel/hostname")
+	if err != nil {
+		return
+	}
+	res["hostname"] = hostname
+	res["fqdn"] = hostname
+	lookup := f.LookupCNAME
+	if lookup == nil {
+		lookup = net.LookupCNAME
+	}
+	if cname, lookupErr := lookup(hostname); lookupErr == nil && cname != "" {
+		res["fqdn"] = strings.TrimSuffix(cname, ".")
+	}
+	return
+}
+
+func (f HostFacts) collectKernel(res map[string]string) (err error) {
+	kernel, err := f.readTrimmed("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return
+	}
+	res["kernel"] = kernel
+	return
+}
+
+func (f HostFacts) collectCPU(res map[string]string) (err error) {
+	raw, err := ioutil.ReadFile(f.path("/proc/cpuinfo"))
+	if err != nil {
+		res["cpu_count"] = strconv.Itoa(runtime.NumCPU())
+		return
+	}
+	var count int
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "processor") {
+			count++
+		}
+	}
+	if count == 0 {
+		count = runtime.NumCPU()
+	}
+	res["cpu_count"] = strconv.Itoa(count)
+	return
+}
+
+func (f HostFacts) collectMemory(res map[string]string) (err error) {
+	raw, err := ioutil.ReadFile(f.path("/proc/meminfo"))
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemTotal:" {
+			continue
+		}
+		var total uint64
+		if total, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+			return
+		}
+		if len(fields) > 2 && strings.ToLower(fields[2]) == "kb" {
+			total *= 1024
+		}
+		res["memory_total"] = strconv.FormatUint(total, 10)
+		return
+	}
+	err = fmt.Errorf(`MemTotal is not found in meminfo`)
+	return
+}
+
+func (f HostFacts) collectMachineID(res map[string]string) (err error) {
+	id, err := f.readTrimmed("/etc/machine-id")
+	if err != nil {
+		return
+	}
+	res["machine_id"] = id
+	return
+}
+
+// collectOSRelease reads os-release fields to "os.<lowercase-key>"
+func (f HostFacts) collectOSRelease(res map[string]string) (err error) {
+	raw, err := ioutil.ReadFile(f.path("/etc/os-release"))
+	if err != nil {
+		var fallbackErr error
+		if raw, fallbackErr = ioutil.ReadFile(f.path("/usr/lib/os-release")); fallbackErr != nil {
+			return
+		}
+		err = nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.SplitN(line, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		value := split[1]
+		if unquoted, unquoteErr := strconv.Unquote(value); unquoteErr == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `"'`)
+		}
+		res["os."+strings.ToLower(split[0])] = value
+	}
+	return
+}
+
+// collectIPs collects global unicast addresses of all interfaces which are
+// up. First found IPv4 and IPv6 addresses are exposed as "ipv4" and "ipv6".
+func (f HostFacts) collectIPs(res map[string]string) (err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	var ips []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, addrErr := iface.Addrs()
+		if addrErr != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			ip := ipNet.IP.String()
+			ips = append(ips, ip)
+			if ipNet.IP.To4() != nil {
+				if _, ok := res["ipv4"]; !ok {
+					res["ipv4"] = ip
+				}
+				continue
+			}
+			if _, ok := res["ipv6"]; !ok {
+				res["ipv6"] = ip
+			}
+		}
+	}
+	res["ips"] = strings.Join(ips, ",")
+	return
+}
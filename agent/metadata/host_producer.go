@@ -0,0 +1,74 @@
+package metadata
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/supervisor"
+	"time"
+)
+
+const (
+	HostMessageID       = "host"
+	DefaultHostInterval = time.Minute
+)
+
+// HostProducer collects host facts on open and periodically and sends them
+// to consumer as "host" message. Message is sent only if facts are changed.
+// Facts are collected in background: Open doesn't wait for FQDN resolution.
+type HostProducer struct {
+	*supervisor.Control
+	log      *logx.Log
+	facts    HostFacts
+	interval time.Duration
+	consumer bus.Consumer
+
+	last bus.Message
+}
+
+func NewHostProducer(ctx context.Context, log *logx.Log, facts HostFacts, interval time.Duration, consumer bus.Consumer) (p *HostProducer) {
+	p = &HostProducer{
+		Control:  supervisor.NewControl(ctx),
+		log:      log.GetLog("metadata", "host"),
+		facts:    facts,
+		interval: interval,
+		consumer: consumer,
+		last:     bus.NewMessage(HostMessageID, nil),
+	}
+	return
+}
+
+func (p *HostProducer) Open() (err error) {
+	go p.loop()
+	err = p.Control.Open()
+	return
+}
+
+func (p *HostProducer) loop() {
+	p.collect()
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.Control.Ctx().Done():
+			return
+		case <-ticker.C:
+			p.collect()
+		}
+	}
+}
+
+func (p *HostProducer) collect() {
+	facts, err := p.facts.Collect()
+	if err != nil {
+		p.log.Warningf(`collected with failures: %v`, err)
+	}
+	message := bus.NewMessage(HostMessageID, facts)
+	if p.last.IsEqual(message) {
+		p.log.Tracef(`skip update: facts are equal`)
+		return
+	}
+	p.last = message
+	p.log.Debugf(`facts: %v`, facts)
+	p.consumer.ConsumeMessage(message)
+}
@@ -0,0 +1,104 @@
+// +build ide test_unit
+
+package metadata_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/metadata"
+	"github.com/akaspin/soil/fixture"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHostFacts_Collect(t *testing.T) {
+	facts := metadata.HostFacts{
+		Root: "testdata/host",
+		LookupCNAME: func(host string) (string, error) {
+			return host + ".example.com.", nil
+		},
+	}
+	res, err := facts.Collect()
+	assert.NoError(t, err)
+	for k, v := range map[string]string{
+		"hostname":       "test-host",
+		"fqdn":           "test-host.example.com",
+		"kernel":         "4.13.0-test",
+		"cpu_count":      "2",
+		"memory_total":   "2097152000",
+		"machine_id":     "0123456789abcdef0123456789abcdef",
+		"os.id":          "coreos",
+		"os.version_id":  "1576.4.0",
+		"os.name":        "Container Linux by CoreOS",
+		"os.pretty_name": "Container Linux by CoreOS 1576.4.0 (Ladybug)",
+	} {
+		assert.Equal(t, v, res[k], k)
+	}
+	assert.Contains(t, res, "ips")
+}
+
+func TestHostProducer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cons := bus.NewTestingConsumer(ctx)
+	producer := metadata.NewHostProducer(ctx, logx.GetLog("test"), metadata.HostFacts{
+		Root: "testdata/host",
+		LookupCNAME: func(host string) (string, error) {
+			return "", fmt.Errorf(`not found`)
+		},
+	}, time.Millisecond*50, cons)
+	assert.NoError(t, producer.Open())
+
+	expect, _ := metadata.HostFacts{
+		Root: "testdata/host",
+		LookupCNAME: func(host string) (string, error) {
+			return "", fmt.Errorf(`not found`)
+		},
+	}.Collect()
+	fixture.WaitNoError10(t, cons.ExpectMessagesFn(
+		bus.NewMessage("host", expect),
+	))
+	producer.Close()
+	producer.Wait()
+}
+
+func TestHostProducer_SlowLookup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	cons := bus.NewTestingConsumer(ctx)
+	producer := metadata.NewHostProducer(ctx, logx.GetLog("test"), metadata.HostFacts{
+		Root: "testdata/host",
+		LookupCNAME: func(host string) (string, error) {
+			<-release
+			return host + ".example.com.", nil
+		},
+	}, time.Minute, cons)
+
+	opened := make(chan error, 1)
+	go func() {
+		opened <- producer.Open()
+	}()
+	select {
+	case err := <-opened:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal(`open is blocked by lookup`)
+	}
+
+	expect, _ := metadata.HostFacts{
+		Root: "testdata/host",
+		LookupCNAME: func(host string) (string, error) {
+			return host + ".example.com.", nil
+		},
+	}.Collect()
+	close(release)
+	fixture.WaitNoError10(t, cons.ExpectLastMessageFn(bus.NewMessage("host", expect)))
+	producer.Close()
+	producer.Wait()
+}
@@ -0,0 +1,105 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/lib"
+	"github.com/akaspin/supervisor"
+	"sync"
+)
+
+const RuntimeMessageID = "runtime"
+
+// Runtime holds metadata set at runtime. If state path is not empty Runtime
+// restores values from state file on create and persists them on each
+// change. Runtime sends all values to consumer as "runtime" message on open
+// and on each change.
+type Runtime struct {
+	*supervisor.Control
+	log      *logx.Log
+	path     string
+	consumer bus.Consumer
+
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func NewRuntime(ctx context.Context, log *logx.Log, path string, consumer bus.Consumer) (r *Runtime) {
+	r = &Runtime{
+		Control:  supervisor.NewControl(ctx),
+		log:      log.GetLog("metadata", "runtime"),
+		path:     path,
+		consumer: consumer,
+		values:   map[string]string{},
+	}
+	if path != "" {
+		if err := lib.ReadStateFile(path, &r.values); err != nil {
+			r.log.Errorf(`can't restore state from %s: %v`, path, err)
+		}
+		if r.values == nil {
+			r.values = map[string]string{}
+		}
+	}
+	return
+}
+
+func (r *Runtime) Open() (err error) {
+	r.mu.Lock()
+	r.consumer.ConsumeMessage(bus.NewMessage(RuntimeMessageID, r.values))
+	r.mu.Unlock()
+	err = r.Control.Open()
+	return
+}
+
+// Get returns copy of all values
+func (r *Runtime) Get() (res map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res = lib.CloneMap(r.values)
+	return
+}
+
+// Set sets given values
+func (r *Runtime) Set(values map[string]string) (err error) {
+	for k := range values {
+		if k == "" {
+			err = fmt.Errorf(`empty key`)
+			return
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next := lib.CloneMap(r.values)
+	for k, v := range values {
+		next[k] = v
+	}
+	err = r.commit(next)
+	return
+}
+
+// Delete removes given keys
+func (r *Runtime) Delete(keys ...string) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	next := lib.CloneMap(r.values)
+	for _, k := range keys {
+		delete(next, k)
+	}
+	err = r.commit(next)
+	return
+}
+
+func (r *Runtime) commit(next map[string]string) (err error) {
+	if r.path != "" {
+		if err = lib.WriteStateFile(r.path, next); err != nil {
+			r.log.Errorf(`can't persist state to %s: %v`, r.path, err)
+			return
+		}
+	}
+	r.values = next
+	r.log.Debugf(`values: %v`, next)
+	r.consumer.ConsumeMessage(bus.NewMessage(RuntimeMessageID, lib.CloneMap(next)))
+	return
+}
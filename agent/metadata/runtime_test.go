@@ -0,0 +1,55 @@
+// +build ide test_unit
+
+package metadata_test
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/metadata"
+	"github.com/akaspin/soil/fixture"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestRuntime(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := "testdata/.test_runtime/meta.json"
+	os.RemoveAll("testdata/.test_runtime")
+	defer os.RemoveAll("testdata/.test_runtime")
+
+	cons := bus.NewTestingConsumer(ctx)
+	runtime := metadata.NewRuntime(ctx, logx.GetLog("test"), path, cons)
+	assert.NoError(t, runtime.Open())
+
+	t.Run(`0 open`, func(t *testing.T) {
+		fixture.WaitNoError10(t, cons.ExpectMessagesFn(
+			bus.NewMessage("runtime", map[string]string{}),
+		))
+	})
+	t.Run(`1 set`, func(t *testing.T) {
+		assert.NoError(t, runtime.Set(map[string]string{"a": "1", "b": "2"}))
+		assert.Error(t, runtime.Set(map[string]string{"": "1"}))
+		assert.Equal(t, map[string]string{"a": "1", "b": "2"}, runtime.Get())
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("runtime", map[string]string{"a": "1", "b": "2"}),
+		))
+	})
+	t.Run(`2 delete`, func(t *testing.T) {
+		assert.NoError(t, runtime.Delete("a", "c"))
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("runtime", map[string]string{"b": "2"}),
+		))
+	})
+	t.Run(`3 restore`, func(t *testing.T) {
+		restoredCons := bus.NewTestingConsumer(ctx)
+		restored := metadata.NewRuntime(ctx, logx.GetLog("test"), path, restoredCons)
+		assert.NoError(t, restored.Open())
+		fixture.WaitNoError10(t, restoredCons.ExpectMessagesFn(
+			bus.NewMessage("runtime", map[string]string{"b": "2"}),
+		))
+	})
+}
@@ -0,0 +1,90 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	fileSourceKind = "file"
+	execSourceKind = "exec"
+
+	defaultFileSourceInterval = time.Minute
+	defaultExecSourceInterval = time.Minute
+)
+
+// source reads values once
+type sourceFn func(ctx context.Context) (res map[string]string, err error)
+
+// sourceWatchFn starts watching source and returns channel which receives
+// notification on each change. Watch is stopped then context is done.
+// Failures after start are logged and stop notifications.
+type sourceWatchFn func(ctx context.Context, log *logx.Log) (changes <-chan struct{}, err error)
+
+// newSourceFn returns source function, optional watch function and interval
+// for given config
+func newSourceFn(config SourceConfig) (fn sourceFn, watch sourceWatchFn, interval time.Duration, err error) {
+	switch config.Kind {
+	case fileSourceKind:
+		path := config.GetString("path", "")
+		if path == "" {
+			err = fmt.Errorf(`"path" is required`)
+			return
+		}
+		if interval, err = config.GetDuration("interval", defaultFileSourceInterval); err != nil {
+			return
+		}
+		format := config.GetString("format", strings.TrimPrefix(filepath.Ext(path), "."))
+		switch format {
+		case formatJSON, formatHCL:
+		default:
+			format = formatEnv
+		}
+		fn = func(ctx context.Context) (res map[string]string, err error) {
+			raw, err := ioutil.ReadFile(path)
+			if err != nil {
+				return
+			}
+			res, err = parseSource(format, raw)
+			return
+		}
+		watch = watchFile(path)
+	case execSourceKind:
+		command := config.GetString("command", "")
+		if command == "" {
+			err = fmt.Errorf(`"command" is required`)
+			return
+		}
+		if interval, err = config.GetDuration("interval", defaultExecSourceInterval); err != nil {
+			return
+		}
+		var timeout time.Duration
+		if timeout, err = config.GetDuration("timeout", interval); err != nil {
+			return
+		}
+		fn = func(ctx context.Context) (res map[string]string, err error) {
+			execCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			var stdout, stderr bytes.Buffer
+			cmd := exec.CommandContext(execCtx, "/bin/sh", "-c", command)
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+			if err = cmd.Run(); err != nil {
+				err = fmt.Errorf(`%v: %s`, err, strings.TrimSpace(stderr.String()))
+				return
+			}
+			res = parseKeyValue(stdout.Bytes())
+			return
+		}
+	default:
+		err = fmt.Errorf(`unknown meta source kind: %s`, config.Kind)
+	}
+	return
+}
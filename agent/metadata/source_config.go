@@ -0,0 +1,112 @@
+package metadata
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/mitchellh/hashstructure"
+	"io"
+	"time"
+)
+
+// SourceConfig represents one "meta_source" stanza in Agent configuration
+type SourceConfig struct {
+	Kind       string                 // Source kind
+	Name       string                 // Source name unique within agent
+	Properties map[string]interface{} // Properties
+}
+
+func (c SourceConfig) IsEqual(config SourceConfig) (res bool) {
+	leftHash, _ := hashstructure.Hash(c, nil)
+	rightHash, _ := hashstructure.Hash(config, nil)
+	res = leftHash == rightHash
+	return
+}
+
+// GetString returns string property or default value
+func (c SourceConfig) GetString(key string, def string) (res string) {
+	res = def
+	if v, ok := c.Properties[key]; ok {
+		res = fmt.Sprint(v)
+	}
+	return
+}
+
+// GetDuration returns duration property or default value
+func (c SourceConfig) GetDuration(key string, def time.Duration) (res time.Duration, err error) {
+	res = def
+	v, ok := c.Properties[key]
+	if !ok {
+		return
+	}
+	switch v1 := v.(type) {
+	case int:
+		res = time.Duration(v1) * time.Second
+	default:
+		res, err = time.ParseDuration(fmt.Sprint(v1))
+	}
+	return
+}
+
+func (c *SourceConfig) parseAst(m *ast.ObjectItem) (err error) {
+	if len(m.Keys) != 2 {
+		err = fmt.Errorf(`meta source config should be named as "kind" "name"`)
+		return
+	}
+	if err = hcl.DecodeObject(&(c.Properties), m.Val); err != nil {
+		return
+	}
+	c.Kind = m.Keys[0].Token.Value().(string)
+	c.Name = m.Keys[1].Token.Value().(string)
+	return
+}
+
+type SourceConfigs []SourceConfig
+
+func (c *SourceConfigs) Unmarshal(readers ...io.Reader) (err error) {
+	var failures []error
+	for _, reader := range readers {
+		if failure := c.unmarshal(reader); failure != nil {
+			failures = append(failures, failure)
+		}
+	}
+	if len(failures) > 0 {
+		err = fmt.Errorf("%v", failures)
+	}
+	return
+}
+
+func (c *SourceConfigs) unmarshal(reader io.Reader) (err error) {
+	var buf bytes.Buffer
+	if _, err = io.Copy(&buf, reader); err != nil {
+		return
+	}
+	root, err := hcl.Parse(buf.String())
+	if err != nil {
+		err = fmt.Errorf("error parsing: %s", err)
+		return
+	}
+	buf.Reset()
+
+	list, ok := root.Node.(*ast.ObjectList)
+	if !ok {
+		err = fmt.Errorf("error parsing: %s", fmt.Errorf("error parsing: root should be an object"))
+		return
+	}
+	matches := list.Filter("meta_source")
+
+	var failures []error
+	for _, m := range matches.Items {
+		var config SourceConfig
+		if failure := config.parseAst(m); failure != nil {
+			failures = append(failures, failure)
+			continue
+		}
+		*c = append(*c, config)
+	}
+	if len(failures) > 0 {
+		err = fmt.Errorf("%v", failures)
+	}
+	return
+}
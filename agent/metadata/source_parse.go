@@ -0,0 +1,106 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/hcl"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatJSON = "json"
+	formatEnv  = "env"
+	formatHCL  = "hcl"
+)
+
+// parseSource parses raw data in given format to flat map. Nested keys are
+// delimited by dot.
+func parseSource(format string, raw []byte) (res map[string]string, err error) {
+	res = map[string]string{}
+	switch format {
+	case formatEnv:
+		res = parseKeyValue(raw)
+	case formatJSON:
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err = dec.Decode(&v); err != nil {
+			return
+		}
+		flatten("", v, res)
+	case formatHCL:
+		var v map[string]interface{}
+		if err = hcl.Unmarshal(raw, &v); err != nil {
+			return
+		}
+		flatten("", v, res)
+	default:
+		err = fmt.Errorf(`unknown format: %s`, format)
+	}
+	return
+}
+
+// parseKeyValue parses "key=value" lines. Empty lines and lines beginning
+// with "#" are ignored. Quoted values are unquoted.
+func parseKeyValue(raw []byte) (res map[string]string) {
+	res = map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		split := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(split[1])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'`)
+		}
+		res[strings.TrimSpace(split[0])] = value
+	}
+	return
+}
+
+func flatten(prefix string, v interface{}, res map[string]string) {
+	switch v1 := v.(type) {
+	case map[string]interface{}:
+		for k, val := range v1 {
+			flatten(joinKey(prefix, k), val, res)
+		}
+	case []map[string]interface{}:
+		for _, m := range v1 {
+			flatten(prefix, m, res)
+		}
+	case []interface{}:
+		var scalars []string
+		for _, item := range v1 {
+			switch item.(type) {
+			case map[string]interface{}, []map[string]interface{}:
+				flatten(prefix, item, res)
+			default:
+				scalars = append(scalars, fmt.Sprint(item))
+			}
+		}
+		if len(scalars) > 0 {
+			res[prefix] = strings.Join(scalars, ",")
+		}
+	case nil:
+		res[prefix] = ""
+	default:
+		res[prefix] = fmt.Sprint(v1)
+	}
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
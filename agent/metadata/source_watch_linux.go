@@ -0,0 +1,91 @@
+// +build linux
+
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/akaspin/logx"
+	"golang.org/x/sys/unix"
+	"path/filepath"
+	"unsafe"
+)
+
+const (
+	fileWatchMask        = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+	fileWatchPollTimeout = 500 // milliseconds
+)
+
+// watchFile watches parent directory of file with inotify to catch
+// modifications, replacements and removals of file.
+func watchFile(path string) (fn sourceWatchFn) {
+	dir, name := filepath.Dir(path), filepath.Base(path)
+	fn = func(ctx context.Context, log *logx.Log) (changes <-chan struct{}, err error) {
+		fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+		if err != nil {
+			return
+		}
+		if _, err = unix.InotifyAddWatch(fd, dir, fileWatchMask); err != nil {
+			unix.Close(fd)
+			return
+		}
+		changesChan := make(chan struct{}, 1)
+		go func() {
+			defer unix.Close(fd)
+			if watchErr := readFileEvents(ctx, fd, name, changesChan); watchErr != nil {
+				log.Errorf(`watch %s stopped: %v`, path, watchErr)
+			}
+		}()
+		changes = changesChan
+		return
+	}
+	return
+}
+
+// readFileEvents reads inotify events until context is done and notifies
+// changes channel about events related to file with given name.
+func readFileEvents(ctx context.Context, fd int, name string, changes chan struct{}) (err error) {
+	buf := make([]byte, (unix.SizeofInotifyEvent+unix.NAME_MAX+1)*16)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for ctx.Err() == nil {
+		var n int
+		if n, err = unix.Poll(fds, fileWatchPollTimeout); err == unix.EINTR || (err == nil && n == 0) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if n, err = unix.Read(fd, buf); err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		changed := false
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameLen := int(event.Len)
+			raw := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+nameLen]
+			if i := bytes.IndexByte(raw, 0); i >= 0 {
+				raw = raw[:i]
+			}
+			if event.Mask&unix.IN_IGNORED != 0 {
+				err = errors.New(`watched directory is removed`)
+				return
+			}
+			if event.Mask&unix.IN_Q_OVERFLOW != 0 || string(raw) == name {
+				changed = true
+			}
+			offset += unix.SizeofInotifyEvent + nameLen
+		}
+		if changed {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+	err = nil
+	return
+}
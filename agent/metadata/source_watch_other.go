@@ -0,0 +1,9 @@
+// +build !linux
+
+package metadata
+
+// watchFile is not supported on this platform. Files are reread only by
+// interval.
+func watchFile(path string) (fn sourceWatchFn) {
+	return
+}
@@ -0,0 +1,244 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/supervisor"
+	"time"
+)
+
+const (
+	SourcesMessageID       = "sources"
+	SourcesStatusMessageID = "meta_sources"
+)
+
+// SourceStatus represents status of one meta source
+type SourceStatus struct {
+	Kind    string
+	Values  map[string]string
+	Failure string `json:",omitempty"`
+}
+
+// Sources evaluates configured meta sources and sends merged values to
+// consumer as "sources" message. Sources in later "meta_source" stanzas
+// override values from earlier ones. Sources with failures keep their last
+// values. Statuses of all sources are sent to status consumer as
+// "meta_sources" message with map[string]SourceStatus payload.
+type Sources struct {
+	*supervisor.Control
+	log            *logx.Log
+	consumer       bus.Consumer
+	statusConsumer bus.Consumer
+
+	order    []string
+	workers  map[string]*sourceWorker
+	dirty    map[string]struct{}
+	status   map[string]SourceStatus
+	lastSent bus.Message
+
+	configChan chan SourceConfigs
+	resultChan chan sourceResult
+}
+
+func NewSources(ctx context.Context, log *logx.Log, consumer, statusConsumer bus.Consumer) (s *Sources) {
+	s = &Sources{
+		Control:        supervisor.NewControl(ctx),
+		log:            log.GetLog("metadata", "sources"),
+		consumer:       consumer,
+		statusConsumer: statusConsumer,
+		workers:        map[string]*sourceWorker{},
+		dirty:          map[string]struct{}{},
+		status:         map[string]SourceStatus{},
+		lastSent:       bus.NewMessage(SourcesMessageID, nil),
+		configChan:     make(chan SourceConfigs),
+		resultChan:     make(chan sourceResult),
+	}
+	return
+}
+
+func (s *Sources) Open() (err error) {
+	go s.loop()
+	err = s.Control.Open()
+	return
+}
+
+func (s *Sources) Configure(configs SourceConfigs) {
+	select {
+	case <-s.Control.Ctx().Done():
+		s.log.Warningf(`ignore configs %v: %v`, configs, s.Control.Ctx().Err())
+	case s.configChan <- configs:
+	}
+}
+
+func (s *Sources) loop() {
+	log := s.log.GetLog(s.log.Prefix(), append(s.log.Tags(), "loop")...)
+	for {
+		select {
+		case <-s.Control.Ctx().Done():
+			return
+		case configs := <-s.configChan:
+			log.Tracef(`config: %v`, configs)
+			s.handleConfigs(configs)
+		case result := <-s.resultChan:
+			log.Tracef(`result: %v`, result)
+			s.handleResult(result)
+		}
+	}
+}
+
+func (s *Sources) handleConfigs(configs SourceConfigs) {
+	byName := map[string]SourceConfig{}
+	s.order = nil
+	for _, config := range configs {
+		if _, ok := byName[config.Name]; !ok {
+			s.order = append(s.order, config.Name)
+		}
+		byName[config.Name] = config
+	}
+	for name, w := range s.workers {
+		if config, ok := byName[name]; !ok || !w.config.IsEqual(config) {
+			w.close()
+			delete(s.workers, name)
+			delete(s.dirty, name)
+			s.log.Infof(`removed: %s`, name)
+		}
+	}
+	for name := range s.status {
+		if _, ok := byName[name]; !ok {
+			delete(s.status, name)
+		}
+	}
+	for name, config := range byName {
+		if _, ok := s.workers[name]; ok {
+			continue
+		}
+		fn, watch, interval, err := newSourceFn(config)
+		if err != nil {
+			s.log.Errorf(`can't create meta source "%s": %v`, name, err)
+			s.status[name] = SourceStatus{
+				Kind:    config.Kind,
+				Values:  map[string]string{},
+				Failure: err.Error(),
+			}
+			continue
+		}
+		s.workers[name] = newSourceWorker(s.Control.Ctx(), s.log, config, fn, watch, interval, s.resultChan)
+		s.dirty[name] = struct{}{}
+		s.log.Infof(`created: %s (%s every %s)`, name, config.Kind, interval)
+	}
+	s.notify()
+}
+
+func (s *Sources) handleResult(result sourceResult) {
+	if w, ok := s.workers[result.name]; !ok || w != result.worker {
+		s.log.Tracef(`ignore result from stale worker %s`, result.name)
+		return
+	}
+	delete(s.dirty, result.name)
+	current, ok := s.status[result.name]
+	if !ok || current.Values == nil {
+		current = SourceStatus{
+			Kind:   result.worker.config.Kind,
+			Values: map[string]string{},
+		}
+	}
+	current.Failure = ""
+	if result.err != nil {
+		s.log.Errorf(`meta source "%s" failed: %v`, result.name, result.err)
+		current.Failure = result.err.Error()
+	} else {
+		current.Values = result.values
+	}
+	s.status[result.name] = current
+	s.notify()
+}
+
+func (s *Sources) notify() {
+	status := map[string]SourceStatus{}
+	for name, st := range s.status {
+		status[name] = st
+	}
+	s.statusConsumer.ConsumeMessage(bus.NewMessage(SourcesStatusMessageID, status))
+
+	if len(s.dirty) > 0 {
+		s.log.Tracef(`skip update: %d sources are dirty`, len(s.dirty))
+		return
+	}
+	merged := map[string]string{}
+	for _, name := range s.order {
+		for k, v := range s.status[name].Values {
+			merged[k] = v
+		}
+	}
+	message := bus.NewMessage(SourcesMessageID, merged)
+	if s.lastSent.IsEqual(message) {
+		return
+	}
+	s.lastSent = message
+	s.log.Debugf(`values: %v`, merged)
+	s.consumer.ConsumeMessage(message)
+}
+
+type sourceResult struct {
+	name   string
+	worker *sourceWorker
+	values map[string]string
+	err    error
+}
+
+func (r sourceResult) String() string {
+	return fmt.Sprintf(`%s:%v:%v`, r.name, r.values, r.err)
+}
+
+// sourceWorker invokes source function on start, on each change reported
+// by watch function and by interval. If watch fails worker falls back to
+// interval.
+type sourceWorker struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	config SourceConfig
+}
+
+func newSourceWorker(ctx context.Context, log *logx.Log, config SourceConfig, fn sourceFn, watch sourceWatchFn, interval time.Duration, resultChan chan sourceResult) (w *sourceWorker) {
+	w = &sourceWorker{
+		config: config,
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var changes <-chan struct{}
+		if watch != nil {
+			var err error
+			if changes, err = watch(w.ctx, log); err != nil {
+				log.Warningf(`can't watch meta source "%s", falling back to interval %s: %v`, config.Name, interval, err)
+			}
+		}
+		for {
+			values, err := fn(w.ctx)
+			select {
+			case <-w.ctx.Done():
+				return
+			case resultChan <- sourceResult{
+				name:   config.Name,
+				worker: w,
+				values: values,
+				err:    err,
+			}:
+			}
+			select {
+			case <-w.ctx.Done():
+				return
+			case <-ticker.C:
+			case <-changes:
+			}
+		}
+	}()
+	return
+}
+
+func (w *sourceWorker) close() {
+	w.cancel()
+}
@@ -0,0 +1,149 @@
+// +build ide test_unit
+
+package metadata_test
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/metadata"
+	"github.com/akaspin/soil/fixture"
+	"github.com/akaspin/soil/lib"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestSourceConfigs_Unmarshal(t *testing.T) {
+	var buffers lib.StaticBuffers
+	assert.NoError(t, buffers.ReadFiles("testdata/sources_test_0.hcl"))
+	var configs metadata.SourceConfigs
+	assert.NoError(t, configs.Unmarshal(buffers.GetReaders()...))
+	assert.Equal(t, metadata.SourceConfigs{
+		{
+			Kind: "file",
+			Name: "provision",
+			Properties: map[string]interface{}{
+				"path":     "/etc/provision/meta.json",
+				"interval": "5s",
+			},
+		},
+		{
+			Kind: "exec",
+			Name: "facter",
+			Properties: map[string]interface{}{
+				"command":  "/usr/bin/facter-meta",
+				"interval": "1m",
+				"timeout":  10,
+			},
+		},
+	}, configs)
+	timeout, err := configs[1].GetDuration("timeout", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second*10, timeout)
+}
+
+func TestSources(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cons := bus.NewTestingConsumer(ctx)
+	statusCons := bus.NewTestingConsumer(ctx)
+	sources := metadata.NewSources(ctx, logx.GetLog("test"), cons, statusCons)
+	assert.NoError(t, sources.Open())
+
+	t.Run(`0 empty`, func(t *testing.T) {
+		sources.Configure(nil)
+		fixture.WaitNoError10(t, cons.ExpectMessagesFn(
+			bus.NewMessage("sources", map[string]string{}),
+		))
+	})
+	t.Run(`1 files`, func(t *testing.T) {
+		sources.Configure(metadata.SourceConfigs{
+			{Kind: "file", Name: "json", Properties: map[string]interface{}{"path": "testdata/source_0.json"}},
+			{Kind: "file", Name: "env", Properties: map[string]interface{}{"path": "testdata/source_1.env"}},
+			{Kind: "file", Name: "hcl", Properties: map[string]interface{}{"path": "testdata/source_2.hcl"}},
+		})
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("sources", map[string]string{
+				"rack":        "center",
+				"dc.name":     "dc1",
+				"dc.zone":     "2",
+				"groups":      "a,b",
+				"ROLE":        "web",
+				"labels.tier": "front",
+			}),
+		))
+	})
+	t.Run(`2 exec with failure`, func(t *testing.T) {
+		sources.Configure(metadata.SourceConfigs{
+			{Kind: "exec", Name: "ok", Properties: map[string]interface{}{"command": "echo rack=exec; echo 'a = 1'"}},
+			{Kind: "exec", Name: "fail", Properties: map[string]interface{}{"command": "echo fail >&2; exit 1"}},
+		})
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("sources", map[string]string{
+				"rack": "exec",
+				"a":    "1",
+			}),
+		))
+		fixture.WaitNoError10(t, statusCons.ExpectLastMessageFn(
+			bus.NewMessage("meta_sources", map[string]metadata.SourceStatus{
+				"ok": {
+					Kind:   "exec",
+					Values: map[string]string{"rack": "exec", "a": "1"},
+				},
+				"fail": {
+					Kind:    "exec",
+					Values:  map[string]string{},
+					Failure: "exit status 1: fail",
+				},
+			}),
+		))
+	})
+	t.Run(`3 file watch`, func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip(`file watch is supported only on linux`)
+		}
+		dir, err := ioutil.TempDir("", "")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "meta.env")
+		assert.NoError(t, ioutil.WriteFile(path, []byte("a=1\n"), 0644))
+
+		sources.Configure(metadata.SourceConfigs{
+			{Kind: "file", Name: "watched", Properties: map[string]interface{}{"path": path, "interval": "1h"}},
+		})
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("sources", map[string]string{"a": "1"}),
+		))
+
+		// in-place write
+		assert.NoError(t, ioutil.WriteFile(path, []byte("a=2\n"), 0644))
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("sources", map[string]string{"a": "2"}),
+		))
+
+		// atomic replace
+		assert.NoError(t, ioutil.WriteFile(path+".tmp", []byte("a=3\n"), 0644))
+		assert.NoError(t, os.Rename(path+".tmp", path))
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("sources", map[string]string{"a": "3"}),
+		))
+
+		// removal keeps last values
+		assert.NoError(t, os.Remove(path))
+		fixture.WaitNoError10(t, statusCons.ExpectLastMessageFn(
+			bus.NewMessage("meta_sources", map[string]metadata.SourceStatus{
+				"watched": {
+					Kind:    "file",
+					Values:  map[string]string{"a": "3"},
+					Failure: "open " + path + ": no such file or directory",
+				},
+			}),
+		))
+	})
+}
@@ -0,0 +1,4 @@
+rack = "center"
+labels {
+  tier = "front"
+}
@@ -0,0 +1,10 @@
+meta_source "file" "provision" {
+  path = "/etc/provision/meta.json"
+  interval = "5s"
+}
+
+meta_source "exec" "facter" {
+  command = "/usr/bin/facter-meta"
+  interval = "1m"
+  timeout = 10
+}
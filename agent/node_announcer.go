@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/scheduler"
+	"github.com/akaspin/soil/lib"
+	"github.com/akaspin/soil/proto"
+	"sync"
+)
+
+// nodeAnnouncer announces node info to consumer on each change. Announcer
+// accepts "drain" messages with drain state and "meta" messages with actual
+// agent metadata.
+type nodeAnnouncer struct {
+	consumer bus.Consumer
+
+	mu   sync.Mutex
+	info proto.NodeInfo
+}
+
+func newNodeAnnouncer(consumer bus.Consumer) (a *nodeAnnouncer) {
+	a = &nodeAnnouncer{
+		consumer: consumer,
+		info: proto.NodeInfo{
+			Version: proto.Version,
+			API:     proto.APIV1Version,
+			Meta:    map[string]string{},
+		},
+	}
+	return
+}
+
+// Configure sets node ID and advertise address
+func (a *nodeAnnouncer) Configure(id, advertise string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.info.ID = id
+	a.info.Advertise = advertise
+	a.announce()
+}
+
+func (a *nodeAnnouncer) ConsumeMessage(message bus.Message) (err error) {
+	switch message.GetID() {
+	case scheduler.DrainMessageID:
+		var drain proto.DrainState
+		if err = message.Payload().Unmarshal(&drain); err != nil {
+			return
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.info.Drain = drain
+	default:
+		var meta map[string]string
+		if err = message.Payload().Unmarshal(&meta); err != nil {
+			return
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.info.Meta = lib.CloneMap(meta)
+	}
+	a.announce()
+	return
+}
+
+func (a *nodeAnnouncer) announce() {
+	if a.info.ID == "" {
+		return
+	}
+	a.consumer.ConsumeMessage(bus.NewMessage("", a.info))
+}
@@ -0,0 +1,111 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const clusterPodsMessageID = "cluster_pods"
+
+// podAnnouncer announces compact statuses of pods on node to consumer on each
+// change. Announcer accepts "provision" messages with provision states. Pod
+// namespaces and marks are requested from sinkFn.
+type podAnnouncer struct {
+	consumer bus.Consumer
+	sinkFn   func() map[string]proto.PodStatus
+
+	mu   sync.Mutex
+	last proto.NodePodsStatus
+}
+
+func newPodAnnouncer(consumer bus.Consumer, sinkFn func() map[string]proto.PodStatus) (a *podAnnouncer) {
+	a = &podAnnouncer{
+		consumer: consumer,
+		sinkFn:   sinkFn,
+	}
+	return
+}
+
+func (a *podAnnouncer) ConsumeMessage(message bus.Message) (err error) {
+	var chunk map[string]string
+	if err = message.Payload().Unmarshal(&chunk); err != nil {
+		return
+	}
+	scheduled := a.sinkFn()
+	pods := proto.NodePodsStatus{}
+
+	// provision: <pod>.<field>
+	for k, v := range chunk {
+		split := strings.SplitN(k, ".", 2)
+		if len(split) != 2 {
+			continue
+		}
+		pod := pods[split[0]]
+		switch split[1] {
+		case "state":
+			pod.State = v
+		case "failure":
+			pod.Failure = v
+		}
+		pods[split[0]] = pod
+	}
+	for name, pod := range pods {
+		if status, ok := scheduled[name]; ok {
+			pod.Namespace = status.Namespace
+			pod.Mark = status.Mark
+		}
+		switch {
+		case pod.Failure != "":
+			pod.Health = proto.PodHealthFailing
+		case pod.State == "done":
+			pod.Health = proto.PodHealthPassing
+		default:
+			pod.Health = proto.PodHealthPending
+		}
+		pods[name] = pod
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.last != nil && reflect.DeepEqual(a.last, pods) {
+		return
+	}
+	a.last = pods
+	a.consumer.ConsumeMessage(bus.NewMessage("", pods))
+	return
+}
+
+// newRunningCountPipe returns pipe which accepts compact pod statuses of all
+// nodes in cluster and propagates "pod.<name>.running_count" variables with
+// number of nodes where pod is passing.
+func newRunningCountPipe(consumer bus.Consumer) (p *bus.FnPipe) {
+	p = bus.NewFnPipe(func(message bus.Message) bus.Message {
+		var nodes map[string]proto.NodePodsStatus
+		if err := message.Payload().Unmarshal(&nodes); err != nil {
+			// undeclared message is ignored downstream
+			return message
+		}
+		counts := map[string]int{}
+		for _, pods := range nodes {
+			for name, pod := range pods {
+				if _, ok := counts[name]; !ok {
+					counts[name] = 0
+				}
+				if pod.Health == proto.PodHealthPassing {
+					counts[name]++
+				}
+			}
+		}
+		variables := map[string]string{}
+		for name, count := range counts {
+			variables[fmt.Sprintf("pod.%s.running_count", name)] = strconv.Itoa(count)
+		}
+		return bus.NewMessage(clusterPodsMessageID, variables)
+	}, consumer)
+	return
+}
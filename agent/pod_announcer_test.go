@@ -0,0 +1,122 @@
+// +build ide test_unit
+
+package agent_test
+
+import (
+	"context"
+	"github.com/akaspin/soil/agent"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/fixture"
+	"github.com/akaspin/soil/proto"
+	"testing"
+)
+
+func TestPodAnnouncer_ConsumeMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cons := bus.NewTestingConsumer(ctx)
+	announcer := agent.NewPodAnnouncer(cons, func() map[string]proto.PodStatus {
+		return map[string]proto.PodStatus{
+			"1": {Namespace: "private", Mark: 1},
+			"2": {Namespace: "public", Mark: 2},
+		}
+	})
+
+	t.Run(`0 health`, func(t *testing.T) {
+		announcer.ConsumeMessage(bus.NewMessage("provision", map[string]string{
+			"1.state":   "done",
+			"2.state":   "done",
+			"2.failure": "failed",
+			"3.state":   "evaluating",
+		}))
+		fixture.WaitNoError10(t, cons.ExpectMessagesFn(
+			bus.NewMessage("", proto.NodePodsStatus{
+				"1": {Namespace: "private", Mark: 1, State: "done", Health: proto.PodHealthPassing},
+				"2": {Namespace: "public", Mark: 2, State: "done", Health: proto.PodHealthFailing, Failure: "failed"},
+				"3": {State: "evaluating", Health: proto.PodHealthPending},
+			}),
+		))
+	})
+	t.Run(`1 same`, func(t *testing.T) {
+		announcer.ConsumeMessage(bus.NewMessage("provision", map[string]string{
+			"1.state":   "done",
+			"2.state":   "done",
+			"2.failure": "failed",
+			"3.state":   "evaluating",
+		}))
+		announcer.ConsumeMessage(bus.NewMessage("provision", map[string]string{
+			"1.state": "done",
+			"3.state": "done",
+		}))
+		fixture.WaitNoError10(t, cons.ExpectMessagesFn(
+			bus.NewMessage("", proto.NodePodsStatus{
+				"1": {Namespace: "private", Mark: 1, State: "done", Health: proto.PodHealthPassing},
+				"2": {Namespace: "public", Mark: 2, State: "done", Health: proto.PodHealthFailing, Failure: "failed"},
+				"3": {State: "evaluating", Health: proto.PodHealthPending},
+			}),
+			bus.NewMessage("", proto.NodePodsStatus{
+				"1": {Namespace: "private", Mark: 1, State: "done", Health: proto.PodHealthPassing},
+				"3": {State: "done", Health: proto.PodHealthPassing},
+			}),
+		))
+	})
+}
+
+func TestRunningCountPipe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cons := bus.NewTestingConsumer(ctx)
+	pipe := agent.NewRunningCountPipe(cons)
+
+	t.Run(`0 count`, func(t *testing.T) {
+		pipe.ConsumeMessage(bus.NewMessage("nodes", map[string]proto.NodePodsStatus{
+			"node-1": {
+				"1": {Health: proto.PodHealthPassing},
+				"2": {Health: proto.PodHealthPassing},
+			},
+			"node-2": {
+				"1": {Health: proto.PodHealthPassing},
+				"2": {Health: proto.PodHealthFailing},
+				"3": {Health: proto.PodHealthPending},
+			},
+		}))
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("cluster_pods", map[string]string{
+				"pod.1.running_count": "2",
+				"pod.2.running_count": "1",
+				"pod.3.running_count": "0",
+			}),
+		))
+	})
+	t.Run(`1 disappeared from node`, func(t *testing.T) {
+		pipe.ConsumeMessage(bus.NewMessage("nodes", map[string]proto.NodePodsStatus{
+			"node-1": {
+				"2": {Health: proto.PodHealthPassing},
+			},
+			"node-2": {
+				"1": {Health: proto.PodHealthPassing},
+				"2": {Health: proto.PodHealthFailing},
+			},
+		}))
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("cluster_pods", map[string]string{
+				"pod.1.running_count": "1",
+				"pod.2.running_count": "1",
+			}),
+		))
+	})
+	t.Run(`2 node left`, func(t *testing.T) {
+		pipe.ConsumeMessage(bus.NewMessage("nodes", map[string]proto.NodePodsStatus{
+			"node-2": {
+				"1": {Health: proto.PodHealthPassing},
+			},
+		}))
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("cluster_pods", map[string]string{
+				"pod.1.running_count": "1",
+			}),
+		))
+	})
+}
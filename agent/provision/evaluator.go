@@ -2,6 +2,7 @@ package provision
 
 import (
 	"context"
+	"fmt"
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent/allocation"
 	"github.com/akaspin/soil/agent/bus"
@@ -120,10 +121,14 @@ func (e *Evaluator) executeEvaluation(evaluation *Evaluation) {
 	e.log.Debugf("plan done: %s:%s (failures:%v)", evaluation, plan, failures)
 	e.log.Infof("evaluation done: %s (failures:%v)", evaluation, failures)
 	if evaluation.Right != nil {
-		e.config.StatusConsumer.ConsumeMessage(bus.NewMessage(name, map[string]string{
+		status := map[string]string{
 			"present": "true",
 			"state":   "done",
-		}))
+		}
+		if len(failures) > 0 {
+			status["failure"] = fmt.Sprint(failures)
+		}
+		e.config.StatusConsumer.ConsumeMessage(bus.NewMessage(name, status))
 	} else {
 		e.config.StatusConsumer.ConsumeMessage(bus.NewMessage(evaluation.Name(), nil))
 	}
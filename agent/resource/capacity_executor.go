@@ -0,0 +1,141 @@
+package resource
+
+import (
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
+	"sync"
+)
+
+// CapacityExecutor allocates amounts from configured total. Executor
+// publishes "__total", "__allocated" and "__free" values.
+type CapacityExecutor struct {
+	log      *logx.Log
+	consumer bus.Consumer
+	total    int64
+
+	mu          sync.Mutex
+	allocated   int64
+	allocations map[string]capacityExecutorAllocation
+}
+
+func NewCapacityExecutor(log *logx.Log, config Config, consumer bus.Consumer) (e *CapacityExecutor) {
+	e = &CapacityExecutor{
+		log:         log,
+		consumer:    consumer,
+		allocations: map[string]capacityExecutorAllocation{},
+	}
+	if v, ok := config.Properties["total"]; ok {
+		var err error
+		if e.total, err = parseAmount(v); err != nil {
+			e.log.Errorf(`bad total: %v`, err)
+		}
+	}
+	e.log.Debugf("started: total:%d", e.total)
+	e.notifyTotals()
+	return
+}
+
+func (e *CapacityExecutor) Close() error {
+	return nil
+}
+
+// Capacity returns configured total and allocated amount
+func (e *CapacityExecutor) Capacity() (res proto.ResourceCapacity) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	res = proto.ResourceCapacity{
+		Total:     e.total,
+		Allocated: e.allocated,
+		Free:      e.total - e.allocated,
+	}
+	return
+}
+
+func (e *CapacityExecutor) Allocate(request Alloc) {
+	e.log.Tracef(`request: %v`, request)
+	id := request.GetID()
+	amount, err := parseAmount(request.Request.Config["amount"])
+	if err != nil {
+		err = fmt.Errorf(`bad amount: %v`, err)
+	}
+	go func(id string, amount int64, err error) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if state, ok := e.allocations[id]; ok {
+			if state.failure == nil {
+				if state.amount == amount {
+					e.log.Tracef(`already allocated: %s:%v`, id, state)
+					return
+				}
+				e.allocated -= state.amount
+			}
+		}
+		if err != nil {
+			e.notify(id, capacityExecutorAllocation{amount: amount, failure: err})
+			e.notifyTotals()
+			return
+		}
+		e.allocateAmount(id, amount)
+		e.notifyTotals()
+	}(id, amount, err)
+}
+
+func (e *CapacityExecutor) Deallocate(id string) {
+	go func(id string) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if state, ok := e.allocations[id]; ok {
+			if state.failure == nil {
+				e.allocated -= state.amount
+			}
+			delete(e.allocations, id)
+			e.log.Debugf(`deallocated: %s:%v`, id, state)
+			e.consumer.ConsumeMessage(bus.NewMessage(id, nil))
+			for allocatedId, allocation := range e.allocations {
+				if allocation.failure == executorNotAvailableError {
+					e.allocateAmount(allocatedId, allocation.amount)
+				}
+			}
+			e.notifyTotals()
+			return
+		}
+		e.log.Tracef(`deallocate: not found: %s`, id)
+	}(id)
+}
+
+func (e *CapacityExecutor) allocateAmount(id string, amount int64) {
+	if e.allocated+amount > e.total {
+		e.notify(id, capacityExecutorAllocation{
+			amount:  amount,
+			failure: executorNotAvailableError,
+		})
+		return
+	}
+	e.allocated += amount
+	e.notify(id, capacityExecutorAllocation{
+		amount: amount,
+	})
+}
+
+func (e *CapacityExecutor) notify(id string, state capacityExecutorAllocation) {
+	e.allocations[id] = state
+	e.log.Debugf(`allocated %s:%d (failure:%v)`, id, state.amount, state.failure)
+	e.consumer.ConsumeMessage(NewExecutorMessage(id, state.failure, map[string]string{
+		"amount": fmt.Sprintf("%d", state.amount),
+	}))
+}
+
+func (e *CapacityExecutor) notifyTotals() {
+	e.consumer.ConsumeMessage(bus.NewMessage("", map[string]string{
+		"__total":     fmt.Sprintf("%d", e.total),
+		"__allocated": fmt.Sprintf("%d", e.allocated),
+		"__free":      fmt.Sprintf("%d", e.total-e.allocated),
+	}))
+}
+
+type capacityExecutorAllocation struct {
+	amount  int64
+	failure error
+}
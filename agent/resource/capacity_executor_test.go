@@ -0,0 +1,90 @@
+// +build ide test_unit
+
+package resource_test
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/resource"
+	"github.com/akaspin/soil/fixture"
+	"github.com/akaspin/soil/manifest"
+	"testing"
+	"time"
+)
+
+func TestCapacityExecutor_Allocate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cons := bus.NewTestingConsumer(ctx)
+	executor := resource.NewCapacityExecutor(logx.GetLog("test"), resource.Config{
+		Nature: "capacity",
+		Kind:   "memory",
+		Properties: map[string]interface{}{
+			"total": 1024,
+		},
+	}, cons)
+	totals := func(allocated, free string) bus.Message {
+		return bus.NewMessage("", map[string]string{
+			"__total":     "1024",
+			"__allocated": allocated,
+			"__free":      free,
+		})
+	}
+	allocate := func(name string, amount interface{}) {
+		executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{
+				Kind:   "memory",
+				Name:   name,
+				Config: map[string]interface{}{"amount": amount},
+			},
+		})
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	t.Run("0 allocate", func(t *testing.T) {
+		allocate("a", 512)
+		allocate("b", "256")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+			totals("0", "1024"),
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "amount": "512"}),
+			totals("512", "512"),
+			bus.NewMessage("1.b", map[string]string{"allocated": "true", "amount": "256"}),
+			totals("768", "256"),
+		))
+	})
+	t.Run("1 over-request", func(t *testing.T) {
+		allocate("c", 512)
+		allocate("bad", nil)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+			totals("0", "1024"),
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "amount": "512"}),
+			totals("512", "512"),
+			bus.NewMessage("1.b", map[string]string{"allocated": "true", "amount": "256"}),
+			totals("768", "256"),
+			bus.NewMessage("1.c", map[string]string{"allocated": "false", "failure": "not-available"}),
+			totals("768", "256"),
+			bus.NewMessage("1.bad", map[string]string{"allocated": "false", "failure": "bad amount: not defined"}),
+			totals("768", "256"),
+		))
+	})
+	t.Run("2 deallocate", func(t *testing.T) {
+		executor.Deallocate("1.a")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+			totals("0", "1024"),
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "amount": "512"}),
+			totals("512", "512"),
+			bus.NewMessage("1.b", map[string]string{"allocated": "true", "amount": "256"}),
+			totals("768", "256"),
+			bus.NewMessage("1.c", map[string]string{"allocated": "false", "failure": "not-available"}),
+			totals("768", "256"),
+			bus.NewMessage("1.bad", map[string]string{"allocated": "false", "failure": "bad amount: not defined"}),
+			totals("768", "256"),
+			bus.NewMessage("1.a", nil),
+			bus.NewMessage("1.c", map[string]string{"allocated": "true", "amount": "512"}),
+			totals("768", "256"),
+		))
+	})
+}
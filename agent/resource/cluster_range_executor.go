@@ -0,0 +1,424 @@
+package resource
+
+import (
+	"context"
+	"fmt"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/cluster"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maximum number of failed claims for one allocation
+	clusterRangeMaxAttempts = 8
+
+	// maximum number of values in block. Each value takes two operations
+	// in Consul transaction which is limited to 64 operations.
+	clusterRangeMaxCount = 32
+
+	defaultClusterRangeRetryInterval = time.Second * 5
+)
+
+// ClusterRangeExecutor allocates integers unique across all agents in
+// cluster. Each allocated value is claimed in cluster KV with compare-and-set
+// under "resource/<kind>/<value>" key bound to node TTL. Requests accept same
+// "value", "count", "min" and "max" properties as "range" executor.
+// Allocations failed due cluster errors are retried after "retry_interval".
+// Count of values in block is limited to 32.
+type ClusterRangeExecutor struct {
+	ctx           context.Context
+	cancel        context.CancelFunc
+	log           *logx.Log
+	consumer      bus.Consumer
+	kv            ClusterKV
+	prefix        string
+	min           uint32
+	max           uint32
+	retryInterval time.Duration
+	wakeChan      chan struct{}
+
+	claimedMu sync.Mutex
+	claimed   map[uint32]clusterRangeOwner // claims in cluster
+
+	mu          sync.Mutex
+	retryTimer  *time.Timer
+	state       *roaring.Bitmap   // values allocated by executor
+	releases    map[uint32]string // values failed to release in cluster
+	allocations map[string]rangeExecutorAllocation
+}
+
+func NewClusterRangeExecutor(ctx context.Context, log *logx.Log, evaluatorConfig EvaluatorConfig, config Config, consumer bus.Consumer) (e *ClusterRangeExecutor) {
+	e = &ClusterRangeExecutor{
+		log:           log,
+		consumer:      consumer,
+		kv:            evaluatorConfig.ClusterKV,
+		prefix:        cluster.NormalizeKey("resource", config.Kind),
+		max:           ^uint32(0),
+		retryInterval: defaultClusterRangeRetryInterval,
+		wakeChan:      make(chan struct{}, 1),
+		claimed:       map[uint32]clusterRangeOwner{},
+		state:         roaring.New(),
+		releases:      map[uint32]string{},
+		allocations:   map[string]rangeExecutorAllocation{},
+	}
+	e.ctx, e.cancel = context.WithCancel(ctx)
+	if v, ok := config.Properties["min"]; ok {
+		e.min = uint32(v.(int))
+	}
+	if v, ok := config.Properties["max"]; ok {
+		e.max = uint32(v.(int))
+	}
+	if v, ok := config.Properties["retry_interval"]; ok {
+		var err error
+		if e.retryInterval, err = parseDuration(v); err != nil || e.retryInterval == 0 {
+			e.log.Errorf(`bad retry_interval: %v`, v)
+			e.retryInterval = defaultClusterRangeRetryInterval
+		}
+	}
+	if e.kv == nil {
+		e.log.Error(`cluster KV is not defined`)
+		return
+	}
+	e.kv.SubscribeKey(e.prefix, e.ctx, bus.NewFnPipe(func(message bus.Message) bus.Message {
+		e.handleClaims(message)
+		return message
+	}))
+	go e.loop()
+	e.log.Debugf("started: min:%d max:%d prefix:%s", e.min, e.max, e.prefix)
+	return
+}
+
+func (e *ClusterRangeExecutor) Close() error {
+	e.cancel()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.retryTimer != nil {
+		e.retryTimer.Stop()
+	}
+	return nil
+}
+
+func (e *ClusterRangeExecutor) Allocate(request Alloc) {
+	e.log.Tracef(`request: %v`, request)
+	var value uint32
+	var recovered bool
+	id := request.GetID()
+
+	req, reqErr := parseRangeRequest(e.min, e.max, request.Request.Config)
+	if reqErr == nil && req.count > clusterRangeMaxCount {
+		reqErr = fmt.Errorf(`bad count: %d is greater than %d`, req.count, clusterRangeMaxCount)
+	}
+
+	var valuesChunk map[string]string
+	if errU := request.Values.Payload().Unmarshal(&valuesChunk); errU == nil && reqErr == nil {
+		if val, ok := valuesChunk["value"]; ok {
+			if parsed, err := strconv.ParseUint(val, 10, 32); err == nil && req.fits(uint32(parsed)) {
+				value = uint32(parsed)
+				recovered = true
+				e.log.Tracef(`recovered value: %s:%d`, id, value)
+			}
+		}
+	}
+	go func(id string, value uint32, recovered bool) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if state, ok := e.allocations[id]; ok {
+			if state.failure == nil {
+				if state.request == req {
+					e.log.Tracef(`already allocated: %s:%v`, id, state)
+					return
+				}
+				e.release(id, state)
+				if reqErr == nil && req.fits(state.value) {
+					value = state.value
+					recovered = true
+				}
+			}
+		}
+		if reqErr != nil {
+			e.notify(id, rangeExecutorAllocation{
+				request: req,
+				failure: reqErr,
+			})
+			return
+		}
+		e.allocateValue(id, req, value, recovered)
+	}(id, value, recovered)
+}
+
+func (e *ClusterRangeExecutor) Deallocate(id string) {
+	go func(id string) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		state, ok := e.allocations[id]
+		if !ok {
+			e.log.Tracef(`deallocate: not found: %s`, id)
+			return
+		}
+		if state.failure == nil {
+			e.release(id, state)
+		}
+		delete(e.allocations, id)
+		e.log.Debugf(`deallocated: %s:%v`, id, state)
+		e.consumer.ConsumeMessage(bus.NewMessage(id, nil))
+		e.retryFailed()
+	}(id)
+}
+
+// handleClaims accepts actual claims from cluster and wakes loop to retry
+// failed allocations. handleClaims is called by KV watch and never blocks on
+// cluster operations.
+func (e *ClusterRangeExecutor) handleClaims(message bus.Message) {
+	var raw map[string]clusterRangeOwner
+	if err := message.Payload().Unmarshal(&raw); err != nil {
+		e.log.Error(err)
+		return
+	}
+	claimed := map[uint32]clusterRangeOwner{}
+	for k, owner := range raw {
+		value, err := strconv.ParseUint(k, 10, 32)
+		if err != nil {
+			e.log.Warningf(`bad claim %s: %v`, k, err)
+			continue
+		}
+		claimed[uint32(value)] = owner
+	}
+	e.claimedMu.Lock()
+	e.claimed = claimed
+	e.claimedMu.Unlock()
+	e.log.Tracef(`claims updated: %d`, len(claimed))
+	e.wake()
+}
+
+func (e *ClusterRangeExecutor) wake() {
+	select {
+	case e.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// loop retries failed allocations on wake
+func (e *ClusterRangeExecutor) loop() {
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-e.wakeChan:
+			e.mu.Lock()
+			e.retryFailed()
+			e.mu.Unlock()
+		}
+	}
+}
+
+// scheduleRetry retries failed allocations after retry interval
+func (e *ClusterRangeExecutor) scheduleRetry() {
+	if e.retryTimer != nil {
+		return
+	}
+	e.retryTimer = time.AfterFunc(e.retryInterval, func() {
+		e.mu.Lock()
+		e.retryTimer = nil
+		e.mu.Unlock()
+		e.log.Trace(`retrying failed allocations`)
+		e.wake()
+	})
+}
+
+func (e *ClusterRangeExecutor) retryFailed() {
+	for value, id := range e.releases {
+		ok, err := e.kv.CAS(e.ctx, e.ops(value, 1, nil, e.expect(id)))
+		if err != nil {
+			e.scheduleRetry()
+			continue
+		}
+		if !ok {
+			e.log.Debugf(`value %d is not claimed by %s`, value, id)
+		}
+		delete(e.releases, value)
+	}
+	for id, allocation := range e.allocations {
+		if allocation.failure != nil && allocation.retry {
+			e.allocateValue(id, allocation.request, 0, false)
+		}
+	}
+}
+
+func (e *ClusterRangeExecutor) allocateValue(id string, req rangeRequest, preferred uint32, hasPreferred bool) {
+	if e.kv == nil {
+		e.notify(id, rangeExecutorAllocation{
+			request: req,
+			failure: fmt.Errorf(`cluster KV is not defined`),
+		})
+		return
+	}
+	var candidates []uint32
+	switch {
+	case req.pinned:
+		candidates = []uint32{req.value}
+	case hasPreferred:
+		candidates = []uint32{preferred}
+	}
+	var attempts int
+	try := func(candidate uint32) (done bool) {
+		ok, err := e.claim(id, candidate, req.count)
+		if err != nil {
+			e.notify(id, rangeExecutorAllocation{request: req, failure: err, retry: true})
+			e.scheduleRetry()
+			return true
+		}
+		if ok {
+			e.state.AddRange(uint64(candidate), uint64(candidate)+uint64(req.count))
+			for i := uint64(candidate); i < uint64(candidate)+uint64(req.count); i++ {
+				delete(e.releases, uint32(i))
+			}
+			e.notify(id, rangeExecutorAllocation{request: req, value: candidate})
+			return true
+		}
+		attempts++
+		return false
+	}
+	for _, candidate := range candidates {
+		if try(candidate) {
+			return
+		}
+	}
+	if req.pinned {
+		e.notify(id, rangeExecutorAllocation{
+			request: req,
+			failure: fmt.Errorf(`%s is allocated in cluster`, req.describe(req.value)),
+			retry:   true,
+		})
+		return
+	}
+	candidate := uint64(req.min)
+	for candidate+uint64(req.count)-1 <= uint64(req.max) && attempts < clusterRangeMaxAttempts {
+		if conflict, found := e.findConflict(id, uint32(candidate), req.count); found {
+			candidate = uint64(conflict) + 1
+			continue
+		}
+		if try(uint32(candidate)) {
+			return
+		}
+		candidate++
+	}
+	e.notify(id, rangeExecutorAllocation{
+		request: req,
+		failure: executorNotAvailableError,
+		retry:   true,
+	})
+}
+
+// findConflict returns first value in block allocated locally or claimed
+// by other allocation in cluster
+func (e *ClusterRangeExecutor) findConflict(id string, first, count uint32) (res uint32, found bool) {
+	owner := e.owner(id)
+	e.claimedMu.Lock()
+	defer e.claimedMu.Unlock()
+	for i := uint64(first); i < uint64(first)+uint64(count); i++ {
+		if e.state.Contains(uint32(i)) {
+			return uint32(i), true
+		}
+		if claim, ok := e.claimed[uint32(i)]; ok && claim != owner {
+			return uint32(i), true
+		}
+	}
+	return
+}
+
+// claim claims block in cluster. Block already claimed by allocation is
+// claimed again.
+func (e *ClusterRangeExecutor) claim(id string, first, count uint32) (ok bool, err error) {
+	value := e.owner(id).payload()
+	if ok, err = e.kv.CAS(e.ctx, e.ops(first, count, value, nil)); err != nil || ok {
+		return
+	}
+	ok, err = e.kv.CAS(e.ctx, e.ops(first, count, value, e.expect(id)))
+	return
+}
+
+// release releases block in cluster. Values failed to release due cluster
+// errors are released on retry.
+func (e *ClusterRangeExecutor) release(id string, state rangeExecutorAllocation) {
+	e.state.RemoveRange(uint64(state.value), uint64(state.value)+uint64(state.request.count))
+	ok, err := e.kv.CAS(e.ctx, e.ops(state.value, state.request.count, nil, e.expect(id)))
+	if err != nil {
+		e.log.Warningf(`can't release %s:%s in cluster: %v`, id, state.request.describe(state.value), err)
+		for i := uint64(state.value); i < uint64(state.value)+uint64(state.request.count); i++ {
+			e.releases[uint32(i)] = id
+		}
+		e.scheduleRetry()
+		return
+	}
+	if !ok {
+		e.log.Warningf(`%s:%s is not claimed in cluster`, id, state.request.describe(state.value))
+	}
+}
+
+func (e *ClusterRangeExecutor) ops(first, count uint32, value interface{}, expect *bus.Payload) (res []cluster.CASOp) {
+	for i := uint64(first); i < uint64(first)+uint64(count); i++ {
+		res = append(res, cluster.CASOp{
+			Message: bus.NewMessage(cluster.NormalizeKey(e.prefix, strconv.FormatUint(i, 10)), value),
+			Expect:  expect,
+			WithTTL: true,
+		})
+	}
+	return
+}
+
+// expect returns expectation of value claimed by allocation
+func (e *ClusterRangeExecutor) expect(id string) (res *bus.Payload) {
+	payload := e.owner(id).payload()
+	res = &payload
+	return
+}
+
+func (e *ClusterRangeExecutor) owner(id string) (res clusterRangeOwner) {
+	res = clusterRangeOwner{
+		Node: e.kv.NodeID(),
+		ID:   id,
+	}
+	return
+}
+
+func (e *ClusterRangeExecutor) notify(id string, state rangeExecutorAllocation) {
+	prev, exists := e.allocations[id]
+	e.allocations[id] = state
+	if exists && prev.failure != nil && state.failure != nil && prev.request == state.request && prev.failure.Error() == state.failure.Error() {
+		// retries shouldn't flood consumer with same failures
+		return
+	}
+	e.log.Debugf(`allocated %s:%d (failure:%v)`, id, state.value, state.failure)
+	values := map[string]string{
+		"value": fmt.Sprintf("%d", state.value),
+	}
+	if state.request.count > 1 {
+		var block []string
+		for i := uint64(state.value); i < uint64(state.value)+uint64(state.request.count); i++ {
+			block = append(block, fmt.Sprintf("%d", i))
+		}
+		values["values"] = strings.Join(block, ",")
+		values["first"] = block[0]
+		values["last"] = block[len(block)-1]
+	}
+	e.consumer.ConsumeMessage(NewExecutorMessage(id, state.failure, values))
+}
+
+// clusterRangeOwner is value of claimed key
+type clusterRangeOwner struct {
+	Node string `json:"node"`
+	ID   string `json:"id"`
+}
+
+func (o clusterRangeOwner) payload() (res bus.Payload) {
+	res = bus.NewPayload(map[string]string{
+		"node": o.Node,
+		"id":   o.ID,
+	})
+	return
+}
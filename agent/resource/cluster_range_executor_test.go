@@ -0,0 +1,279 @@
+// +build ide test_unit
+
+package resource_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/cluster"
+	"github.com/akaspin/soil/agent/resource"
+	"github.com/akaspin/soil/fixture"
+	"github.com/akaspin/soil/manifest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testingClusterStore is in-memory CAS storage shared by testing nodes
+type testingClusterStore struct {
+	mu          sync.Mutex
+	ready       bool
+	data        map[string]interface{}
+	subscribers []testingClusterSubscriber
+}
+
+type testingClusterSubscriber struct {
+	key      string
+	ctx      context.Context
+	consumer bus.Consumer
+}
+
+func newTestingClusterStore() (s *testingClusterStore) {
+	s = &testingClusterStore{
+		ready: true,
+		data:  map[string]interface{}{},
+	}
+	return
+}
+
+func (s *testingClusterStore) setReady(ready bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ready = ready
+}
+
+func (s *testingClusterStore) node(id string) (res *testingClusterKV) {
+	res = &testingClusterKV{
+		id:    id,
+		store: s,
+	}
+	return
+}
+
+// broadcast sends actual data to subscribers synchronously like KV watch
+func (s *testingClusterStore) broadcast() {
+	for _, sub := range s.subscribers {
+		select {
+		case <-sub.ctx.Done():
+			continue
+		default:
+		}
+		payload := map[string]interface{}{}
+		for k, v := range s.data {
+			if strings.HasPrefix(k, sub.key+"/") {
+				payload[strings.TrimPrefix(k, sub.key+"/")] = v
+			}
+		}
+		sub.consumer.ConsumeMessage(bus.NewMessage(sub.key, payload))
+	}
+}
+
+type testingClusterKV struct {
+	id    string
+	store *testingClusterStore
+}
+
+func (k *testingClusterKV) NodeID() string {
+	return k.id
+}
+
+func (k *testingClusterKV) CAS(ctx context.Context, ops []cluster.CASOp) (ok bool, err error) {
+	k.store.mu.Lock()
+	defer k.store.mu.Unlock()
+	if !k.store.ready {
+		err = cluster.ErrNotReady
+		return
+	}
+	for _, op := range ops {
+		current, exists := k.store.data[op.Message.GetID()]
+		if op.Expect == nil && exists {
+			return
+		}
+		if op.Expect != nil {
+			if !exists {
+				return
+			}
+			var expect interface{}
+			if err = op.Expect.Unmarshal(&expect); err != nil || !reflect.DeepEqual(current, expect) {
+				return
+			}
+		}
+	}
+	for _, op := range ops {
+		if op.Message.Payload().IsEmpty() {
+			delete(k.store.data, op.Message.GetID())
+			continue
+		}
+		var value interface{}
+		if err = op.Message.Payload().Unmarshal(&value); err != nil {
+			return
+		}
+		k.store.data[op.Message.GetID()] = value
+	}
+	ok = true
+	k.store.broadcast()
+	return
+}
+
+func (k *testingClusterKV) SubscribeKey(key string, ctx context.Context, consumer bus.Consumer) {
+	k.store.mu.Lock()
+	defer k.store.mu.Unlock()
+	k.store.subscribers = append(k.store.subscribers, testingClusterSubscriber{
+		key:      key,
+		ctx:      ctx,
+		consumer: consumer,
+	})
+}
+
+func TestClusterRangeExecutor(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := newTestingClusterStore()
+	config := resource.Config{
+		Nature: "cluster_range",
+		Kind:   "port",
+		Properties: map[string]interface{}{
+			"min":            8000,
+			"max":            8003,
+			"retry_interval": "100ms",
+		},
+	}
+	consA := bus.NewTestingConsumer(ctx)
+	executorA := resource.NewClusterRangeExecutor(ctx, logx.GetLog("test"), resource.EvaluatorConfig{
+		ClusterKV: store.node("a"),
+	}, config, consA)
+	defer executorA.Close()
+	consB := bus.NewTestingConsumer(ctx)
+	executorB := resource.NewClusterRangeExecutor(ctx, logx.GetLog("test"), resource.EvaluatorConfig{
+		ClusterKV: store.node("b"),
+	}, config, consB)
+	defer executorB.Close()
+
+	allocate := func(executor *resource.ClusterRangeExecutor, pod, name string, config map[string]interface{}, values map[string]string) {
+		executor.Allocate(resource.Alloc{
+			PodName: pod,
+			Request: manifest.Resource{Kind: "port", Name: name, Config: config},
+			Values:  bus.NewMessage(pod+"."+name, values),
+		})
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	t.Run("0 allocate", func(t *testing.T) {
+		allocate(executorA, "1", "a", nil, nil)
+		allocate(executorB, "2", "b", nil, nil)
+		allocate(executorB, "2", "pinned", map[string]interface{}{"value": 8000}, nil)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), consA.ExpectMessagesFn(
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "8000"}),
+		))
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), consB.ExpectMessagesFn(
+			bus.NewMessage("2.b", map[string]string{"allocated": "true", "value": "8001"}),
+			bus.NewMessage("2.pinned", map[string]string{"allocated": "false", "failure": "value 8000 is allocated in cluster"}),
+		))
+	})
+	t.Run("1 recover", func(t *testing.T) {
+		allocate(executorA, "1", "recovered", nil, map[string]string{"allocated": "true", "value": "8003"})
+		allocate(executorA, "1", "conflict", nil, map[string]string{"allocated": "true", "value": "8001"})
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), consA.ExpectMessagesFn(
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "8000"}),
+			bus.NewMessage("1.recovered", map[string]string{"allocated": "true", "value": "8003"}),
+			bus.NewMessage("1.conflict", map[string]string{"allocated": "true", "value": "8002"}),
+		))
+	})
+	t.Run("2 deallocate", func(t *testing.T) {
+		executorA.Deallocate("1.a")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), consA.ExpectMessagesFn(
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "8000"}),
+			bus.NewMessage("1.recovered", map[string]string{"allocated": "true", "value": "8003"}),
+			bus.NewMessage("1.conflict", map[string]string{"allocated": "true", "value": "8002"}),
+			bus.NewMessage("1.a", nil),
+		))
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), consB.ExpectMessagesFn(
+			bus.NewMessage("2.b", map[string]string{"allocated": "true", "value": "8001"}),
+			bus.NewMessage("2.pinned", map[string]string{"allocated": "false", "failure": "value 8000 is allocated in cluster"}),
+			bus.NewMessage("2.pinned", map[string]string{"allocated": "true", "value": "8000"}),
+		))
+	})
+	t.Run("3 not ready", func(t *testing.T) {
+		executorA.Deallocate("1.recovered")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), consA.ExpectLastMessageFn(
+			bus.NewMessage("1.recovered", nil),
+		))
+		store.setReady(false)
+		executorA.Deallocate("1.conflict")
+		allocate(executorB, "2", "c", nil, nil)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), consA.ExpectLastMessageFn(
+			bus.NewMessage("1.conflict", nil),
+		))
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), consB.ExpectLastMessageFn(
+			bus.NewMessage("2.c", map[string]string{"allocated": "false", "failure": "cluster backend is not ready"}),
+		))
+		store.setReady(true)
+
+		// 8002 is released on retry
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), func() error {
+			store.mu.Lock()
+			defer store.mu.Unlock()
+			if _, ok := store.data["resource/port/8002"]; ok {
+				return fmt.Errorf(`8002 is not released`)
+			}
+			return nil
+		})
+		// 8002 or 8003 depends on order of retries
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), func() (err error) {
+			if err = consB.ExpectLastMessageFn(
+				bus.NewMessage("2.c", map[string]string{"allocated": "true", "value": "8003"}),
+			)(); err == nil {
+				return
+			}
+			return consB.ExpectLastMessageFn(
+				bus.NewMessage("2.c", map[string]string{"allocated": "true", "value": "8002"}),
+			)()
+		})
+	})
+}
+
+func TestClusterRangeExecutor_Count(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := newTestingClusterStore()
+	cons := bus.NewTestingConsumer(ctx)
+	executor := resource.NewClusterRangeExecutor(ctx, logx.GetLog("test"), resource.EvaluatorConfig{
+		ClusterKV: store.node("a"),
+	}, resource.Config{
+		Nature: "cluster_range",
+		Kind:   "port",
+		Properties: map[string]interface{}{
+			"min": 8000,
+			"max": 8100,
+		},
+	}, cons)
+	defer executor.Close()
+
+	executor.Allocate(resource.Alloc{
+		PodName: "1",
+		Request: manifest.Resource{Kind: "port", Name: "large", Config: map[string]interface{}{"count": 33}},
+		Values:  bus.NewMessage("1.large", nil),
+	})
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+		bus.NewMessage("1.large", map[string]string{"allocated": "false", "failure": "bad count: 33 is greater than 32"}),
+	))
+	executor.Allocate(resource.Alloc{
+		PodName: "1",
+		Request: manifest.Resource{Kind: "port", Name: "large", Config: map[string]interface{}{"count": 32}},
+		Values:  bus.NewMessage("1.large", nil),
+	})
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), func() (err error) {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		if len(store.data) != 32 {
+			err = fmt.Errorf(`claimed: %d`, len(store.data))
+		}
+		return
+	})
+}
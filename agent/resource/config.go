@@ -2,7 +2,10 @@ package resource
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/cluster"
 	"github.com/hashicorp/hcl"
 	"github.com/hashicorp/hcl/hcl/ast"
 	"github.com/mitchellh/hashstructure"
@@ -11,6 +14,15 @@ import (
 
 // Static external configuration propagated to all workers and executors
 type EvaluatorConfig struct {
+	StateDir  string    // Directory to persist executor state. State is not persisted if empty
+	ClusterKV ClusterKV // Cluster storage for cluster-wide executors
+}
+
+// ClusterKV is cluster key-value storage
+type ClusterKV interface {
+	NodeID() string
+	CAS(ctx context.Context, ops []cluster.CASOp) (ok bool, err error)
+	SubscribeKey(key string, ctx context.Context, consumer bus.Consumer)
 }
 
 // Config represents one resource in Agent configuration
@@ -2,11 +2,15 @@ package resource
 
 import (
 	"context"
+	"fmt"
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent/allocation"
 	"github.com/akaspin/soil/agent/bus"
 	"github.com/akaspin/soil/manifest"
+	"github.com/akaspin/soil/proto"
 	"github.com/akaspin/supervisor"
+	"strings"
+	"sync"
 )
 
 // Resource evaluator
@@ -21,11 +25,17 @@ type Evaluator struct {
 	workers      map[string]*Worker
 	dirtyWorkers map[string]struct{}
 	cache        map[string]bus.Message
+	natures      map[string]string
+
+	statusMu sync.Mutex
+	status   map[string]proto.ResourceWorkerStatus
 
 	configChan     chan []Config
 	allocateChan   chan *manifest.Pod
 	deallocateChan chan string
 	messageChan    chan bus.Message
+	rotateChan     chan rotateRequest
+	inventoryChan  chan chan map[string]proto.ResourceInventory
 }
 
 func NewEvaluator(ctx context.Context, log *logx.Log, workerConfig EvaluatorConfig, state allocation.Recovery, downstream, upstream bus.Consumer) (e *Evaluator) {
@@ -39,11 +49,15 @@ func NewEvaluator(ctx context.Context, log *logx.Log, workerConfig EvaluatorConf
 		workers:      map[string]*Worker{},
 		dirtyWorkers: map[string]struct{}{},
 		cache:        map[string]bus.Message{},
+		natures:      map[string]string{},
+		status:       map[string]proto.ResourceWorkerStatus{},
 
 		configChan:     make(chan []Config),
 		allocateChan:   make(chan *manifest.Pod),
 		deallocateChan: make(chan string),
 		messageChan:    make(chan bus.Message),
+		rotateChan:     make(chan rotateRequest),
+		inventoryChan:  make(chan chan map[string]proto.ResourceInventory),
 	}
 	byKind := map[string][]Alloc{}
 	for _, alloc := range state {
@@ -59,8 +73,14 @@ func NewEvaluator(ctx context.Context, log *logx.Log, workerConfig EvaluatorConf
 	for name, a := range byKind {
 		e.workers[name] = NewWorker(e.Control.Ctx(), e.log, name, e, e.evaluatorConfig, a)
 		e.dirtyWorkers[name] = struct{}{}
-		e.log.Debugf(`worker "%s" created: %v`, name, a)
+		// recovered values may contain secrets: log only IDs
+		var ids []string
+		for _, alloc := range a {
+			ids = append(ids, alloc.GetID())
+		}
+		e.log.Debugf(`worker "%s" created: %v`, name, ids)
 	}
+	e.updateStatus()
 	return
 }
 
@@ -102,6 +122,46 @@ func (e *Evaluator) Configure(configs Configs) {
 	}
 }
 
+// Status returns actual states of resource workers by kind
+func (e *Evaluator) Status() (res map[string]proto.ResourceWorkerStatus) {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	res = make(map[string]proto.ResourceWorkerStatus, len(e.status))
+	for k, v := range e.status {
+		res[k] = v
+	}
+	return
+}
+
+// Rotate regenerates values of allocated resource with given kind and id
+// "<pod>.<resource>". Resource nature should support rotation.
+func (e *Evaluator) Rotate(kind, id string) (err error) {
+	req := newRotateRequest(kind, id)
+	select {
+	case <-e.Control.Ctx().Done():
+		err = e.Control.Ctx().Err()
+		return
+	case e.rotateChan <- req:
+	}
+	err = req.wait(e.Control.Ctx())
+	return
+}
+
+// Inventory returns inventories of all resource workers by kind
+func (e *Evaluator) Inventory() (res map[string]proto.ResourceInventory) {
+	resChan := make(chan map[string]proto.ResourceInventory, 1)
+	select {
+	case <-e.Control.Ctx().Done():
+		return
+	case e.inventoryChan <- resChan:
+	}
+	select {
+	case <-e.Control.Ctx().Done():
+	case res = <-resChan:
+	}
+	return
+}
+
 // Consume message from worker
 func (e *Evaluator) ConsumeMessage(message bus.Message) (err error) {
 	e.log.Tracef("message consumed: %v", message)
@@ -133,10 +193,45 @@ func (e *Evaluator) loop() {
 		case message := <-e.messageChan:
 			log.Tracef("message: %v", message)
 			e.handleMessage(message)
+		case req := <-e.rotateChan:
+			log.Tracef("rotate: %s:%s", req.kind, req.id)
+			e.handleRotate(req)
+		case resChan := <-e.inventoryChan:
+			e.handleInventory(resChan)
 		}
 	}
 }
 
+func (e *Evaluator) handleRotate(req rotateRequest) {
+	worker, ok := e.workers[req.kind]
+	if !ok {
+		req.resChan <- fmt.Errorf(`resource kind %s not found`, req.kind)
+		return
+	}
+	go func() {
+		req.resChan <- worker.Rotate(req.id)
+	}()
+}
+
+func (e *Evaluator) handleInventory(resChan chan map[string]proto.ResourceInventory) {
+	workers := make(map[string]*Worker, len(e.workers))
+	for kind, worker := range e.workers {
+		workers[kind] = worker
+	}
+	go func() {
+		res := map[string]proto.ResourceInventory{}
+		for kind, worker := range workers {
+			inventory, err := worker.Inventory()
+			if err != nil {
+				e.log.Warningf(`can't get inventory of "%s": %v`, kind, err)
+				continue
+			}
+			res[kind] = inventory
+		}
+		resChan <- res
+	}()
+}
+
 func (e *Evaluator) handleMessage(message bus.Message) {
 	kind := message.GetID()
 	if _, ok := e.workers[kind]; !ok {
@@ -145,9 +240,42 @@ func (e *Evaluator) handleMessage(message bus.Message) {
 	}
 	delete(e.dirtyWorkers, kind)
 	e.cache[kind] = message
+	e.updateStatus()
 	e.notify()
 }
 
+// updateStatus updates worker states from cached worker messages
+func (e *Evaluator) updateStatus() {
+	status := map[string]proto.ResourceWorkerStatus{}
+	for kind := range e.workers {
+		_, dirty := e.dirtyWorkers[kind]
+		workerStatus := proto.ResourceWorkerStatus{
+			Nature: e.natures[kind],
+			Dirty:  dirty,
+		}
+		if message, ok := e.cache[kind]; ok {
+			var chunk map[string]string
+			if err := message.Payload().Unmarshal(&chunk); err != nil {
+				e.log.Error(err)
+			}
+			for k, v := range chunk {
+				if !strings.HasSuffix(k, ".allocated") {
+					continue
+				}
+				if v == "true" {
+					workerStatus.Allocated++
+					continue
+				}
+				workerStatus.Failed++
+			}
+		}
+		status[kind] = workerStatus
+	}
+	e.statusMu.Lock()
+	e.status = status
+	e.statusMu.Unlock()
+}
+
 func (e *Evaluator) notify() {
 	if len(e.dirtyWorkers) > 0 {
 		e.log.Tracef(`skip update: %d workers are dirty`, len(e.dirtyWorkers))
@@ -181,21 +309,24 @@ func (e *Evaluator) handleConfigs(configs []Config) {
 			delete(e.workers, k)
 			delete(e.dirtyWorkers, k)
 			delete(e.cache, k)
+			delete(e.natures, k)
 			e.log.Infof(`removed worker: %s`, k)
 		}
 	}
 	for name, config := range byName {
+		e.natures[name] = config.Nature
 		if w, ok := e.workers[name]; ok {
 			e.log.Debugf(`sending config to worker "%s": %v"`, name, config)
 			w.Configure(config)
 			continue
 		}
 
-		e.workers[name] = NewWorker(e.Control.Ctx(), e.log, name, e, EvaluatorConfig{}, nil)
+		e.workers[name] = NewWorker(e.Control.Ctx(), e.log, name, e, e.evaluatorConfig, nil)
 		e.dirtyWorkers[name] = struct{}{}
 		e.workers[name].Configure(config)
 		e.log.Infof(`worker created "%s": %v"`, name, config)
 	}
+	e.updateStatus()
 	e.notify()
 }
 
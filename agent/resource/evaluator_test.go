@@ -129,5 +129,39 @@ func TestEvaluator_Configure(t *testing.T) {
 				})},
 		)
 	})
-
+	t.Run("0 configs with unsupported hold", func(t *testing.T) {
+		runTest(t,
+			[]resource.Config{
+				{
+					Kind:   "fake1",
+					Nature: "dummy",
+				},
+				{
+					Kind:   "fake2",
+					Nature: "dummy",
+					Properties: map[string]interface{}{
+						"hold": "1m",
+					},
+				},
+			},
+			state,
+			[]bus.Message{
+				bus.NewMessage("resource", map[string]string{
+					"fake1.test-1.1.allocated": "true",
+					"fake1.test-1.1.fixed":     "8080",
+					"fake1.test-1.1.__values":  "{\"allocated\":\"true\",\"fixed\":\"8080\"}",
+					"fake1.test-1.2.allocated": "true",
+					"fake1.test-1.2.__values":  "{\"allocated\":\"true\"}",
+					"fake2.test-1.1.allocated": "false",
+					"fake2.test-1.1.failure":   `"hold" is not supported by dummy nature`,
+					"fake2.test-1.1.__values":  `{"allocated":"false","failure":"\"hold\" is not supported by dummy nature"}`,
+				}),
+			},
+			[]bus.Message{bus.NewMessage("resource",
+				map[string]string{
+					"request.fake1.allow": "true",
+					"request.fake2.allow": "true",
+				})},
+		)
+	})
 }
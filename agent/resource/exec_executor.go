@@ -0,0 +1,298 @@
+package resource
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const defaultExecRestartDelay = time.Second
+
+// ExecExecutor delegates allocations to external program. Program receives
+// JSON-lines requests on stdin and replies with JSON-lines on stdout.
+// Requests are queued and written to stdin by dedicated goroutine. Program is
+// restarted on exit. After restart all current allocations are sent again
+// with last known values. Replies are sent to consumer under lock to keep
+// them in order with deallocations.
+type ExecExecutor struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	log       *logx.Log
+	config    Config
+	consumer  bus.Consumer
+	command   string
+	args      []string
+	restart   time.Duration
+	queueChan chan struct{}
+
+	mu          sync.Mutex
+	running     bool
+	queue       []ExecRequest // requests to write to program stdin
+	allocations map[string]ExecRequest
+}
+
+func NewExecExecutor(ctx context.Context, log *logx.Log, config Config, consumer bus.Consumer) (e *ExecExecutor) {
+	e = &ExecExecutor{
+		log:         log,
+		config:      config,
+		consumer:    consumer,
+		restart:     defaultExecRestartDelay,
+		queueChan:   make(chan struct{}, 1),
+		allocations: map[string]ExecRequest{},
+	}
+	e.ctx, e.cancel = context.WithCancel(ctx)
+	if v, ok := config.Properties["command"]; ok {
+		e.command = fmt.Sprint(v)
+	}
+	e.args = parseSetValues(config.Properties["args"])
+	if v, ok := config.Properties["restart"]; ok {
+		var err error
+		if e.restart, err = parseDuration(v); err != nil {
+			e.log.Errorf(`bad restart: %v`, err)
+			e.restart = defaultExecRestartDelay
+		}
+	}
+	if e.command == "" {
+		e.log.Error(`command is not defined`)
+		return
+	}
+	go e.loop()
+	e.log.Debugf("started: command:%s args:%v", e.command, e.args)
+	return
+}
+
+func (e *ExecExecutor) Close() error {
+	e.cancel()
+	return nil
+}
+
+func (e *ExecExecutor) Allocate(request Alloc) {
+	e.log.Tracef(`request: %v`, request)
+	id := request.GetID()
+	req := ExecRequest{
+		Type:   execAllocate,
+		ID:     id,
+		Pod:    request.PodName,
+		Name:   request.Request.Name,
+		Config: request.Request.Config,
+	}
+	var valuesChunk map[string]string
+	if errU := request.Values.Payload().Unmarshal(&valuesChunk); errU == nil && len(valuesChunk) > 0 {
+		req.Values = map[string]string{}
+		for k, v := range valuesChunk {
+			if k != "allocated" && k != "failure" {
+				req.Values[k] = v
+			}
+		}
+	}
+	if e.command == "" {
+		e.consumer.ConsumeMessage(NewExecutorMessage(id, fmt.Errorf(`command is not defined`), nil))
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if state, ok := e.allocations[id]; ok && req.Values == nil {
+		req.Values = state.Values
+	}
+	e.allocations[id] = req
+	e.send(req)
+}
+
+func (e *ExecExecutor) Deallocate(id string) {
+	e.log.Tracef(`deallocate: %s`, id)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.allocations[id]; ok {
+		delete(e.allocations, id)
+		e.send(ExecRequest{
+			Type: execDeallocate,
+			ID:   id,
+		})
+	} else {
+		e.log.Tracef(`deallocate: not found: %s`, id)
+	}
+	e.consumer.ConsumeMessage(bus.NewMessage(id, nil))
+}
+
+// send queues request to program stdin. Should be called under lock.
+// Requests are dropped if program is not running. They will be sent again
+// after restart.
+func (e *ExecExecutor) send(req ExecRequest) {
+	if !e.running {
+		e.log.Tracef(`program is not running: skipping %v`, req)
+		return
+	}
+	e.queue = append(e.queue, req)
+	select {
+	case e.queueChan <- struct{}{}:
+	default:
+	}
+}
+
+// write writes queued requests to program stdin until context is done
+func (e *ExecExecutor) write(ctx context.Context, stdin io.Writer) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.queueChan:
+		}
+		e.mu.Lock()
+		queue := e.queue
+		e.queue = nil
+		e.mu.Unlock()
+		for _, req := range queue {
+			raw, err := json.Marshal(req)
+			if err != nil {
+				e.log.Error(err)
+				continue
+			}
+			if _, err = stdin.Write(append(raw, '\n')); err != nil {
+				e.log.Errorf(`can't send %s: %v`, req.Type, err)
+				return
+			}
+		}
+	}
+}
+
+func (e *ExecExecutor) loop() {
+	for {
+		if err := e.run(); err != nil {
+			e.log.Errorf(`program exited: %v`, err)
+		}
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-time.After(e.restart):
+			e.log.Debugf(`restarting: %s`, e.command)
+		}
+	}
+}
+
+// run starts program, sends configure and all current allocations and reads
+// replies until program exits
+func (e *ExecExecutor) run() (err error) {
+	cmd := exec.CommandContext(e.ctx, e.command, e.args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			e.log.Warningf(`stderr: %s`, scanner.Text())
+		}
+	}()
+
+	writeCtx, writeCancel := context.WithCancel(e.ctx)
+	writeDone := make(chan struct{})
+	go func() {
+		defer close(writeDone)
+		e.write(writeCtx, stdin)
+	}()
+
+	e.mu.Lock()
+	e.running = true
+	e.queue = nil
+	e.send(ExecRequest{
+		Type:       execConfigure,
+		Kind:       e.config.Kind,
+		Properties: e.config.Properties,
+	})
+	for _, req := range e.allocations {
+		e.send(req)
+	}
+	e.mu.Unlock()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		e.handleReply(scanner.Bytes())
+	}
+
+	e.mu.Lock()
+	e.running = false
+	e.queue = nil
+	e.mu.Unlock()
+	writeCancel()
+	stdin.Close()
+	<-writeDone
+
+	err = cmd.Wait()
+	if err == nil {
+		err = fmt.Errorf(`unexpected exit`)
+	}
+	return
+}
+
+func (e *ExecExecutor) handleReply(raw []byte) {
+	var reply ExecReply
+	if err := json.Unmarshal(raw, &reply); err != nil {
+		e.log.Errorf(`bad reply "%s": %v`, string(raw), err)
+		return
+	}
+	e.log.Tracef(`reply: %v`, reply)
+	// kind values
+	if reply.ID == "" {
+		e.consumer.ConsumeMessage(bus.NewMessage("", reply.Values))
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	req, ok := e.allocations[reply.ID]
+	if ok && reply.Failure == "" {
+		req.Values = reply.Values
+		e.allocations[reply.ID] = req
+	}
+	if !ok {
+		e.log.Warningf(`reply for unknown allocation: %s`, reply.ID)
+		return
+	}
+	if reply.Failure != "" {
+		e.consumer.ConsumeMessage(NewExecutorMessage(reply.ID, fmt.Errorf("%s", reply.Failure), nil))
+		return
+	}
+	e.consumer.ConsumeMessage(NewExecutorMessage(reply.ID, nil, reply.Values))
+}
+
+const (
+	execConfigure  = "configure"
+	execAllocate   = "allocate"
+	execDeallocate = "deallocate"
+)
+
+// ExecRequest is sent to external program
+type ExecRequest struct {
+	Type       string                 `json:"type"`
+	Kind       string                 `json:"kind,omitempty"`       // configure
+	Properties map[string]interface{} `json:"properties,omitempty"` // configure
+	ID         string                 `json:"id,omitempty"`         // allocate, deallocate
+	Pod        string                 `json:"pod,omitempty"`        // allocate
+	Name       string                 `json:"name,omitempty"`       // allocate
+	Config     map[string]interface{} `json:"config,omitempty"`     // allocate
+	Values     map[string]string      `json:"values,omitempty"`     // allocate: recovered values
+}
+
+// ExecReply is received from external program
+type ExecReply struct {
+	ID      string            `json:"id"`
+	Values  map[string]string `json:"values,omitempty"`
+	Failure string            `json:"failure,omitempty"`
+}
@@ -0,0 +1,236 @@
+// +build ide test_unit
+
+package resource_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/resource"
+	"github.com/akaspin/soil/fixture"
+	"github.com/akaspin/soil/manifest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExecExecutor_Helper is not a real test. It is external program for
+// TestExecExecutor_Allocate.
+func TestExecExecutor_Helper(t *testing.T) {
+	if os.Getenv("SOIL_TEST_EXEC_HELPER") != "1" {
+		return
+	}
+	var next int
+	reply := func(v resource.ExecReply) {
+		raw, _ := json.Marshal(v)
+		fmt.Fprintln(os.Stdout, string(raw))
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req resource.ExecRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		switch req.Type {
+		case "configure":
+			reply(resource.ExecReply{Values: map[string]string{"__kind": req.Kind}})
+		case "allocate":
+			if _, ok := req.Config["fail"]; ok {
+				reply(resource.ExecReply{ID: req.ID, Failure: "requested failure"})
+				continue
+			}
+			value, ok := req.Values["value"]
+			if !ok {
+				next++
+				value = fmt.Sprintf("%d", 100+next)
+			}
+			reply(resource.ExecReply{ID: req.ID, Values: map[string]string{"value": value}})
+		case "deallocate":
+			if req.ID == "1.crash" {
+				os.Exit(1)
+			}
+		}
+	}
+	os.Exit(0)
+}
+
+func TestExecExecutor_Allocate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	os.Setenv("SOIL_TEST_EXEC_HELPER", "1")
+	defer os.Unsetenv("SOIL_TEST_EXEC_HELPER")
+
+	cons := bus.NewTestingConsumer(ctx)
+	executor := resource.NewExecExecutor(ctx, logx.GetLog("test"), resource.Config{
+		Nature: "exec",
+		Kind:   "ip",
+		Properties: map[string]interface{}{
+			"command": os.Args[0],
+			"args":    []interface{}{"-test.run=TestExecExecutor_Helper"},
+			"restart": "100ms",
+		},
+	}, cons)
+	defer executor.Close()
+
+	allocate := func(name string, config map[string]interface{}, values map[string]string) {
+		executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "ip", Name: name, Config: config},
+			Values:  bus.NewMessage("1."+name, values),
+		})
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	t.Run("0 allocate", func(t *testing.T) {
+		allocate("a", nil, nil)
+		allocate("recovered", nil, map[string]string{"allocated": "true", "value": "200"})
+		allocate("failed", map[string]interface{}{"fail": true}, nil)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesByIdFn(map[string][]bus.Message{
+			"": {
+				bus.NewMessage("", map[string]string{"__kind": "ip"}),
+			},
+			"1.a": {
+				bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "101"}),
+			},
+			"1.recovered": {
+				bus.NewMessage("1.recovered", map[string]string{"allocated": "true", "value": "200"}),
+			},
+			"1.failed": {
+				bus.NewMessage("1.failed", map[string]string{"allocated": "false", "failure": "requested failure"}),
+			},
+		}))
+	})
+	t.Run("1 restart", func(t *testing.T) {
+		allocate("crash", nil, nil)
+		executor.Deallocate("1.crash")
+		time.Sleep(time.Millisecond * 300)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesByIdFn(map[string][]bus.Message{
+			"": {
+				bus.NewMessage("", map[string]string{"__kind": "ip"}),
+				bus.NewMessage("", map[string]string{"__kind": "ip"}),
+			},
+			"1.a": {
+				bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "101"}),
+				bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "101"}),
+			},
+			"1.recovered": {
+				bus.NewMessage("1.recovered", map[string]string{"allocated": "true", "value": "200"}),
+				bus.NewMessage("1.recovered", map[string]string{"allocated": "true", "value": "200"}),
+			},
+			"1.failed": {
+				bus.NewMessage("1.failed", map[string]string{"allocated": "false", "failure": "requested failure"}),
+				bus.NewMessage("1.failed", map[string]string{"allocated": "false", "failure": "requested failure"}),
+			},
+			"1.crash": {
+				bus.NewMessage("1.crash", map[string]string{"allocated": "true", "value": "102"}),
+				bus.NewMessage("1.crash", nil),
+			},
+		}))
+	})
+	t.Run("2 reallocate", func(t *testing.T) {
+		executor.Deallocate("1.a")
+		allocate("a", nil, nil)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesByIdFn(map[string][]bus.Message{
+			"": {
+				bus.NewMessage("", map[string]string{"__kind": "ip"}),
+				bus.NewMessage("", map[string]string{"__kind": "ip"}),
+			},
+			"1.a": {
+				bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "101"}),
+				bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "101"}),
+				bus.NewMessage("1.a", nil),
+				// helper counter is reset by restart
+				bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "101"}),
+			},
+			"1.recovered": {
+				bus.NewMessage("1.recovered", map[string]string{"allocated": "true", "value": "200"}),
+				bus.NewMessage("1.recovered", map[string]string{"allocated": "true", "value": "200"}),
+			},
+			"1.failed": {
+				bus.NewMessage("1.failed", map[string]string{"allocated": "false", "failure": "requested failure"}),
+				bus.NewMessage("1.failed", map[string]string{"allocated": "false", "failure": "requested failure"}),
+			},
+			"1.crash": {
+				bus.NewMessage("1.crash", map[string]string{"allocated": "true", "value": "102"}),
+				bus.NewMessage("1.crash", nil),
+			},
+		}))
+	})
+}
+
+func TestExecExecutor_NoCommand(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cons := bus.NewTestingConsumer(ctx)
+	executor := resource.NewExecExecutor(ctx, logx.GetLog("test"), resource.Config{
+		Nature: "exec",
+		Kind:   "ip",
+	}, cons)
+	defer executor.Close()
+
+	executor.Allocate(resource.Alloc{
+		PodName: "1",
+		Request: manifest.Resource{Kind: "ip", Name: "a"},
+		Values:  bus.NewMessage("1.a", nil),
+	})
+	executor.Deallocate("1.a")
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesByIdFn(map[string][]bus.Message{
+		"1.a": {
+			bus.NewMessage("1.a", map[string]string{"allocated": "false", "failure": "command is not defined"}),
+			bus.NewMessage("1.a", nil),
+		},
+	}))
+}
+
+func TestExecExecutor_StuckStdin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cons := bus.NewTestingConsumer(ctx)
+	// program never reads stdin but keeps replying
+	executor := resource.NewExecExecutor(ctx, logx.GetLog("test"), resource.Config{
+		Nature: "exec",
+		Kind:   "ip",
+		Properties: map[string]interface{}{
+			"command": "/bin/sh",
+			"args":    []interface{}{"-c", `echo '{"values":{"step":"1"}}'; sleep 1; echo '{"values":{"step":"2"}}'; exec sleep 30`},
+		},
+	}, cons)
+	defer executor.Close()
+	time.Sleep(time.Millisecond * 200)
+
+	config := map[string]interface{}{"payload": strings.Repeat("x", 1024)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 256; i++ {
+			executor.Allocate(resource.Alloc{
+				PodName: "1",
+				Request: manifest.Resource{Kind: "ip", Name: fmt.Sprintf("%d", i), Config: config},
+				Values:  bus.NewMessage(fmt.Sprintf("1.%d", i), nil),
+			})
+		}
+		executor.Deallocate("1.0")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal(`allocate is blocked by program stdin`)
+	}
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesByIdFn(map[string][]bus.Message{
+		"": {
+			bus.NewMessage("", map[string]string{"step": "1"}),
+			bus.NewMessage("", map[string]string{"step": "2"}),
+		},
+		"1.0": {
+			bus.NewMessage("1.0", nil),
+		},
+	}))
+}
@@ -5,12 +5,19 @@ import (
 	"fmt"
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
 	"io"
+	"sync"
 )
 
 const (
-	dummyExecutorNature = "dummy"
-	rangeExecutorNature = "range"
+	dummyExecutorNature        = "dummy"
+	rangeExecutorNature        = "range"
+	setExecutorNature          = "set"
+	capacityExecutorNature     = "capacity"
+	execExecutorNature         = "exec"
+	secretExecutorNature       = "secret"
+	clusterRangeExecutorNature = "cluster_range"
 )
 
 // Executor
@@ -22,6 +29,17 @@ type Executor interface {
 	Deallocate(id string)
 }
 
+// CapacityReporter is implemented by executors with limited capacity
+type CapacityReporter interface {
+	Capacity() proto.ResourceCapacity
+}
+
+// Rotator is implemented by executors which can regenerate values of
+// allocated resources
+type Rotator interface {
+	Rotate(id string) error
+}
+
 // replaceable Executor instance
 type ExecutorInstance struct {
 	ctx      context.Context
@@ -29,6 +47,10 @@ type ExecutorInstance struct {
 	log      *logx.Log
 	consumer bus.Consumer
 
+	mu        sync.Mutex
+	queue     []bus.Message
+	queueChan chan struct{}
+
 	ExecutorConfig Config
 	Executor       Executor
 }
@@ -38,38 +60,117 @@ func NewExecutorInstance(ctx context.Context, log *logx.Log, evaluatorConfig Eva
 		log:            log.GetLog("resource", "executor", "instance", executorConfig.Nature, executorConfig.Kind),
 		ExecutorConfig: executorConfig,
 		consumer:       consumer,
+		queueChan:      make(chan struct{}, 1),
 	}
 	i.ctx, i.cancel = context.WithCancel(ctx)
 
 	executorLog := log.GetLog("resource", "worker", executorConfig.Kind, executorConfig.Nature)
+	if _, ok := executorConfig.Properties["hold"]; ok {
+		switch executorConfig.Nature {
+		case dummyExecutorNature, capacityExecutorNature, secretExecutorNature, execExecutorNature, clusterRangeExecutorNature:
+			// keep instance to fail allocations of this kind only
+			holdErr := fmt.Errorf(`"hold" is not supported by %s nature`, executorConfig.Nature)
+			i.log.Error(holdErr)
+			i.Executor = NewFailedExecutor(holdErr, i)
+			go i.loop()
+			return
+		}
+	}
 	switch executorConfig.Nature {
 	case dummyExecutorNature:
 		i.Executor = NewDummyExecutor(executorLog, executorConfig, i)
 	case rangeExecutorNature:
-		i.Executor = NewRangeExecutor(executorLog, executorConfig, i)
+		i.Executor = NewRangeExecutor(executorLog, evaluatorConfig, executorConfig, i)
+	case setExecutorNature:
+		i.Executor = NewSetExecutor(executorLog, evaluatorConfig, executorConfig, i)
+	case capacityExecutorNature:
+		i.Executor = NewCapacityExecutor(executorLog, executorConfig, i)
+	case secretExecutorNature:
+		i.Executor = NewSecretExecutor(executorLog, executorConfig, i)
+	case execExecutorNature:
+		i.Executor = NewExecExecutor(i.ctx, executorLog, executorConfig, i)
+	case clusterRangeExecutorNature:
+		i.Executor = NewClusterRangeExecutor(i.ctx, executorLog, evaluatorConfig, executorConfig, i)
 	default:
+		i.cancel()
 		err = fmt.Errorf("unknown Executor nature: %v", executorConfig)
+		return
 	}
+	go i.loop()
 	return
 }
 
 func (i *ExecutorInstance) Close() (err error) {
 	i.cancel()
+	if i.Executor != nil {
+		err = i.Executor.Close()
+	}
 	return
 }
 
+// ConsumeMessage queues message from executor. Queued messages are
+// propagated to consumer in order without blocking executor.
 func (i *ExecutorInstance) ConsumeMessage(message bus.Message) (err error) {
-	go func() {
+	i.mu.Lock()
+	i.queue = append(i.queue, message)
+	i.mu.Unlock()
+	select {
+	case i.queueChan <- struct{}{}:
+	default:
+	}
+	return
+}
+
+func (i *ExecutorInstance) loop() {
+	for {
 		select {
 		case <-i.ctx.Done():
-			i.log.Tracef("ignoring %v: %v", message, i.ctx.Err())
-		default:
-			i.consumer.ConsumeMessage(message)
+			return
+		case <-i.queueChan:
+			i.mu.Lock()
+			queue := i.queue
+			i.queue = nil
+			i.mu.Unlock()
+			for _, message := range queue {
+				select {
+				case <-i.ctx.Done():
+					i.log.Tracef("ignoring %v: %v", message, i.ctx.Err())
+					return
+				default:
+					i.consumer.ConsumeMessage(message)
+				}
+			}
 		}
-	}()
+	}
+}
+
+// FailedExecutor fails all allocations with given error. It is used for
+// kinds with bad configuration to keep allocations of other kinds running.
+type FailedExecutor struct {
+	err      error
+	consumer bus.Consumer
+}
+
+func NewFailedExecutor(err error, consumer bus.Consumer) (e *FailedExecutor) {
+	e = &FailedExecutor{
+		err:      err,
+		consumer: consumer,
+	}
 	return
 }
 
+func (e *FailedExecutor) Close() error {
+	return nil
+}
+
+func (e *FailedExecutor) Allocate(request Alloc) {
+	e.consumer.ConsumeMessage(NewExecutorMessage(request.GetID(), e.err, nil))
+}
+
+func (e *FailedExecutor) Deallocate(id string) {
+	e.consumer.ConsumeMessage(bus.NewMessage(id, nil))
+}
+
 func NewExecutorMessage(id string, err error, values map[string]string) (res bus.Message) {
 	if err != nil {
 		res = bus.NewMessage(id, map[string]string{
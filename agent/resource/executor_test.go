@@ -3,7 +3,12 @@
 package resource_test
 
 import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
 	"github.com/akaspin/soil/agent/resource"
+	"github.com/akaspin/soil/fixture"
+	"github.com/akaspin/soil/manifest"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -63,3 +68,61 @@ func TestExecutorConfig_IsEqual(t *testing.T) {
 	})
 
 }
+
+func TestNewExecutorInstance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cons := bus.NewTestingConsumer(ctx)
+
+	t.Run(`unknown nature`, func(t *testing.T) {
+		_, err := resource.NewExecutorInstance(ctx, logx.GetLog("test"), resource.EvaluatorConfig{}, resource.Config{
+			Nature: "unknown",
+			Kind:   "test",
+		}, cons)
+		assert.Error(t, err)
+	})
+	t.Run(`hold is not supported`, func(t *testing.T) {
+		instance, err := resource.NewExecutorInstance(ctx, logx.GetLog("test"), resource.EvaluatorConfig{}, resource.Config{
+			Nature: "capacity",
+			Kind:   "test",
+			Properties: map[string]interface{}{
+				"total": 10,
+				"hold":  "1m",
+			},
+		}, cons)
+		assert.NoError(t, err)
+		instance.Executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "test", Name: "a"},
+		})
+		instance.Executor.Deallocate("1.a")
+		fixture.WaitNoError10(t, cons.ExpectMessagesFn(
+			bus.NewMessage("1.a", map[string]string{
+				"allocated": "false",
+				"failure":   `"hold" is not supported by capacity nature`,
+			}),
+			bus.NewMessage("1.a", nil),
+		))
+		assert.NoError(t, instance.Close())
+	})
+	t.Run(`dummy`, func(t *testing.T) {
+		instance, err := resource.NewExecutorInstance(ctx, logx.GetLog("test"), resource.EvaluatorConfig{}, resource.Config{
+			Nature: "dummy",
+			Kind:   "test",
+		}, cons)
+		assert.NoError(t, err)
+		instance.Executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "test", Name: "a"},
+		})
+		fixture.WaitNoError10(t, cons.ExpectMessagesFn(
+			bus.NewMessage("1.a", map[string]string{
+				"allocated": "false",
+				"failure":   `"hold" is not supported by capacity nature`,
+			}),
+			bus.NewMessage("1.a", nil),
+			bus.NewMessage("1.a", map[string]string{"allocated": "true"}),
+		))
+		assert.NoError(t, instance.Close())
+	})
+}
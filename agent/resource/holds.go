@@ -0,0 +1,136 @@
+package resource
+
+import (
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/lib"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// executorHold is reservation of deallocated value
+type executorHold struct {
+	Value string    `json:"value"`
+	Count uint32    `json:"count,omitempty"`
+	Until time.Time `json:"until"`
+}
+
+// executorHolds keeps deallocated values reserved for the same allocation ID
+// during "hold" duration. Holds are persisted in state directory and restored
+// on start. executorHolds is not synchronized: methods should be called under
+// owner lock. The same lock is acquired to expire holds.
+type executorHolds struct {
+	log      *logx.Log
+	duration time.Duration
+	path     string
+	lock     sync.Locker
+	expire   func(id string, hold executorHold) // called under lock
+	closed   bool
+	holds    map[string]executorHold
+	timers   map[string]*time.Timer
+}
+
+func newExecutorHolds(log *logx.Log, evaluatorConfig EvaluatorConfig, config Config, lock sync.Locker, expire func(id string, hold executorHold)) (h *executorHolds) {
+	h = &executorHolds{
+		log:    log,
+		lock:   lock,
+		expire: expire,
+		holds:  map[string]executorHold{},
+		timers: map[string]*time.Timer{},
+	}
+	if v, ok := config.Properties["hold"]; ok {
+		var err error
+		if h.duration, err = parseDuration(v); err != nil {
+			h.log.Errorf(`bad hold: %v`, err)
+		}
+	}
+	if evaluatorConfig.StateDir != "" {
+		h.path = filepath.Join(evaluatorConfig.StateDir, "resource-"+config.Kind+"-holds.json")
+	}
+	return
+}
+
+// enabled returns true if deallocated values should be held
+func (h *executorHolds) enabled() bool {
+	return h.duration > 0
+}
+
+// restore restores unexpired holds from state file. Holds not accepted by
+// owner are dropped.
+func (h *executorHolds) restore(accept func(id string, hold executorHold) bool) {
+	if h.path == "" {
+		return
+	}
+	var holds map[string]executorHold
+	if err := lib.ReadStateFile(h.path, &holds); err != nil {
+		h.log.Errorf(`can't read holds: %v`, err)
+		return
+	}
+	now := time.Now()
+	for id, hold := range holds {
+		if !h.enabled() || !hold.Until.After(now) || !accept(id, hold) {
+			h.log.Tracef(`dropping hold: %s:%v`, id, hold)
+			continue
+		}
+		h.arm(id, hold)
+		h.log.Debugf(`hold restored: %s:%s`, id, hold.Value)
+	}
+	h.store()
+}
+
+// put holds value for allocation during hold duration
+func (h *executorHolds) put(id string, hold executorHold) (res executorHold) {
+	hold.Until = time.Now().Add(h.duration)
+	h.arm(id, hold)
+	h.store()
+	res = hold
+	return
+}
+
+// take removes hold of allocation without releasing value
+func (h *executorHolds) take(id string) (hold executorHold, ok bool) {
+	if hold, ok = h.holds[id]; !ok {
+		return
+	}
+	if timer, found := h.timers[id]; found {
+		timer.Stop()
+	}
+	delete(h.timers, id)
+	delete(h.holds, id)
+	h.store()
+	return
+}
+
+// close stops expiration timers. Holds are kept in state file.
+func (h *executorHolds) close() {
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for _, timer := range h.timers {
+		timer.Stop()
+	}
+}
+
+func (h *executorHolds) arm(id string, hold executorHold) {
+	h.holds[id] = hold
+	h.timers[id] = time.AfterFunc(time.Until(hold.Until), func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		if current, ok := h.holds[id]; h.closed || !ok || current != hold {
+			return
+		}
+		h.take(id)
+		h.log.Debugf(`hold expired: %s:%s`, id, hold.Value)
+		h.expire(id, hold)
+	})
+}
+
+func (h *executorHolds) store() {
+	if h.path == "" {
+		return
+	}
+	if err := lib.WriteStateFile(h.path, h.holds); err != nil {
+		h.log.Errorf(`can't store holds: %v`, err)
+	}
+}
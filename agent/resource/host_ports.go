@@ -0,0 +1,61 @@
+package resource
+
+import (
+	"bufio"
+	"github.com/RoaringBitmap/roaring"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tcpListenState is hex state of listening sockets in /proc/net/tcp
+const tcpListenState = "0A"
+
+// ReadBoundPorts returns ports bound on host for given protocol ("tcp" or
+// "udp"). Ports are read from <procRoot>/net/<proto> and
+// <procRoot>/net/<proto>6. For "tcp" only listening sockets are counted.
+// Missing files are ignored.
+func ReadBoundPorts(procRoot string, proto string) (res *roaring.Bitmap, err error) {
+	res = roaring.New()
+	for _, name := range []string{proto, proto + "6"} {
+		if err = readBoundPortsFile(filepath.Join(procRoot, "net", name), proto, res); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+				continue
+			}
+			return
+		}
+	}
+	return
+}
+
+func readBoundPortsFile(path string, proto string, res *roaring.Bitmap) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		if proto == "tcp" && fields[3] != tcpListenState {
+			continue
+		}
+		split := strings.LastIndex(fields[1], ":")
+		if split < 0 {
+			continue
+		}
+		port, parseErr := strconv.ParseUint(fields[1][split+1:], 16, 16)
+		if parseErr != nil {
+			continue
+		}
+		res.Add(uint32(port))
+	}
+	err = scanner.Err()
+	return
+}
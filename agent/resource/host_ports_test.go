@@ -0,0 +1,27 @@
+// +build ide test_unit
+
+package resource_test
+
+import (
+	"github.com/akaspin/soil/agent/resource"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReadBoundPorts(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		res, err := resource.ReadBoundPorts("testdata/TestReadBoundPorts", "tcp")
+		assert.NoError(t, err)
+		assert.Equal(t, []uint32{8080, 8081, 8082}, res.ToArray())
+	})
+	t.Run("udp", func(t *testing.T) {
+		res, err := resource.ReadBoundPorts("testdata/TestReadBoundPorts", "udp")
+		assert.NoError(t, err)
+		assert.Equal(t, []uint32{53, 8083}, res.ToArray())
+	})
+	t.Run("missing", func(t *testing.T) {
+		res, err := resource.ReadBoundPorts("testdata/not-exists", "tcp")
+		assert.NoError(t, err)
+		assert.True(t, res.IsEmpty())
+	})
+}
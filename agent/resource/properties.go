@@ -0,0 +1,46 @@
+package resource
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// parseDuration parses duration string or number of seconds
+func parseDuration(v interface{}) (res time.Duration, err error) {
+	if str, ok := v.(string); ok {
+		if res, err = time.ParseDuration(str); err == nil && res < 0 {
+			err = fmt.Errorf(`negative duration %s`, str)
+		}
+		return
+	}
+	seconds, err := parseAmount(v)
+	res = time.Second * time.Duration(seconds)
+	return
+}
+
+// parseAmount parses non-negative integer amount
+func parseAmount(v interface{}) (res int64, err error) {
+	switch amount := v.(type) {
+	case nil:
+		err = fmt.Errorf(`not defined`)
+		return
+	case int:
+		res = int64(amount)
+	case int64:
+		res = amount
+	case float64:
+		res = int64(amount)
+	case string:
+		if res, err = strconv.ParseInt(amount, 10, 64); err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf(`unsupported type %T`, v)
+		return
+	}
+	if res < 0 {
+		err = fmt.Errorf(`negative amount %d`, res)
+	}
+	return
+}
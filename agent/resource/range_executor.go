@@ -5,66 +5,126 @@ import (
 	"github.com/RoaringBitmap/roaring"
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	executorNotAvailableError = fmt.Errorf("not-available")
 )
 
+const defaultRangeCheckInterval = time.Second * 30
+
+// RangeExecutor allocates unique integers from configured range. Requests
+// may pin specific value with "value", ask for contiguous block with "count"
+// and restrict allocation to sub-range with "min" and "max". With "check"
+// set to "tcp" or "udp" executor skips ports bound on host and periodically
+// retries allocations failed by conflicts. With "hold" deallocated values
+// are reserved for the same allocation ID for given duration.
 type RangeExecutor struct {
-	log      *logx.Log
-	consumer bus.Consumer
-	min      uint32
-	max      uint32
+	log       *logx.Log
+	consumer  bus.Consumer
+	min       uint32
+	max       uint32
+	check     string
+	procRoot  string
+	closeChan chan struct{}
 
 	mu          sync.Mutex
 	state       *roaring.Bitmap
 	allocations map[string]rangeExecutorAllocation
+	holds       *executorHolds
 }
 
-func NewRangeExecutor(log *logx.Log, config Config, consumer bus.Consumer) (e *RangeExecutor) {
+func NewRangeExecutor(log *logx.Log, evaluatorConfig EvaluatorConfig, config Config, consumer bus.Consumer) (e *RangeExecutor) {
 	e = &RangeExecutor{
 		log:         log,
 		consumer:    consumer,
 		max:         ^uint32(0),
+		procRoot:    "/proc",
+		closeChan:   make(chan struct{}),
 		state:       roaring.New(),
 		allocations: map[string]rangeExecutorAllocation{},
 	}
+	e.holds = newExecutorHolds(log, evaluatorConfig, config, &e.mu, e.expireHold)
 	if v, ok := config.Properties["min"]; ok {
 		e.min = uint32(v.(int))
 	}
 	if v, ok := config.Properties["max"]; ok {
 		e.max = uint32(v.(int))
 	}
-	e.log.Debugf("started: min:%d max:%d", e.min, e.max)
+	if v, ok := config.Properties["check"]; ok {
+		switch check := fmt.Sprint(v); check {
+		case "tcp", "udp":
+			e.check = check
+		default:
+			e.log.Errorf(`unsupported check "%s": should be "tcp" or "udp"`, check)
+		}
+	}
+	if e.check != "" {
+		interval := defaultRangeCheckInterval
+		if v, ok := config.Properties["check_interval"]; ok {
+			if parsed, err := parseDuration(v); err != nil || parsed <= 0 {
+				e.log.Errorf(`bad check_interval: %v`, v)
+			} else {
+				interval = parsed
+			}
+		}
+		go e.checkLoop(interval)
+	}
+	e.mu.Lock()
+	e.holds.restore(e.restoreHold)
+	e.mu.Unlock()
+	e.log.Debugf("started: min:%d max:%d check:%s hold:%s", e.min, e.max, e.check, e.holds.duration)
 	return
 }
 
 func (e *RangeExecutor) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	select {
+	case <-e.closeChan:
+	default:
+		close(e.closeChan)
+		e.holds.close()
+	}
 	return nil
 }
 
+// Capacity returns size of range and number of allocated and held values
+func (e *RangeExecutor) Capacity() (res proto.ResourceCapacity) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	res.Total = int64(e.max) - int64(e.min) + 1
+	res.Allocated = int64(e.state.GetCardinality())
+	res.Free = res.Total - res.Allocated
+	return
+}
+
 func (e *RangeExecutor) Allocate(request Alloc) {
 	e.log.Tracef(`request: %v`, request)
 	var value uint32
 	var recovered bool
 	id := request.GetID()
 
+	req, reqErr := parseRangeRequest(e.min, e.max, request.Request.Config)
+
 	// try to recover value from allocated
 	var valuesChunk map[string]string
 	errU := request.Values.Payload().Unmarshal(&valuesChunk)
-	if errU == nil {
+	if errU == nil && reqErr == nil {
 		if val, ok := valuesChunk["value"]; ok {
 			if parsed, err := strconv.ParseUint(val, 10, 32); err != nil {
 				e.log.Warningf(`can't parse value: %s:%s`, id, val)
 			} else {
-				if value = uint32(parsed); value >= e.min && value <= e.max {
+				if value = uint32(parsed); req.fits(value) {
 					recovered = true
 					e.log.Tracef(`recovered value: %s:%d`, id, value)
 				} else {
-					e.log.Warningf(`recovered value exceeds limits: %s:%d:%d:%d`, id, e.min, value, e.max)
+					e.log.Warningf(`recovered value exceeds limits: %s:%d:%d:%d`, id, req.min, value, req.max)
 				}
 			}
 		}
@@ -72,22 +132,46 @@ func (e *RangeExecutor) Allocate(request Alloc) {
 	go func(id string, value uint32, recovered bool) {
 		e.mu.Lock()
 		defer e.mu.Unlock()
+		// held value is given back to the same allocation
+		if hold, ok := e.holds.take(id); ok {
+			held, _ := strconv.ParseUint(hold.Value, 10, 32)
+			e.release(rangeHoldAllocation(uint32(held), hold.Count))
+			if reqErr == nil && hold.Count == req.count && req.fits(uint32(held)) {
+				value = uint32(held)
+				recovered = true
+				e.log.Debugf(`returning held value: %s:%d`, id, value)
+			}
+		}
 		// alloc found
 		if state, ok := e.allocations[id]; ok {
 			e.log.Tracef(`found: %s:%v`, id, state)
 			if state.failure == nil {
-				e.log.Tracef(`already allocated: %s:%v`, id, state)
-				return
+				if state.request == req {
+					e.log.Tracef(`already allocated: %s:%v`, id, state)
+					return
+				}
+				// request is changed: try to keep allocated value
+				e.release(state)
+				if reqErr == nil && req.fits(state.value) {
+					value = state.value
+					recovered = true
+				}
 			}
 		}
+		if reqErr != nil {
+			e.notify(id, rangeExecutorAllocation{
+				request: req,
+				failure: reqErr,
+			})
+			return
+		}
 		// recovered
-		if recovered {
-			if ok := e.state.CheckedAdd(value); ok {
-				e.notify(id, rangeExecutorAllocation{value: value})
-				return
-			}
+		if recovered && e.isFree(value, req.count) {
+			e.reserve(value, req.count)
+			e.notify(id, rangeExecutorAllocation{request: req, value: value})
+			return
 		}
-		e.allocateValue(id)
+		e.allocateValue(id, req)
 	}(id, value, recovered)
 }
 
@@ -96,57 +180,273 @@ func (e *RangeExecutor) Deallocate(id string) {
 		e.mu.Lock()
 		defer e.mu.Unlock()
 		if state, ok := e.allocations[id]; ok {
-			if state.failure == nil {
-				e.state.Remove(state.value)
-			}
 			delete(e.allocations, id)
-			e.log.Debugf(`deallocated: %s:%v`, id, state)
 			e.consumer.ConsumeMessage(bus.NewMessage(id, nil))
-			for allocatedId, allocation := range e.allocations {
-				if allocation.failure != nil {
-					e.allocateValue(allocatedId)
-				}
+			if state.failure == nil && e.holds.enabled() {
+				hold := e.holds.put(id, executorHold{
+					Value: fmt.Sprintf("%d", state.value),
+					Count: state.request.count,
+				})
+				e.log.Debugf(`deallocated: %s:%v (held until %s)`, id, state, hold.Until)
+				return
 			}
+			if state.failure == nil {
+				e.release(state)
+			}
+			e.log.Debugf(`deallocated: %s:%v`, id, state)
+			e.retryFailed()
 			return
 		}
 		e.log.Tracef(`deallocate: not found: %s`, id)
 	}(id)
 }
 
-func (e *RangeExecutor) allocateValue(id string) {
-	if ok := e.state.CheckedAdd(e.min); ok {
-		e.notify(id, rangeExecutorAllocation{
-			value: e.min,
-		})
+// retryFailed retries allocations failed by conflicts
+func (e *RangeExecutor) retryFailed() {
+	for id, allocation := range e.allocations {
+		if allocation.failure != nil && allocation.retry {
+			e.allocateValue(id, allocation.request)
+		}
+	}
+}
+
+// expireHold releases value of expired hold
+func (e *RangeExecutor) expireHold(id string, hold executorHold) {
+	held, _ := strconv.ParseUint(hold.Value, 10, 32)
+	e.release(rangeHoldAllocation(uint32(held), hold.Count))
+	e.retryFailed()
+}
+
+// restoreHold reserves value of restored hold
+func (e *RangeExecutor) restoreHold(id string, hold executorHold) (ok bool) {
+	held, err := strconv.ParseUint(hold.Value, 10, 32)
+	if err != nil || hold.Count == 0 {
 		return
 	}
-	iter := e.state.Iterator()
-	for iter.HasNext() {
-		candidate := iter.Next() + 1
-		if candidate > e.max {
+	e.reserve(uint32(held), hold.Count)
+	ok = true
+	return
+}
+
+// checkLoop periodically retries allocations failed by conflicts
+func (e *RangeExecutor) checkLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.closeChan:
+			return
+		case <-ticker.C:
+			e.mu.Lock()
+			e.retryFailed()
+			e.mu.Unlock()
+		}
+	}
+}
+
+func (e *RangeExecutor) allocateValue(id string, req rangeRequest) {
+	bound := e.getBound()
+	if req.pinned {
+		if !e.isFree(req.value, req.count) {
 			e.notify(id, rangeExecutorAllocation{
-				failure: executorNotAvailableError,
+				request: req,
+				failure: fmt.Errorf(`%s is already allocated`, req.describe(req.value)),
+				retry:   true,
 			})
 			return
 		}
-		if ok := e.state.CheckedAdd(candidate); ok {
+		if conflict, found := findBound(bound, req.value, req.count); found {
 			e.notify(id, rangeExecutorAllocation{
-				value: candidate,
+				request: req,
+				failure: fmt.Errorf(`%s is bound on host: %s port %d`, req.describe(req.value), e.check, conflict),
+				retry:   true,
 			})
 			return
 		}
+		e.reserve(req.value, req.count)
+		e.notify(id, rangeExecutorAllocation{request: req, value: req.value})
+		return
+	}
+	candidate := uint64(req.min)
+	for candidate+uint64(req.count)-1 <= uint64(req.max) {
+		conflict, found := e.findConflict(uint32(candidate), req.count)
+		if !found {
+			conflict, found = findBound(bound, uint32(candidate), req.count)
+		}
+		if !found {
+			e.reserve(uint32(candidate), req.count)
+			e.notify(id, rangeExecutorAllocation{request: req, value: uint32(candidate)})
+			return
+		}
+		candidate = uint64(conflict) + 1
+	}
+	e.notify(id, rangeExecutorAllocation{
+		request: req,
+		failure: executorNotAvailableError,
+		retry:   true,
+	})
+}
+
+// findConflict returns first allocated value in block
+func (e *RangeExecutor) findConflict(first, count uint32) (res uint32, found bool) {
+	for i := uint64(first); i < uint64(first)+uint64(count); i++ {
+		if e.state.Contains(uint32(i)) {
+			res = uint32(i)
+			found = true
+			return
+		}
+	}
+	return
+}
+
+// getBound returns ports bound on host or nil if check is not defined
+func (e *RangeExecutor) getBound() (res *roaring.Bitmap) {
+	if e.check == "" {
+		return
+	}
+	var err error
+	if res, err = ReadBoundPorts(e.procRoot, e.check); err != nil {
+		e.log.Errorf(`can't read bound ports: %v`, err)
+	}
+	return
+}
+
+// findBound returns first bound value in block
+func findBound(bound *roaring.Bitmap, first, count uint32) (res uint32, found bool) {
+	if bound == nil {
+		return
+	}
+	for i := uint64(first); i < uint64(first)+uint64(count); i++ {
+		if bound.Contains(uint32(i)) {
+			res = uint32(i)
+			found = true
+			return
+		}
 	}
+	return
+}
+
+func (e *RangeExecutor) isFree(first, count uint32) (ok bool) {
+	_, found := e.findConflict(first, count)
+	ok = !found
+	return
+}
+
+func (e *RangeExecutor) reserve(first, count uint32) {
+	e.state.AddRange(uint64(first), uint64(first)+uint64(count))
+}
+
+func (e *RangeExecutor) release(state rangeExecutorAllocation) {
+	e.state.RemoveRange(uint64(state.value), uint64(state.value)+uint64(state.request.count))
 }
 
 func (e *RangeExecutor) notify(id string, state rangeExecutorAllocation) {
 	e.allocations[id] = state
 	e.log.Debugf(`allocated %s:%d`, id, state.value)
-	e.consumer.ConsumeMessage(NewExecutorMessage(id, state.failure, map[string]string{
+	values := map[string]string{
 		"value": fmt.Sprintf("%d", state.value),
-	}))
+	}
+	if state.request.count > 1 {
+		var block []string
+		for i := uint64(state.value); i < uint64(state.value)+uint64(state.request.count); i++ {
+			block = append(block, fmt.Sprintf("%d", i))
+		}
+		values["values"] = strings.Join(block, ",")
+		values["first"] = block[0]
+		values["last"] = block[len(block)-1]
+	}
+	e.consumer.ConsumeMessage(NewExecutorMessage(id, state.failure, values))
+}
+
+// parseRangeRequest parses request config within given limits
+func parseRangeRequest(min, max uint32, config map[string]interface{}) (req rangeRequest, err error) {
+	req = rangeRequest{
+		count: 1,
+		min:   min,
+		max:   max,
+	}
+	parse := func(key string, fn func(v uint32)) {
+		v, ok := config[key]
+		if !ok || err != nil {
+			return
+		}
+		var parsed int64
+		if parsed, err = parseAmount(v); err != nil {
+			err = fmt.Errorf(`bad %s: %v`, key, err)
+			return
+		}
+		if parsed > int64(^uint32(0)) {
+			err = fmt.Errorf(`bad %s: %d is too large`, key, parsed)
+			return
+		}
+		fn(uint32(parsed))
+	}
+	parse("min", func(v uint32) { req.min = v })
+	parse("max", func(v uint32) { req.max = v })
+	parse("count", func(v uint32) { req.count = v })
+	parse("value", func(v uint32) {
+		req.pinned = true
+		req.value = v
+	})
+	if err != nil {
+		return
+	}
+	if req.min < min || req.max > max || req.min > req.max {
+		err = fmt.Errorf(`range %d-%d is out of %d-%d`, req.min, req.max, min, max)
+		return
+	}
+	if req.count == 0 {
+		err = fmt.Errorf(`bad count: should be positive`)
+		return
+	}
+	if uint64(req.min)+uint64(req.count)-1 > uint64(req.max) {
+		err = fmt.Errorf(`count %d exceeds range %d-%d`, req.count, req.min, req.max)
+		return
+	}
+	if req.pinned && !req.fits(req.value) {
+		err = fmt.Errorf(`%s is out of range %d-%d`, req.describe(req.value), req.min, req.max)
+	}
+	return
+}
+
+type rangeRequest struct {
+	pinned bool
+	value  uint32
+	count  uint32
+	min    uint32
+	max    uint32
+}
+
+// fits returns true if block with given first value fits request
+func (r rangeRequest) fits(first uint32) (ok bool) {
+	if r.pinned && first != r.value {
+		return
+	}
+	ok = first >= r.min && uint64(first)+uint64(r.count)-1 <= uint64(r.max)
+	return
+}
+
+func (r rangeRequest) describe(first uint32) (res string) {
+	if r.count > 1 {
+		res = fmt.Sprintf(`block %d-%d`, first, uint64(first)+uint64(r.count)-1)
+		return
+	}
+	res = fmt.Sprintf(`value %d`, first)
+	return
+}
+
+// rangeHoldAllocation returns allocation of held block
+func rangeHoldAllocation(value, count uint32) (res rangeExecutorAllocation) {
+	res = rangeExecutorAllocation{
+		request: rangeRequest{count: count},
+		value:   value,
+	}
+	return
 }
 
 type rangeExecutorAllocation struct {
+	request rangeRequest
 	value   uint32
 	failure error
+	retry   bool // retry on deallocations
 }
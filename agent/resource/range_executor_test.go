@@ -9,6 +9,10 @@ import (
 	"github.com/akaspin/soil/agent/resource"
 	"github.com/akaspin/soil/fixture"
 	"github.com/akaspin/soil/manifest"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -18,7 +22,7 @@ func TestRangeExecutor_Allocate(t *testing.T) {
 	defer cancel()
 
 	cons := bus.NewTestingConsumer(ctx)
-	executor := resource.NewRangeExecutor(logx.GetLog("test"), resource.Config{
+	executor := resource.NewRangeExecutor(logx.GetLog("test"), resource.EvaluatorConfig{}, resource.Config{
 		Nature: "range",
 		Kind:   "port",
 		Properties: map[string]interface{}{
@@ -95,3 +99,194 @@ func TestRangeExecutor_Allocate(t *testing.T) {
 	})
 
 }
+
+func TestRangeExecutor_Request(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cons := bus.NewTestingConsumer(ctx)
+	executor := resource.NewRangeExecutor(logx.GetLog("test"), resource.EvaluatorConfig{}, resource.Config{
+		Nature: "range",
+		Kind:   "port",
+		Properties: map[string]interface{}{
+			"min": 8000,
+			"max": 8010,
+		},
+	}, cons)
+	allocate := func(name string, config map[string]interface{}, values map[string]string) {
+		executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "port", Name: name, Config: config},
+			Values:  bus.NewMessage("1."+name, values),
+		})
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	t.Run("0 requests", func(t *testing.T) {
+		allocate("pinned", map[string]interface{}{"value": 8005}, nil)
+		allocate("block", map[string]interface{}{"count": 3}, nil)
+		allocate("sub", map[string]interface{}{"min": 8004, "max": 8006}, nil)
+		allocate("conflict", map[string]interface{}{"value": "8005"}, nil)
+		allocate("out", map[string]interface{}{"value": 9000}, nil)
+		allocate("bad-range", map[string]interface{}{"min": 7000}, nil)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+			bus.NewMessage("1.pinned", map[string]string{"allocated": "true", "value": "8005"}),
+			bus.NewMessage("1.block", map[string]string{"allocated": "true", "value": "8000", "values": "8000,8001,8002", "first": "8000", "last": "8002"}),
+			bus.NewMessage("1.sub", map[string]string{"allocated": "true", "value": "8004"}),
+			bus.NewMessage("1.conflict", map[string]string{"allocated": "false", "failure": "value 8005 is already allocated"}),
+			bus.NewMessage("1.out", map[string]string{"allocated": "false", "failure": "value 9000 is out of range 8000-8010"}),
+			bus.NewMessage("1.bad-range", map[string]string{"allocated": "false", "failure": "range 7000-8010 is out of 8000-8010"}),
+		))
+	})
+	t.Run("1 pinned survives reallocation", func(t *testing.T) {
+		executor.Deallocate("1.pinned")
+		time.Sleep(time.Millisecond * 100)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("1.conflict", map[string]string{"allocated": "true", "value": "8005"}),
+		))
+	})
+	t.Run("2 recovered block", func(t *testing.T) {
+		allocate("recovered", map[string]interface{}{"count": 2}, map[string]string{"value": "8008"})
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("1.recovered", map[string]string{"allocated": "true", "value": "8008", "values": "8008,8009", "first": "8008", "last": "8009"}),
+		))
+	})
+	t.Run("3 change request", func(t *testing.T) {
+		allocate("sub", map[string]interface{}{"min": 8004, "max": 8007, "count": 2}, nil)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("1.sub", map[string]string{"allocated": "true", "value": "8006", "values": "8006,8007", "first": "8006", "last": "8007"}),
+		))
+	})
+}
+
+func TestRangeExecutor_Check(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	portValue := strconv.Itoa(port)
+
+	cons := bus.NewTestingConsumer(ctx)
+	executor := resource.NewRangeExecutor(logx.GetLog("test"), resource.EvaluatorConfig{}, resource.Config{
+		Nature: "range",
+		Kind:   "port",
+		Properties: map[string]interface{}{
+			"min":            port,
+			"max":            port,
+			"check":          "tcp",
+			"check_interval": 1,
+		},
+	}, cons)
+	defer executor.Close()
+
+	t.Run("0 bound", func(t *testing.T) {
+		executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "port", Name: "pinned", Config: map[string]interface{}{"value": port}},
+		})
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("1.pinned", map[string]string{"allocated": "false", "failure": "value " + portValue + " is bound on host: tcp port " + portValue}),
+		))
+	})
+	t.Run("1 recovered", func(t *testing.T) {
+		executor.Allocate(resource.Alloc{
+			PodName: "2",
+			Request: manifest.Resource{Kind: "port", Name: "recovered"},
+			Values:  bus.NewMessage("2.recovered", map[string]string{"value": portValue}),
+		})
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("2.recovered", map[string]string{"allocated": "true", "value": portValue}),
+		))
+	})
+	t.Run("2 released", func(t *testing.T) {
+		executor.Deallocate("2.recovered")
+		time.Sleep(time.Millisecond * 100)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("1.pinned", map[string]string{"allocated": "false", "failure": "value " + portValue + " is bound on host: tcp port " + portValue}),
+		))
+		listener.Close()
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("1.pinned", map[string]string{"allocated": "true", "value": portValue}),
+		))
+	})
+}
+
+func TestRangeExecutor_Hold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	os.RemoveAll("testdata/.test_range_hold")
+	defer os.RemoveAll("testdata/.test_range_hold")
+
+	evaluatorConfig := resource.EvaluatorConfig{
+		StateDir: "testdata/.test_range_hold",
+	}
+	config := resource.Config{
+		Nature: "range",
+		Kind:   "port",
+		Properties: map[string]interface{}{
+			"min":  8000,
+			"max":  8001,
+			"hold": "2s",
+		},
+	}
+	allocate := func(executor *resource.RangeExecutor, name string) {
+		executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "port", Name: name},
+		})
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	cons := bus.NewTestingConsumer(ctx)
+	executor := resource.NewRangeExecutor(logx.GetLog("test"), evaluatorConfig, config, cons)
+
+	t.Run("0 allocate", func(t *testing.T) {
+		allocate(executor, "a")
+		allocate(executor, "b")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "8000"}),
+			bus.NewMessage("1.b", map[string]string{"allocated": "true", "value": "8001"}),
+		))
+	})
+	t.Run("1 held", func(t *testing.T) {
+		executor.Deallocate("1.a")
+		time.Sleep(time.Millisecond * 100)
+		allocate(executor, "c")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("1.c", map[string]string{"allocated": "false", "failure": "not-available"}),
+		))
+	})
+	t.Run("2 given back", func(t *testing.T) {
+		allocate(executor, "a")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "8000"}),
+		))
+	})
+	t.Run("3 restored and expired", func(t *testing.T) {
+		executor.Deallocate("1.a")
+		time.Sleep(time.Millisecond * 100)
+		executor.Close()
+
+		cons2 := bus.NewTestingConsumer(ctx)
+		executor2 := resource.NewRangeExecutor(logx.GetLog("test"), evaluatorConfig, config, cons2)
+		defer executor2.Close()
+		executor2.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "port", Name: "b"},
+			Values:  bus.NewMessage("1.b", map[string]string{"value": "8001"}),
+		})
+		time.Sleep(time.Millisecond * 100)
+		allocate(executor2, "c")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons2.ExpectMessagesFn(
+			bus.NewMessage("1.b", map[string]string{"allocated": "true", "value": "8001"}),
+			bus.NewMessage("1.c", map[string]string{"allocated": "false", "failure": "not-available"}),
+		))
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons2.ExpectLastMessageFn(
+			bus.NewMessage("1.c", map[string]string{"allocated": "true", "value": "8000"}),
+		))
+	})
+}
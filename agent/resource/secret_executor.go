@@ -0,0 +1,300 @@
+package resource
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	secretTypePassword = "password"
+	secretTypeToken    = "token"
+	secretTypeTLS      = "tls"
+
+	defaultSecretLength   = 32
+	minSecretLength       = 8
+	defaultSecretAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	defaultSecretTTL      = time.Hour * 24 * 365
+)
+
+// SecretExecutor generates secrets: random passwords, tokens and
+// self-signed TLS keypairs. Generated values are recovered from allocation
+// and are never logged. Executor supports rotation.
+type SecretExecutor struct {
+	log      *logx.Log
+	consumer bus.Consumer
+	defaults map[string]interface{}
+
+	mu          sync.Mutex
+	allocations map[string]secretExecutorAllocation
+}
+
+func NewSecretExecutor(log *logx.Log, config Config, consumer bus.Consumer) (e *SecretExecutor) {
+	e = &SecretExecutor{
+		log:         log,
+		consumer:    consumer,
+		defaults:    config.Properties,
+		allocations: map[string]secretExecutorAllocation{},
+	}
+	e.log.Debugf("started: %s", config.Kind)
+	return
+}
+
+func (e *SecretExecutor) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, state := range e.allocations {
+		state.unregister()
+	}
+	return nil
+}
+
+func (e *SecretExecutor) Allocate(request Alloc) {
+	id := request.GetID()
+	e.log.Tracef(`request: %s`, id)
+	spec, specErr := e.parseSpec(request.PodName+"."+request.Request.Name, request.Request.Config)
+
+	var recovered map[string]string
+	var valuesChunk map[string]string
+	if errU := request.Values.Payload().Unmarshal(&valuesChunk); errU == nil && specErr == nil {
+		if valuesChunk["value"] != "" && valuesChunk["type"] == spec.typ {
+			recovered = map[string]string{}
+			for k, v := range valuesChunk {
+				if k != "allocated" && k != "failure" {
+					recovered[k] = v
+				}
+			}
+		}
+	}
+	go func(id string) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if state, ok := e.allocations[id]; ok {
+			if state.failure == nil && state.spec == spec {
+				e.log.Tracef(`already allocated: %s`, id)
+				return
+			}
+			state.unregister()
+			if state.failure == nil {
+				// request is changed: generate new secret
+				recovered = nil
+			}
+		}
+		if specErr != nil {
+			e.notify(id, secretExecutorAllocation{failure: specErr})
+			return
+		}
+		if recovered != nil {
+			e.log.Tracef(`recovered: %s`, id)
+			e.notify(id, secretExecutorAllocation{spec: spec, values: recovered})
+			return
+		}
+		e.generate(id, spec)
+	}(id)
+}
+
+func (e *SecretExecutor) Deallocate(id string) {
+	go func(id string) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		state, ok := e.allocations[id]
+		if !ok {
+			e.log.Tracef(`deallocate: not found: %s`, id)
+			return
+		}
+		state.unregister()
+		delete(e.allocations, id)
+		e.log.Debugf(`deallocated: %s`, id)
+		e.consumer.ConsumeMessage(bus.NewMessage(id, nil))
+	}(id)
+}
+
+// Rotate generates new secret for allocation
+func (e *SecretExecutor) Rotate(id string) (err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	state, ok := e.allocations[id]
+	if !ok {
+		err = fmt.Errorf(`allocation %s not found`, id)
+		return
+	}
+	if state.failure != nil {
+		err = fmt.Errorf(`allocation %s is failed: %v`, id, state.failure)
+		return
+	}
+	state.unregister()
+	e.generate(id, state.spec)
+	e.log.Infof(`rotated: %s`, id)
+	return
+}
+
+func (e *SecretExecutor) generate(id string, spec secretSpec) {
+	values, err := spec.generate()
+	if err != nil {
+		e.notify(id, secretExecutorAllocation{spec: spec, failure: err})
+		return
+	}
+	e.notify(id, secretExecutorAllocation{spec: spec, values: values})
+}
+
+func (e *SecretExecutor) notify(id string, state secretExecutorAllocation) {
+	state.register()
+	e.allocations[id] = state
+	e.log.Debugf(`allocated %s (failure:%v)`, id, state.failure)
+	e.consumer.ConsumeMessage(NewExecutorMessage(id, state.failure, state.values))
+}
+
+// parseSpec parses request config with executor properties as defaults
+func (e *SecretExecutor) parseSpec(name string, config map[string]interface{}) (spec secretSpec, err error) {
+	get := func(key string) (v interface{}, ok bool) {
+		if v, ok = config[key]; ok {
+			return
+		}
+		v, ok = e.defaults[key]
+		return
+	}
+	spec = secretSpec{
+		typ:        secretTypePassword,
+		length:     defaultSecretLength,
+		alphabet:   defaultSecretAlphabet,
+		commonName: name,
+		ttl:        defaultSecretTTL,
+	}
+	if v, ok := get("type"); ok {
+		spec.typ = fmt.Sprint(v)
+	}
+	switch spec.typ {
+	case secretTypePassword, secretTypeToken, secretTypeTLS:
+	default:
+		err = fmt.Errorf(`unsupported type "%s"`, spec.typ)
+		return
+	}
+	if v, ok := get("length"); ok {
+		var length int64
+		if length, err = parseAmount(v); err != nil {
+			err = fmt.Errorf(`bad length: %v`, err)
+			return
+		}
+		spec.length = int(length)
+	}
+	if spec.length < minSecretLength {
+		err = fmt.Errorf(`bad length: should be at least %d`, minSecretLength)
+		return
+	}
+	if v, ok := get("alphabet"); ok {
+		if spec.alphabet = fmt.Sprint(v); len(spec.alphabet) < 2 {
+			err = fmt.Errorf(`bad alphabet: should contain at least 2 characters`)
+			return
+		}
+	}
+	if v, ok := get("common_name"); ok {
+		spec.commonName = fmt.Sprint(v)
+	}
+	if v, ok := get("ttl"); ok {
+		if spec.ttl, err = parseDuration(v); err != nil || spec.ttl <= 0 {
+			err = fmt.Errorf(`bad ttl: %v`, v)
+			return
+		}
+	}
+	return
+}
+
+type secretSpec struct {
+	typ        string
+	length     int
+	alphabet   string
+	commonName string
+	ttl        time.Duration
+}
+
+func (s secretSpec) generate() (res map[string]string, err error) {
+	res = map[string]string{
+		"type": s.typ,
+	}
+	switch s.typ {
+	case secretTypeToken:
+		buf := make([]byte, s.length)
+		if _, err = rand.Read(buf); err != nil {
+			return
+		}
+		res["value"] = hex.EncodeToString(buf)
+	case secretTypeTLS:
+		res["value"], res["cert"], err = s.generateKeypair()
+	default:
+		res["value"], err = s.generatePassword()
+	}
+	return
+}
+
+func (s secretSpec) generatePassword() (res string, err error) {
+	alphabet := []rune(s.alphabet)
+	buf := make([]rune, s.length)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range buf {
+		var n *big.Int
+		if n, err = rand.Int(rand.Reader, max); err != nil {
+			return
+		}
+		buf[i] = alphabet[n.Int64()]
+	}
+	res = string(buf)
+	return
+}
+
+// generateKeypair generates ECDSA P-256 key and self-signed certificate
+func (s secretSpec) generateKeypair() (key, cert string, err error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: s.commonName},
+		DNSNames:              []string{s.commonName},
+		NotBefore:             now,
+		NotAfter:              now.Add(s.ttl),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		return
+	}
+	keyDer, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return
+	}
+	key = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	cert = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}))
+	return
+}
+
+type secretExecutorAllocation struct {
+	spec    secretSpec
+	values  map[string]string
+	failure error
+}
+
+func (a secretExecutorAllocation) register() {
+	bus.RegisterSecret(a.values["value"])
+}
+
+func (a secretExecutorAllocation) unregister() {
+	bus.UnregisterSecret(a.values["value"])
+}
@@ -0,0 +1,226 @@
+package resource
+
+import (
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/proto"
+	"strings"
+	"sync"
+)
+
+var setValueRemovedError = fmt.Errorf("value removed from set")
+
+// SetExecutor allocates unique items from configured list of values.
+// Recovered allocations with values which are not in set are failed. With
+// "hold" deallocated values are reserved for the same allocation ID for given
+// duration.
+type SetExecutor struct {
+	log      *logx.Log
+	consumer bus.Consumer
+	values   []string
+	index    map[string]struct{}
+
+	mu          sync.Mutex
+	used        map[string]string // value:id
+	allocations map[string]setExecutorAllocation
+	holds       *executorHolds
+}
+
+func NewSetExecutor(log *logx.Log, evaluatorConfig EvaluatorConfig, config Config, consumer bus.Consumer) (e *SetExecutor) {
+	e = &SetExecutor{
+		log:         log,
+		consumer:    consumer,
+		index:       map[string]struct{}{},
+		used:        map[string]string{},
+		allocations: map[string]setExecutorAllocation{},
+	}
+	e.holds = newExecutorHolds(log, evaluatorConfig, config, &e.mu, e.expireHold)
+	for _, value := range parseSetValues(config.Properties["values"]) {
+		if _, ok := e.index[value]; ok {
+			e.log.Warningf(`duplicate value: %s`, value)
+			continue
+		}
+		e.index[value] = struct{}{}
+		e.values = append(e.values, value)
+	}
+	e.mu.Lock()
+	e.holds.restore(e.restoreHold)
+	e.mu.Unlock()
+	e.log.Debugf("started: values:%v hold:%s", e.values, e.holds.duration)
+	return
+}
+
+func (e *SetExecutor) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.holds.close()
+	return nil
+}
+
+// Capacity returns number of items in set and number of allocated and held
+// items
+func (e *SetExecutor) Capacity() (res proto.ResourceCapacity) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	res.Total = int64(len(e.values))
+	res.Allocated = int64(len(e.used))
+	res.Free = res.Total - res.Allocated
+	return
+}
+
+func (e *SetExecutor) Allocate(request Alloc) {
+	e.log.Tracef(`request: %v`, request)
+	var value string
+	var recovered, removed bool
+	id := request.GetID()
+
+	// try to recover value from allocated
+	var valuesChunk map[string]string
+	if errU := request.Values.Payload().Unmarshal(&valuesChunk); errU == nil {
+		if val, ok := valuesChunk["value"]; ok && val != "" {
+			if _, ok = e.index[val]; ok {
+				value = val
+				recovered = true
+				e.log.Tracef(`recovered value: %s:%s`, id, value)
+			} else {
+				removed = true
+				e.log.Warningf(`recovered value is not in set: %s:%s`, id, val)
+			}
+		}
+	}
+	go func(id string, value string, recovered, removed bool) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if state, ok := e.allocations[id]; ok {
+			e.log.Tracef(`found: %s:%v`, id, state)
+			if state.failure == nil {
+				e.log.Tracef(`already allocated: %s:%v`, id, state)
+				return
+			}
+		}
+		if hold, ok := e.holds.take(id); ok {
+			delete(e.used, hold.Value)
+			if !recovered && !removed {
+				value = hold.Value
+				recovered = true
+				e.log.Tracef(`value returned from hold: %s:%s`, id, value)
+			}
+		}
+		if removed {
+			e.notify(id, setExecutorAllocation{
+				failure: setValueRemovedError,
+				removed: true,
+			})
+			return
+		}
+		if recovered {
+			if _, used := e.used[value]; !used {
+				e.used[value] = id
+				e.notify(id, setExecutorAllocation{value: value})
+				return
+			}
+		}
+		e.allocateValue(id)
+	}(id, value, recovered, removed)
+}
+
+func (e *SetExecutor) Deallocate(id string) {
+	go func(id string) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if state, ok := e.allocations[id]; ok {
+			delete(e.allocations, id)
+			e.consumer.ConsumeMessage(bus.NewMessage(id, nil))
+			if state.failure == nil && e.holds.enabled() {
+				hold := e.holds.put(id, executorHold{
+					Value: state.value,
+				})
+				e.log.Debugf(`deallocated: %s:%v (held until %s)`, id, state, hold.Until)
+				return
+			}
+			if state.failure == nil {
+				delete(e.used, state.value)
+			}
+			e.log.Debugf(`deallocated: %s:%v`, id, state)
+			e.retryFailed()
+			return
+		}
+		e.log.Tracef(`deallocate: not found: %s`, id)
+	}(id)
+}
+
+// retryFailed retries allocations failed by exhausted set
+func (e *SetExecutor) retryFailed() {
+	for id, allocation := range e.allocations {
+		if allocation.failure != nil && !allocation.removed {
+			e.allocateValue(id)
+		}
+	}
+}
+
+// expireHold releases value of expired hold
+func (e *SetExecutor) expireHold(id string, hold executorHold) {
+	delete(e.used, hold.Value)
+	e.retryFailed()
+}
+
+// restoreHold reserves restored value if it is in set and not used
+func (e *SetExecutor) restoreHold(id string, hold executorHold) (ok bool) {
+	_, inSet := e.index[hold.Value]
+	_, used := e.used[hold.Value]
+	if !inSet || used {
+		return
+	}
+	e.used[hold.Value] = id
+	ok = true
+	return
+}
+
+func (e *SetExecutor) allocateValue(id string) {
+	for _, candidate := range e.values {
+		if _, used := e.used[candidate]; !used {
+			e.used[candidate] = id
+			e.notify(id, setExecutorAllocation{
+				value: candidate,
+			})
+			return
+		}
+	}
+	e.notify(id, setExecutorAllocation{
+		failure: executorNotAvailableError,
+	})
+}
+
+func (e *SetExecutor) notify(id string, state setExecutorAllocation) {
+	e.allocations[id] = state
+	e.log.Debugf(`allocated %s:%s`, id, state.value)
+	e.consumer.ConsumeMessage(NewExecutorMessage(id, state.failure, map[string]string{
+		"value": state.value,
+	}))
+}
+
+type setExecutorAllocation struct {
+	value   string
+	failure error
+	removed bool // recovered value is removed from set
+}
+
+// parseSetValues accepts list or comma-delimited string
+func parseSetValues(v interface{}) (res []string) {
+	switch values := v.(type) {
+	case []interface{}:
+		for _, value := range values {
+			res = append(res, fmt.Sprint(value))
+		}
+	case []string:
+		res = values
+	case string:
+		for _, value := range strings.Split(values, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				res = append(res, value)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,229 @@
+// +build ide test_unit
+
+package resource_test
+
+import (
+	"context"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/resource"
+	"github.com/akaspin/soil/fixture"
+	"github.com/akaspin/soil/manifest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSetExecutor_Allocate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cons := bus.NewTestingConsumer(ctx)
+	executor := resource.NewSetExecutor(logx.GetLog("test"), resource.EvaluatorConfig{}, resource.Config{
+		Nature: "set",
+		Kind:   "ip",
+		Properties: map[string]interface{}{
+			"values": []interface{}{"10.0.0.5", "10.0.0.6", "10.0.0.7"},
+		},
+	}, cons)
+
+	t.Run("0 recovered in set", func(t *testing.T) {
+		executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "ip", Name: "a"},
+			Values:  bus.NewMessage("1.a", map[string]string{"value": "10.0.0.6"}),
+		})
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "10.0.0.6"}),
+		))
+	})
+	t.Run("1 recovered not in set", func(t *testing.T) {
+		executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "ip", Name: "b"},
+			Values:  bus.NewMessage("1.b", map[string]string{"value": "10.0.0.1"}),
+		})
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "10.0.0.6"}),
+			bus.NewMessage("1.b", map[string]string{"allocated": "false", "failure": "value removed from set"}),
+		))
+	})
+	t.Run("2 not available", func(t *testing.T) {
+		executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "ip", Name: "c"},
+		})
+		time.Sleep(time.Millisecond * 100)
+		executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "ip", Name: "d"},
+		})
+		time.Sleep(time.Millisecond * 100)
+		executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "ip", Name: "failed"},
+		})
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "10.0.0.6"}),
+			bus.NewMessage("1.b", map[string]string{"allocated": "false", "failure": "value removed from set"}),
+			bus.NewMessage("1.c", map[string]string{"allocated": "true", "value": "10.0.0.5"}),
+			bus.NewMessage("1.d", map[string]string{"allocated": "true", "value": "10.0.0.7"}),
+			bus.NewMessage("1.failed", map[string]string{"allocated": "false", "failure": "not-available"}),
+		))
+	})
+	t.Run("3 remove 1.a", func(t *testing.T) {
+		executor.Deallocate("1.a")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "10.0.0.6"}),
+			bus.NewMessage("1.b", map[string]string{"allocated": "false", "failure": "value removed from set"}),
+			bus.NewMessage("1.c", map[string]string{"allocated": "true", "value": "10.0.0.5"}),
+			bus.NewMessage("1.d", map[string]string{"allocated": "true", "value": "10.0.0.7"}),
+			bus.NewMessage("1.failed", map[string]string{"allocated": "false", "failure": "not-available"}),
+			bus.NewMessage("1.a", nil),
+			bus.NewMessage("1.failed", map[string]string{"allocated": "true", "value": "10.0.0.6"}),
+		))
+	})
+}
+
+func TestSetExecutor_Shrink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cons := bus.NewTestingConsumer(ctx)
+	executor := resource.NewSetExecutor(logx.GetLog("test"), resource.EvaluatorConfig{}, resource.Config{
+		Nature: "set",
+		Kind:   "ip",
+		Properties: map[string]interface{}{
+			"values": "10.0.0.5",
+		},
+	}, cons)
+
+	executor.Allocate(resource.Alloc{
+		PodName: "1",
+		Request: manifest.Resource{Kind: "ip", Name: "a"},
+		Values:  bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "10.0.0.5"}),
+	})
+	time.Sleep(time.Millisecond * 100)
+	executor.Allocate(resource.Alloc{
+		PodName: "1",
+		Request: manifest.Resource{Kind: "ip", Name: "b"},
+		Values:  bus.NewMessage("1.b", map[string]string{"allocated": "true", "value": "10.0.0.6"}),
+	})
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+		bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "10.0.0.5"}),
+		bus.NewMessage("1.b", map[string]string{"allocated": "false", "failure": "value removed from set"}),
+	))
+}
+
+func TestSetExecutor_ShrinkWithFree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cons := bus.NewTestingConsumer(ctx)
+	executor := resource.NewSetExecutor(logx.GetLog("test"), resource.EvaluatorConfig{}, resource.Config{
+		Nature: "set",
+		Kind:   "ip",
+		Properties: map[string]interface{}{
+			"values": "10.0.0.5,10.0.0.7",
+		},
+	}, cons)
+
+	executor.Allocate(resource.Alloc{
+		PodName: "1",
+		Request: manifest.Resource{Kind: "ip", Name: "a"},
+		Values:  bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "10.0.0.5"}),
+	})
+	time.Sleep(time.Millisecond * 100)
+	executor.Allocate(resource.Alloc{
+		PodName: "1",
+		Request: manifest.Resource{Kind: "ip", Name: "b"},
+		Values:  bus.NewMessage("1.b", map[string]string{"allocated": "true", "value": "10.0.0.6"}),
+	})
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+		bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "10.0.0.5"}),
+		bus.NewMessage("1.b", map[string]string{"allocated": "false", "failure": "value removed from set"}),
+	))
+
+	// removed value is not replaced by freed value
+	executor.Deallocate("1.a")
+	time.Sleep(time.Millisecond * 100)
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+		bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "10.0.0.5"}),
+		bus.NewMessage("1.b", map[string]string{"allocated": "false", "failure": "value removed from set"}),
+		bus.NewMessage("1.a", nil),
+	))
+}
+
+func TestSetExecutor_Hold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	os.RemoveAll("testdata/.test_set_hold")
+	defer os.RemoveAll("testdata/.test_set_hold")
+
+	evaluatorConfig := resource.EvaluatorConfig{
+		StateDir: "testdata/.test_set_hold",
+	}
+	config := resource.Config{
+		Nature: "set",
+		Kind:   "ip",
+		Properties: map[string]interface{}{
+			"values": "10.0.0.5,10.0.0.6",
+			"hold":   "1m",
+		},
+	}
+	allocate := func(executor *resource.SetExecutor, name string) {
+		executor.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "ip", Name: name},
+		})
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	cons := bus.NewTestingConsumer(ctx)
+	executor := resource.NewSetExecutor(logx.GetLog("test"), evaluatorConfig, config, cons)
+
+	t.Run("0 allocate", func(t *testing.T) {
+		allocate(executor, "a")
+		allocate(executor, "b")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectMessagesFn(
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "10.0.0.5"}),
+			bus.NewMessage("1.b", map[string]string{"allocated": "true", "value": "10.0.0.6"}),
+		))
+	})
+	t.Run("1 held", func(t *testing.T) {
+		executor.Deallocate("1.a")
+		time.Sleep(time.Millisecond * 100)
+		allocate(executor, "c")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("1.c", map[string]string{"allocated": "false", "failure": "not-available"}),
+		))
+	})
+	t.Run("2 given back", func(t *testing.T) {
+		allocate(executor, "a")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("1.a", map[string]string{"allocated": "true", "value": "10.0.0.5"}),
+		))
+	})
+	// hold expiry is tested by TestRangeExecutor_Hold
+	t.Run("3 restored", func(t *testing.T) {
+		executor.Deallocate("1.a")
+		time.Sleep(time.Millisecond * 100)
+		executor.Close()
+
+		cons2 := bus.NewTestingConsumer(ctx)
+		executor2 := resource.NewSetExecutor(logx.GetLog("test"), evaluatorConfig, config, cons2)
+		defer executor2.Close()
+		executor2.Allocate(resource.Alloc{
+			PodName: "1",
+			Request: manifest.Resource{Kind: "ip", Name: "b"},
+			Values:  bus.NewMessage("1.b", map[string]string{"value": "10.0.0.6"}),
+		})
+		time.Sleep(time.Millisecond * 100)
+		allocate(executor2, "c")
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons2.ExpectMessagesFn(
+			bus.NewMessage("1.b", map[string]string{"allocated": "true", "value": "10.0.0.6"}),
+			bus.NewMessage("1.c", map[string]string{"allocated": "false", "failure": "not-available"}),
+		))
+	})
+}
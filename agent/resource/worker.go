@@ -3,9 +3,11 @@ package resource
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent/bus"
 	"github.com/akaspin/soil/manifest"
+	"github.com/akaspin/soil/proto"
 )
 
 type Worker struct {
@@ -19,10 +21,14 @@ type Worker struct {
 	executorInstance *ExecutorInstance
 	state            map[string]*Alloc // key: pod.resource-kind
 	dirty            map[string]struct{}
+	executorValues   map[string]string // values of executor itself
 
 	configChan  chan Config
 	requestChan chan workerRequest
 	valuesChan  chan bus.Message
+	rotateChan  chan rotateRequest
+
+	inventoryChan chan chan proto.ResourceInventory
 }
 
 // Create new worker with recovered allocations
@@ -40,13 +46,16 @@ func NewWorker(ctx context.Context, log *logx.Log, name string, consumer bus.Con
 		configChan:  make(chan Config, 1),
 		requestChan: make(chan workerRequest, 1),
 		valuesChan:  make(chan bus.Message, 1),
+		rotateChan:  make(chan rotateRequest),
+
+		inventoryChan: make(chan chan proto.ResourceInventory),
 	}
 	w.ctx, w.cancelFunc = context.WithCancel(ctx)
 	for _, alloc := range recovered {
 		cloned := alloc.Clone()
 		w.state[cloned.GetID()] = &cloned
 		w.dirty[cloned.GetID()] = struct{}{}
-		w.log.Debugf("recovered: %v", cloned)
+		w.log.Debugf("recovered: %s", cloned.GetID())
 	}
 	go w.loop()
 
@@ -75,6 +84,7 @@ func (w *Worker) Submit(podName string, requests []manifest.Resource) {
 }
 
 // Consume message with values from worker. Message prefix should be resource id.
+// Message with empty prefix contains values of executor itself.
 func (w *Worker) ConsumeMessage(message bus.Message) (err error) {
 	w.log.Tracef(`message consumed: %v`, message)
 	select {
@@ -84,6 +94,36 @@ func (w *Worker) ConsumeMessage(message bus.Message) (err error) {
 	return
 }
 
+// Rotate regenerates values of allocated resource
+func (w *Worker) Rotate(id string) (err error) {
+	req := newRotateRequest(w.name, id)
+	select {
+	case <-w.ctx.Done():
+		err = w.ctx.Err()
+		return
+	case w.rotateChan <- req:
+	}
+	err = req.wait(w.ctx)
+	return
+}
+
+// Inventory returns configuration, allocations and capacity of worker
+func (w *Worker) Inventory() (res proto.ResourceInventory, err error) {
+	resChan := make(chan proto.ResourceInventory, 1)
+	select {
+	case <-w.ctx.Done():
+		err = w.ctx.Err()
+		return
+	case w.inventoryChan <- resChan:
+	}
+	select {
+	case <-w.ctx.Done():
+		err = w.ctx.Err()
+	case res = <-resChan:
+	}
+	return
+}
+
 func (w *Worker) Close() (err error) {
 	w.cancelFunc()
 	return
@@ -106,8 +146,16 @@ LOOP:
 		case message := <-w.valuesChan:
 			log.Tracef(`message: %v`, message)
 			w.handleMessage(message)
+		case req := <-w.rotateChan:
+			log.Tracef(`rotate: %s`, req.id)
+			req.resChan <- w.handleRotate(req.id)
+		case resChan := <-w.inventoryChan:
+			resChan <- w.inventory()
 		}
 	}
+	if w.executorInstance != nil {
+		w.executorInstance.Close()
+	}
 	log.Trace("close")
 }
 
@@ -123,15 +171,17 @@ func (w *Worker) handleConfig(config Config) {
 		for k := range w.state {
 			w.dirty[k] = struct{}{}
 		}
+		w.executorValues = nil
 		var err error
 		if w.executorInstance, err = NewExecutorInstance(w.ctx, w.log, w.evaluatorConfig, config, w); err != nil {
+			w.executorInstance = nil
 			w.log.Error(err)
 			return
 		}
 		w.log.Debugf(`executor created: %v`, config)
 		if len(w.state) > 0 {
 			for _, v := range w.state {
-				w.log.Tracef(`sending allocate request: %v`, v)
+				w.log.Tracef(`sending allocate request: %s`, v.GetID())
 				w.executorInstance.Executor.Allocate((*v).Clone())
 			}
 		} else {
@@ -156,16 +206,24 @@ func (w *Worker) handleRequest(podName string, requests []manifest.Resource) {
 				Request: req,
 				Values:  bus.NewMessage(id, nil),
 			}
-			w.log.Debugf(`submitting allocate: %v`, w.state[id])
+			if w.executorInstance == nil {
+				w.handleMessage(NewExecutorMessage(id, fmt.Errorf(`executor for %s is not configured`, w.name), nil))
+				continue
+			}
+			w.log.Debugf(`submitting allocate: %s`, id)
 			w.executorInstance.Executor.Allocate((*w.state[id]).Clone())
 		} else {
-			w.log.Tracef(`skip submit %v: config is equal`, allocated)
+			w.log.Tracef(`skip submit %s: config is equal`, id)
 		}
 	}
 	for id, allocated := range w.state {
 		_, ok := names[id]
 		if allocated.PodName == podName && !ok {
-			w.log.Debugf(`submitting deallocate: %v`, allocated)
+			if w.executorInstance == nil {
+				w.handleMessage(bus.NewMessage(id, nil))
+				continue
+			}
+			w.log.Debugf(`submitting deallocate: %s`, id)
 			w.executorInstance.Executor.Deallocate(id)
 		}
 	}
@@ -174,6 +232,17 @@ func (w *Worker) handleRequest(podName string, requests []manifest.Resource) {
 func (w *Worker) handleMessage(message bus.Message) {
 	w.log.Tracef("message: %v", message)
 	prefix := message.GetID()
+	if prefix == "" {
+		// executor values
+		var values map[string]string
+		if err := message.Payload().Unmarshal(&values); err != nil {
+			w.log.Error(err)
+			return
+		}
+		w.executorValues = values
+		w.notify()
+		return
+	}
 	delete(w.dirty, prefix)
 	if !message.Payload().IsEmpty() {
 		var allocated *Alloc
@@ -191,6 +260,65 @@ func (w *Worker) handleMessage(message bus.Message) {
 	w.notify()
 }
 
+func (w *Worker) handleRotate(id string) (err error) {
+	if _, ok := w.state[id]; !ok {
+		err = fmt.Errorf(`allocation %s not found`, id)
+		return
+	}
+	if w.executorInstance == nil {
+		err = fmt.Errorf(`executor for %s is not configured`, w.name)
+		return
+	}
+	rotator, ok := w.executorInstance.Executor.(Rotator)
+	if !ok {
+		err = fmt.Errorf(`%s resources don't support rotation`, w.executorInstance.ExecutorConfig.Nature)
+		return
+	}
+	err = rotator.Rotate(id)
+	return
+}
+
+func (w *Worker) inventory() (res proto.ResourceInventory) {
+	res = proto.ResourceInventory{
+		Kind:        w.name,
+		Allocations: map[string]proto.ResourceAllocation{},
+	}
+	if w.executorInstance != nil {
+		res.Nature = w.executorInstance.ExecutorConfig.Nature
+		res.Properties = w.executorInstance.ExecutorConfig.Properties
+		if reporter, ok := w.executorInstance.Executor.(CapacityReporter); ok {
+			capacity := reporter.Capacity()
+			res.Capacity = &capacity
+		}
+	}
+	for id, alloc := range w.state {
+		_, dirty := w.dirty[id]
+		allocation := proto.ResourceAllocation{
+			Pod:     alloc.PodName,
+			Name:    alloc.Request.Name,
+			Request: alloc.Request.Config,
+			Values:  map[string]string{},
+			Dirty:   dirty,
+		}
+		var values map[string]string
+		if err := alloc.Values.Payload().Unmarshal(&values); err != nil {
+			w.log.Error(err)
+		}
+		for k, v := range values {
+			switch k {
+			case "allocated":
+				allocation.Allocated = v == "true"
+			case "failure":
+				allocation.Failure = v
+			default:
+				allocation.Values[k] = v
+			}
+		}
+		res.Allocations[id] = allocation
+	}
+	return
+}
+
 func (w *Worker) notify() {
 	if len(w.dirty) > 0 {
 		w.log.Debugf("skipping update: state is dirty %v", w.dirty)
@@ -221,8 +349,36 @@ func (w *Worker) notify() {
 			data[id+"."+k] = v
 		}
 	}
-	w.log.Debugf("notify: %v", data)
-	w.consumer.ConsumeMessage(bus.NewMessage(w.name, data))
+	for k, v := range w.executorValues {
+		data[k] = v
+	}
+	message := bus.NewMessage(w.name, data)
+	w.log.Debugf("notify: %v", message)
+	w.consumer.ConsumeMessage(message)
+}
+
+type rotateRequest struct {
+	kind    string
+	id      string
+	resChan chan error
+}
+
+func newRotateRequest(kind, id string) (r rotateRequest) {
+	r = rotateRequest{
+		kind:    kind,
+		id:      id,
+		resChan: make(chan error, 1),
+	}
+	return
+}
+
+func (r rotateRequest) wait(ctx context.Context) (err error) {
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-r.resChan:
+	}
+	return
 }
 
 type workerRequest struct {
@@ -9,6 +9,8 @@ import (
 	"github.com/akaspin/soil/agent/resource"
 	"github.com/akaspin/soil/fixture"
 	"github.com/akaspin/soil/manifest"
+	"github.com/akaspin/soil/proto"
+	"github.com/stretchr/testify/assert"
 	"testing"
 )
 
@@ -311,4 +313,152 @@ func TestWorker_Configure(t *testing.T) {
 			bus.NewMessage("dummy1", map[string]string{}),
 		))
 	})
+	t.Run("1 bad config", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		cons := bus.NewTestingConsumer(ctx)
+		worker := resource.NewWorker(ctx, logx.GetLog(""), "cap", cons, resource.EvaluatorConfig{}, nil)
+		worker.Configure(resource.Config{
+			Nature: "capacity",
+			Kind:   "cap",
+			Properties: map[string]interface{}{
+				"total": 10,
+				"hold":  "1m",
+			},
+		})
+		worker.Submit("1", []manifest.Resource{
+			{Kind: "cap", Name: "a", Config: map[string]interface{}{"amount": 1}},
+		})
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("cap", map[string]string{
+				"1.a.allocated": "false",
+				"1.a.failure":   `"hold" is not supported by capacity nature`,
+				"1.a.__values":  `{"allocated":"false","failure":"\"hold\" is not supported by capacity nature"}`,
+			}),
+		))
+		worker.Submit("1", nil)
+		fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+			bus.NewMessage("cap", map[string]string{}),
+		))
+	})
+}
+
+func TestWorker_ExecutorValues(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cons := bus.NewTestingConsumer(ctx)
+	worker := resource.NewWorker(ctx, logx.GetLog(""), "memory", cons, resource.EvaluatorConfig{}, nil)
+	worker.Configure(resource.Config{
+		Nature:     "capacity",
+		Kind:       "memory",
+		Properties: map[string]interface{}{"total": 1024},
+	})
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+		bus.NewMessage("memory", map[string]string{
+			"__total":     "1024",
+			"__allocated": "0",
+			"__free":      "1024",
+		}),
+	))
+	worker.Submit("1", []manifest.Resource{
+		{Kind: "memory", Name: "main", Config: map[string]interface{}{"amount": 256}},
+	})
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+		bus.NewMessage("memory", map[string]string{
+			"__total":          "1024",
+			"__allocated":      "256",
+			"__free":           "768",
+			"1.main.allocated": "true",
+			"1.main.amount":    "256",
+			"1.main.__values":  `{"allocated":"true","amount":"256"}`,
+		}),
+	))
+	worker.Close()
+}
+
+func TestWorker_Rotate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cons := bus.NewTestingConsumer(ctx)
+	worker := resource.NewWorker(ctx, logx.GetLog(""), "dummy1", cons, resource.EvaluatorConfig{}, nil)
+	defer worker.Close()
+	worker.Configure(resource.Config{
+		Nature: "dummy",
+		Kind:   "dummy1",
+	})
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+		bus.NewMessage("dummy1", map[string]string{}),
+	))
+	worker.Submit("1", []manifest.Resource{
+		{Kind: "dummy1", Name: "main"},
+	})
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+		bus.NewMessage("dummy1", map[string]string{
+			"1.main.allocated": "true",
+			"1.main.__values":  `{"allocated":"true"}`,
+		}),
+	))
+	assert.EqualError(t, worker.Rotate("1.main"), "dummy resources don't support rotation")
+	assert.EqualError(t, worker.Rotate("2.main"), "allocation 2.main not found")
+}
+
+func TestWorker_Inventory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cons := bus.NewTestingConsumer(ctx)
+	worker := resource.NewWorker(ctx, logx.GetLog(""), "memory", cons, resource.EvaluatorConfig{}, nil)
+	defer worker.Close()
+	worker.Configure(resource.Config{
+		Nature:     "capacity",
+		Kind:       "memory",
+		Properties: map[string]interface{}{"total": 1024},
+	})
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+		bus.NewMessage("memory", map[string]string{
+			"__total":     "1024",
+			"__allocated": "0",
+			"__free":      "1024",
+		}),
+	))
+	worker.Submit("1", []manifest.Resource{
+		{Kind: "memory", Name: "main", Config: map[string]interface{}{"amount": 256}},
+		{Kind: "memory", Name: "huge", Config: map[string]interface{}{"amount": 2048}},
+	})
+	fixture.WaitNoError(t, fixture.DefaultWaitConfig(), cons.ExpectLastMessageFn(
+		bus.NewMessage("memory", map[string]string{
+			"__total":          "1024",
+			"__allocated":      "256",
+			"__free":           "768",
+			"1.main.allocated": "true",
+			"1.main.amount":    "256",
+			"1.main.__values":  `{"allocated":"true","amount":"256"}`,
+			"1.huge.allocated": "false",
+			"1.huge.failure":   "not-available",
+			"1.huge.__values":  `{"allocated":"false","failure":"not-available"}`,
+		}),
+	))
+	res, err := worker.Inventory()
+	assert.NoError(t, err)
+	assert.Equal(t, proto.ResourceInventory{
+		Nature:     "capacity",
+		Kind:       "memory",
+		Properties: map[string]interface{}{"total": 1024},
+		Allocations: map[string]proto.ResourceAllocation{
+			"1.main": {
+				Pod:       "1",
+				Name:      "main",
+				Request:   map[string]interface{}{"amount": 256},
+				Allocated: true,
+				Values:    map[string]string{"amount": "256"},
+			},
+			"1.huge": {
+				Pod:     "1",
+				Name:    "huge",
+				Request: map[string]interface{}{"amount": 2048},
+				Values:  map[string]string{},
+				Failure: "not-available",
+			},
+		},
+		Capacity: &proto.ResourceCapacity{Total: 1024, Allocated: 256, Free: 768},
+	}, res)
 }
@@ -39,6 +39,7 @@ func NewArbiter(ctx context.Context, log *logx.Log, name string, config ArbiterC
 	a = &Arbiter{
 		Control:     supervisor.NewControl(ctx),
 		log:         log.GetLog("arbiter", name),
+		name:        name,
 		config:      config,
 		state:       bus.NewMessage(name, nil),
 		entities:    map[string]arbiterEntity{},
@@ -55,6 +56,11 @@ func (a *Arbiter) Open() (err error) {
 	return
 }
 
+// Name returns arbiter name
+func (a *Arbiter) Name() string {
+	return a.name
+}
+
 // Bind entity to arbiter
 func (a *Arbiter) Bind(id string, constraint manifest.Constraint, callback func(error, bus.Message)) {
 	select {
@@ -136,8 +142,8 @@ LOOP:
 			if reg.MatchString(k) {
 				continue LOOP
 			}
-			env[k] = v
 		}
+		env[k] = v
 	}
 	a.env = bus.NewMessage(a.state.GetID(), env)
 }
@@ -222,3 +222,44 @@ func TestArbiter_ConsumeMessage(t *testing.T) {
 	arbiter.Close()
 	arbiter.Wait()
 }
+
+func TestArbiter_ConstraintOnly(t *testing.T) {
+	arbiter := scheduler.NewArbiter(context.Background(), logx.GetLog("test"), "test",
+		scheduler.ArbiterConfig{
+			ConstraintOnly: []*regexp.Regexp{
+				regexp.MustCompile(`^status\.pod\..+`),
+				regexp.MustCompile(`^cluster\.pod\..+`),
+			},
+		},
+	)
+	entity := &dummyArbiterEntity{}
+	assert.NoError(t, arbiter.Open())
+
+	arbiter.Bind("1", manifest.Constraint{
+		"${1}":                    "true",
+		"${status.pod.1}":         "ok",
+		"${cluster.pod.1.placed}": "true",
+	}, entity.notify)
+	arbiter.ConsumeMessage(bus.NewMessage("private", map[string]string{
+		"1":                    "true",
+		"2":                    "true",
+		"status.pod.1":         "ok",
+		"status.pod.2":         "ok",
+		"cluster.pod.1.placed": "true",
+		"cluster.pod.2.placed": "false",
+	}))
+	time.Sleep(time.Millisecond * 100)
+
+	entity.mu.Lock()
+	defer entity.mu.Unlock()
+	assert.Equal(t, []error{nil}, entity.errors)
+	var chunk map[string]string
+	assert.NoError(t, entity.messages[len(entity.messages)-1].Payload().Unmarshal(&chunk))
+	assert.Equal(t, map[string]string{
+		"1": "true",
+		"2": "true",
+	}, chunk)
+
+	arbiter.Close()
+	arbiter.Wait()
+}
@@ -7,6 +7,7 @@ import (
 
 // ConstraintBinder can bind and unbind specific function to specific callback
 type ConstraintBinder interface {
+	Name() string
 	Bind(id string, constraint manifest.Constraint, callback func(reason error, message bus.Message))
 	Unbind(id string, callback func())
 }
@@ -0,0 +1,189 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/lib"
+	"github.com/akaspin/soil/manifest"
+	"github.com/akaspin/soil/proto"
+	"github.com/akaspin/supervisor"
+	"sync"
+	"time"
+)
+
+const DrainMessageID = "drain"
+
+type DrainConfig struct {
+	StatePath     string        // Drain state is not persisted if empty
+	DivertFn      func(on bool) // Called with true on full drain
+	Consumer      bus.Consumer  // Receives "drain" messages with partial drain variables
+	StateConsumer bus.Consumer  // Receives "drain" messages with proto.DrainState
+}
+
+// Drain holds agent drain state. Full drain is performed by DivertFn. Partial
+// drain is propagated to Consumer as "drain.namespace.<namespace>" and
+// "drain.pod.<name>" variables which are checked by pod drain constraint.
+// Drain is lifted automatically after deadline.
+type Drain struct {
+	*supervisor.Control
+	log    *logx.Log
+	config DrainConfig
+
+	mu    sync.Mutex
+	state proto.DrainState
+	timer *time.Timer
+}
+
+func NewDrain(ctx context.Context, log *logx.Log, config DrainConfig) (d *Drain) {
+	d = &Drain{
+		Control: supervisor.NewControl(ctx),
+		log:     log.GetLog("scheduler", "drain"),
+		config:  config,
+	}
+	if config.StatePath != "" {
+		if err := lib.ReadStateFile(config.StatePath, &d.state); err != nil {
+			d.log.Errorf(`can't restore state from %s: %v`, config.StatePath, err)
+		}
+	}
+	return
+}
+
+func (d *Drain) Open() (err error) {
+	d.mu.Lock()
+	d.apply()
+	d.mu.Unlock()
+	go func() {
+		<-d.Control.Ctx().Done()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.timer != nil {
+			d.timer.Stop()
+		}
+	}()
+	err = d.Control.Open()
+	return
+}
+
+// State returns actual drain state
+func (d *Drain) State() (res proto.DrainState) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res = d.state
+	return
+}
+
+// Drain puts agent in drain mode
+func (d *Drain) Drain(req proto.DrainRequest) (err error) {
+	now := time.Now().UTC()
+	next := proto.DrainState{
+		On:         true,
+		Since:      &now,
+		Namespaces: req.Namespaces,
+		Pods:       req.Pods,
+		Deadline:   req.Deadline,
+		Reason:     req.Reason,
+	}
+	if req.TTL != "" {
+		var ttl time.Duration
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			return
+		}
+		deadline := now.Add(ttl)
+		next.Deadline = &deadline
+	}
+	if next.Deadline != nil && !next.Deadline.After(now) {
+		err = fmt.Errorf(`deadline %v is in the past`, next.Deadline)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err = d.commit(next)
+	return
+}
+
+// Undrain lifts drain
+func (d *Drain) Undrain() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err = d.commit(proto.DrainState{})
+	return
+}
+
+func (d *Drain) commit(next proto.DrainState) (err error) {
+	if d.config.StatePath != "" {
+		if err = lib.WriteStateFile(d.config.StatePath, next); err != nil {
+			d.log.Errorf(`can't persist state to %s: %v`, d.config.StatePath, err)
+			return
+		}
+	}
+	d.state = next
+	d.apply()
+	return
+}
+
+// apply propagates drain state and arms deadline timer. Should be called
+// under lock.
+func (d *Drain) apply() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.state.On && d.state.Deadline != nil {
+		if wait := time.Until(*d.state.Deadline); wait > 0 {
+			d.timer = time.AfterFunc(wait, d.expire)
+		} else {
+			d.log.Infof(`drain deadline %v is reached`, d.state.Deadline)
+			d.state = proto.DrainState{}
+			if d.config.StatePath != "" {
+				if err := lib.WriteStateFile(d.config.StatePath, d.state); err != nil {
+					d.log.Errorf(`can't persist state to %s: %v`, d.config.StatePath, err)
+				}
+			}
+		}
+	}
+	d.log.Infof(`drain: on=%t namespaces=%v pods=%v reason="%s"`, d.state.On, d.state.Namespaces, d.state.Pods, d.state.Reason)
+
+	vars := map[string]string{}
+	if d.state.On && d.state.IsPartial() {
+		for _, ns := range d.state.Namespaces {
+			vars["drain.namespace."+ns] = "true"
+		}
+		for _, pod := range d.state.Pods {
+			vars["drain.pod."+pod] = "true"
+		}
+	}
+	if d.config.DivertFn != nil {
+		d.config.DivertFn(d.state.On && !d.state.IsPartial())
+	}
+	if d.config.Consumer != nil {
+		d.config.Consumer.ConsumeMessage(bus.NewMessage(DrainMessageID, vars))
+	}
+	if d.config.StateConsumer != nil {
+		d.config.StateConsumer.ConsumeMessage(bus.NewMessage(DrainMessageID, d.state))
+	}
+}
+
+func (d *Drain) expire() {
+	if d.Control.Ctx().Err() != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.state.Deadline == nil || time.Now().Before(*d.state.Deadline) {
+		return
+	}
+	d.log.Infof(`lifting drain: deadline %v is reached`, d.state.Deadline)
+	d.commit(proto.DrainState{})
+}
+
+// GetDrainConstraint returns constraint which fails when pod is drained by
+// partial drain
+func GetDrainConstraint(pod *manifest.Pod) (res manifest.Constraint) {
+	res = manifest.Constraint{
+		fmt.Sprintf("${agent.drain.namespace.%s|false}", pod.Namespace): "!= true",
+		fmt.Sprintf("${agent.drain.pod.%s|false}", pod.Name):            "!= true",
+	}
+	return
+}
@@ -0,0 +1,127 @@
+// +build ide test_unit
+
+package scheduler_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/scheduler"
+	"github.com/akaspin/soil/fixture"
+	"github.com/akaspin/soil/manifest"
+	"github.com/akaspin/soil/proto"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := "testdata/.test_drain/drain.json"
+	os.RemoveAll("testdata/.test_drain")
+	defer os.RemoveAll("testdata/.test_drain")
+
+	var mu sync.Mutex
+	var diverts []bool
+	divertFn := func(on bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		diverts = append(diverts, on)
+	}
+	expectDiverts := func(expect ...bool) func() error {
+		return func() (err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if fmt.Sprint(diverts) != fmt.Sprint(expect) {
+				err = fmt.Errorf(`not equal (expected)%v != (actual)%v`, expect, diverts)
+			}
+			return
+		}
+	}
+
+	cons := bus.NewTestingConsumer(ctx)
+	drain := scheduler.NewDrain(ctx, logx.GetLog("test"), scheduler.DrainConfig{
+		StatePath: path,
+		DivertFn:  divertFn,
+		Consumer:  cons,
+	})
+	assert.NoError(t, drain.Open())
+
+	t.Run(`0 open`, func(t *testing.T) {
+		fixture.WaitNoError10(t, cons.ExpectMessagesFn(
+			bus.NewMessage("drain", map[string]string{}),
+		))
+		fixture.WaitNoError10(t, expectDiverts(false))
+	})
+	t.Run(`1 partial`, func(t *testing.T) {
+		assert.NoError(t, drain.Drain(proto.DrainRequest{
+			Namespaces: []string{"public"},
+			Pods:       []string{"pod-1"},
+			Reason:     "test",
+		}))
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("drain", map[string]string{
+				"drain.namespace.public": "true",
+				"drain.pod.pod-1":        "true",
+			}),
+		))
+		fixture.WaitNoError10(t, expectDiverts(false, false))
+		state := drain.State()
+		assert.True(t, state.On)
+		assert.Equal(t, "test", state.Reason)
+	})
+	t.Run(`2 restore`, func(t *testing.T) {
+		restoredCons := bus.NewTestingConsumer(ctx)
+		restored := scheduler.NewDrain(ctx, logx.GetLog("test"), scheduler.DrainConfig{
+			StatePath: path,
+			Consumer:  restoredCons,
+		})
+		assert.NoError(t, restored.Open())
+		fixture.WaitNoError10(t, restoredCons.ExpectMessagesFn(
+			bus.NewMessage("drain", map[string]string{
+				"drain.namespace.public": "true",
+				"drain.pod.pod-1":        "true",
+			}),
+		))
+		assert.Equal(t, []string{"pod-1"}, restored.State().Pods)
+	})
+	t.Run(`3 full with deadline`, func(t *testing.T) {
+		assert.Error(t, drain.Drain(proto.DrainRequest{TTL: "-1s"}))
+		assert.NoError(t, drain.Drain(proto.DrainRequest{TTL: "200ms"}))
+		fixture.WaitNoError10(t, expectDiverts(false, false, true))
+		assert.True(t, drain.State().On)
+		time.Sleep(time.Millisecond * 400)
+		fixture.WaitNoError10(t, expectDiverts(false, false, true, false))
+		assert.False(t, drain.State().On)
+	})
+	t.Run(`4 undrain`, func(t *testing.T) {
+		assert.NoError(t, drain.Drain(proto.DrainRequest{Pods: []string{"pod-2"}}))
+		assert.NoError(t, drain.Undrain())
+		fixture.WaitNoError10(t, cons.ExpectLastMessageFn(
+			bus.NewMessage("drain", map[string]string{}),
+		))
+	})
+}
+
+func TestGetDrainConstraint(t *testing.T) {
+	pod := &manifest.Pod{
+		Name:      "pod-1",
+		Namespace: "public",
+	}
+	constraint := scheduler.GetDrainConstraint(pod)
+	assert.NoError(t, constraint.Check(map[string]string{}))
+	assert.NoError(t, constraint.Check(map[string]string{
+		"agent.drain.pod.pod-2": "true",
+	}))
+	assert.Error(t, constraint.Check(map[string]string{
+		"agent.drain.pod.pod-1": "true",
+	}))
+	assert.Error(t, constraint.Check(map[string]string{
+		"agent.drain.namespace.public": "true",
+	}))
+}
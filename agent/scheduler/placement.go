@@ -0,0 +1,440 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/cluster"
+	"github.com/akaspin/soil/manifest"
+	"github.com/akaspin/soil/proto"
+	"github.com/akaspin/supervisor"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PlacementMessageID = "placement"
+
+	placementPrefix               = "placement"
+	defaultPlacementRetryInterval = time.Second * 5
+)
+
+// PlacementKV is cluster storage used to claim placement slots
+type PlacementKV interface {
+	NodeID() string
+	CAS(ctx context.Context, ops []cluster.CASOp) (ok bool, err error)
+	SubscribeKey(key string, ctx context.Context, consumer bus.Consumer)
+}
+
+type PlacementConfig struct {
+	KV            PlacementKV
+	Binder        ConstraintBinder // Evaluates eligibility of node to run pod
+	Consumer      bus.Consumer     // Receives "placement" messages with "pod.<name>.placed" variables
+	RetryInterval time.Duration    // Interval to retry failed claims
+}
+
+// Placement places public pods with "count" on at most "count" eligible
+// nodes in cluster. Each node claims one of "placement/<pod>/<slot>" keys
+// with compare-and-set. Claims are bound to node TTL: slots of dead nodes are
+// claimed by other eligible nodes. Node is eligible to run pod if pod
+// constraint without "resource", "provision" and "cluster" variables and
+// drain constraint are passed.
+//
+// Placement is propagated to Consumer as "pod.<name>.placed" variables which
+// are exposed as "cluster" variables and checked by placement constraint.
+// Public pods without count are always placed.
+type Placement struct {
+	*supervisor.Control
+	log    *logx.Log
+	config PlacementConfig
+
+	wakeChan chan struct{}
+
+	mu       sync.Mutex
+	registry map[string]*manifest.Pod  // public pods
+	eligible map[string]bool           // eligibility by pod
+	claims   map[string]map[int]string // claimed slots with owner node by pod
+	retry    *time.Timer
+
+	// loop state
+	pods      map[string]*placementState
+	published map[string]string
+
+	statusMu sync.Mutex
+	status   map[string]proto.PodPlacementStatus
+}
+
+func NewPlacement(ctx context.Context, log *logx.Log, config PlacementConfig) (p *Placement) {
+	p = &Placement{
+		Control:   supervisor.NewControl(ctx),
+		log:       log.GetLog("scheduler", "placement"),
+		config:    config,
+		wakeChan:  make(chan struct{}, 1),
+		registry:  map[string]*manifest.Pod{},
+		eligible:  map[string]bool{},
+		claims:    map[string]map[int]string{},
+		pods:      map[string]*placementState{},
+		published: map[string]string{},
+		status:    map[string]proto.PodPlacementStatus{},
+	}
+	if p.config.RetryInterval <= 0 {
+		p.config.RetryInterval = defaultPlacementRetryInterval
+	}
+	return
+}
+
+func (p *Placement) Open() (err error) {
+	p.config.Consumer.ConsumeMessage(bus.NewMessage(PlacementMessageID, map[string]string{}))
+	p.config.KV.SubscribeKey(placementPrefix, p.Control.Ctx(), bus.NewFnPipe(func(message bus.Message) bus.Message {
+		p.handleClaims(message)
+		return message
+	}))
+	go p.loop()
+	err = p.Control.Open()
+	return
+}
+
+func (p *Placement) Close() error {
+	p.mu.Lock()
+	if p.retry != nil {
+		p.retry.Stop()
+	}
+	p.mu.Unlock()
+	return p.Control.Close()
+}
+
+// ConsumeMessage accepts cluster registry
+func (p *Placement) ConsumeMessage(message bus.Message) (err error) {
+	var pods manifest.Registry
+	if err = message.Payload().Unmarshal(&pods); err != nil {
+		return
+	}
+	registry := map[string]*manifest.Pod{}
+	for _, pod := range pods {
+		if pod.Namespace == manifest.PublicNamespace {
+			registry[pod.Name] = pod
+		}
+	}
+	p.mu.Lock()
+	p.registry = registry
+	p.mu.Unlock()
+	p.wake()
+	return
+}
+
+// Status returns placement of pods with count
+func (p *Placement) Status() (res map[string]proto.PodPlacementStatus) {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	res = make(map[string]proto.PodPlacementStatus, len(p.status))
+	for name, status := range p.status {
+		res[name] = status
+	}
+	return
+}
+
+// Annotate adds placement to given pod statuses
+func (p *Placement) Annotate(statuses map[string]proto.PodStatus) (res map[string]proto.PodStatus) {
+	res = statuses
+	for name, placement := range p.Status() {
+		if status, ok := res[name]; ok && status.Namespace == manifest.PublicNamespace {
+			placement := placement
+			status.Placement = &placement
+			res[name] = status
+		}
+	}
+	return
+}
+
+func (p *Placement) handleClaims(message bus.Message) {
+	var raw map[string]placementOwner
+	if err := message.Payload().Unmarshal(&raw); err != nil {
+		p.log.Error(err)
+		return
+	}
+	claims := map[string]map[int]string{}
+	for key, owner := range raw {
+		split := strings.LastIndex(key, "/")
+		if split < 0 {
+			p.log.Warningf(`bad claim: %s`, key)
+			continue
+		}
+		slot, err := strconv.Atoi(key[split+1:])
+		if err != nil {
+			p.log.Warningf(`bad claim %s: %v`, key, err)
+			continue
+		}
+		name := key[:split]
+		if _, ok := claims[name]; !ok {
+			claims[name] = map[int]string{}
+		}
+		claims[name][slot] = owner.Node
+	}
+	p.mu.Lock()
+	p.claims = claims
+	p.mu.Unlock()
+	p.wake()
+}
+
+func (p *Placement) setEligible(name string, eligible bool) {
+	p.mu.Lock()
+	p.eligible[name] = eligible
+	p.mu.Unlock()
+	p.wake()
+}
+
+func (p *Placement) wake() {
+	select {
+	case p.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Placement) scheduleRetry() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.retry != nil {
+		return
+	}
+	p.retry = time.AfterFunc(p.config.RetryInterval, func() {
+		p.mu.Lock()
+		p.retry = nil
+		p.mu.Unlock()
+		p.wake()
+	})
+}
+
+func (p *Placement) loop() {
+	p.log.Debug(`open`)
+LOOP:
+	for {
+		select {
+		case <-p.Control.Ctx().Done():
+			break LOOP
+		case <-p.wakeChan:
+			p.reconcile()
+		}
+	}
+	p.log.Debug(`close`)
+}
+
+func (p *Placement) reconcile() {
+	p.mu.Lock()
+	registry := p.registry
+	eligible := make(map[string]bool, len(p.eligible))
+	for k, v := range p.eligible {
+		eligible[k] = v
+	}
+	claims := p.claims
+	p.mu.Unlock()
+
+	// sync registry
+	for name, state := range p.pods {
+		if pod, ok := registry[name]; !ok || (pod.Count == 0 && state.count > 0) {
+			if state.slot >= 0 {
+				p.release(name, state.slot)
+			}
+			if state.count > 0 {
+				p.config.Binder.Unbind(name, func() {})
+				p.mu.Lock()
+				delete(p.eligible, name)
+				p.mu.Unlock()
+			}
+			delete(p.pods, name)
+		}
+	}
+	for name, pod := range registry {
+		state, ok := p.pods[name]
+		if !ok {
+			state = &placementState{
+				slot: -1,
+			}
+			p.pods[name] = state
+		}
+		constraint := p.constraint(pod)
+		if pod.Count > 0 && (state.count == 0 || !reflect.DeepEqual(constraint, state.constraint)) {
+			name := name
+			p.config.Binder.Bind(name, constraint, func(reason error, message bus.Message) {
+				p.setEligible(name, reason == nil)
+			})
+		}
+		state.count = pod.Count
+		state.constraint = constraint
+		state.eligible = eligible[name]
+	}
+
+	// claim slots
+	var failed bool
+	for name, state := range p.pods {
+		if state.count == 0 {
+			continue
+		}
+		if state.slot >= 0 {
+			owner, claimed := claims[name][state.slot]
+			switch {
+			case !state.eligible || state.slot >= state.count:
+				p.release(name, state.slot)
+				state.slot = -1
+			case claimed && owner != p.config.KV.NodeID():
+				p.log.Warningf(`slot %s/%d is claimed by %s`, name, state.slot, owner)
+				state.slot = -1
+			case !claimed:
+				// claim is expired or not yet observed
+				if ok, err := p.claim(name, state.slot); err != nil || !ok {
+					state.slot = -1
+				}
+			}
+		}
+		if state.slot < 0 && state.eligible {
+			state.failure = nil
+			for _, slot := range p.candidates(name, state.count, claims[name]) {
+				ok, err := p.claim(name, slot)
+				if err != nil {
+					state.failure = err
+					failed = true
+					break
+				}
+				if ok {
+					state.slot = slot
+					p.log.Infof(`placed %s in slot %d`, name, slot)
+					break
+				}
+			}
+		}
+	}
+	if failed {
+		p.scheduleRetry()
+	}
+	p.publish(claims)
+}
+
+// candidates returns slots to claim: slots claimed by node in previous run
+// first then free slots
+func (p *Placement) candidates(name string, count int, claims map[int]string) (res []int) {
+	var free []int
+	for slot := 0; slot < count; slot++ {
+		owner, claimed := claims[slot]
+		switch {
+		case !claimed:
+			free = append(free, slot)
+		case owner == p.config.KV.NodeID():
+			res = append(res, slot)
+		}
+	}
+	res = append(res, free...)
+	return
+}
+
+// claim claims slot. Slot already claimed by node is claimed again to bind
+// it to actual node session.
+func (p *Placement) claim(name string, slot int) (ok bool, err error) {
+	value := p.owner()
+	if ok, err = p.config.KV.CAS(p.Control.Ctx(), p.ops(name, slot, value, nil)); err != nil || ok {
+		return
+	}
+	expect := bus.NewPayload(value)
+	ok, err = p.config.KV.CAS(p.Control.Ctx(), p.ops(name, slot, value, &expect))
+	return
+}
+
+func (p *Placement) release(name string, slot int) {
+	expect := bus.NewPayload(p.owner())
+	ok, err := p.config.KV.CAS(p.Control.Ctx(), p.ops(name, slot, nil, &expect))
+	if err != nil {
+		p.log.Warningf(`can't release %s/%d: %v`, name, slot, err)
+		return
+	}
+	if !ok {
+		p.log.Warningf(`%s/%d is not claimed by node`, name, slot)
+		return
+	}
+	p.log.Infof(`released %s slot %d`, name, slot)
+}
+
+func (p *Placement) ops(name string, slot int, value interface{}, expect *bus.Payload) (res []cluster.CASOp) {
+	res = []cluster.CASOp{
+		{
+			Message: bus.NewMessage(cluster.NormalizeKey(placementPrefix, name, strconv.Itoa(slot)), value),
+			Expect:  expect,
+			WithTTL: true,
+		},
+	}
+	return
+}
+
+func (p *Placement) owner() (res map[string]string) {
+	res = map[string]string{
+		"node": p.config.KV.NodeID(),
+	}
+	return
+}
+
+// constraint returns constraint to evaluate eligibility of node
+func (p *Placement) constraint(pod *manifest.Pod) (res manifest.Constraint) {
+	res = pod.Constraint.FilterOut("resource", "provision", "cluster", "__").Merge(GetDrainConstraint(pod))
+	return
+}
+
+func (p *Placement) publish(claims map[string]map[int]string) {
+	variables := map[string]string{}
+	status := map[string]proto.PodPlacementStatus{}
+	for name, state := range p.pods {
+		placed := state.count == 0 || state.slot >= 0
+		variables[fmt.Sprintf("pod.%s.placed", name)] = strconv.FormatBool(placed)
+		variables[fmt.Sprintf("pod.%s.count", name)] = strconv.Itoa(state.count)
+		if state.count == 0 {
+			continue
+		}
+		podStatus := proto.PodPlacementStatus{
+			Count:  state.count,
+			Placed: placed,
+		}
+		for slot, node := range claims[name] {
+			if slot < state.count {
+				podStatus.Nodes = append(podStatus.Nodes, node)
+			}
+		}
+		sort.Strings(podStatus.Nodes)
+		if state.failure != nil {
+			podStatus.Failure = state.failure.Error()
+		}
+		status[name] = podStatus
+	}
+	p.statusMu.Lock()
+	p.status = status
+	p.statusMu.Unlock()
+
+	if reflect.DeepEqual(variables, p.published) {
+		return
+	}
+	p.published = variables
+	p.config.Consumer.ConsumeMessage(bus.NewMessage(PlacementMessageID, variables))
+}
+
+// GetPlacementConstraint returns constraint which passes only if public pod
+// is placed on node
+func GetPlacementConstraint(pod *manifest.Pod) (res manifest.Constraint) {
+	res = manifest.Constraint{}
+	if pod.Namespace != manifest.PublicNamespace {
+		return
+	}
+	res[fmt.Sprintf("${cluster.pod.%s.placed}", pod.Name)] = "true"
+	return
+}
+
+type placementState struct {
+	count      int
+	constraint manifest.Constraint
+	eligible   bool
+	slot       int // claimed slot or -1
+	failure    error
+}
+
+type placementOwner struct {
+	Node string `json:"node"`
+}
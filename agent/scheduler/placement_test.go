@@ -0,0 +1,244 @@
+// +build ide test_unit
+
+package scheduler_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/akaspin/logx"
+	"github.com/akaspin/soil/agent/bus"
+	"github.com/akaspin/soil/agent/cluster"
+	"github.com/akaspin/soil/agent/scheduler"
+	"github.com/akaspin/soil/fixture"
+	"github.com/akaspin/soil/manifest"
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testingPlacementStore is in-memory CAS storage shared by testing nodes.
+// Volatile records are bound to node and removed on expire.
+type testingPlacementStore struct {
+	mu          sync.Mutex
+	data        map[string]interface{}
+	owners      map[string]string
+	subscribers []testingPlacementSubscriber
+}
+
+type testingPlacementSubscriber struct {
+	key      string
+	ctx      context.Context
+	consumer bus.Consumer
+}
+
+func (s *testingPlacementStore) expire(node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, owner := range s.owners {
+		if owner == node {
+			delete(s.data, key)
+			delete(s.owners, key)
+		}
+	}
+	s.broadcast()
+}
+
+func (s *testingPlacementStore) broadcast() {
+	for _, sub := range s.subscribers {
+		select {
+		case <-sub.ctx.Done():
+			continue
+		default:
+		}
+		payload := map[string]interface{}{}
+		for k, v := range s.data {
+			if strings.HasPrefix(k, sub.key+"/") {
+				payload[strings.TrimPrefix(k, sub.key+"/")] = v
+			}
+		}
+		sub.consumer.ConsumeMessage(bus.NewMessage(sub.key, payload))
+	}
+}
+
+type testingPlacementKV struct {
+	id    string
+	store *testingPlacementStore
+}
+
+func (k *testingPlacementKV) NodeID() string {
+	return k.id
+}
+
+func (k *testingPlacementKV) CAS(ctx context.Context, ops []cluster.CASOp) (ok bool, err error) {
+	k.store.mu.Lock()
+	defer k.store.mu.Unlock()
+	for _, op := range ops {
+		current, exists := k.store.data[op.Message.GetID()]
+		if op.Expect == nil && exists {
+			return
+		}
+		if op.Expect != nil {
+			var expect interface{}
+			if err = op.Expect.Unmarshal(&expect); err != nil || !exists || !reflect.DeepEqual(current, expect) {
+				return
+			}
+		}
+	}
+	for _, op := range ops {
+		if op.Message.Payload().IsEmpty() {
+			delete(k.store.data, op.Message.GetID())
+			delete(k.store.owners, op.Message.GetID())
+			continue
+		}
+		var value interface{}
+		if err = op.Message.Payload().Unmarshal(&value); err != nil {
+			return
+		}
+		k.store.data[op.Message.GetID()] = value
+		if op.WithTTL {
+			k.store.owners[op.Message.GetID()] = k.id
+		}
+	}
+	ok = true
+	k.store.broadcast()
+	return
+}
+
+func (k *testingPlacementKV) SubscribeKey(key string, ctx context.Context, consumer bus.Consumer) {
+	k.store.mu.Lock()
+	defer k.store.mu.Unlock()
+	k.store.subscribers = append(k.store.subscribers, testingPlacementSubscriber{
+		key:      key,
+		ctx:      ctx,
+		consumer: consumer,
+	})
+	k.store.broadcast()
+}
+
+func TestPlacement(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &testingPlacementStore{
+		data:   map[string]interface{}{},
+		owners: map[string]string{},
+	}
+	type node struct {
+		cancel    context.CancelFunc
+		arbiter   *scheduler.Arbiter
+		placement *scheduler.Placement
+		consumer  *bus.TestingConsumer
+	}
+	var nodes []node
+	for i := 0; i < 3; i++ {
+		nodeCtx, nodeCancel := context.WithCancel(ctx)
+		arbiter := scheduler.NewArbiter(nodeCtx, logx.GetLog("test"), "placement", scheduler.ArbiterConfig{
+			Required: manifest.Constraint{"${agent.drain}": "!= true"},
+		})
+		assert.NoError(t, arbiter.Open())
+		arbiter.ConsumeMessage(bus.NewMessage("private", map[string]string{
+			"meta.role":   "worker",
+			"agent.drain": "false",
+		}))
+		consumer := bus.NewTestingConsumer(nodeCtx)
+		placement := scheduler.NewPlacement(nodeCtx, logx.GetLog("test"), scheduler.PlacementConfig{
+			KV: &testingPlacementKV{
+				id:    fmt.Sprintf("node-%d", i),
+				store: store,
+			},
+			Binder:        arbiter,
+			Consumer:      consumer,
+			RetryInterval: time.Millisecond * 100,
+		})
+		assert.NoError(t, placement.Open())
+		nodes = append(nodes, node{
+			cancel:    nodeCancel,
+			arbiter:   arbiter,
+			placement: placement,
+			consumer:  consumer,
+		})
+	}
+	registry := bus.NewMessage("registry", manifest.Registry{
+		{
+			Namespace:  "public",
+			Name:       "counted",
+			Count:      2,
+			Constraint: manifest.Constraint{"${meta.role}": "worker"},
+		},
+		{
+			Namespace: "public",
+			Name:      "everywhere",
+		},
+	})
+	expectPlaced := func(expect int, alive ...int) func() error {
+		return func() (err error) {
+			var placed int
+			for _, i := range alive {
+				status, ok := nodes[i].placement.Status()["counted"]
+				if !ok {
+					return fmt.Errorf(`node-%d: no status`, i)
+				}
+				if len(status.Nodes) != expect {
+					return fmt.Errorf(`node-%d: nodes %v`, i, status.Nodes)
+				}
+				if status.Placed {
+					placed++
+				}
+			}
+			if placed != expect {
+				err = fmt.Errorf(`placed on %d nodes`, placed)
+			}
+			return
+		}
+	}
+	var evicted int
+
+	t.Run(`place`, func(t *testing.T) {
+		for _, n := range nodes {
+			n.placement.ConsumeMessage(registry)
+		}
+		fixture.WaitNoError10(t, expectPlaced(2, 0, 1, 2))
+	})
+	t.Run(`re-place on expire`, func(t *testing.T) {
+		for i, n := range nodes {
+			if n.placement.Status()["counted"].Placed {
+				evicted = i
+				break
+			}
+		}
+		nodes[evicted].cancel()
+		store.expire(fmt.Sprintf("node-%d", evicted))
+		var alive []int
+		for i := range nodes {
+			if i != evicted {
+				alive = append(alive, i)
+			}
+		}
+		fixture.WaitNoError10(t, expectPlaced(2, alive...))
+	})
+	t.Run(`drain`, func(t *testing.T) {
+		var alive []int
+		for i := range nodes {
+			if i != evicted {
+				alive = append(alive, i)
+			}
+		}
+		nodes[alive[0]].arbiter.ConsumeMessage(bus.NewMessage("private", map[string]string{
+			"meta.role":   "worker",
+			"agent.drain": "true",
+		}))
+		fixture.WaitNoError10(t, expectPlaced(1, alive...))
+		assert.False(t, nodes[alive[0]].placement.Status()["counted"].Placed)
+		fixture.WaitNoError10(t, nodes[alive[0]].consumer.ExpectLastMessageFn(
+			bus.NewMessage("placement", map[string]string{
+				"pod.counted.placed":    "false",
+				"pod.counted.count":     "2",
+				"pod.everywhere.placed": "true",
+				"pod.everywhere.count":  "0",
+			}),
+		))
+	})
+}
@@ -7,31 +7,130 @@ import (
 	"github.com/akaspin/soil/agent/allocation"
 	"github.com/akaspin/soil/agent/bus"
 	"github.com/akaspin/soil/manifest"
+	"github.com/akaspin/soil/proto"
 	"github.com/akaspin/supervisor"
+	"golang.org/x/crypto/ed25519"
+	"sync"
 )
 
+// SinkConfig defines verification of pods from cluster registry
+type SinkConfig struct {
+	Signed      bool                // Require signatures of pods from cluster registry
+	TrustedKeys []ed25519.PublicKey // Keys to verify signatures
+}
+
+// Sink submits pods from local and cluster registries to bounded evaluators.
+// Registry from cluster is not evaluated until sink is configured. Sink
+// produces pods accepted from cluster registry to subscribers.
 type Sink struct {
 	*supervisor.Control
 	log               *logx.Log
 	boundedEvaluators []BoundedEvaluator
 
 	state *SinkState
+
+	clusterMu   sync.Mutex
+	config      SinkConfig
+	configured  bool
+	cluster     manifest.Registry // last registry from cluster
+	received    bool
+	accepted    manifest.Registry // accepted pods from cluster registry
+	subscribers []sinkSubscriber
+
+	statusMu sync.Mutex
+	status   map[string]proto.PodStatus
+	rejected map[string]proto.PodStatus // rejected pods from cluster registry
 }
 
+// ConsumeMessage accepts registry from cluster. If signatures are required
+// unsigned and badly signed pods are rejected.
 func (s *Sink) ConsumeMessage(message bus.Message) (err error) {
 	var pods manifest.Registry
 	if err = message.Payload().Unmarshal(&pods); err != nil {
 		return
 	}
-	s.ConsumeRegistry(pods)
+	s.clusterMu.Lock()
+	defer s.clusterMu.Unlock()
+	s.cluster = pods
+	s.received = true
+	if !s.configured {
+		s.log.Debug(`cluster registry is received before configuration`)
+		return
+	}
+	s.consumeCluster()
 	return
 }
 
+// Configure sets verification of pods from cluster registry and re-evaluates
+// last received registry
+func (s *Sink) Configure(config SinkConfig) {
+	s.clusterMu.Lock()
+	defer s.clusterMu.Unlock()
+	s.config = config
+	s.configured = true
+	if s.received {
+		s.consumeCluster()
+	}
+}
+
+// Subscribe subscribes consumer to pods accepted from cluster registry
+func (s *Sink) Subscribe(ctx context.Context, consumer bus.Consumer) {
+	s.clusterMu.Lock()
+	defer s.clusterMu.Unlock()
+	s.subscribers = append(s.subscribers, sinkSubscriber{
+		ctx:      ctx,
+		consumer: consumer,
+	})
+	if s.accepted != nil {
+		consumer.ConsumeMessage(bus.NewMessage("registry", s.accepted))
+	}
+}
+
+func (s *Sink) consumeCluster() {
+	byNamespace := map[string]manifest.Registry{}
+	rejected := map[string]proto.PodStatus{}
+	accepted := manifest.Registry{}
+	for _, pod := range s.cluster {
+		if _, ok := byNamespace[pod.Namespace]; !ok {
+			byNamespace[pod.Namespace] = manifest.Registry{}
+		}
+		if s.config.Signed {
+			if err := pod.Verify(s.config.TrustedKeys...); err != nil {
+				s.log.Errorf(`rejected %s: %v`, pod.Name, err)
+				rejected[pod.Name] = proto.PodStatus{
+					Name:      pod.Name,
+					Namespace: pod.Namespace,
+					Mark:      pod.Mark(),
+					Rejection: err.Error(),
+				}
+				continue
+			}
+		}
+		byNamespace[pod.Namespace] = append(byNamespace[pod.Namespace], pod)
+		accepted = append(accepted, pod)
+	}
+	s.statusMu.Lock()
+	s.rejected = rejected
+	s.statusMu.Unlock()
+	s.syncNamespaces(byNamespace)
+	s.accepted = accepted
+	for _, sub := range s.subscribers {
+		select {
+		case <-sub.ctx.Done():
+			continue
+		default:
+		}
+		sub.consumer.ConsumeMessage(bus.NewMessage("registry", accepted))
+	}
+}
+
 func NewSink(ctx context.Context, log *logx.Log, state allocation.Recovery, boundedEvaluators ...BoundedEvaluator) (s *Sink) {
 	s = &Sink{
 		Control:           supervisor.NewControl(ctx),
 		log:               log.GetLog("scheduler", "sink"),
 		boundedEvaluators: boundedEvaluators,
+		status:            map[string]proto.PodStatus{},
+		rejected:          map[string]proto.PodStatus{},
 	}
 	dirty := map[string]string{}
 	for _, recovered := range state {
@@ -46,7 +145,10 @@ func (s *Sink) ConsumeRegistry(registry manifest.Registry) {
 	for _, pod := range registry {
 		byNamespace[pod.Namespace] = append(byNamespace[pod.Namespace], pod)
 	}
+	s.syncNamespaces(byNamespace)
+}
 
+func (s *Sink) syncNamespaces(byNamespace map[string]manifest.Registry) {
 	for ns, r := range byNamespace {
 		s.log.Debugf("submitting: %s", ns)
 		changes := s.state.SyncNamespace(ns, r)
@@ -61,11 +163,44 @@ func (s *Sink) ConsumeRegistry(registry manifest.Registry) {
 		}
 		s.log.Infof("submitted changes: %v", report)
 	}
+}
 
+// Status returns scheduling status of registered pods with arbiter verdicts
+// and rejected pods from cluster registry
+func (s *Sink) Status() (res map[string]proto.PodStatus) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	res = make(map[string]proto.PodStatus, len(s.status)+len(s.rejected))
+	for name, status := range s.rejected {
+		res[name] = status
+	}
+	for name, status := range s.status {
+		arbiters := make(map[string]proto.PodArbiterStatus, len(status.Arbiters))
+		for k, v := range status.Arbiters {
+			arbiters[k] = v
+		}
+		status.Arbiters = arbiters
+		res[name] = status
+	}
+	return
 }
 
 func (s *Sink) submitToEvaluators(id string, pod *manifest.Pod) {
 	s.log.Debugf("submitting %s to %d arbiters", id, len(s.boundedEvaluators))
+	var mark uint64
+	s.statusMu.Lock()
+	if pod == nil {
+		delete(s.status, id)
+	} else {
+		mark = pod.Mark()
+		s.status[id] = proto.PodStatus{
+			Name:      id,
+			Namespace: pod.Namespace,
+			Mark:      mark,
+			Arbiters:  map[string]proto.PodArbiterStatus{},
+		}
+	}
+	s.statusMu.Unlock()
 	for _, me := range s.boundedEvaluators {
 		func(me BoundedEvaluator, pod *manifest.Pod) {
 			if pod == nil {
@@ -77,9 +212,10 @@ func (s *Sink) submitToEvaluators(id string, pod *manifest.Pod) {
 			}
 
 			s.log.Tracef(`register "%s"`, id)
-			constraint := me.evaluator.GetConstraint(pod)
+			constraint := me.evaluator.GetConstraint(pod).Merge(GetDrainConstraint(pod), GetPlacementConstraint(pod))
 			me.binder.Bind(id, constraint, func(reason error, message bus.Message) {
 				s.log.Tracef(`received %v for "%s"`, reason, id)
+				s.setArbiterStatus(id, mark, me.binder.Name(), reason)
 				if reason != nil {
 					me.evaluator.Deallocate(id)
 					return
@@ -94,3 +230,24 @@ func (s *Sink) submitToEvaluators(id string, pod *manifest.Pod) {
 	}
 	return
 }
+
+func (s *Sink) setArbiterStatus(id string, mark uint64, arbiter string, reason error) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	status, ok := s.status[id]
+	if !ok || status.Mark != mark {
+		return
+	}
+	verdict := proto.PodArbiterStatus{
+		Accepted: reason == nil,
+	}
+	if reason != nil {
+		verdict.Failure = reason.Error()
+	}
+	status.Arbiters[arbiter] = verdict
+}
+
+type sinkSubscriber struct {
+	ctx      context.Context
+	consumer bus.Consumer
+}
@@ -4,14 +4,20 @@ package scheduler_test
 
 import (
 	"context"
+	"fmt"
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent/bus"
 	"github.com/akaspin/soil/agent/scheduler"
+	"github.com/akaspin/soil/fixture"
 	"github.com/akaspin/soil/lib"
 	"github.com/akaspin/soil/manifest"
+	"github.com/akaspin/soil/proto"
 	"github.com/akaspin/supervisor"
 	"github.com/mitchellh/hashstructure"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"reflect"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -205,6 +211,12 @@ func TestSink_ConsumeRegistry(t *testing.T) {
 				{alloc: false, pod: 0x0, env: 0x0},
 			},
 		}, "drain")
+		status := sink.Status()
+		assert.Equal(t, proto.PodArbiterStatus{
+			Failure: `constraint failed: "true":"!= true" ("${drain}":"!= true")`,
+		}, status["first"].Arbiters["a1"])
+		assert.Equal(t, "private", status["first"].Namespace)
+		assert.Equal(t, uint64(0x5adf1b783ee18a25), status["first"].Mark)
 	})
 	t.Run("7 remove drain", func(t *testing.T) {
 		arbiter1.ConsumeMessage(bus.NewMessage("", map[string]string{
@@ -236,3 +248,164 @@ func TestSink_ConsumeRegistry(t *testing.T) {
 	sv.Close()
 	sv.Wait()
 }
+
+func TestSink_Configure(t *testing.T) {
+	ctx := context.Background()
+	log := logx.GetLog("test")
+
+	trusted, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	arbiter1 := scheduler.NewArbiter(ctx, log, "a1", scheduler.ArbiterConfig{})
+	evaluator1 := &dummyEv{}
+	sink := scheduler.NewSink(ctx, log, nil, scheduler.NewBoundedEvaluator(arbiter1, evaluator1))
+	sv := supervisor.NewChain(ctx, arbiter1, sink)
+	assert.NoError(t, sv.Open())
+	arbiter1.ConsumeMessage(bus.NewMessage("", map[string]string{
+		"cluster.pod.signed.placed":   "true",
+		"cluster.pod.unsigned.placed": "true",
+	}))
+
+	signed := &manifest.Pod{Namespace: manifest.PublicNamespace, Name: "signed", Target: "multi-user.target"}
+	assert.NoError(t, signed.Sign(key))
+	unsigned := &manifest.Pod{Namespace: manifest.PublicNamespace, Name: "unsigned", Target: "multi-user.target"}
+
+	allocated := func(names ...string) func() error {
+		return func() (err error) {
+			evaluator1.mu.Lock()
+			defer evaluator1.mu.Unlock()
+			var res []string
+			for name, records := range evaluator1.records {
+				if records[len(records)-1].alloc {
+					res = append(res, name)
+				}
+			}
+			sort.Strings(res)
+			if !reflect.DeepEqual(res, names) {
+				err = fmt.Errorf(`unexpected allocations: %v`, res)
+			}
+			return
+		}
+	}
+
+	t.Run(`reject unsigned`, func(t *testing.T) {
+		sink.Configure(scheduler.SinkConfig{
+			Signed:      true,
+			TrustedKeys: []ed25519.PublicKey{trusted},
+		})
+		sink.ConsumeMessage(bus.NewMessage("registry", manifest.Registry{signed, unsigned}))
+		fixture.WaitNoError10(t, allocated("signed"))
+
+		status := sink.Status()
+		assert.Empty(t, status["signed"].Rejection)
+		assert.Equal(t, manifest.PublicNamespace, status["unsigned"].Namespace)
+		assert.Equal(t, "pod unsigned is not signed", status["unsigned"].Rejection)
+	})
+	t.Run(`reject untrusted`, func(t *testing.T) {
+		other, _, err := ed25519.GenerateKey(nil)
+		assert.NoError(t, err)
+		sink.Configure(scheduler.SinkConfig{
+			Signed:      true,
+			TrustedKeys: []ed25519.PublicKey{other},
+		})
+		fixture.WaitNoError10(t, allocated())
+		assert.Equal(t, "signature of pod signed is not trusted", sink.Status()["signed"].Rejection)
+	})
+	t.Run(`disable`, func(t *testing.T) {
+		sink.Configure(scheduler.SinkConfig{})
+		fixture.WaitNoError10(t, allocated("signed", "unsigned"))
+		assert.Empty(t, sink.Status()["unsigned"].Rejection)
+	})
+
+	sv.Close()
+	sv.Wait()
+}
+
+func TestSink_Subscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	log := logx.GetLog("test")
+
+	trusted, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	placementArbiter := scheduler.NewArbiter(ctx, log, "placement", scheduler.ArbiterConfig{})
+	assert.NoError(t, placementArbiter.Open())
+	placementArbiter.ConsumeMessage(bus.NewMessage("private", map[string]string{
+		"agent.drain": "false",
+	}))
+	store := &testingPlacementStore{
+		data:   map[string]interface{}{},
+		owners: map[string]string{},
+	}
+	placement := scheduler.NewPlacement(ctx, log, scheduler.PlacementConfig{
+		KV: &testingPlacementKV{
+			id:    "node-0",
+			store: store,
+		},
+		Binder:        placementArbiter,
+		Consumer:      bus.NewTestingConsumer(ctx),
+		RetryInterval: time.Millisecond * 100,
+	})
+	assert.NoError(t, placement.Open())
+
+	arbiter1 := scheduler.NewArbiter(ctx, log, "a1", scheduler.ArbiterConfig{})
+	evaluator1 := &dummyEv{}
+	sink := scheduler.NewSink(ctx, log, nil, scheduler.NewBoundedEvaluator(arbiter1, evaluator1))
+	sv := supervisor.NewChain(ctx, arbiter1, sink)
+	assert.NoError(t, sv.Open())
+	sink.Subscribe(ctx, placement)
+
+	signed := &manifest.Pod{Namespace: manifest.PublicNamespace, Name: "signed", Count: 1}
+	assert.NoError(t, signed.Sign(key))
+	unsigned := &manifest.Pod{Namespace: manifest.PublicNamespace, Name: "unsigned", Count: 1}
+
+	claimed := func(expect ...string) func() error {
+		return func() (err error) {
+			store.mu.Lock()
+			defer store.mu.Unlock()
+			var res []string
+			for k := range store.data {
+				res = append(res, k)
+			}
+			sort.Strings(res)
+			if !reflect.DeepEqual(res, expect) {
+				err = fmt.Errorf(`unexpected claims: %v`, res)
+			}
+			return
+		}
+	}
+
+	t.Run(`not configured`, func(t *testing.T) {
+		sink.ConsumeMessage(bus.NewMessage("registry", manifest.Registry{signed, unsigned}))
+		time.Sleep(time.Millisecond * 200)
+		assert.NoError(t, claimed()())
+		assert.Empty(t, placement.Status())
+		evaluator1.mu.Lock()
+		assert.Empty(t, evaluator1.records)
+		evaluator1.mu.Unlock()
+	})
+	t.Run(`rejected pod is not placed`, func(t *testing.T) {
+		sink.Configure(scheduler.SinkConfig{
+			Signed:      true,
+			TrustedKeys: []ed25519.PublicKey{trusted},
+		})
+		fixture.WaitNoError10(t, claimed("placement/signed/0"))
+		fixture.WaitNoError10(t, func() error {
+			if !placement.Status()["signed"].Placed {
+				return fmt.Errorf(`signed is not placed`)
+			}
+			return nil
+		})
+		_, ok := placement.Status()["unsigned"]
+		assert.False(t, ok)
+		assert.Equal(t, "pod unsigned is not signed", sink.Status()["unsigned"].Rejection)
+	})
+	t.Run(`disable`, func(t *testing.T) {
+		sink.Configure(scheduler.SinkConfig{})
+		fixture.WaitNoError10(t, claimed("placement/signed/0", "placement/unsigned/0"))
+	})
+
+	sv.Close()
+	sv.Wait()
+}
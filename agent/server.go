@@ -8,6 +8,7 @@ import (
 	"github.com/akaspin/soil/agent/api/api-server"
 	"github.com/akaspin/soil/agent/bus"
 	"github.com/akaspin/soil/agent/cluster"
+	"github.com/akaspin/soil/agent/metadata"
 	"github.com/akaspin/soil/agent/provision"
 	"github.com/akaspin/soil/agent/resource"
 	"github.com/akaspin/soil/agent/scheduler"
@@ -15,6 +16,7 @@ import (
 	"github.com/akaspin/soil/manifest"
 	"github.com/akaspin/soil/proto"
 	"github.com/akaspin/supervisor"
+	"path/filepath"
 	"regexp"
 )
 
@@ -25,6 +27,7 @@ type ServerOptions struct {
 	ConfigPath []string
 	Address    string
 	Meta       map[string]string
+	StateDir   string // Directory to persist agent state. State is not persisted if empty
 }
 
 // Agent instance
@@ -36,13 +39,28 @@ type Server struct {
 	sv supervisor.Component
 
 	confPipe          bus.Consumer
+	metaPipe          bus.Consumer
+	metaSources       *metadata.Sources
+	agentPipe         bus.Consumer
+	announcer         *nodeAnnouncer
+	podAnnouncer      *podAnnouncer
+	clusterPodsPipe   bus.Consumer
+	drain             *scheduler.Drain
+	placement         *scheduler.Placement
+	election          *cluster.Election
 	resourceEvaluator *resource.Evaluator
 	sink              *scheduler.Sink
 	kv                *cluster.KV
+	registryHistory   *api.RegistryHistory
 	api               *api_server.Router
 	endpoints         struct {
-		registryGet    *api_server.Endpoint
-		statusNodesGet *api_server.Endpoint
+		registryGet          *api_server.Endpoint
+		statusNodesGet       *api_server.Endpoint
+		statusMetaSourcesGet *api_server.Endpoint
+		statusNodeGet        *api_server.Endpoint
+		statusPodsGet        *api_server.Endpoint
+		clusterPodsGet       *api_server.Endpoint
+		resourcesGet         *api_server.Endpoint
 	}
 }
 
@@ -52,7 +70,7 @@ func NewServer(ctx context.Context, log *logx.Log, options ServerOptions) (s *Se
 		log:     log.GetLog("server"),
 		options: options,
 	}
-	s.kv = cluster.NewKV(ctx, log, cluster.DefaultBackendFactory)
+	s.kv = cluster.NewKV(ctx, log, cluster.NewBackendFactory(options.StateDir))
 
 	var state allocation.Recovery
 	if recoveryErr := state.FromFilesystem(allocation.DefaultSystemPaths(), allocation.DefaultDbusDiscoveryFunc); recoveryErr != nil {
@@ -61,15 +79,33 @@ func NewServer(ctx context.Context, log *logx.Log, options ServerOptions) (s *Se
 
 	systemPaths := allocation.DefaultSystemPaths()
 
+	s.endpoints.statusNodeGet = api.NewStatusNodeGet(log, func() (res proto.ClusterStatus) {
+		res = s.kv.Status()
+		res.Leader, res.IsLeader = s.election.Leader()
+		return
+	}, func() map[string]proto.ResourceWorkerStatus {
+		return s.resourceEvaluator.Status()
+	})
+	statusNodeConsumer := s.endpoints.statusNodeGet.Processor().(bus.Consumer)
+	s.endpoints.statusPodsGet = api.NewStatusPodsGet(log, func() map[string]proto.PodStatus {
+		return s.placement.Annotate(s.sink.Status())
+	})
+	statusPodsConsumer := s.endpoints.statusPodsGet.Processor().(bus.Consumer)
+	s.endpoints.resourcesGet = api.NewResourcesGet(func() map[string]proto.ResourceInventory {
+		return s.resourceEvaluator.Inventory()
+	})
+
 	// Resource
 	resourceArbiter := scheduler.NewArbiter(ctx, log, "resource", scheduler.ArbiterConfig{
 		Required: manifest.Constraint{"${agent.drain}": "!= true"},
 		ConstraintOnly: []*regexp.Regexp{
 			regexp.MustCompile(`^provision\..+`),
+			regexp.MustCompile(`^agent\.drain\..+`),
+			regexp.MustCompile(`^cluster\.pod\..+`),
 		},
 	})
 	resourceDrainPipe := bus.NewDivertPipe(resourceArbiter, bus.NewMessage("private", map[string]string{"agent.drain": "true"}))
-	resourceCompositePipe := bus.NewCompositePipe("private", log, resourceDrainPipe, "meta", "system", "resource", "provision")
+	resourceCompositePipe := bus.NewCompositePipe("private", log, resourceDrainPipe, "meta", "system", "host", "agent", "resource", "provision", "cluster")
 
 	// provision
 	provisionArbiter := scheduler.NewArbiter(ctx, log, "provision",
@@ -77,43 +113,103 @@ func NewServer(ctx context.Context, log *logx.Log, options ServerOptions) (s *Se
 			Required: manifest.Constraint{"${agent.drain}": "!= true"},
 			ConstraintOnly: []*regexp.Regexp{
 				regexp.MustCompile(`^provision\..+`),
+				regexp.MustCompile(`^agent\.drain\..+`),
+				regexp.MustCompile(`^cluster\.pod\..+`),
 			},
 		})
 	provisionDrainPipe := bus.NewDivertPipe(provisionArbiter, bus.NewMessage("private", map[string]string{"agent.drain": "true"}))
-	provisionCompositePipe := bus.NewCompositePipe("private", log, provisionDrainPipe, "meta", "system", "resource", "provision")
+	provisionCompositePipe := bus.NewCompositePipe("private", log, provisionDrainPipe, "meta", "system", "host", "agent", "resource", "provision", "cluster")
 
-	s.confPipe = bus.NewTeePipe(resourceCompositePipe, provisionCompositePipe)
+	// placement
+	placementArbiter := scheduler.NewArbiter(ctx, log, "placement", scheduler.ArbiterConfig{
+		Required: manifest.Constraint{"${agent.drain}": "!= true"},
+	})
+	placementDrainPipe := bus.NewDivertPipe(placementArbiter, bus.NewMessage("private", map[string]string{"agent.drain": "true"}))
+	placementCompositePipe := bus.NewCompositePipe("private", log, placementDrainPipe, "meta", "system", "host", "agent")
+	clusterPipe := bus.NewMergePipe("cluster", log, bus.NewTeePipe(resourceCompositePipe, provisionCompositePipe), scheduler.PlacementMessageID, cluster.ElectionMessageID, clusterPodsMessageID)
+	s.placement = scheduler.NewPlacement(ctx, log, scheduler.PlacementConfig{
+		KV:       s.kv,
+		Binder:   placementArbiter,
+		Consumer: clusterPipe,
+	})
+	s.election = cluster.NewElection(ctx, log, cluster.ElectionConfig{
+		KV:       s.kv,
+		Consumer: clusterPipe,
+	})
 
-	drainFn := func(on bool) {
-		resourceDrainPipe.Divert(on)
-		provisionDrainPipe.Divert(on)
-	}
+	s.confPipe = bus.NewTeePipe(resourceCompositePipe, provisionCompositePipe, placementCompositePipe, statusNodeConsumer)
+
+	s.announcer = newNodeAnnouncer(s.kv.VolatileStore("nodes"))
+	s.podAnnouncer = newPodAnnouncer(s.kv.VolatileStore("status"), func() map[string]proto.PodStatus {
+		return s.sink.Status()
+	})
+	s.clusterPodsPipe = newRunningCountPipe(clusterPipe)
+	s.metaPipe = bus.NewMergePipe("meta", log, bus.NewTeePipe(s.confPipe, s.announcer), "config", metadata.SourcesMessageID, metadata.RuntimeMessageID)
+	metaRuntime := metadata.NewRuntime(ctx, log, s.statePath("meta.json"), s.metaPipe)
+
+	s.agentPipe = bus.NewMergePipe("agent", log, s.confPipe, "config", scheduler.DrainMessageID)
+	s.drain = scheduler.NewDrain(ctx, log, scheduler.DrainConfig{
+		StatePath: s.statePath("drain.json"),
+		DivertFn: func(on bool) {
+			resourceDrainPipe.Divert(on)
+			provisionDrainPipe.Divert(on)
+			placementDrainPipe.Divert(on)
+		},
+		Consumer:      s.agentPipe,
+		StateConsumer: bus.NewTeePipe(s.announcer, statusNodeConsumer),
+	})
 
 	s.endpoints.statusNodesGet = api.NewClusterNodesGet(log)
-	s.endpoints.registryGet = api.NewRegistryPodsGet()
+	s.endpoints.clusterPodsGet = api.NewClusterPodsGet(log)
+	s.registryHistory = api.NewRegistryHistory(log, s.kv, s.kv.PermanentStore("history"))
+	s.endpoints.registryGet = api.NewRegistryPodsGet(s.registryHistory)
+	s.endpoints.statusMetaSourcesGet = api.NewStatusMetaSourcesGet(log)
+	s.metaSources = metadata.NewSources(ctx, log, s.metaPipe, bus.NewTeePipe(s.endpoints.statusMetaSourcesGet.Processor().(bus.Consumer), statusNodeConsumer))
 
 	s.api = api_server.NewRouter(s.log,
 		// status
 		api.NewStatusPingGet(),
+		s.endpoints.statusNodeGet,
+		s.endpoints.statusPodsGet,
+		api.NewStatusPodGet(s.endpoints.statusPodsGet),
+		s.endpoints.statusMetaSourcesGet,
 
 		// agent
 		api.NewAgentReloadPut(s.Configure),
-		api.NewAgentDrainPut(drainFn),
-		api.NewAgentDrainDelete(drainFn),
+		api.NewAgentDrainGet(s.drain),
+		api.NewAgentDrainPut(s.drain),
+		api.NewAgentDrainDelete(s.drain),
+		api.NewAgentMetaGet(metaRuntime),
+		api.NewAgentMetaPut(metaRuntime),
+		api.NewAgentMetaDelete(metaRuntime),
+
+		// resource
+		s.endpoints.resourcesGet,
+		api.NewResourceGet(s.endpoints.resourcesGet),
+		api.NewResourceRotatePut(api.ResourceRotatorFunc(func(kind, id string) error {
+			return s.resourceEvaluator.Rotate(kind, id)
+		})),
 
 		// cluster
 		s.endpoints.statusNodesGet,
+		s.endpoints.clusterPodsGet,
+		api.NewClusterPodGet(s.endpoints.clusterPodsGet),
 
 		// registry
 		s.endpoints.registryGet,
-		api.NewRegistryPodsPut(s.log, s.kv.PermanentStore("registry")),
-		api.NewRegistryPodsDelete(s.log, s.kv.PermanentStore("registry")),
+		api.NewRegistryPodsPut(s.log, s.kv.PermanentStore("registry"), s.registryHistory),
+		api.NewRegistryPodsDelete(s.log, s.kv.PermanentStore("registry"), s.registryHistory),
+		api.NewRegistryHistoryGet(s.registryHistory),
+		api.NewRegistryRollbackPost(s.log, s.registryHistory),
 	)
 
 	provisionStateConsumer := bus.NewCatalogPipe("provision", bus.NewTeePipe(
-		resourceCompositePipe, provisionCompositePipe,
+		resourceCompositePipe, provisionCompositePipe, statusNodeConsumer, statusPodsConsumer, s.podAnnouncer,
 	))
-	s.resourceEvaluator = resource.NewEvaluator(ctx, log, resource.EvaluatorConfig{}, state, provisionCompositePipe, resourceCompositePipe)
+	s.resourceEvaluator = resource.NewEvaluator(ctx, log, resource.EvaluatorConfig{
+		StateDir:  s.options.StateDir,
+		ClusterKV: s.kv,
+	}, state, bus.NewTeePipe(provisionCompositePipe, statusPodsConsumer), resourceCompositePipe)
 	provisionEvaluator := provision.NewEvaluator(ctx, s.log, provision.EvaluatorConfig{
 		SystemPaths:    systemPaths,
 		Recovery:       state,
@@ -126,7 +222,13 @@ func NewServer(ctx context.Context, log *logx.Log, options ServerOptions) (s *Se
 
 	s.sv = supervisor.NewChain(ctx,
 		s.kv,
-		supervisor.NewGroup(ctx, resourceArbiter, provisionArbiter),
+		supervisor.NewGroup(ctx, resourceArbiter, provisionArbiter, placementArbiter),
+		s.drain,
+		s.election,
+		s.placement,
+		metadata.NewHostProducer(ctx, s.log, metadata.HostFacts{}, metadata.DefaultHostInterval, s.confPipe),
+		metaRuntime,
+		s.metaSources,
 		s.resourceEvaluator,
 		provisionEvaluator,
 		s.sink,
@@ -144,10 +246,19 @@ func (s *Server) Open() (err error) {
 		s.api,
 		s.endpoints.statusNodesGet.Processor().(bus.Consumer),
 	)))
+	s.clusterPodsPipe.ConsumeMessage(bus.NewMessage("status", map[string]interface{}{}))
+	s.kv.Producer("status").Subscribe(s.ctx, bus.NewTeePipe(
+		s.clusterPodsPipe,
+		s.endpoints.clusterPodsGet.Processor().(bus.Consumer),
+	))
+	s.kv.Producer("history").Subscribe(s.ctx, s.registryHistory)
+	s.kv.Producer("registry").Subscribe(s.ctx, s.registryHistory.RegistryConsumer())
 	s.kv.Producer("registry").Subscribe(s.ctx, bus.NewSlicerPipe(s.log, bus.NewTeePipe(
 		s.sink,
 		s.endpoints.registryGet.Processor().(bus.Consumer),
 	)))
+	// only verified pods are placed
+	s.sink.Subscribe(s.ctx, s.placement)
 
 	s.Configure()
 	return
@@ -161,6 +272,16 @@ func (s *Server) Wait() (err error) {
 	return s.sv.Wait()
 }
 
+// statePath returns path to file in state directory or empty string if state
+// directory is not defined
+func (s *Server) statePath(name string) (res string) {
+	if s.options.StateDir == "" {
+		return
+	}
+	res = filepath.Join(s.options.StateDir, name)
+	return
+}
+
 func (s *Server) Configure() {
 	s.log.Infof("config: %v", s.options)
 	var buffers lib.StaticBuffers
@@ -174,6 +295,10 @@ func (s *Server) Configure() {
 	if err := serverCfg.Unmarshal(buffers.GetReaders()...); err != nil {
 		s.log.Errorf("unmarshal server configs: %v", err)
 	}
+	var sourceConfigs metadata.SourceConfigs
+	if err := sourceConfigs.Unmarshal(buffers.GetReaders()...); err != nil {
+		s.log.Errorf("unmarshal meta source configs: %v", err)
+	}
 	var resourceConfigs resource.Configs
 	if err := resourceConfigs.Unmarshal(buffers.GetReaders()...); err != nil {
 		s.log.Errorf("unmarshal resource configs: %v", err)
@@ -188,19 +313,33 @@ func (s *Server) Configure() {
 		s.log.Errorf("unmarshal cluster config: %v", err)
 	}
 
+	// verification of cluster registry should be configured before cluster
+	sinkConfig := scheduler.SinkConfig{
+		Signed: len(serverCfg.Registry.TrustedKeys) > 0,
+	}
+	for _, raw := range serverCfg.Registry.TrustedKeys {
+		key, err := manifest.ParsePublicKey(raw)
+		if err != nil {
+			s.log.Errorf("bad trusted key %s: %v", raw, err)
+			continue
+		}
+		sinkConfig.TrustedKeys = append(sinkConfig.TrustedKeys, key)
+	}
+	s.sink.Configure(sinkConfig)
+
 	s.kv.Configure(clusterConfig)
 
-	// announce node
-	s.kv.VolatileStore("nodes").ConsumeMessage(bus.NewMessage("", proto.NodeInfo{
-		ID:        clusterConfig.NodeID,
-		Advertise: clusterConfig.Advertise,
-		Version:   proto.Version,
-		API:       proto.APIV1Version,
-	}))
+	s.announcer.Configure(clusterConfig.NodeID, clusterConfig.Advertise)
 
-	s.confPipe.ConsumeMessage(bus.NewMessage("meta", serverCfg.Meta))
+	s.metaSources.Configure(sourceConfigs)
+	s.metaPipe.ConsumeMessage(bus.NewMessage("config", serverCfg.Meta))
+	s.agentPipe.ConsumeMessage(bus.NewMessage("config", map[string]string{
+		"id":        clusterConfig.NodeID,
+		"advertise": clusterConfig.Advertise,
+	}))
 	s.confPipe.ConsumeMessage(bus.NewMessage("system", serverCfg.System))
 
+	s.registryHistory.Configure(serverCfg.Registry.History)
 	s.resourceEvaluator.Configure(resourceConfigs)
 	s.sink.ConsumeRegistry(registry)
 	s.log.Debug("configure: done")
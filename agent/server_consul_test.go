@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/akaspin/logx"
 	"github.com/akaspin/soil/agent"
+	agent_api "github.com/akaspin/soil/agent/api"
 	"github.com/akaspin/soil/fixture"
 	"github.com/akaspin/soil/lib"
 	"github.com/akaspin/soil/manifest"
@@ -168,29 +169,7 @@ func TestServer_Configure_Consul(t *testing.T) {
 		require.NoError(t, rs.ReadFiles("testdata/TestServer_Configure_Consul_10.hcl"))
 		require.NoError(t, pods.Unmarshal(manifest.PublicNamespace, rs.GetReaders()...))
 
-		fixture.WaitNoError10(t, func() (err error) {
-			resp, err := http.Get(fmt.Sprintf("http://%s/v1/registry", configEnv["AgentAddress"]))
-			if err != nil {
-				return
-			}
-			if resp == nil {
-				err = fmt.Errorf(`response is nil`)
-				return
-			}
-			if resp.StatusCode != 200 {
-				err = fmt.Errorf(`bad status code: %d`, resp.StatusCode)
-				return
-			}
-			var res manifest.Registry
-			if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
-				return
-			}
-			defer resp.Body.Close()
-			if !reflect.DeepEqual(res, pods) {
-				err = fmt.Errorf(`not equal: (expect)%v != (actual)%v`, pods, res)
-			}
-			return
-		})
+		fixture.WaitNoError10(t, registryPodsFn(configEnv["AgentAddress"].(string), pods, 1))
 	})
 	t.Run(`ensure public pods`, func(t *testing.T) {
 		fixture.WaitNoError(t, waitConfig, sd.UnitStatesFn(allUnitNames, map[string]string{
@@ -216,29 +195,7 @@ func TestServer_Configure_Consul(t *testing.T) {
 		require.NoError(t, rs.ReadFiles("testdata/TestServer_Configure_Consul_11.hcl"))
 		require.NoError(t, pods.Unmarshal(manifest.PublicNamespace, rs.GetReaders()...))
 
-		fixture.WaitNoError10(t, func() (err error) {
-			resp, err := http.Get(fmt.Sprintf("http://%s/v1/registry", configEnv["AgentAddress"]))
-			if err != nil {
-				return
-			}
-			if resp == nil {
-				err = fmt.Errorf(`response is nil`)
-				return
-			}
-			if resp.StatusCode != 200 {
-				err = fmt.Errorf(`bad status code: %d`, resp.StatusCode)
-				return
-			}
-			var res manifest.Registry
-			if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
-				return
-			}
-			defer resp.Body.Close()
-			if !reflect.DeepEqual(res, pods) {
-				err = fmt.Errorf(`not equal: (expect)%v != (actual)%v`, pods, res)
-			}
-			return
-		})
+		fixture.WaitNoError10(t, registryPodsFn(configEnv["AgentAddress"].(string), pods, 1))
 	})
 	t.Run(`ensure 2-public is removed`, func(t *testing.T) {
 		fixture.WaitNoError(t, waitConfig, sd.UnitStatesFn(allUnitNames, map[string]string{
@@ -249,3 +206,39 @@ func TestServer_Configure_Consul(t *testing.T) {
 		}))
 	})
 }
+
+// registryPodsFn returns function which expects given pods with marks and
+// revision in "/v1/registry" response
+func registryPodsFn(address string, pods manifest.Registry, revision int) func() error {
+	return func() (err error) {
+		resp, err := http.Get(fmt.Sprintf("http://%s/v1/registry", address))
+		if err != nil {
+			return
+		}
+		if resp == nil {
+			err = fmt.Errorf(`response is nil`)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			err = fmt.Errorf(`bad status code: %d`, resp.StatusCode)
+			return
+		}
+		var res []agent_api.RegistryPod
+		if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return
+		}
+		var expect []agent_api.RegistryPod
+		for _, pod := range pods {
+			expect = append(expect, agent_api.RegistryPod{
+				Pod:      pod,
+				Mark:     pod.Mark(),
+				Revision: revision,
+			})
+		}
+		if !reflect.DeepEqual(res, expect) {
+			err = fmt.Errorf(`not equal: (expect)%v != (actual)%v`, expect, res)
+		}
+		return
+	}
+}
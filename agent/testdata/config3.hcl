@@ -1,3 +1,8 @@
 meta {
   "from-line1" = "true" "from-line2" = "true"
 }
+
+registry {
+  history = 20
+  trusted_keys = ["W6Bp5EBLRnv0R9/TGF9OzGDF3iwXaS1aU0uXnGMVAuE="]
+}
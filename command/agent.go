@@ -22,6 +22,7 @@ func (o *AgentOptions) Bind(cc *cobra.Command) {
 	cc.Flags().StringArrayVarP(&o.ServerOptions.ConfigPath, "config", "", []string{"/etc/soil/config.hcl"}, "configuration file")
 	cc.Flags().StringArrayVarP(&o.Meta, "meta", "", nil, "node metadata in form field=value")
 	cc.Flags().StringVarP(&o.ServerOptions.Address, "address", "", ":7654", "listen address")
+	cc.Flags().StringVarP(&o.ServerOptions.StateDir, "state-dir", "", "/var/lib/soil", "directory to persist agent state")
 }
 
 type Agent struct {
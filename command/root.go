@@ -21,6 +21,7 @@ func Run(stderr, stdout io.Writer, stdin io.Reader, args ...string) (err error)
 		Stdout: stdout,
 	}
 	configs := &AgentOptions{}
+	signOptions := &SignOptions{}
 
 	cmd := cut.Attach(
 		&Soil{env}, []cut.Binder{env},
@@ -30,6 +31,12 @@ func Run(stderr, stdout io.Writer, stdin io.Reader, args ...string) (err error)
 				AgentOptions: configs,
 			}, []cut.Binder{configs},
 		),
+		cut.Attach(
+			&Sign{
+				Environment: env,
+				SignOptions: signOptions,
+			}, []cut.Binder{signOptions},
+		),
 		cut.Attach(
 			&Version{env}, nil,
 		),
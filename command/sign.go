@@ -0,0 +1,96 @@
+package command
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/akaspin/cut"
+	"github.com/akaspin/soil/lib"
+	"github.com/akaspin/soil/manifest"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type SignOptions struct {
+	Key      string // Path to private key
+	Generate bool   // Generate new key pair
+}
+
+func (o *SignOptions) Bind(cc *cobra.Command) {
+	cc.Flags().StringVarP(&o.Key, "key", "", "", "path to base64 encoded ed25519 private key")
+	cc.Flags().BoolVarP(&o.Generate, "generate", "", false, "generate new private key to --key and print public key")
+}
+
+// Sign signs public pods from manifests and prints registry payload
+type Sign struct {
+	*cut.Environment
+	*SignOptions
+}
+
+func (c *Sign) Bind(cc *cobra.Command) {
+	cc.Use = `sign [manifest...]`
+	cc.Short = "Sign public pods"
+	cc.Long = "Sign public pods from manifests or stdin and print JSON to submit to registry"
+}
+
+func (c *Sign) Run(args ...string) (err error) {
+	if c.Key == "" {
+		err = fmt.Errorf(`--key is required`)
+		return
+	}
+	if c.Generate {
+		err = c.generate()
+		return
+	}
+	raw, err := ioutil.ReadFile(c.Key)
+	if err != nil {
+		return
+	}
+	key, err := manifest.ParsePrivateKey(string(raw))
+	if err != nil {
+		return
+	}
+
+	readers := []io.Reader{c.Stdin}
+	if len(args) > 0 {
+		var buffers lib.StaticBuffers
+		if err = buffers.ReadFiles(args...); err != nil {
+			return
+		}
+		readers = buffers.GetReaders()
+	}
+	var registry manifest.Registry
+	if err = registry.Unmarshal(manifest.PublicNamespace, readers...); err != nil {
+		return
+	}
+	for _, pod := range registry {
+		if err = pod.Sign(key); err != nil {
+			return
+		}
+	}
+	encoder := json.NewEncoder(c.Stdout)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(registry)
+	return
+}
+
+func (c *Sign) generate() (err error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(c.Key, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err = fmt.Fprintln(f, base64.StdEncoding.EncodeToString(private)); err != nil {
+		return
+	}
+	_, err = fmt.Fprintln(c.Stdout, base64.StdEncoding.EncodeToString(public))
+	return
+}
@@ -0,0 +1,68 @@
+package fixture
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// WriteTestingCerts writes CA and certificate for given IP addresses signed
+// by CA to "ca.pem", "cert.pem" and "key.pem" in given directory. Certificate
+// is valid for both server and client authentication.
+func WriteTestingCerts(t *testing.T, dir string, ips ...string) {
+	t.Helper()
+	writePEM := func(name, kind string, data []byte) {
+		f, err := os.Create(filepath.Join(dir, name))
+		require.NoError(t, err)
+		defer f.Close()
+		require.NoError(t, pem.Encode(f, &pem.Block{Type: kind, Bytes: data}))
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "soil-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+	writePEM("ca.pem", "CERTIFICATE", caDER)
+
+	var addresses []net.IP
+	for _, ip := range ips {
+		addresses = append(addresses, net.ParseIP(ip))
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	// certificate has no CommonName: etcd gateway with auth rejects client
+	// certificates with CommonName
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  addresses,
+	}, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	writePEM("cert.pem", "CERTIFICATE", certDER)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	writePEM("key.pem", "EC PRIVATE KEY", keyDER)
+}
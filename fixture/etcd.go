@@ -0,0 +1,271 @@
+package fixture
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/go-connections/nat"
+	"github.com/moby/moby/client"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type EtcdServerConfig struct {
+	RepoTag string
+	Port    int
+
+	// Directory with "ca.pem", "cert.pem" and "key.pem". If defined etcd
+	// serves clients by https and requires client certificates signed by CA.
+	TLSDir string
+}
+
+type EtcdServer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	t           *testing.T
+	Config      *EtcdServerConfig
+	ip          string
+	dockerCli   *client.Client
+	containerID string
+}
+
+func NewEtcdServer(t *testing.T, configFn func(config *EtcdServerConfig)) (s *EtcdServer) {
+	t.Helper()
+	s = &EtcdServer{
+		t:  t,
+		ip: GetLocalIP(t),
+		Config: &EtcdServerConfig{
+			RepoTag: "quay.io/coreos/etcd:v3.4.3",
+			Port:    RandomPort(t),
+		},
+	}
+	if configFn != nil {
+		configFn(s.Config)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	WaitNoError(t, WaitConfig{
+		Retry:   time.Millisecond * 500,
+		Retries: 100,
+	}, func() (err error) {
+		s.dockerCli, err = client.NewEnvClient()
+		return
+	})
+	s.cleanupContainer()
+	return
+}
+
+func (s *EtcdServer) Address() (res string) {
+	res = fmt.Sprintf("%s:%d", s.ip, s.Config.Port)
+	return
+}
+
+// IP returns IP address of server
+func (s *EtcdServer) IP() (res string) {
+	res = s.ip
+	return
+}
+
+// Scheme returns "https" if server is configured with TLS
+func (s *EtcdServer) Scheme() (res string) {
+	res = "http"
+	if s.Config.TLSDir != "" {
+		res = "https"
+	}
+	return
+}
+
+func (s *EtcdServer) Up() {
+	s.t.Helper()
+	s.cleanupContainer()
+	resp, err := s.dockerCli.ImagePull(s.ctx, s.Config.RepoTag, types.ImagePullOptions{})
+	if err != nil {
+		s.t.Error(err)
+		s.t.FailNow()
+		return
+	}
+	ioutil.ReadAll(resp)
+	resp.Close()
+
+	port := nat.Port(fmt.Sprintf("%d/tcp", s.Config.Port))
+	cmd := []string{
+		"etcd",
+		"--name", TestName(s.t),
+		"--listen-client-urls", fmt.Sprintf("%s://0.0.0.0:%d", s.Scheme(), s.Config.Port),
+		"--advertise-client-urls", fmt.Sprintf("%s://%s", s.Scheme(), s.Address()),
+	}
+	var binds []string
+	if s.Config.TLSDir != "" {
+		cmd = append(cmd,
+			"--trusted-ca-file", "/etc/etcd-tls/ca.pem",
+			"--cert-file", "/etc/etcd-tls/cert.pem",
+			"--key-file", "/etc/etcd-tls/key.pem",
+			"--client-cert-auth",
+		)
+		binds = append(binds, s.Config.TLSDir+":/etc/etcd-tls:ro")
+	}
+	res, err := s.dockerCli.ContainerCreate(s.ctx,
+		&container.Config{
+			Image: s.Config.RepoTag,
+			Cmd:   cmd,
+			ExposedPorts: nat.PortSet{
+				port: struct{}{},
+			},
+			AttachStderr: true,
+			AttachStdout: true,
+		},
+		&container.HostConfig{
+			AutoRemove: true,
+			Binds:      binds,
+			PortBindings: nat.PortMap{
+				port: []nat.PortBinding{
+					{
+						HostIP:   "0.0.0.0",
+						HostPort: fmt.Sprintf("%d", s.Config.Port),
+					},
+				},
+			},
+		},
+		nil,
+		TestName(s.t))
+	if err != nil {
+		s.t.Error(err)
+		s.t.FailNow()
+		return
+	}
+	s.containerID = res.ID
+	if err = s.dockerCli.ContainerStart(s.ctx, s.containerID, types.ContainerStartOptions{}); err != nil {
+		s.t.Error(err)
+		s.t.FailNow()
+		return
+	}
+	s.t.Logf(`started: %s on %s`, TestName(s.t), s.Address())
+}
+
+func (s *EtcdServer) cleanupContainer() {
+	s.t.Helper()
+	ctx := context.Background()
+	filterBy, _ := filters.ParseFlag(fmt.Sprintf("name=^/%s$", TestName(s.t)), filters.NewArgs())
+
+	list, err := s.dockerCli.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filterBy,
+	})
+	if err != nil {
+		s.t.Error(err)
+		s.t.Fail()
+	}
+	for _, orphan := range list {
+		s.dockerCli.ContainerStop(ctx, orphan.ID, nil)
+		s.dockerCli.ContainerWait(ctx, orphan.ID)
+		s.dockerCli.ContainerRemove(ctx, orphan.ID, types.ContainerRemoveOptions{
+			Force: true,
+		})
+		s.t.Logf(`removed container: %s`, orphan.ID)
+	}
+}
+
+func (s *EtcdServer) Down() {
+	s.t.Helper()
+	s.cleanupContainer()
+}
+
+func (s *EtcdServer) Clean() {
+	s.t.Helper()
+	s.cleanupContainer()
+	s.cancel()
+}
+
+func (s *EtcdServer) WaitAlive() {
+	s.t.Helper()
+	WaitNoError(s.t, WaitConfig{
+		Retry:   time.Millisecond * 500,
+		Retries: 100,
+	}, func() (err error) {
+		resp, err := s.client().Get(fmt.Sprintf("%s://%s/health", s.Scheme(), s.Address()))
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return
+		}
+		if resp.StatusCode != 200 || !strings.Contains(string(body), "true") {
+			err = fmt.Errorf("not healthy: %d %s", resp.StatusCode, string(body))
+		}
+		return
+	})
+	s.t.Logf(`etcd %s is alive`, s.Address())
+}
+
+// AddUser adds user without roles. Users should be added before auth is
+// enabled.
+func (s *EtcdServer) AddUser(name, password string) {
+	s.t.Helper()
+	s.call("auth/user/add", map[string]string{"name": name, "password": password})
+}
+
+// EnableAuth adds "root" user with given password and enables
+// authentication
+func (s *EtcdServer) EnableAuth(rootPassword string) {
+	s.t.Helper()
+	s.AddUser("root", rootPassword)
+	s.call("auth/user/grant", map[string]string{"user": "root", "role": "root"})
+	s.call("auth/enable", map[string]string{})
+	s.t.Logf(`etcd %s auth is enabled`, s.Address())
+}
+
+// call calls etcd gateway method without credentials
+func (s *EtcdServer) call(method string, req interface{}) {
+	s.t.Helper()
+	raw, err := json.Marshal(req)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	resp, err := s.client().Post(fmt.Sprintf("%s://%s/v3/%s", s.Scheme(), s.Address(), method), "application/json", bytes.NewReader(raw))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		s.t.Fatalf(`%s: %d: %s`, method, resp.StatusCode, string(body))
+	}
+}
+
+// client returns HTTP client with server CA and client certificate if
+// server is configured with TLS
+func (s *EtcdServer) client() (res *http.Client) {
+	res = &http.Client{}
+	if s.Config.TLSDir == "" {
+		return
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(s.Config.TLSDir, "ca.pem"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	cert, err := tls.LoadX509KeyPair(filepath.Join(s.Config.TLSDir, "cert.pem"), filepath.Join(s.Config.TLSDir, "key.pem"))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	res.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:      pool,
+			Certificates: []tls.Certificate{cert},
+		},
+	}
+	return
+}
@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ReadStateFile reads JSON from file to v. Non-existent file is not an error.
+func ReadStateFile(path string, v interface{}) (err error) {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(raw, v)
+	return
+}
+
+// WriteStateFile writes v as JSON to file. File is replaced atomically.
+func WriteStateFile(path string, v interface{}) (err error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		return
+	}
+	err = os.Rename(tmp, path)
+	return
+}
@@ -0,0 +1,28 @@
+// +build ide test_unit
+
+package lib_test
+
+import (
+	"github.com/akaspin/soil/lib"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestStateFile(t *testing.T) {
+	path := "testdata/.test_state/state.json"
+	os.RemoveAll("testdata/.test_state")
+	defer os.RemoveAll("testdata/.test_state")
+
+	t.Run("not exists", func(t *testing.T) {
+		var v map[string]string
+		assert.NoError(t, lib.ReadStateFile(path, &v))
+		assert.Nil(t, v)
+	})
+	t.Run("write and read", func(t *testing.T) {
+		assert.NoError(t, lib.WriteStateFile(path, map[string]string{"a": "1"}))
+		var v map[string]string
+		assert.NoError(t, lib.ReadStateFile(path, &v))
+		assert.Equal(t, map[string]string{"a": "1"}, v)
+	})
+}
@@ -18,10 +18,12 @@ type Pod struct {
 	Name       string
 	Runtime    bool
 	Target     string
+	Count      int `json:",omitempty" hash:"ignore"` // Maximum number of nodes to run public pod. Zero means unlimited
 	Constraint Constraint
 	Units      []Unit
 	Blobs      []Blob
 	Resources  []Resource
+	Signature  string `json:",omitempty" hash:"ignore"` // Base64 encoded ed25519 signature of canonical form
 }
 
 func DefaultPod(namespace string) (p *Pod) {
@@ -36,6 +38,10 @@ func DefaultPod(namespace string) (p *Pod) {
 func (p *Pod) parseAst(raw *ast.ObjectItem) (err error) {
 	err = hcl.DecodeObject(p, raw)
 	p.Name = raw.Keys[0].Token.Value().(string)
+	if p.Count < 0 {
+		err = fmt.Errorf(`pod %s: count should not be negative`, p.Name)
+		return
+	}
 
 	for _, f := range raw.Val.(*ast.ObjectType).List.Filter("unit").Items {
 		unit := defaultUnit()
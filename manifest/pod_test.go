@@ -7,6 +7,7 @@ import (
 	"github.com/akaspin/soil/lib"
 	"github.com/akaspin/soil/manifest"
 	"github.com/stretchr/testify/assert"
+	"strings"
 	"testing"
 )
 
@@ -83,3 +84,17 @@ func TestManifest_JSON(t *testing.T) {
 	data1, err := json.Marshal(pod)
 	assert.Equal(t, string(data), string(data1))
 }
+
+func TestManifest_Count(t *testing.T) {
+	t.Run(`parse`, func(t *testing.T) {
+		var counted, unlimited manifest.Registry
+		assert.NoError(t, counted.Unmarshal(manifest.PublicNamespace, strings.NewReader(`pod "first" { count = 2 }`)))
+		assert.NoError(t, unlimited.Unmarshal(manifest.PublicNamespace, strings.NewReader(`pod "first" {}`)))
+		assert.Equal(t, 2, counted[0].Count)
+		assert.Equal(t, unlimited[0].Mark(), counted[0].Mark())
+	})
+	t.Run(`negative`, func(t *testing.T) {
+		var pods manifest.Registry
+		assert.Error(t, pods.Unmarshal(manifest.PublicNamespace, strings.NewReader(`pod "first" { count = -1 }`)))
+	})
+}
@@ -0,0 +1,91 @@
+package manifest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/ed25519"
+	"strings"
+)
+
+// ParsePublicKey parses base64 encoded ed25519 public key
+func ParsePublicKey(raw string) (key ed25519.PublicKey, err error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(raw))
+	if err != nil {
+		return
+	}
+	if len(data) != ed25519.PublicKeySize {
+		err = fmt.Errorf(`bad public key size: %d`, len(data))
+		return
+	}
+	key = ed25519.PublicKey(data)
+	return
+}
+
+// ParsePrivateKey parses base64 encoded ed25519 private key or seed
+func ParsePrivateKey(raw string) (key ed25519.PrivateKey, err error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(raw))
+	if err != nil {
+		return
+	}
+	switch len(data) {
+	case ed25519.PrivateKeySize:
+		key = ed25519.PrivateKey(data)
+	case ed25519.SeedSize:
+		key = ed25519.NewKeyFromSeed(data)
+	default:
+		err = fmt.Errorf(`bad private key size: %d`, len(data))
+	}
+	return
+}
+
+// CanonicalJSON returns canonical form of pod used to sign pod. Canonical
+// form is JSON with sorted keys without signature.
+func (p *Pod) CanonicalJSON() (res []byte, err error) {
+	unsigned := *p
+	unsigned.Signature = ""
+	raw, err := json.Marshal(&unsigned)
+	if err != nil {
+		return
+	}
+	var v interface{}
+	if err = json.Unmarshal(raw, &v); err != nil {
+		return
+	}
+	res, err = json.Marshal(v)
+	return
+}
+
+// Sign signs pod with given private key
+func (p *Pod) Sign(key ed25519.PrivateKey) (err error) {
+	payload, err := p.CanonicalJSON()
+	if err != nil {
+		return
+	}
+	p.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))
+	return
+}
+
+// Verify verifies pod signature with trusted public keys
+func (p *Pod) Verify(keys ...ed25519.PublicKey) (err error) {
+	if p.Signature == "" {
+		err = fmt.Errorf(`pod %s is not signed`, p.Name)
+		return
+	}
+	signature, err := base64.StdEncoding.DecodeString(p.Signature)
+	if err != nil {
+		err = fmt.Errorf(`bad signature of pod %s: %v`, p.Name, err)
+		return
+	}
+	payload, err := p.CanonicalJSON()
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, payload, signature) {
+			return
+		}
+	}
+	err = fmt.Errorf(`signature of pod %s is not trusted`, p.Name)
+	return
+}
@@ -0,0 +1,64 @@
+// +build ide test_unit
+
+package manifest_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/akaspin/soil/lib"
+	"github.com/akaspin/soil/manifest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"testing"
+)
+
+func TestPod_Sign(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	other, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	var buffers lib.StaticBuffers
+	require.NoError(t, buffers.ReadFiles("testdata/example-multi.hcl"))
+	var registry manifest.Registry
+	require.NoError(t, registry.Unmarshal(manifest.PublicNamespace, buffers.GetReaders()...))
+	pod := registry[0]
+
+	t.Run(`unsigned`, func(t *testing.T) {
+		assert.Error(t, pod.Verify(public))
+	})
+	t.Run(`sign`, func(t *testing.T) {
+		mark := pod.Mark()
+		require.NoError(t, pod.Sign(private))
+		assert.NotEmpty(t, pod.Signature)
+		assert.Equal(t, mark, pod.Mark())
+		assert.NoError(t, pod.Verify(other, public))
+		assert.Error(t, pod.Verify(other))
+		assert.Error(t, pod.Verify())
+	})
+	t.Run(`json`, func(t *testing.T) {
+		data, err := json.Marshal(pod)
+		require.NoError(t, err)
+		var v manifest.Pod
+		require.NoError(t, json.Unmarshal(data, &v))
+		assert.NoError(t, v.Verify(public))
+
+		v.Target = "other.target"
+		assert.Error(t, v.Verify(public))
+	})
+	t.Run(`keys`, func(t *testing.T) {
+		key, err := manifest.ParsePublicKey(base64.StdEncoding.EncodeToString(public))
+		assert.NoError(t, err)
+		assert.Equal(t, public, key)
+		_, err = manifest.ParsePublicKey("AAAA")
+		assert.Error(t, err)
+
+		parsed, err := manifest.ParsePrivateKey(base64.StdEncoding.EncodeToString(private.Seed()))
+		assert.NoError(t, err)
+		assert.Equal(t, private, parsed)
+		parsed, err = manifest.ParsePrivateKey(base64.StdEncoding.EncodeToString(private))
+		assert.NoError(t, err)
+		assert.Equal(t, private, parsed)
+	})
+}
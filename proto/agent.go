@@ -1,7 +1,35 @@
 package proto
 
+import "time"
+
 const (
 	V1AgentStop   = "/v1/agent/stop"
 	V1AgentReload = "/v1/agent/reload"
 	V1AgentDrain  = "/v1/agent/drain"
+	V1AgentMeta   = "/v1/agent/meta"
 )
+
+// DrainRequest is body of drain request. Request without namespaces and pods
+// drains all pods on agent.
+type DrainRequest struct {
+	Namespaces []string   `json:",omitempty"` // Drain pods in given namespaces
+	Pods       []string   `json:",omitempty"` // Drain given pods
+	Deadline   *time.Time `json:",omitempty"` // Lift drain automatically after deadline
+	TTL        string     `json:",omitempty"` // Lift drain automatically after duration
+	Reason     string     `json:",omitempty"`
+}
+
+// DrainState represents agent drain state
+type DrainState struct {
+	On         bool
+	Since      *time.Time `json:",omitempty"`
+	Namespaces []string   `json:",omitempty"`
+	Pods       []string   `json:",omitempty"`
+	Deadline   *time.Time `json:",omitempty"`
+	Reason     string     `json:",omitempty"`
+}
+
+// IsPartial returns true if drain is limited to namespaces or pods
+func (s DrainState) IsPartial() bool {
+	return len(s.Namespaces) > 0 || len(s.Pods) > 0
+}
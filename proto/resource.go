@@ -0,0 +1,39 @@
+package proto
+
+const (
+	V1Resources      = "/v1/resources"
+	V1ResourceRotate = "/v1/resource/rotate"
+)
+
+// ResourceRotateRequest is body of resource rotate request
+type ResourceRotateRequest struct {
+	Kind string // Resource kind
+	ID   string // Allocation ID "<pod>.<resource>"
+}
+
+// ResourceInventory is state of resources of one kind on agent
+type ResourceInventory struct {
+	Nature      string                        // Resource nature
+	Kind        string                        // Resource kind
+	Properties  map[string]interface{}        `json:",omitempty"` // Configured properties
+	Allocations map[string]ResourceAllocation // Allocations by ID "<pod>.<resource>"
+	Capacity    *ResourceCapacity             `json:",omitempty"` // Capacity if supported by nature
+}
+
+// ResourceAllocation is state of one allocation
+type ResourceAllocation struct {
+	Pod       string                 // Pod name
+	Name      string                 // Resource name
+	Request   map[string]interface{} `json:",omitempty"` // Request properties
+	Allocated bool                   // Allocation succeeded
+	Values    map[string]string      `json:",omitempty"` // Allocated values
+	Failure   string                 `json:",omitempty"` // Allocation failure
+	Dirty     bool                   // Allocation is in progress
+}
+
+// ResourceCapacity is capacity of resource kind
+type ResourceCapacity struct {
+	Total     int64
+	Allocated int64
+	Free      int64
+}
@@ -1,14 +1,63 @@
 package proto
 
+const (
+	V1StatusNode        = "/v1/status/node"
+	V1StatusPods        = "/v1/status/pods"
+	V1StatusMetaSources = "/v1/status/meta_sources"
+	V1ClusterPods       = "/v1/cluster/pods"
+)
+
 type NodeInfo struct {
 	ID        string
 	Advertise string
 	Version   string
 	API       string
+	Meta      map[string]string
+	Drain     DrainState
+	Raft      *NodeRaftStatus `json:",omitempty"` // Raft membership with raft backend
+}
+
+// NodeRaftStatus represents membership of node in Raft group
+type NodeRaftStatus struct {
+	Address string // Raft address
+	Voter   bool   // Node is counted in quorum
+	Alive   bool   // Node session is not expired
 }
 
 type NodesInfo []NodeInfo
 
+// NodeStatus represents actual state of specific agent
+type NodeStatus struct {
+	NodeInfo
+	System    map[string]string
+	Cluster   ClusterStatus
+	Resources map[string]ResourceWorkerStatus // Resource workers by kind
+	Pods      map[string]int                  // Pods count by provision state
+
+	MetaSourceFailures map[string]string `json:",omitempty"` // Failures of meta sources by source name
+}
+
+// ClusterStatus represents state of cluster backend
+type ClusterStatus struct {
+	Backend string // Backend URL
+	Kind    string // Backend kind
+	Ready   bool   // Backend is ready to accept operations
+
+	Failure     string `json:",omitempty"` // Last backend failure. Cleared then backend is ready
+	FailureKind string `json:",omitempty"` // "permission" or "connection"
+
+	Leader   string `json:",omitempty"` // Actual cluster leader
+	IsLeader bool   // Agent is cluster leader
+}
+
+// ResourceWorkerStatus represents state of resource worker
+type ResourceWorkerStatus struct {
+	Nature    string
+	Dirty     bool // Worker has pending allocations
+	Allocated int  // Number of allocated resources
+	Failed    int  // Number of failed allocations
+}
+
 func (c NodesInfo) Len() int {
 	return len(c)
 }
@@ -20,3 +69,66 @@ func (c NodesInfo) Less(i, j int) bool {
 func (c NodesInfo) Swap(i, j int) {
 	c[i], c[j] = c[j], c[i]
 }
+
+// PodStatus represents state of pod on specific agent
+type PodStatus struct {
+	Name      string
+	Namespace string                       `json:",omitempty"`
+	Mark      uint64                       `json:",omitempty"`
+	Arbiters  map[string]PodArbiterStatus  `json:",omitempty"` // Arbiter verdicts by arbiter name
+	Resources map[string]PodResourceStatus `json:",omitempty"` // Resource allocations by resource name
+	Provision PodProvisionStatus
+	Placement *PodPlacementStatus `json:",omitempty"` // Cluster-wide placement of public pod with count
+	Rejection string              `json:",omitempty"` // Reason of pod rejection from cluster registry
+}
+
+// PodPlacementStatus represents cluster-wide placement of public pod with count
+type PodPlacementStatus struct {
+	Count   int      // Maximum number of nodes to run pod
+	Placed  bool     // Pod is placed on this node
+	Nodes   []string `json:",omitempty"` // Nodes holding placement slots
+	Failure string   `json:",omitempty"` // Last claim failure
+}
+
+const (
+	PodHealthPassing = "passing" // Pod is provisioned without failures
+	PodHealthFailing = "failing" // Last provision evaluation is failed
+	PodHealthPending = "pending" // Pod is not yet provisioned
+)
+
+// NodePodStatus is compact pod status published by agent to cluster
+type NodePodStatus struct {
+	Namespace string `json:",omitempty"`
+	Mark      uint64 `json:",omitempty"`
+	State     string `json:",omitempty"` // Provision state
+	Health    string // "passing", "failing" or "pending"
+	Failure   string `json:",omitempty"` // Failures of last evaluation
+}
+
+// NodePodsStatus represents compact statuses of pods on agent by pod name
+type NodePodsStatus map[string]NodePodStatus
+
+// ClusterPodsStatus represents compact statuses of pods in cluster by pod
+// name and node ID
+type ClusterPodsStatus map[string]map[string]NodePodStatus
+
+// PodArbiterStatus represents arbiter verdict for pod
+type PodArbiterStatus struct {
+	Accepted bool
+	Failure  string `json:",omitempty"` // Failed constraint with interpolated values
+}
+
+// PodResourceStatus represents resource allocation result
+type PodResourceStatus struct {
+	Kind      string
+	Allocated bool
+	Failure   string            `json:",omitempty"`
+	Values    map[string]string `json:",omitempty"`
+}
+
+// PodProvisionStatus represents provision state and last evaluation outcome
+type PodProvisionStatus struct {
+	Present bool
+	State   string `json:",omitempty"`
+	Failure string `json:",omitempty"` // Failures of last evaluation
+}